@@ -0,0 +1,552 @@
+// Package acme obtains and renews the certificates of the server from an
+// ACME certificate authority (RFC 8555), as Let's Encrypt, answering its
+// http-01 challenges. The account key and the certificates are cached
+// in a directory, so restarts don't ask for new ones.
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/jose"
+)
+
+// LetsEncrypt is the directory of the production CA of Let's Encrypt
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// DefaultRenewBefore is how long before their expiry the certificates
+// are renewed, unless set
+const DefaultRenewBefore = 30 * 24 * time.Hour
+
+// challengePath is the path the CA fetches the http-01 challenges from
+const challengePath = "/.well-known/acme-challenge/"
+
+// Manager keeps a certificate of its domains
+type Manager struct {
+	// Domains are the names of the certificate, the first one being its
+	// subject
+	Domains []string
+	// Email is the contact of the account, told about the problems of
+	// the certificates, if set
+	Email string
+	// CacheDir keeps the account key and the certificate
+	CacheDir string
+	// DirectoryURL is the directory of the CA, LetsEncrypt unless set
+	DirectoryURL string
+	// RenewBefore is how long before its expiry the certificate is
+	// renewed, DefaultRenewBefore unless set
+	RenewBefore time.Duration
+	// Client calls the CA, http.DefaultClient unless set
+	Client *http.Client
+	Logger *slog.Logger
+
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	challenges map[string]string // the key authorizations, by token
+}
+
+// ErrNoCertificate is returned while no certificate was obtained yet
+var ErrNoCertificate = errors.New("acme: no certificate yet")
+
+// GetCertificate returns the certificate, for tls.Config.GetCertificate
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, ErrNoCertificate
+	}
+	return m.cert, nil
+}
+
+// Leaf returns the certificate served, nil when there's none yet
+func (m *Manager) Leaf() *x509.Certificate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil
+	}
+	return m.cert.Leaf
+}
+
+// HTTPHandler answers the http-01 challenges of the CA, handing the
+// other requests to fallback
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, challengePath)
+		if !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		m.mu.RLock()
+		keyAuth, ok := m.challenges[token]
+		m.mu.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// Load reads the certificate of the cache, if it holds one of the
+// domains
+func (m *Manager) Load() error {
+	cert, err := tls.LoadX509KeyPair(m.path("cert.pem"), m.path("key.pem"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+	for _, d := range m.Domains {
+		if cert.Leaf.VerifyHostname(d) != nil {
+			return nil // the domains changed
+		}
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	return nil
+}
+
+// Run obtains the certificate, unless the cache has one, and renews it
+// before it expires until ctx is done, retrying the failures with
+// backoff
+func (m *Manager) Run(ctx context.Context) {
+	backoff := time.Minute
+	for {
+		wait := m.renewIn()
+		if wait <= 0 {
+			err := m.Obtain(ctx)
+			if err == nil {
+				backoff = time.Minute
+				continue
+			}
+			m.logger().ErrorContext(ctx, "obtaining certificate", "domains", m.Domains, "err", err, "retry_in", backoff)
+			wait, backoff = backoff, min(2*backoff, time.Hour)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// renewIn returns the time until the certificate is to be renewed
+func (m *Manager) renewIn() time.Duration {
+	leaf := m.Leaf()
+	if leaf == nil {
+		return 0
+	}
+	before := m.RenewBefore
+	if before == 0 {
+		before = DefaultRenewBefore
+	}
+	return time.Until(leaf.NotAfter.Add(-before))
+}
+
+// Obtain orders a new certificate of the domains and serves it, caching
+// it
+func (m *Manager) Obtain(ctx context.Context) error {
+	if len(m.Domains) == 0 {
+		return errors.New("acme: no domain")
+	}
+	if err := os.MkdirAll(m.CacheDir, 0o700); err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+	c, err := m.client(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	chain, err := c.order(ctx, m, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return fmt.Errorf("acme: certificate issued: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("acme: certificate issued: %w", err)
+	}
+	if err := os.WriteFile(m.path("key.pem"), keyPEM, 0o600); err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+	if err := os.WriteFile(m.path("cert.pem"), chain, 0o600); err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	m.logger().InfoContext(ctx, "certificate obtained", "domains", m.Domains, "not_after", cert.Leaf.NotAfter)
+	return nil
+}
+
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.CacheDir, name)
+}
+
+func (m *Manager) logger() *slog.Logger {
+	if m.Logger == nil {
+		return slog.Default()
+	}
+	return m.Logger
+}
+
+// setChallenge answers the challenge of token with keyAuth, or stops
+// answering it when empty
+func (m *Manager) setChallenge(token, keyAuth string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if keyAuth == "" {
+		delete(m.challenges, token)
+		return
+	}
+	if m.challenges == nil {
+		m.challenges = map[string]string{}
+	}
+	m.challenges[token] = keyAuth
+}
+
+// accountKey returns the key of the account, generated on first use
+func (m *Manager) accountKey() (*jose.Signer, error) {
+	file := m.path("account.key")
+	if _, err := os.Stat(file); err == nil {
+		return jose.LoadSigner(file, "")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, fmt.Errorf("acme: %w", err)
+	}
+	return jose.NewSigner(key, "")
+}
+
+// client talks to the CA on behalf of an account
+type client struct {
+	http  *http.Client
+	key   *jose.Signer
+	dir   directory
+	kid   string // the URL of the account
+	nonce string
+}
+
+// directory are the URLs of the CA
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// challenge is a way of proving the control of a domain
+type challenge struct {
+	Type  string   `json:"type"`
+	URL   string   `json:"url"`
+	Token string   `json:"token"`
+	Error *problem `json:"error"`
+}
+
+// problem is an error of the CA (RFC 7807)
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", strings.TrimPrefix(p.Type, "urn:ietf:params:acme:error:"), p.Detail)
+}
+
+// client returns the client of the account, registering it if new
+func (m *Manager) client(ctx context.Context) (*client, error) {
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	c := &client{http: m.Client, key: key}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	url := m.DirectoryURL
+	if url == "" {
+		url = LetsEncrypt
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("acme: directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("acme: directory: %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&c.dir); err != nil {
+		return nil, fmt.Errorf("acme: directory: %w", err)
+	}
+
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if m.Email != "" {
+		account["contact"] = []string{"mailto:" + m.Email}
+	}
+	resp, _, err = c.post(ctx, c.dir.NewAccount, account)
+	if err != nil {
+		return nil, err
+	}
+	if c.kid = resp.Header.Get("Location"); c.kid == "" {
+		return nil, errors.New("acme: account without location")
+	}
+	return c, nil
+}
+
+// order orders a certificate of the domains of m for key, answering
+// the challenges, and returns its PEM chain
+func (c *client) order(ctx context.Context, m *Manager, key crypto.Signer) ([]byte, error) {
+	ids := make([]map[string]string, len(m.Domains))
+	for i, d := range m.Domains {
+		ids[i] = map[string]string{"type": "dns", "value": d}
+	}
+	var o struct {
+		Status         string   `json:"status"`
+		Authorizations []string `json:"authorizations"`
+		Finalize       string   `json:"finalize"`
+		Certificate    string   `json:"certificate"`
+	}
+	resp, body, err := c.post(ctx, c.dir.NewOrder, map[string]any{"identifiers": ids})
+	if err != nil {
+		return nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+	if err := json.Unmarshal(body, &o); err != nil {
+		return nil, fmt.Errorf("acme: order: %w", err)
+	}
+	for _, authz := range o.Authorizations {
+		if err := c.authorize(ctx, m, authz); err != nil {
+			return nil, err
+		}
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: m.Domains[0]}, DNSNames: m.Domains}, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, body, err = c.post(ctx, o.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}); err != nil {
+		return nil, err
+	}
+	for {
+		if err := json.Unmarshal(body, &o); err != nil {
+			return nil, fmt.Errorf("acme: order: %w", err)
+		}
+		if o.Status == "valid" {
+			break
+		}
+		if o.Status == "invalid" {
+			return nil, errors.New("acme: order invalid")
+		}
+		if err := c.wait(ctx, resp); err != nil {
+			return nil, err
+		}
+		if resp, body, err = c.post(ctx, orderURL, nil); err != nil {
+			return nil, err
+		}
+	}
+	_, chain, err := c.post(ctx, o.Certificate, nil)
+	return chain, err
+}
+
+// authorize answers the http-01 challenge of an authorization and waits
+// for the CA to validate it
+func (c *client) authorize(ctx context.Context, m *Manager, url string) error {
+	var a struct {
+		Status     string `json:"status"`
+		Identifier struct {
+			Value string `json:"value"`
+		} `json:"identifier"`
+		Challenges []challenge `json:"challenges"`
+	}
+	resp, body, err := c.post(ctx, url, nil)
+	if err == nil {
+		err = json.Unmarshal(body, &a)
+	}
+	if err != nil || a.Status == "valid" {
+		return err
+	}
+	i := slices.IndexFunc(a.Challenges, func(ch challenge) bool { return ch.Type == "http-01" })
+	if i < 0 {
+		return fmt.Errorf("acme: no http-01 challenge for %s", a.Identifier.Value)
+	}
+	ch := a.Challenges[i]
+	m.setChallenge(ch.Token, ch.Token+"."+c.key.JWK().Thumbprint())
+	defer m.setChallenge(ch.Token, "")
+	if _, _, err := c.post(ctx, ch.URL, struct{}{}); err != nil {
+		return err
+	}
+	for {
+		if err := c.wait(ctx, resp); err != nil {
+			return err
+		}
+		if resp, body, err = c.post(ctx, url, nil); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, &a); err != nil {
+			return fmt.Errorf("acme: authorization: %w", err)
+		}
+		switch a.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+			continue
+		}
+		for _, ch := range a.Challenges {
+			if ch.Error != nil {
+				return fmt.Errorf("%s: %w", a.Identifier.Value, ch.Error)
+			}
+		}
+		return fmt.Errorf("acme: authorization of %s %s", a.Identifier.Value, a.Status)
+	}
+}
+
+// wait waits for the time the CA advised in resp, or a second
+func (c *client) wait(ctx context.Context, resp *http.Response) error {
+	d := time.Second
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		d = min(time.Duration(s)*time.Second, time.Minute)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// post POSTs payload to url signed by the account, a nil payload
+// being a POST-as-GET, and returns the response and its body. The
+// requests refused for a stale nonce are retried once.
+func (c *client) post(ctx context.Context, url string, payload any) (*http.Response, []byte, error) {
+	var raw []byte
+	if payload != nil {
+		var err error
+		if raw, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	for retry := true; ; retry = false {
+		resp, body, err := c.postOnce(ctx, url, raw)
+		var p *problem
+		if retry && errors.As(err, &p) && p.Type == "urn:ietf:params:acme:error:badNonce" {
+			continue
+		}
+		return resp, body, err
+	}
+}
+
+func (c *client) postOnce(ctx context.Context, url string, payload []byte) (*http.Response, []byte, error) {
+	if c.nonce == "" {
+		if err := c.newNonce(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	header := map[string]any{"nonce": c.nonce, "url": url}
+	if c.kid != "" {
+		header["kid"] = c.kid
+	} else {
+		jwk := c.key.JWK()
+		jwk.Alg, jwk.Use, jwk.Kid = "", "", ""
+		header["jwk"] = jwk
+	}
+	c.nonce = ""
+	jws, err := c.key.SignJSON(header, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := json.Marshal(jws)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: %w", err)
+	}
+	defer resp.Body.Close()
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		p := &problem{Status: resp.StatusCode}
+		if json.Unmarshal(body, p) != nil || p.Type == "" {
+			return nil, nil, fmt.Errorf("acme: %s: %s", url, resp.Status)
+		}
+		return nil, nil, p
+	}
+	return resp, body, nil
+}
+
+// newNonce gets a fresh nonce from the CA
+func (c *client) newNonce(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("acme: nonce: %w", err)
+	}
+	resp.Body.Close()
+	if c.nonce = resp.Header.Get("Replay-Nonce"); c.nonce == "" {
+		return errors.New("acme: no nonce")
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/jose"
+)
+
+// fakeCA is an ACME CA validating the http-01 challenges by asking the
+// manager's handler, and issuing certificates valid for a day
+type fakeCA struct {
+	t       *testing.T
+	srv     *httptest.Server
+	manager *Manager
+	key     *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	nonces    int
+	badNonce  bool   // refuse the next nonce
+	reject    string // the problem type of the orders, if any
+	thumb     string // of the account key
+	validated bool
+	issued    []byte // the chain of the last certificate
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &fakeCA{t: t, key: key}
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *fakeCA) url(path string) string {
+	return ca.srv.URL + path
+}
+
+func (ca *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.nonces++
+	w.Header().Set("Replay-Nonce", fmt.Sprint("n", ca.nonces))
+	switch {
+	case r.URL.Path == "/directory":
+		json.NewEncoder(w).Encode(directory{NewNonce: ca.url("/nonce"), NewAccount: ca.url("/account"), NewOrder: ca.url("/order")})
+		return
+	case r.URL.Path == "/nonce":
+		return
+	}
+
+	header, payload := ca.verify(r)
+	if ca.badNonce {
+		ca.badNonce = false
+		ca.problem(w, "badNonce", "stale nonce")
+		return
+	}
+	switch r.URL.Path {
+	case "/account":
+		var jwk jose.JWK
+		if err := json.Unmarshal(header["jwk"], &jwk); err != nil {
+			ca.t.Errorf("account without a jwk: %v", err)
+		}
+		ca.thumb = jwk.Thumbprint()
+		w.Header().Set("Location", ca.url("/account/1"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+	case "/order":
+		if ca.reject != "" {
+			ca.problem(w, ca.reject, "example.com is forbidden")
+			return
+		}
+		w.Header().Set("Location", ca.url("/order/1"))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"status": "pending",
+			"authorizations": []string{ca.url("/authz/1")}, "finalize": ca.url("/finalize/1")})
+	case "/authz/1":
+		status := "pending"
+		if ca.validated {
+			status = "valid"
+		}
+		w.Header().Set("Retry-After", "1")
+		json.NewEncoder(w).Encode(map[string]any{"status": status, "identifier": map[string]string{"value": "example.com"},
+			"challenges": []challenge{{Type: "dns-01", URL: ca.url("/chal/2"), Token: "dns"}, {Type: "http-01", URL: ca.url("/chal/1"), Token: "tok"}}})
+	case "/chal/1":
+		// the CA fetches the key authorization from the server
+		rec := httptest.NewRecorder()
+		ca.manager.HTTPHandler(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, challengePath+"tok", nil))
+		if got, want := rec.Body.String(), "tok."+ca.thumb; rec.Code != http.StatusOK || got != want {
+			ca.t.Errorf("challenge answered %d %q, want %q", rec.Code, got, want)
+		}
+		ca.validated = true
+		w.Write([]byte(`{"status":"processing"}`))
+	case "/finalize/1":
+		var body struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &body)
+		der, _ := base64.RawURLEncoding.DecodeString(body.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			ca.t.Errorf("csr: %v", err)
+			ca.problem(w, "badCSR", err.Error())
+			return
+		}
+		ca.issued = ca.issue(csr)
+		json.NewEncoder(w).Encode(map[string]any{"status": "valid", "certificate": ca.url("/cert/1")})
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.issued)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// verify checks the JWS of r is signed for its URL, returning its
+// protected header and payload
+func (ca *fakeCA) verify(r *http.Request) (map[string]json.RawMessage, []byte) {
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/jose+json" {
+		ca.t.Errorf("%s %s as %s, want a JWS posted", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+	}
+	var jws jose.JWS
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &jws); err != nil {
+		ca.t.Errorf("%s: %v", r.URL.Path, err)
+	}
+	h, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var header map[string]json.RawMessage
+	json.Unmarshal(h, &header)
+	var url, nonce string
+	json.Unmarshal(header["url"], &url)
+	json.Unmarshal(header["nonce"], &nonce)
+	if url != ca.url(r.URL.Path) || nonce == "" {
+		ca.t.Errorf("%s signed for %q with nonce %q", r.URL.Path, url, nonce)
+	}
+	if r.URL.Path != "/account" && string(header["kid"]) != `"`+ca.url("/account/1")+`"` {
+		ca.t.Errorf("%s signed by %s, want the account", r.URL.Path, header["kid"])
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return header, payload
+}
+
+func (ca *fakeCA) problem(w http.ResponseWriter, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(problem{Type: "urn:ietf:params:acme:error:" + typ, Detail: detail})
+}
+
+func (ca *fakeCA) issue(csr *x509.CertificateRequest) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, csr.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func newManager(ca *fakeCA, dir string, domains ...string) *Manager {
+	m := &Manager{Domains: domains, CacheDir: dir, DirectoryURL: ca.url("/directory"), Client: ca.srv.Client()}
+	ca.manager = m
+	return m
+}
+
+func TestObtain(t *testing.T) {
+	ca := newFakeCA(t)
+	dir := t.TempDir()
+	m := newManager(ca, dir, "example.com", "www.example.com")
+	if _, err := m.GetCertificate(nil); !errors.Is(err, ErrNoCertificate) {
+		t.Fatalf("certificate before obtaining one: %v, want ErrNoCertificate", err)
+	}
+	if m.renewIn() > 0 {
+		t.Error("no renewal due without a certificate")
+	}
+	ca.badNonce = true
+	if err := m.Obtain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf := cert.Leaf; leaf.VerifyHostname("www.example.com") != nil || leaf.Subject.CommonName != "example.com" {
+		t.Errorf("certificate of %s for %v", leaf.Subject.CommonName, leaf.DNSNames)
+	}
+	// renewed 30 days before it expires, so at once
+	if m.renewIn() > 0 {
+		t.Errorf("renewal of a certificate valid a day in %s", m.renewIn())
+	}
+	m.RenewBefore = time.Hour
+	if d := m.renewIn(); d < 22*time.Hour || d > 23*time.Hour {
+		t.Errorf("renewal in %s, want about 23h", d)
+	}
+	if m.challenges["tok"] != "" {
+		t.Error("challenge still answered once validated")
+	}
+
+	// a restart loads the cached certificate, and keeps the account
+	cached := newManager(ca, dir, "example.com")
+	if err := cached.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if cached.Leaf() == nil || !cached.Leaf().Equal(cert.Leaf) {
+		t.Error("cached certificate not loaded")
+	}
+	other := newManager(ca, dir, "example.org")
+	if err := other.Load(); err != nil || other.Leaf() != nil {
+		t.Errorf("certificate of other domains loaded: %v", err)
+	}
+	ca.manager, ca.validated = cached, false
+	if err := cached.Obtain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ca.thumb != mustThumbprint(t, dir) {
+		t.Error("account key not reused")
+	}
+}
+
+func mustThumbprint(t *testing.T, dir string) string {
+	t.Helper()
+	key, err := jose.LoadSigner(dir+"/account.key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.JWK().Thumbprint()
+}
+
+func TestObtainProblem(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.reject = "rejectedIdentifier"
+	m := newManager(ca, t.TempDir(), "example.com")
+	err := m.Obtain(context.Background())
+	var p *problem
+	if !errors.As(err, &p) || p.Type != "urn:ietf:params:acme:error:rejectedIdentifier" || !strings.Contains(err.Error(), "forbidden") {
+		t.Errorf("rejected order: %v, want the problem of the CA", err)
+	}
+	if m.Leaf() != nil {
+		t.Error("certificate served after a failure")
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	m := &Manager{}
+	m.setChallenge("tok", "tok.thumb")
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	h := m.HTTPHandler(fallback)
+	for path, want := range map[string]int{
+		challengePath + "tok":   http.StatusOK,
+		challengePath + "other": http.StatusNotFound,
+		"/users":                http.StatusTeapot,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("%s: %d, want %d", path, w.Code, want)
+		}
+	}
+	m.setChallenge("tok", "")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, challengePath+"tok", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("challenge answered once dropped: %d", w.Code)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/idgen"
+	"github.com/santisdev/go-restapi.git/metrics"
+	"github.com/santisdev/go-restapi.git/outbound"
+	"github.com/santisdev/go-restapi.git/server"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/tracing"
+)
+
+// app is the container of the dependencies of the server. Each of them
+// can be replaced before calling server, e.g. by fakes in tests.
+type app struct {
+	logger *slog.Logger
+	level  *slog.LevelVar // of logger
+	store  store.UserStore
+	clock  clock.Clock
+	ids    idgen.Generator
+	bus    events.Bus
+	tracer *tracing.Tracer
+	// metrics registers the metrics of the server and of the outbound
+	// calls
+	metrics *metrics.Registry
+	// outbound carries the calls to other services, set by serve
+	outbound *outbound.Transport
+}
+
+// newApp returns the production dependencies
+func newApp() *app {
+	level := &slog.LevelVar{}
+	return &app{
+		logger: newLogger("text", level),
+		level:  level,
+		store: store.NewMemory(map[string]store.User{
+			"1": store.User{
+				ID:     "1",
+				Name:   "Charles",
+				Active: true,
+			},
+		}),
+		clock:   clock.System{},
+		ids:     idgen.Random{},
+		bus:     events.NewMemory(),
+		metrics: metrics.NewRegistry(),
+	}
+}
+
+// newLogger returns the logger writing to stderr in format, text or
+// json, the records below level being dropped
+func newLogger(format string, level *slog.LevelVar) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if format == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	return slog.New(tracing.LogHandler{Handler: h})
+}
+
+// server wires the dependencies into a server
+func (a *app) server(cfg server.Config, opts ...server.Option) (*server.Server, error) {
+	if a.outbound != nil {
+		opts = append([]server.Option{server.WithTransport(a.outbound)}, opts...)
+	}
+	return server.New(append([]server.Option{
+		server.WithConfig(cfg),
+		server.WithLogger(a.logger),
+		server.WithStore(a.store),
+		server.WithClock(a.clock),
+		server.WithIDGenerator(a.ids),
+		server.WithEventBus(a.bus),
+		server.WithTracer(a.tracer),
+		server.WithMetrics(a.metrics),
+	}, opts...)...)
+}
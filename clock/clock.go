@@ -0,0 +1,75 @@
+// Package clock abstracts the current time, so that time-dependent code
+// can be driven by tests.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time and waits for durations to elapse
+type Clock interface {
+	Now() time.Time
+	// After sends the current time on the returned channel once d
+	// has elapsed
+	After(d time.Duration) <-chan time.Time
+}
+
+// System is the clock of the operating system
+type System struct{}
+
+func (System) Now() time.Time { return time.Now() }
+
+func (System) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Fake is a clock whose time only moves when told to, for deterministic
+// tests. The zero value starts at the zero time.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewFake returns a fake clock set to now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+	f.waiters = append(f.waiters, waiter{f.now.Add(d), c})
+	return c
+}
+
+// Advance moves the clock forward by d, firing the due waiters
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	pending := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.at.After(f.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- f.now
+	}
+	f.waiters = pending
+}
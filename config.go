@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configSchema is the JSON Schema of the config files of serve
+//
+//go:embed config.schema.json
+var configSchema []byte
+
+// envPrefix starts the names of the environment variables setting the
+// flags, as USERSAPI_WATCHDOG_INTERVAL for -watchdog-interval
+const envPrefix = "USERSAPI_"
+
+// envName returns the environment variable of a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadLayers sets the flags not given on the command line from, by
+// precedence, the environment variables, the overrides of the
+// environment in environments/<env>.json next to the base file, and the
+// base file. It fails with every problem of the files, each on its own
+// line.
+func loadLayers(fs *flag.FlagSet, base, env string) error {
+	var s schema
+	if err := json.Unmarshal(configSchema, &s); err != nil {
+		return fmt.Errorf("config schema: %w", err)
+	}
+	doc := map[string]any{}
+	var layers []string
+	if base != "" {
+		if err := readLayer(base, doc); err != nil {
+			return err
+		}
+		layers = append(layers, base)
+	}
+	if env != "" {
+		overrides := filepath.Join(filepath.Dir(base), "environments", env+".json")
+		if err := readLayer(overrides, doc); err != nil {
+			return err
+		}
+		layers = append(layers, overrides)
+	}
+	if errs := s.validate("", doc); len(errs) > 0 {
+		return prefixErrors(strings.Join(layers, " + "), errs)
+	}
+
+	values := flagValues(&s, doc)
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			values[f.Name] = v
+		}
+	})
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var errs []error
+	for _, name := range sortedKeys(values) {
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readLayer merges the config file at path into doc
+func readLayer(path string, doc map[string]any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var layer any
+	if err := dec.Decode(&layer); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	obj, ok := layer.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: expected an object, got %s", path, typeOf(layer))
+	}
+	mergeLayer(doc, obj)
+	return nil
+}
+
+// mergeLayer merges the objects of layer into doc, its other values
+// replacing the ones of doc
+func mergeLayer(doc, layer map[string]any) {
+	for k, v := range layer {
+		sub, isObj := v.(map[string]any)
+		cur, curIsObj := doc[k].(map[string]any)
+		if isObj && curIsObj {
+			mergeLayer(cur, sub)
+			continue
+		}
+		doc[k] = v
+	}
+}
+
+// flagValues returns the values of the flags the settings of doc map
+// to. Objects mapping to a flag are given as comma-separated key=value,
+// arrays as comma-separated values.
+func flagValues(s *schema, doc any) map[string]string {
+	values := map[string]string{}
+	var walk func(s *schema, v any)
+	walk = func(s *schema, v any) {
+		obj, isObj := v.(map[string]any)
+		arr, isArr := v.([]any)
+		switch {
+		case s.Flag != "" && isObj:
+			var kvs []string
+			for _, k := range sortedKeys(obj) {
+				kvs = append(kvs, k+"="+fmt.Sprint(obj[k]))
+			}
+			values[s.Flag] = strings.Join(kvs, ",")
+		case s.Flag != "" && isArr:
+			items := make([]string, len(arr))
+			for i, item := range arr {
+				items[i] = fmt.Sprint(item)
+			}
+			values[s.Flag] = strings.Join(items, ",")
+		case s.Flag != "":
+			values[s.Flag] = fmt.Sprint(v)
+		case isObj:
+			for name, sub := range s.Properties {
+				if v, ok := obj[name]; ok {
+					walk(sub, v)
+				}
+			}
+		}
+	}
+	walk(s, doc)
+	return values
+}
+
+func prefixErrors(path string, errs []error) error {
+	for i, err := range errs {
+		errs[i] = fmt.Errorf("%s: %w", path, err)
+	}
+	return errors.Join(errs...)
+}
+
+// runConfig checks config files, prints the effective settings, or
+// prints the schema of the files
+func runConfig(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s config validate <file>|print-effective [serve flags]|schema", os.Args[0])
+	}
+	switch args[0] {
+	case "validate":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s config validate <file>", os.Args[0])
+		}
+		sf := newServeFlags(flag.ContinueOnError)
+		if err := sf.parse([]string{"-config", args[1]}); err != nil {
+			return err
+		}
+		fmt.Printf("%s is valid\n", args[1])
+		return nil
+
+	case "schema":
+		_, err := os.Stdout.Write(configSchema)
+		return err
+
+	case "print-effective":
+		sf := newServeFlags(flag.ContinueOnError)
+		if err := sf.parse(args[1:]); err != nil {
+			return err
+		}
+		var s schema
+		if err := json.Unmarshal(configSchema, &s); err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(effective(&s, sf.fs), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+
+	default:
+		return fmt.Errorf("unknown config command %q", args[0])
+	}
+}
+
+// effective returns the settings of the flags of fs in the layout of
+// the config files, the secrets redacted
+func effective(s *schema, fs *flag.FlagSet) any {
+	if s.Flag == "" {
+		doc := map[string]any{}
+		for name, sub := range s.Properties {
+			if v := effective(sub, fs); v != nil {
+				doc[name] = v
+			}
+		}
+		return doc
+	}
+	f := fs.Lookup(s.Flag)
+	if f == nil {
+		return nil
+	}
+	v := f.Value.String()
+	if s.Secret && v != "" {
+		return redact(v)
+	}
+	if s.Type != "object" {
+		return typed(s.Type, v)
+	}
+	extra, _ := s.additional()
+	obj := map[string]any{}
+	for _, kv := range strings.Split(v, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			obj[strings.TrimSpace(k)] = typed(extra.Type, strings.TrimSpace(v))
+		}
+	}
+	return obj
+}
+
+// typed converts a flag value to the JSON type of its setting
+func typed(typ, v string) any {
+	switch typ {
+	case "boolean":
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return json.Number(v)
+		}
+	case "array":
+		items := []any{}
+		for _, item := range strings.Split(v, ",") {
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	return v
+}
+
+// redact hides a secret, but the scheme and host of URLs
+func redact(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" {
+		return "REDACTED"
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	u.RawQuery = ""
+	return u.String()
+}
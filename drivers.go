@@ -0,0 +1,8 @@
+package main
+
+// the database/sql drivers of the stores, named "sqlite" and "pgx" as
+// the stores expect by default
+import (
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
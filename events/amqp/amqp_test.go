@@ -0,0 +1,56 @@
+package amqp
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/events"
+)
+
+func TestPublishRetries(t *testing.T) {
+	// a broker hanging up on every connection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var conns atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			c.Close()
+		}
+	}()
+
+	clk := clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	p := New(Config{URL: "amqp://guest:guest@" + ln.Addr().String() + "/", Exchange: "users"},
+		clk, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer p.Close()
+	done := make(chan error, 1)
+	go func() { done <- p.Publish(context.Background(), events.Event{ID: "e1", Type: events.UserCreated}) }()
+
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("published to a broker hanging up")
+			}
+			if n := conns.Load(); n != maxAttempts {
+				t.Errorf("%d connections, want %d", n, maxAttempts)
+			}
+			return
+		case <-time.After(time.Millisecond):
+			clk.Advance(maxBackoff)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Package aws publishes the events to an SNS topic or an SQS queue, as
+// CloudEvents, and uploads the usage reports to an S3 bucket. Requests
+// are signed with static credentials, those of the environment, or
+// those of the role of the ECS task or EC2 instance.
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/events"
+)
+
+const (
+	maxAttempts    = 3 // of publishing an event
+	initialBackoff = 200 * time.Millisecond
+	requestTimeout = 10 * time.Second
+	roleTimeout    = 2 * time.Second // of the requests for role credentials
+)
+
+// Config tells where the events are published. One of TopicARN and
+// QueueURL must be set. FIFO topics and queues, whose names end in
+// .fifo, get the id of the events as deduplication id and their subject
+// as message group.
+type Config struct {
+	Region   string
+	TopicARN string
+	QueueURL string
+	// Endpoint overrides the endpoint of the service, for local stacks
+	Endpoint string
+	Source   string // CloudEvents source of the events
+	// Transport carries the calls to SNS or SQS, the default one when
+	// nil. The role credentials are always asked for directly, the
+	// metadata endpoints being local to the host.
+	Transport http.RoundTripper
+
+	// static credentials, taken from the environment or the role of
+	// the host when not set
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Publisher is an events.Sink publishing to SNS or SQS
+type Publisher struct {
+	cfg      Config
+	service  string // sns or sqs
+	endpoint string
+	fifo     bool
+	client   *http.Client
+	creds    *credentialProvider
+	clock    clock.Clock
+	logger   *slog.Logger
+}
+
+// New returns a publisher with the given configuration
+func New(cfg Config, c clock.Clock, logger *slog.Logger) (*Publisher, error) {
+	if cfg.Region == "" {
+		return nil, errors.New("aws: no region")
+	}
+	p := &Publisher{
+		cfg:    cfg,
+		client: &http.Client{Transport: cfg.Transport, Timeout: requestTimeout},
+		creds: &credentialProvider{
+			static: credentials{AccessKeyID: cfg.AccessKeyID, SecretAccessKey: cfg.SecretAccessKey, SessionToken: cfg.SessionToken},
+			client: &http.Client{Timeout: roleTimeout},
+			clock:  c,
+		},
+		clock:  c,
+		logger: logger,
+	}
+	switch {
+	case cfg.TopicARN != "" && cfg.QueueURL == "":
+		p.service = "sns"
+		p.fifo = strings.HasSuffix(cfg.TopicARN, ".fifo")
+	case cfg.QueueURL != "" && cfg.TopicARN == "":
+		p.service = "sqs"
+		p.fifo = strings.HasSuffix(cfg.QueueURL, ".fifo")
+	default:
+		return nil, errors.New("aws: exactly one of the topic and the queue must be set")
+	}
+	p.endpoint = cfg.Endpoint
+	if p.endpoint == "" {
+		p.endpoint = "https://" + p.service + "." + cfg.Region + ".amazonaws.com/"
+	}
+	return p, nil
+}
+
+// Publish publishes e, retrying with backoff on failures
+func (p *Publisher) Publish(ctx context.Context, e events.Event) error {
+	body, err := json.Marshal(e.CloudEvent(p.cfg.Source))
+	if err != nil {
+		return err
+	}
+	form := p.form(e, string(body))
+
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err = p.send(ctx, form)
+		if err == nil || attempt == maxAttempts || ctx.Err() != nil {
+			return err
+		}
+		p.logger.WarnContext(ctx, "publishing to "+p.service, "attempt", attempt, "err", err)
+		select {
+		case <-p.clock.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// form returns the parameters of the query API request publishing body
+func (p *Publisher) form(e events.Event, body string) url.Values {
+	form := url.Values{}
+	if p.service == "sns" {
+		form.Set("Action", "Publish")
+		form.Set("Version", "2010-03-31")
+		form.Set("TopicArn", p.cfg.TopicARN)
+		form.Set("Message", body)
+		form.Set("MessageAttributes.entry.1.Name", "type")
+		form.Set("MessageAttributes.entry.1.Value.DataType", "String")
+		form.Set("MessageAttributes.entry.1.Value.StringValue", e.SchemaType())
+	} else {
+		form.Set("Action", "SendMessage")
+		form.Set("Version", "2012-11-05")
+		form.Set("QueueUrl", p.cfg.QueueURL)
+		form.Set("MessageBody", body)
+		form.Set("MessageAttribute.1.Name", "type")
+		form.Set("MessageAttribute.1.Value.DataType", "String")
+		form.Set("MessageAttribute.1.Value.StringValue", e.SchemaType())
+	}
+	if p.fifo {
+		group := e.Subject
+		if group == "" {
+			group = e.Type
+		}
+		form.Set("MessageGroupId", group)
+		form.Set("MessageDeduplicationId", e.ID)
+	}
+	return form
+}
+
+func (p *Publisher) send(ctx context.Context, form url.Values) error {
+	creds, err := p.creds.get(ctx)
+	if err != nil {
+		return err
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	sign(req, body, creds, p.service, p.cfg.Region, p.clock.Now())
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: status %d: %s", p.service, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package aws
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/events"
+)
+
+func TestPublishFIFOQueue(t *testing.T) {
+	var form url.Values
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form, auth = r.PostForm, r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	p, err := New(Config{
+		Region:          "eu-west-1",
+		QueueURL:        "https://sqs.eu-west-1.amazonaws.com/123456789012/users.fifo",
+		Endpoint:        srv.URL,
+		Source:          "urn:test",
+		AccessKeyID:     exampleCreds.AccessKeyID,
+		SecretAccessKey: exampleCreds.SecretAccessKey,
+	}, clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := events.Event{ID: "e1", Type: events.UserUpdated, Version: 1, Subject: "42"}
+	if err := p.Publish(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"Action":                               "SendMessage",
+		"MessageGroupId":                       "42",
+		"MessageDeduplicationId":               "e1",
+		"MessageAttribute.1.Value.StringValue": "user.updated.v1",
+	} {
+		if got := form.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if !strings.Contains(form.Get("MessageBody"), `"source":"urn:test"`) {
+		t.Errorf("message body %s isn't the CloudEvent", form.Get("MessageBody"))
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential="+exampleCreds.AccessKeyID+"/20240601/eu-west-1/sqs/") {
+		t.Errorf("Authorization %s", auth)
+	}
+}
+
+func TestNewRequiresOneDestination(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, cfg := range []Config{
+		{},
+		{Region: "eu-west-1"},
+		{Region: "eu-west-1", TopicARN: "arn:aws:sns:eu-west-1:123456789012:users", QueueURL: "https://sqs/q"},
+	} {
+		if _, err := New(cfg, clock.System{}, logger); err == nil {
+			t.Errorf("New(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+)
+
+const (
+	imdsURL         = "http://169.254.169.254/latest"
+	containerCredIP = "http://169.254.170.2"
+	refreshMargin   = 5 * time.Minute // before the expiry of role credentials
+)
+
+var errNoCredentials = errors.New("no aws credentials: none configured, in the environment or from a role")
+
+// credentials sign the requests to AWS
+type credentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"` // zero for static credentials
+}
+
+// credentialProvider returns the static credentials when given, else
+// those of the environment, else those of the role of the ECS task or
+// EC2 instance, refreshed before they expire
+type credentialProvider struct {
+	static credentials
+	client *http.Client
+	clock  clock.Clock
+
+	mu     sync.Mutex
+	cached credentials
+}
+
+func (p *credentialProvider) get(ctx context.Context) (credentials, error) {
+	if p.static.AccessKeyID != "" {
+		return p.static, nil
+	}
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return credentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cached.AccessKeyID != "" && p.clock.Now().Add(refreshMargin).Before(p.cached.Expiration) {
+		return p.cached, nil
+	}
+	creds, err := p.role(ctx)
+	if err != nil {
+		return credentials{}, err
+	}
+	p.cached = creds
+	return creds, nil
+}
+
+// role fetches the credentials of the role of the ECS task, or of the
+// EC2 instance through IMDSv2
+func (p *credentialProvider) role(ctx context.Context) (credentials, error) {
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return p.fetch(ctx, containerCredIP+uri, nil)
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		return p.fetch(ctx, uri, http.Header{"Authorization": {os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")}})
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imdsURL+"/api/token", nil)
+	if err != nil {
+		return credentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := p.read(req)
+	if err != nil {
+		return credentials{}, errNoCredentials
+	}
+	header := http.Header{"X-aws-ec2-metadata-token": {token}}
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, imdsURL+"/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return credentials{}, err
+	}
+	req.Header = header
+	roles, err := p.read(req)
+	if err != nil {
+		return credentials{}, fmt.Errorf("listing the instance roles: %w", err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(roles), "\n")
+	if role == "" {
+		return credentials{}, errNoCredentials
+	}
+	return p.fetch(ctx, imdsURL+"/meta-data/iam/security-credentials/"+role, header)
+}
+
+// fetch reads the credentials served as JSON at url
+func (p *credentialProvider) fetch(ctx context.Context, url string, header http.Header) (credentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return credentials{}, err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	body, err := p.read(req)
+	if err != nil {
+		return credentials{}, fmt.Errorf("fetching the role credentials: %w", err)
+	}
+	var creds credentials
+	if err := json.Unmarshal([]byte(body), &creds); err != nil || creds.AccessKeyID == "" {
+		return credentials{}, fmt.Errorf("fetching the role credentials: invalid response")
+	}
+	return creds, nil
+}
+
+func (p *credentialProvider) read(req *http.Request) (string, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return string(b), nil
+}
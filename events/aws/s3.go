@@ -0,0 +1,97 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/santisdev/go-restapi.git/clock"
+)
+
+// UploaderConfig tells the S3 bucket the objects are put in
+type UploaderConfig struct {
+	Region string
+	Bucket string
+	Prefix string // of the keys of the objects, as "usage/"
+	// Endpoint overrides the endpoint of S3, for local stacks, the
+	// bucket then being the first segment of the path
+	Endpoint string
+	// Transport carries the calls to S3, the default one when nil
+	Transport http.RoundTripper
+
+	// static credentials, taken from the environment or the role of
+	// the host when not set
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Uploader puts objects in an S3 bucket, as the usage reports of the
+// server
+type Uploader struct {
+	cfg    UploaderConfig
+	base   string // URL of the bucket, ending in /
+	client *http.Client
+	creds  *credentialProvider
+	clock  clock.Clock
+}
+
+// NewUploader returns an uploader with the given configuration
+func NewUploader(cfg UploaderConfig, c clock.Clock) (*Uploader, error) {
+	if cfg.Region == "" {
+		return nil, errors.New("aws: no region")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("aws: no bucket")
+	}
+	u := &Uploader{
+		cfg:    cfg,
+		base:   "https://" + cfg.Bucket + ".s3." + cfg.Region + ".amazonaws.com/",
+		client: &http.Client{Transport: cfg.Transport, Timeout: requestTimeout},
+		creds: &credentialProvider{
+			static: credentials{AccessKeyID: cfg.AccessKeyID, SecretAccessKey: cfg.SecretAccessKey, SessionToken: cfg.SessionToken},
+			client: &http.Client{Timeout: roleTimeout},
+			clock:  c,
+		},
+		clock: c,
+	}
+	if cfg.Endpoint != "" {
+		u.base = strings.TrimSuffix(cfg.Endpoint, "/") + "/" + cfg.Bucket + "/"
+	}
+	return u, nil
+}
+
+// Upload puts body in the bucket under the prefix and name, replacing
+// the object there
+func (u *Uploader) Upload(ctx context.Context, name string, body []byte, contentType string) error {
+	creds, err := u.creds.get(ctx)
+	if err != nil {
+		return err
+	}
+	target, err := url.Parse(u.base)
+	if err != nil {
+		return err
+	}
+	target.Path += u.cfg.Prefix + name
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	sign(req, body, creds, "s3", u.cfg.Region, u.clock.Now())
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("s3: status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package events
+
+import (
+	"encoding/json"
+
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+// CloudEventsContentType is the media type of the events in the
+// structured mode of CloudEvents
+const CloudEventsContentType = "application/cloudevents+json"
+
+// CloudEvent is an event in the JSON format of CloudEvents 1.0
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            timestamp.Time  `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data,omitempty"`
+}
+
+// CloudEvent returns e as emitted by source, a URI reference
+// identifying the API. Its type is the versioned type of e, so
+// consumers can route on the version.
+func (e Event) CloudEvent(source string) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              e.ID,
+		Source:          source,
+		Type:            e.SchemaType(),
+		Subject:         e.Subject,
+		Time:            e.Time,
+		DataContentType: "application/json",
+		Data:            e.Data,
+	}
+}
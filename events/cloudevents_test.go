@@ -0,0 +1,29 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+func TestCloudEvent(t *testing.T) {
+	e := Event{
+		ID:      "e1",
+		Type:    UserCreated,
+		Time:    timestamp.New(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)),
+		Subject: "42",
+		Version: 1,
+		Data:    json.RawMessage(`{"id":"42"}`),
+	}
+	b, err := json.Marshal(e.CloudEvent("urn:test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"specversion":"1.0","id":"e1","source":"urn:test","type":"user.created.v1","subject":"42",` +
+		`"time":"2024-06-01T12:00:00Z","datacontenttype":"application/json","data":{"id":"42"}}`
+	if string(b) != want {
+		t.Errorf("got %s\nwant %s", b, want)
+	}
+}
@@ -0,0 +1,141 @@
+// Package events defines the events emitted on changes of the users and
+// the bus they are published on.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+// event types
+const (
+	UserCreated     = "user.created"
+	UserUpdated     = "user.updated"
+	UserDeleted     = "user.deleted"
+	UserActivated   = "user.activated"
+	UserDeactivated = "user.deactivated"
+	UserMerged      = "user.merged"
+	UsersReplaced   = "users.replaced"
+	// TrafficAnomaly alerts of a client writing far more than usual
+	TrafficAnomaly = "traffic.anomaly"
+	// QuotaWarning warns of a client reaching a share of its monthly
+	// quota
+	QuotaWarning = "quota.warning"
+)
+
+// Event is a change notification
+type Event struct {
+	ID      string         `json:"id"`
+	Type    string         `json:"type"`
+	Time    timestamp.Time `json:"time"`
+	Subject string         `json:"subject,omitempty"` // id of the changed resource
+	// Version is the version of the schema of Data
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// sensitive are the types of the events whose data holds personal
+// information, the names and emails of the users
+var sensitive = map[string]bool{
+	UserCreated:     true,
+	UserUpdated:     true,
+	UserDeleted:     true,
+	UserActivated:   true,
+	UserDeactivated: true,
+	UserMerged:      true,
+	UsersReplaced:   true,
+	TrafficAnomaly:  true,
+}
+
+// Sensitive tells whether the data of e holds personal information
+func (e Event) Sensitive() bool {
+	return len(e.Data) > 0 && sensitive[e.Type]
+}
+
+// SchemaType is the versioned type of the event, as in user.created.v1
+func (e Event) SchemaType() string {
+	return e.Type + ".v" + strconv.Itoa(e.Version)
+}
+
+// Bus carries events from publishers to subscribers
+type Bus interface {
+	Publish(ctx context.Context, e Event) error
+	// Subscribe calls fn on every event published from now on, until
+	// the returned function is called
+	Subscribe(fn func(Event)) (unsubscribe func())
+}
+
+// Memory is an in-process bus calling the subscribers synchronously
+type Memory struct {
+	mu   sync.RWMutex
+	next int
+	subs map[int]func(Event)
+}
+
+// NewMemory returns an in-process bus
+func NewMemory() *Memory {
+	return &Memory{subs: map[int]func(Event){}}
+}
+
+func (b *Memory) Publish(ctx context.Context, e Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.subs {
+		fn(e)
+	}
+	return nil
+}
+
+func (b *Memory) Subscribe(fn func(Event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+// Sink receives the published events, as the publishers to brokers do
+type Sink interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// WithSinks returns a bus publishing every event on bus, then to the
+// sinks. The errors of the sinks are joined.
+func WithSinks(bus Bus, sinks ...Sink) Bus {
+	return &sinkBus{Bus: bus, sinks: sinks}
+}
+
+type sinkBus struct {
+	Bus
+	sinks []Sink
+}
+
+func (b *sinkBus) Publish(ctx context.Context, e Event) error {
+	errs := []error{b.Bus.Publish(ctx, e)}
+	for _, s := range b.sinks {
+		errs = append(errs, s.Publish(ctx, e))
+	}
+	return errors.Join(errs...)
+}
+
+// Expand fills a template, such as a routing key or a topic, with the
+// attributes of e: {type}, {version}, {schema_type} and {subject}
+func Expand(template string, e Event) string {
+	return strings.NewReplacer(
+		"{type}", e.Type,
+		"{version}", strconv.Itoa(e.Version),
+		"{schema_type}", e.SchemaType(),
+		"{subject}", e.Subject,
+	).Replace(template)
+}
@@ -0,0 +1,44 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type sinkFunc func(context.Context, Event) error
+
+func (f sinkFunc) Publish(ctx context.Context, e Event) error { return f(ctx, e) }
+
+func TestWithSinks(t *testing.T) {
+	bus := NewMemory()
+	var got []string
+	bus.Subscribe(func(e Event) { got = append(got, "bus "+e.ID) })
+	errDown := errors.New("broker down")
+	b := WithSinks(bus,
+		sinkFunc(func(_ context.Context, e Event) error { got = append(got, "sink "+e.ID); return nil }),
+		sinkFunc(func(context.Context, Event) error { return errDown }),
+	)
+
+	err := b.Publish(context.Background(), Event{ID: "e1"})
+	if !errors.Is(err, errDown) {
+		t.Errorf("publish: %v, want the error of the sink", err)
+	}
+	if len(got) != 2 || got[0] != "bus e1" || got[1] != "sink e1" {
+		t.Errorf("delivered %v, want the bus then the sinks", got)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	e := Event{Type: UserUpdated, Version: 2, Subject: "42"}
+	for tmpl, want := range map[string]string{
+		"{type}":                    "user.updated",
+		"users.{schema_type}":       "users.user.updated.v2",
+		"users/{subject}/{version}": "users/42/2",
+		"{unknown}":                 "{unknown}",
+	} {
+		if got := Expand(tmpl, e); got != want {
+			t.Errorf("Expand(%q) = %q, want %q", tmpl, got, want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/events"
+)
+
+// packet is a packet received by the broker, with the flags of its
+// fixed header
+type packet struct {
+	typ, flags byte
+	body       []byte
+}
+
+// broker accepts one client and acknowledges its packets as a broker
+// would, sending them on the returned channel
+func broker(t *testing.T) (string, <-chan packet) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	c := make(chan packet, 16)
+	go func() {
+		defer close(c)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		// the publisher framing the packets of the broker
+		w := &Publisher{conn: conn}
+		for {
+			header, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			n, mult := 0, 1
+			for {
+				b, err := r.ReadByte()
+				if err != nil {
+					return
+				}
+				n += int(b&0x7f) * mult
+				mult *= 128
+				if b&0x80 == 0 {
+					break
+				}
+			}
+			body := make([]byte, n)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+			pkt := packet{header >> 4, header & 0x0f, body}
+			c <- pkt
+
+			switch pkt.typ {
+			case connect:
+				w.write(connack<<4, []byte{0, 0})
+			case publish:
+				topic := int(binary.BigEndian.Uint16(body))
+				id := body[2+topic : 2+topic+2]
+				switch qos := pkt.flags >> 1 & 3; qos {
+				case 1:
+					w.write(puback<<4, id)
+				case 2:
+					w.write(pubrec<<4, id)
+				}
+			case pubrel:
+				w.write(pubcomp<<4, body)
+			}
+		}
+	}()
+	return ln.Addr().String(), c
+}
+
+// str reads a length-prefixed string at the start of b, returning the
+// rest
+func str(b []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func TestPublishQoS2(t *testing.T) {
+	addr, c := broker(t)
+	p, err := New(Config{
+		URL:    "mqtt://ada:secret@" + addr,
+		Topics: map[string]string{events.UserDeleted: "users/{subject}/gone"},
+		QoS:    2,
+		Retain: true,
+		Source: "urn:test",
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Publish(context.Background(), events.Event{ID: "e1", Type: events.UserCreated, Subject: "42"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(context.Background(), events.Event{ID: "e2", Type: events.UserDeleted, Subject: "42"}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := <-c
+	if conn.typ != connect {
+		t.Fatalf("first packet of type %d, want CONNECT", conn.typ)
+	}
+	_, rest := str(conn.body)
+	if flags := rest[1]; flags != 0xc2 {
+		t.Errorf("connect flags %#x, want a clean session with username and password", flags)
+	}
+	_, rest = str(rest[4:]) // client id
+	if user, rest := str(rest); user != "ada" {
+		t.Errorf("username %q", user)
+	} else if pw, _ := str(rest); pw != "secret" {
+		t.Errorf("password %q", pw)
+	}
+
+	for _, want := range []struct{ topic, id string }{{"users/user.created", "e1"}, {"users/42/gone", "e2"}} {
+		pub := <-c
+		if pub.typ != publish || pub.flags != 2<<1|1 {
+			t.Fatalf("packet of type %d with flags %#x, want a retained PUBLISH at qos 2", pub.typ, pub.flags)
+		}
+		topic, rest := str(pub.body)
+		if topic != want.topic {
+			t.Errorf("topic %q, want %q", topic, want.topic)
+		}
+		var ce events.CloudEvent
+		if err := json.Unmarshal(rest[2:], &ce); err != nil {
+			t.Fatal(err)
+		}
+		if ce.ID != want.id || ce.Source != "urn:test" {
+			t.Errorf("published %+v, want the CloudEvent of %s", ce, want.id)
+		}
+		if rel := <-c; rel.typ != pubrel || string(rel.body) != string(rest[:2]) {
+			t.Errorf("packet of type %d, want the PUBREL of the message", rel.typ)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{URL: "tcp://localhost"},
+		{URL: "mqtt://"},
+		{URL: "mqtt://localhost", QoS: 3},
+	} {
+		if _, err := New(cfg, slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+			t.Errorf("New(%+v) succeeded", cfg)
+		}
+	}
+}
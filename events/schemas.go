@@ -0,0 +1,94 @@
+package events
+
+import "encoding/json"
+
+// Schema describes the payload of a version of an event type. Several
+// versions of a type are emitted side by side while consumers move to
+// the newest one, as separate events.
+type Schema struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	// Emitted is false for the versions no longer published
+	Emitted    bool            `json:"emitted"`
+	Deprecated bool            `json:"deprecated,omitempty"`
+	Schema     json.RawMessage `json:"schema"` // JSON Schema of the data
+}
+
+// SchemaType is the versioned type of the events, as in user.created.v1
+func (s Schema) SchemaType() string {
+	return Event{Type: s.Type, Version: s.Version}.SchemaType()
+}
+
+const userSchemaV1 = `{
+	"type": "object",
+	"required": ["id", "name", "active", "version"],
+	"properties": {
+		"id": {"type": "string"},
+		"name": {"type": "string"},
+		"active": {"type": "boolean"},
+		"tags": {"type": "array", "items": {"type": "string"}},
+		"metadata": {"type": "object", "additionalProperties": {"type": "string"}},
+		"external_ids": {"type": "object", "additionalProperties": {"type": "string"}},
+		"merged_into": {"type": "string"},
+		"version": {"type": "integer"}
+	}
+}`
+
+// Schemas are the schemas of every version of the events, oldest first
+// within a type. Events are only published in their emitted versions,
+// so every type needs one.
+var Schemas = []Schema{
+	{UserCreated, 1, true, false, json.RawMessage(userSchemaV1)},
+	{UserUpdated, 1, true, false, json.RawMessage(userSchemaV1)},
+	{UserDeleted, 1, true, false, json.RawMessage(userSchemaV1)},
+	{UserActivated, 1, true, false, json.RawMessage(userSchemaV1)},
+	{UserDeactivated, 1, true, false, json.RawMessage(userSchemaV1)},
+	{UserMerged, 1, true, false, json.RawMessage(`{
+	"type": "object",
+	"required": ["target", "source"],
+	"properties": {
+		"target": ` + userSchemaV1 + `,
+		"source": {"type": "string"}
+	}
+}`)},
+	{UsersReplaced, 1, true, false, json.RawMessage(`{
+	"type": "object",
+	"required": ["count"],
+	"properties": {"count": {"type": "integer"}}
+}`)},
+	{TrafficAnomaly, 1, true, false, json.RawMessage(`{
+	"type": "object",
+	"required": ["client", "operation", "count", "usual", "window"],
+	"properties": {
+		"client": {"type": "string"},
+		"operation": {"type": "string", "enum": ["create", "delete"]},
+		"count": {"type": "integer"},
+		"usual": {"type": "number"},
+		"window": {"type": "string"},
+		"throttled_until": {"type": "string", "format": "date-time"}
+	}
+}`)},
+	{QuotaWarning, 1, true, false, json.RawMessage(`{
+	"type": "object",
+	"required": ["client", "resource", "threshold", "used", "limit", "month"],
+	"properties": {
+		"client": {"type": "string"},
+		"resource": {"type": "string", "enum": ["requests", "records"]},
+		"threshold": {"type": "integer", "enum": [80, 90, 100]},
+		"used": {"type": "integer"},
+		"limit": {"type": "integer"},
+		"month": {"type": "string"}
+	}
+}`)},
+}
+
+// EmittedVersions returns the versions of typ being published
+func EmittedVersions(typ string) []int {
+	var versions []int
+	for _, s := range Schemas {
+		if s.Type == typ && s.Emitted {
+			versions = append(versions, s.Version)
+		}
+	}
+	return versions
+}
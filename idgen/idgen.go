@@ -0,0 +1,37 @@
+// Package idgen generates the identifiers of resources, events and
+// tokens.
+package idgen
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+)
+
+// Generator returns a new identifier on every call
+type Generator interface {
+	NewID() string
+}
+
+// Random generates random 128-bit identifiers, hex encoded
+type Random struct{}
+
+func (Random) NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("idgen: reading random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Sequence generates Prefix followed by 1, 2, 3... and is meant for
+// deterministic tests
+type Sequence struct {
+	Prefix string
+	n      atomic.Uint64
+}
+
+func (s *Sequence) NewID() string {
+	return s.Prefix + strconv.FormatUint(s.n.Add(1), 10)
+}
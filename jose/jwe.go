@@ -0,0 +1,239 @@
+package jose
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the content of the JWEs is encrypted with AES-256-GCM
+const enc = "A256GCM"
+
+// EncryptionKey returns the key of k the payloads are encrypted to, an
+// *ecdh.PublicKey for P-256 and X25519 keys, agreed on by ECDH-ES, or an
+// *rsa.PublicKey wrapping the content key with RSA-OAEP-256
+func (k JWK) EncryptionKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "enc" {
+		return nil, fmt.Errorf("jose: key meant for %q, not encryption", k.Use)
+	}
+	switch {
+	case k.Kty == "OKP" && k.Crv == "X25519":
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, errors.New("jose: invalid X25519 key")
+		}
+		pub, err := ecdh.X25519().NewPublicKey(x)
+		if err != nil {
+			return nil, errors.New("jose: invalid X25519 key")
+		}
+		return pub, nil
+	case k.Kty == "EC":
+		pub, err := k.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		return pub.(*ecdsa.PublicKey).ECDH()
+	case k.Kty == "RSA":
+		pub, err := k.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if pub.(*rsa.PublicKey).N.BitLen() < 2048 {
+			return nil, errors.New("jose: RSA key shorter than 2048 bits")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("jose: unsupported encryption key type %s %s", k.Kty, k.Crv)
+}
+
+// Encrypt returns the compact serialization of the JWE (RFC 7516) of
+// plaintext to the key of k
+func Encrypt(k JWK, plaintext []byte) (string, error) {
+	pub, err := k.EncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	header := map[string]any{"enc": enc}
+	if k.Kid != "" {
+		header["kid"] = k.Kid
+	}
+	var cek, wrapped []byte
+	switch pub := pub.(type) {
+	case *ecdh.PublicKey:
+		// ECDH-ES in direct key agreement: the agreed key is the content key
+		eph, err := pub.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		z, err := eph.ECDH(pub)
+		if err != nil {
+			return "", err
+		}
+		header["alg"] = "ECDH-ES"
+		header["epk"] = ephemeralJWK(eph.PublicKey())
+		cek = concatKDF(z, enc, 32)
+	case *rsa.PublicKey:
+		cek = make([]byte, 32)
+		if _, err := rand.Read(cek); err != nil {
+			return "", err
+		}
+		wrapped, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, cek, nil)
+		if err != nil {
+			return "", err
+		}
+		header["alg"] = "RSA-OAEP-256"
+	}
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	protected := b64.EncodeToString(rawHeader)
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	return strings.Join([]string{
+		protected,
+		b64.EncodeToString(wrapped),
+		b64.EncodeToString(iv),
+		b64.EncodeToString(ciphertext),
+		b64.EncodeToString(tag),
+	}, "."), nil
+}
+
+// Decrypt returns the plaintext of a compact JWE encrypted by Encrypt to
+// the public key of key, an *ecdh.PrivateKey, *ecdsa.PrivateKey or
+// *rsa.PrivateKey
+func Decrypt(key crypto.PrivateKey, jwe string) ([]byte, error) {
+	parts := strings.Split(jwe, ".")
+	if len(parts) != 5 {
+		return nil, errors.New("jose: not a compact JWE")
+	}
+	raw := make([][]byte, 5)
+	for i, p := range parts {
+		b, err := b64.DecodeString(p)
+		if err != nil {
+			return nil, fmt.Errorf("jose: JWE part %d: %w", i, err)
+		}
+		raw[i] = b
+	}
+	var h struct {
+		Alg string `json:"alg"`
+		Enc string `json:"enc"`
+		Epk JWK    `json:"epk"`
+	}
+	if err := json.Unmarshal(raw[0], &h); err != nil {
+		return nil, fmt.Errorf("jose: header: %w", err)
+	}
+	if h.Enc != enc {
+		return nil, fmt.Errorf("jose: unsupported content encryption %q", h.Enc)
+	}
+	if k, ok := key.(*ecdsa.PrivateKey); ok {
+		ek, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		key = ek
+	}
+	var cek []byte
+	switch k := key.(type) {
+	case *ecdh.PrivateKey:
+		if h.Alg != "ECDH-ES" {
+			return nil, fmt.Errorf("jose: unexpected algorithm %q", h.Alg)
+		}
+		epk, err := h.Epk.EncryptionKey()
+		if err != nil {
+			return nil, fmt.Errorf("jose: epk: %w", err)
+		}
+		pub, ok := epk.(*ecdh.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("jose: epk: %s key, expected an ECDH one", h.Epk.Kty)
+		}
+		if pub.Curve() != k.Curve() {
+			return nil, errors.New("jose: epk: not on the curve of the key")
+		}
+		z, err := k.ECDH(pub)
+		if err != nil {
+			return nil, err
+		}
+		cek = concatKDF(z, enc, 32)
+	case *rsa.PrivateKey:
+		if h.Alg != "RSA-OAEP-256" {
+			return nil, fmt.Errorf("jose: unexpected algorithm %q", h.Alg)
+		}
+		var err error
+		if cek, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, k, raw[1], nil); err != nil {
+			return nil, fmt.Errorf("jose: content key: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("jose: unsupported key %T", key)
+	}
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw[2]) != gcm.NonceSize() {
+		return nil, errors.New("jose: invalid IV")
+	}
+	plaintext, err := gcm.Open(nil, raw[2], append(raw[3], raw[4]...), []byte(parts[0]))
+	if err != nil {
+		return nil, errors.New("jose: invalid JWE")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ephemeralJWK returns the public ECDH key of the sender as epk
+func ephemeralJWK(pub *ecdh.PublicKey) JWK {
+	b := pub.Bytes()
+	if pub.Curve() == ecdh.X25519() {
+		return JWK{Kty: "OKP", Crv: "X25519", X: b64.EncodeToString(b)}
+	}
+	// uncompressed point, 0x04 || x || y
+	return JWK{Kty: "EC", Crv: "P-256", X: b64.EncodeToString(b[1:33]), Y: b64.EncodeToString(b[33:])}
+}
+
+// concatKDF derives size bytes from the shared secret z, as the Concat
+// KDF of NIST SP 800-56A with the empty party infos of RFC 7518, 4.6.2
+func concatKDF(z []byte, alg string, size int) []byte {
+	var info []byte
+	info = binary.BigEndian.AppendUint32(info, uint32(len(alg)))
+	info = append(info, alg...)
+	info = binary.BigEndian.AppendUint32(info, 0) // PartyUInfo
+	info = binary.BigEndian.AppendUint32(info, 0) // PartyVInfo
+	info = binary.BigEndian.AppendUint32(info, uint32(size*8))
+
+	var out []byte
+	for counter := uint32(1); len(out) < size; counter++ {
+		h := sha256.New()
+		binary.Write(h, binary.BigEndian, counter)
+		h.Write(z)
+		h.Write(info)
+		out = h.Sum(out)
+	}
+	return out[:size]
+}
@@ -0,0 +1,225 @@
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// encryptionKeys returns private keys of every type the JWEs are
+// encrypted to, with their public JWK
+func encryptionKeys(t *testing.T) map[string]struct {
+	priv crypto.PrivateKey
+	jwk  JWK
+} {
+	t.Helper()
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]struct {
+		priv crypto.PrivateKey
+		jwk  JWK
+	}{
+		"P-256":  {p256, publicJWK(&p256.PublicKey)},
+		"X25519": {x25519, ephemeralJWK(x25519.PublicKey())},
+		"RSA":    {rsaKey, publicJWK(&rsaKey.PublicKey)},
+	}
+}
+
+func TestJWERoundTrip(t *testing.T) {
+	plaintext := []byte(`{"id":"u1","name":"Ada","email":"ada@example.com"}`)
+	for name, k := range encryptionKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			jwk := k.jwk
+			jwk.Kid = "key-1"
+			jwe, err := Encrypt(jwk, plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(jwe, "."); n != 4 {
+				t.Fatalf("%d dots in %q, want a compact JWE", n, jwe)
+			}
+			header := decodeHeader(t, jwe)
+			if header["enc"] != enc || header["kid"] != "key-1" {
+				t.Errorf("header %v, want enc %s and kid key-1", header, enc)
+			}
+			got, err := Decrypt(k.priv, jwe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(plaintext) {
+				t.Errorf("decrypted %q, want %q", got, plaintext)
+			}
+
+			// a fresh content key and IV per message
+			again, err := Encrypt(jwk, plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again == jwe {
+				t.Error("the same JWE twice")
+			}
+		})
+	}
+}
+
+func TestJWETampered(t *testing.T) {
+	for name, k := range encryptionKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			jwe, err := Encrypt(k.jwk, []byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts := strings.Split(jwe, ".")
+			for i := range parts {
+				if name != "RSA" && i == 1 {
+					continue // no wrapped key for ECDH-ES
+				}
+				tampered := append([]string(nil), parts...)
+				b, err := b64.DecodeString(tampered[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				b[len(b)-1] ^= 1
+				tampered[i] = b64.EncodeToString(b)
+				if _, err := Decrypt(k.priv, strings.Join(tampered, ".")); err == nil {
+					t.Errorf("part %d tampered: decrypted", i)
+				}
+			}
+		})
+	}
+}
+
+func TestJWEWrongKey(t *testing.T) {
+	keys := encryptionKeys(t)
+	other := encryptionKeys(t)
+	for name, k := range keys {
+		jwe, err := Encrypt(k.jwk, []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Decrypt(other[name].priv, jwe); err == nil {
+			t.Errorf("%s: decrypted with another key", name)
+		}
+	}
+	// a JWE to a P-256 key isn't decrypted by an X25519 one
+	jwe, err := Encrypt(keys["P-256"].jwk, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(keys["X25519"].priv, jwe); err == nil || !strings.Contains(err.Error(), "curve") {
+		t.Errorf("P-256 epk with an X25519 key: %v, want a curve mismatch", err)
+	}
+}
+
+func TestJWEMalformedHeader(t *testing.T) {
+	keys := encryptionKeys(t)
+	p256 := keys["P-256"].priv
+	jwe, err := Encrypt(keys["P-256"].jwk, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := decodeHeader(t, jwe)
+	rest := jwe[strings.Index(jwe, "."):]
+
+	// withHeader returns the JWE with its header changed by fn
+	withHeader := func(fn func(h map[string]any)) string {
+		h := map[string]any{}
+		for k, v := range header {
+			h[k] = v
+		}
+		fn(h)
+		b, err := json.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b64.EncodeToString(b) + rest
+	}
+
+	for _, tc := range []struct {
+		name string
+		jwe  string
+		key  crypto.PrivateKey
+	}{
+		{"too few parts", "a.b.c", p256},
+		{"not base64url", "!!!" + rest, p256},
+		{"header not JSON", b64.EncodeToString([]byte("{")) + rest, p256},
+		{"header not an object", b64.EncodeToString([]byte(`"ECDH-ES"`)) + rest, p256},
+		{"unsupported enc", withHeader(func(h map[string]any) { h["enc"] = "A128CBC-HS256" }), p256},
+		{"no enc", withHeader(func(h map[string]any) { delete(h, "enc") }), p256},
+		{"alg none", withHeader(func(h map[string]any) { h["alg"] = "none" }), p256},
+		{"RSA alg for an EC key", withHeader(func(h map[string]any) { h["alg"] = "RSA-OAEP-256" }), p256},
+		{"ECDH alg for an RSA key", jwe, keys["RSA"].priv},
+		{"no epk", withHeader(func(h map[string]any) { delete(h, "epk") }), p256},
+		{"epk off the curve", withHeader(func(h map[string]any) {
+			h["epk"] = JWK{Kty: "EC", Crv: "P-256", X: b64.EncodeToString(make([]byte, 32)), Y: b64.EncodeToString(make([]byte, 32))}
+		}), p256},
+		{"epk of another curve", withHeader(func(h map[string]any) { h["epk"] = keys["X25519"].jwk }), p256},
+		{"epk of type RSA", withHeader(func(h map[string]any) { h["epk"] = keys["RSA"].jwk }), p256},
+		{"epk meant for signing", withHeader(func(h map[string]any) {
+			epk := header["epk"].(map[string]any)
+			epk["use"] = "sig"
+			h["epk"] = epk
+		}), p256},
+		{"unsupported key", jwe, "not a key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Decrypt(tc.key, tc.jwe); err == nil {
+				t.Error("decrypted")
+			}
+		})
+	}
+}
+
+func TestEncryptionKeyRefused(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signing := publicJWK(&p256.PublicKey)
+	signing.Use = "sig"
+	for name, k := range map[string]JWK{
+		"RSA under 2048 bits": publicJWK(&small.PublicKey),
+		"meant for signing":   signing,
+		"Ed25519":             {Kty: "OKP", Crv: "Ed25519", X: b64.EncodeToString(make([]byte, 32))},
+		"invalid X25519":      {Kty: "OKP", Crv: "X25519", X: "AAAA"},
+		"unknown type":        {Kty: "oct"},
+	} {
+		if _, err := Encrypt(k, []byte("secret")); err == nil {
+			t.Errorf("%s: encrypted", name)
+		}
+	}
+}
+
+// decodeHeader returns the protected header of a compact JWE
+func decodeHeader(t *testing.T, jwe string) map[string]any {
+	t.Helper()
+	b, err := b64.DecodeString(jwe[:strings.Index(jwe, ".")])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h map[string]any
+	if err := json.Unmarshal(b, &h); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
@@ -0,0 +1,242 @@
+// Package jose implements the parts of JOSE the API needs: detached JSON
+// Web Signatures (RFC 7515) of its responses, JSON Web Tokens (RFC 7519)
+// of its clients, JSON Web Encryption (RFC 7516) of the webhook payloads
+// and the JSON Web Keys (RFC 7517) of them all.
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+var b64 = base64.RawURLEncoding
+
+// Signer signs payloads with a private key, as ES256 for P-256 keys,
+// EdDSA for Ed25519 keys and RS256 for RSA keys, or with a secret, as
+// HS256
+type Signer struct {
+	key    crypto.Signer // nil for secrets
+	secret []byte
+	alg    string
+	kid    string
+}
+
+// minSecretLen is the shortest HS256 secret, as long as its hash
+const minSecretLen = 32
+
+// NewHMACSigner returns the HS256 signer of secret, its signatures
+// naming it by kid
+func NewHMACSigner(secret []byte, kid string) (*Signer, error) {
+	if len(secret) < minSecretLen {
+		return nil, fmt.Errorf("jose: HMAC secret shorter than %d bytes", minSecretLen)
+	}
+	if kid == "" {
+		return nil, errors.New("jose: HMAC secret with no key id")
+	}
+	return &Signer{secret: secret, alg: "HS256", kid: kid}, nil
+}
+
+// NewSigner returns the signer of key, its signatures naming the key by
+// kid, or by its RFC 7638 thumbprint when empty
+func NewSigner(key crypto.Signer, kid string) (*Signer, error) {
+	s := &Signer{key: key, kid: kid}
+	switch k := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("jose: unsupported curve %s, expected P-256", k.Curve.Params().Name)
+		}
+		s.alg = "ES256"
+	case ed25519.PublicKey:
+		s.alg = "EdDSA"
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("jose: RSA key shorter than 2048 bits")
+		}
+		s.alg = "RS256"
+	default:
+		return nil, fmt.Errorf("jose: unsupported key %T", k)
+	}
+	if s.kid == "" {
+		s.kid = s.JWK().Thumbprint()
+	}
+	return s, nil
+}
+
+// LoadSigner reads the private key of a PEM file, in PKCS #8, SEC 1 or
+// PKCS #1
+func LoadSigner(file, kid string) (*Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jose: %s: no PEM block", file)
+	}
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jose: %s: %w", file, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("jose: %s: unsupported key %T", file, key)
+	}
+	return NewSigner(signer, kid)
+}
+
+// KeyID names the key in the signatures
+func (s *Signer) KeyID() string {
+	return s.kid
+}
+
+// Alg is the algorithm of the signatures
+func (s *Signer) Alg() string {
+	return s.alg
+}
+
+// SignDetached returns the compact serialization of the JWS of payload
+// without the payload, as header..signature (RFC 7515, appendix F). The
+// verifiers put back the base64url of the payload between the dots.
+func (s *Signer) SignDetached(payload []byte) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid})
+	if err != nil {
+		return "", err
+	}
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	sig, err := s.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return b64.EncodeToString(header) + ".." + b64.EncodeToString(sig), nil
+}
+
+// JWS is a signature in the flattened JSON serialization (RFC 7515,
+// section 7.2.2), as ACME takes its requests
+type JWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// SignJSON returns the flattened JWS of payload, header holding the
+// members of the protected header besides alg
+func (s *Signer) SignJSON(header map[string]any, payload []byte) (JWS, error) {
+	protected := map[string]any{"alg": s.alg}
+	for k, v := range header {
+		protected[k] = v
+	}
+	h, err := json.Marshal(protected)
+	if err != nil {
+		return JWS{}, err
+	}
+	jws := JWS{Protected: b64.EncodeToString(h), Payload: b64.EncodeToString(payload)}
+	sig, err := s.sign([]byte(jws.Protected + "." + jws.Payload))
+	if err != nil {
+		return JWS{}, err
+	}
+	jws.Signature = b64.EncodeToString(sig)
+	return jws, nil
+}
+
+func (s *Signer) sign(input []byte) ([]byte, error) {
+	switch s.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case "EdDSA":
+		return s.key.Sign(rand.Reader, input, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(input)
+	sig, err := s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil || s.alg != "ES256" {
+		return sig, err
+	}
+	// JWS wants r || s, not the ASN.1 of crypto/ecdsa
+	r, ss, err := parseECDSA(sig)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, 64)
+	r.FillBytes(raw[:32])
+	ss.FillBytes(raw[32:])
+	return raw, nil
+}
+
+// VerifyDetached checks a detached JWS of payload against the public key
+// of jwk
+func VerifyDetached(jwk JWK, jws string, payload []byte) error {
+	header, sig, ok := strings.Cut(jws, "..")
+	if !ok {
+		return errors.New("jose: not a detached JWS")
+	}
+	rawHeader, err := b64.DecodeString(header)
+	if err != nil {
+		return fmt.Errorf("jose: header: %w", err)
+	}
+	var h struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &h); err != nil {
+		return fmt.Errorf("jose: header: %w", err)
+	}
+	if h.Alg != jwk.Alg || (jwk.Kid != "" && h.Kid != jwk.Kid) {
+		return errors.New("jose: signed by another key")
+	}
+	rawSig, err := b64.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("jose: signature: %w", err)
+	}
+	pub, err := jwk.PublicKey()
+	if err != nil {
+		return err
+	}
+	if !verify(pub, []byte(header+"."+b64.EncodeToString(payload)), rawSig) {
+		return errors.New("jose: invalid signature")
+	}
+	return nil
+}
+
+// verify checks the signature of input by key, a public key or the
+// secret of HS256
+func verify(key any, input, sig []byte) bool {
+	digest := sha256.Sum256(input)
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *ecdsa.PublicKey:
+		return len(sig) == 64 && ecdsa.Verify(key, digest[:],
+			new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, input, sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
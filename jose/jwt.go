@@ -0,0 +1,90 @@
+package jose
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrTokenExpired is returned for the tokens past their exp claim, or
+// before their nbf one
+var ErrTokenExpired = errors.New("jose: token expired or not yet valid")
+
+// SignJWT returns the JWT of claims, a compact JWS typed JWT
+func (s *Signer) SignJWT(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	sig, err := s.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + b64.EncodeToString(sig), nil
+}
+
+// VerifyJWT checks the signature of token with the key it names among
+// keys, as signed by it with its algorithm, and its exp and nbf claims
+// at now. It returns the claims of the token.
+func VerifyJWT(token string, keys []*Signer, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jose: not a compact JWS")
+	}
+	rawHeader, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("jose: header: %w", err)
+	}
+	var h struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &h); err != nil {
+		return nil, fmt.Errorf("jose: header: %w", err)
+	}
+	var key *Signer
+	for _, k := range keys {
+		if k.kid == h.Kid {
+			key = k
+			break
+		}
+	}
+	// the algorithm is the key's, whatever the header says, lest a
+	// public key be taken for an HS256 secret
+	if key == nil || h.Alg != key.alg {
+		return nil, fmt.Errorf("jose: unknown key %q", h.Kid)
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jose: signature: %w", err)
+	}
+	var verifier any = key.secret
+	if key.key != nil {
+		verifier = key.key.Public()
+	}
+	if !verify(verifier, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.New("jose: invalid signature")
+	}
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("jose: payload: %w", err)
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("jose: claims: %w", err)
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.Unix() >= int64(exp) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return nil, ErrTokenExpired
+	}
+	return claims, nil
+}
@@ -0,0 +1,113 @@
+package jose
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var jwtNow = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func hmacSigner(t *testing.T, kid string) *Signer {
+	t.Helper()
+	s, err := NewHMACSigner([]byte(strings.Repeat("k", minSecretLen)), kid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVerifyJWT(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := NewSigner(p256, "es-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := hmacSigner(t, "hs-1")
+	keys := []*Signer{es, hs}
+	for _, s := range keys {
+		token, err := s.SignJWT(map[string]any{"sub": "ada", "exp": jwtNow.Add(time.Minute).Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := VerifyJWT(token, keys, jwtNow)
+		if err != nil {
+			t.Errorf("%s: %v", s.Alg(), err)
+			continue
+		}
+		if claims["sub"] != "ada" {
+			t.Errorf("%s: claims %v", s.Alg(), claims)
+		}
+		if _, err := VerifyJWT(token, keys, jwtNow.Add(time.Minute)); !errors.Is(err, ErrTokenExpired) {
+			t.Errorf("%s at its exp: %v, want ErrTokenExpired", s.Alg(), err)
+		}
+	}
+
+	notYet, _ := hs.SignJWT(map[string]any{"nbf": jwtNow.Add(time.Minute).Unix()})
+	if _, err := VerifyJWT(notYet, keys, jwtNow); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("before nbf: %v, want ErrTokenExpired", err)
+	}
+	other, _ := hmacSigner(t, "hs-2").SignJWT(map[string]any{"sub": "ada"})
+	if _, err := VerifyJWT(other, keys, jwtNow); err == nil {
+		t.Error("token of an unknown key verified")
+	}
+	token, _ := hs.SignJWT(map[string]any{"sub": "ada"})
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(map[string]any{"sub": "root"})
+	for name, bad := range map[string]string{
+		"not a JWS":         "abc.def",
+		"forged payload":    parts[0] + "." + b64.EncodeToString(forged) + "." + parts[2],
+		"no signature":      parts[0] + "." + parts[1] + ".",
+		"garbled header":    "!!." + parts[1] + "." + parts[2],
+		"garbled signature": parts[0] + "." + parts[1] + ".!!",
+	} {
+		if _, err := VerifyJWT(bad, keys, jwtNow); err == nil {
+			t.Errorf("%s: verified", name)
+		}
+	}
+}
+
+// TestVerifyJWTAlgorithmConfusion checks that a token can't pick the
+// algorithm its key is verified with, as an HS256 token signed with the
+// public key of an ES256 one
+func TestVerifyJWTAlgorithmConfusion(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := NewSigner(p256, "es-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, _ := json.Marshal(es.JWK())
+	forger := &Signer{secret: jwk, alg: "HS256", kid: "es-1"}
+	token, err := forger.SignJWT(map[string]any{"sub": "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyJWT(token, []*Signer{es}, jwtNow); err == nil {
+		t.Error("HS256 token verified with an ES256 key")
+	}
+	none := b64.EncodeToString([]byte(`{"alg":"none","kid":"es-1"}`)) + "." +
+		b64.EncodeToString([]byte(`{"sub":"root"}`)) + "."
+	if _, err := VerifyJWT(none, []*Signer{es}, jwtNow); err == nil {
+		t.Error("unsigned token verified")
+	}
+}
+
+func TestNewHMACSigner(t *testing.T) {
+	if _, err := NewHMACSigner([]byte("short"), "k"); err == nil {
+		t.Error("short secret accepted")
+	}
+	if _, err := NewHMACSigner([]byte(strings.Repeat("k", minSecretLen)), ""); err == nil {
+		t.Error("secret without a key id accepted")
+	}
+}
@@ -0,0 +1,271 @@
+// Package metrics implements counters, gauges and histograms exposed in
+// the Prometheus text format, or in the OpenMetrics one which adds
+// exemplars linking histogram buckets to traces.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// content types of the exposition formats
+const (
+	PrometheusFormat  = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsFormat = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// DefBuckets are latency buckets in seconds, suited to an HTTP API
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is a metric family of a registry
+type collector interface {
+	write(w io.Writer, openMetrics bool)
+}
+
+// Registry holds the metrics of a process
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write exposes every metric of the registry
+func (r *Registry) Write(w io.Writer, openMetrics bool) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	for _, c := range collectors {
+		c.write(w, openMetrics)
+	}
+	if openMetrics {
+		io.WriteString(w, "# EOF\n")
+	}
+}
+
+// family holds the name and labels shared by the series of a metric
+type family struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (f family) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, typ)
+}
+
+// key joins label values into a map key
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// format renders the label set of a series, with extra pairs appended
+func (f family) format(values []string, extra ...string) string {
+	var pairs []string
+	for i, l := range f.labels {
+		pairs = append(pairs, l, values[i])
+	}
+	return formatLabels(append(pairs, extra...))
+}
+
+// formatLabels renders name, value pairs as a label set
+func formatLabels(pairs []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i] + "=" + strconv.Quote(pairs[i+1]))
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "{" + b.String() + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a family of counters partitioned by labels
+type CounterVec struct {
+	family
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	n      float64
+}
+
+// NewCounterVec registers a counter family with the given labels
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family: family{name, help, labels}, series: map[string]*counterSeries{}}
+	r.register(c)
+	return c
+}
+
+// Add increments the counter of the label values by v
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key(values)]
+	if !ok {
+		s = &counterSeries{values: values}
+		c.series[key(values)] = s
+	}
+	s.n += v
+}
+
+// Inc increments the counter of the label values by one
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) write(w io.Writer, openMetrics bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := c.name
+	if openMetrics {
+		// OpenMetrics names the family without the _total suffix
+		name = strings.TrimSuffix(name, "_total")
+	}
+	family{name, c.help, c.labels}.header(w, "counter")
+	for _, k := range sortedKeys(c.series) {
+		s := c.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.format(s.values), formatFloat(s.n))
+	}
+}
+
+// GaugeFunc is a gauge whose value is read on exposition
+type GaugeFunc struct {
+	family
+	fn func() float64
+}
+
+// NewGaugeFunc registers a gauge reading its value from fn
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{family: family{name: name, help: help}, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer, openMetrics bool) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+// HistogramVec is a family of histograms partitioned by labels
+type HistogramVec struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values    []string
+	counts    []uint64 // per bucket, the last one being +Inf
+	sum       float64
+	count     uint64
+	exemplars []*exemplar // per bucket, nil until observed with one
+}
+
+// exemplar is an observation carrying the identifier of its trace
+type exemplar struct {
+	labels []string // name, value pairs
+	value  float64
+	at     time.Time
+}
+
+// NewHistogramVec registers a histogram family with the given upper
+// bucket bounds, in increasing order, and labels
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{family: family{name, help, labels}, buckets: buckets, series: map[string]*histogramSeries{}}
+	r.register(h)
+	return h
+}
+
+// Observe adds v to the histogram of the label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.ObserveWithExemplar(v, nil, values...)
+}
+
+// ObserveWithExemplar adds v to the histogram of the label values and,
+// when exemplarLabels isn't empty, keeps the observation as the exemplar
+// of its bucket. exemplarLabels holds name, value pairs such as
+// "trace_id", id.
+func (h *HistogramVec) ObserveWithExemplar(v float64, exemplarLabels []string, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key(values)]
+	if !ok {
+		s = &histogramSeries{
+			values:    values,
+			counts:    make([]uint64, len(h.buckets)+1),
+			exemplars: make([]*exemplar, len(h.buckets)+1),
+		}
+		h.series[key(values)] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	s.counts[i]++
+	s.sum += v
+	s.count++
+	if len(exemplarLabels) > 0 {
+		s.exemplars[i] = &exemplar{labels: exemplarLabels, value: v, at: time.Now()}
+	}
+}
+
+func (h *HistogramVec) write(w io.Writer, openMetrics bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		var cum uint64
+		for i, n := range s.counts {
+			cum += n
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d", h.name, h.format(s.values, "le", formatFloat(le)), cum)
+			if e := s.exemplars[i]; openMetrics && e != nil {
+				fmt.Fprintf(w, " # %s %s %.3f", formatLabels(e.labels), formatFloat(e.value), float64(e.at.UnixMilli())/1000)
+			}
+			io.WriteString(w, "\n")
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.format(s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.format(s.values), s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
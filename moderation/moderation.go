@@ -0,0 +1,170 @@
+// Package moderation checks the text the users write against a content
+// policy, as a deny-list of words or an external moderation service.
+// The filters are pluggable: any Filter can be given to the server.
+package moderation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Filter checks text against a content policy
+type Filter interface {
+	// Check returns a *Violation when text, the value of field, breaks
+	// the policy, and other errors when it can't tell
+	Check(ctx context.Context, field, text string) error
+}
+
+// Violation is a text breaking the policy
+type Violation struct {
+	Field  string
+	Reason string
+}
+
+func (v *Violation) Error() string {
+	return v.Field + ": " + v.Reason
+}
+
+// All is the filter of the policies of its filters, checked in order
+type All []Filter
+
+func (fs All) Check(ctx context.Context, field, text string) error {
+	for _, f := range fs {
+		if err := f.Check(ctx, field, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WordList denies the texts holding any of its words or phrases, whole
+// and in any case, as "darn" denies "Darn it" but not "darned"
+type WordList struct {
+	// entries are the words of the phrases, by their first word
+	entries map[string][][]string
+}
+
+// NewWordList returns the filter of words, phrases being words
+// separated by spaces
+func NewWordList(words []string) *WordList {
+	l := &WordList{entries: map[string][][]string{}}
+	for _, w := range words {
+		if tokens := tokenize(w); len(tokens) > 0 {
+			l.entries[tokens[0]] = append(l.entries[tokens[0]], tokens)
+		}
+	}
+	return l
+}
+
+// LoadWordList reads the words of the file path, one per line, the
+// empty lines and those starting with # ignored
+func LoadWordList(path string) (*WordList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var words []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewWordList(words), nil
+}
+
+func (l *WordList) Check(_ context.Context, field, text string) error {
+	tokens := tokenize(text)
+	for i, t := range tokens {
+		for _, e := range l.entries[t] {
+			if i+len(e) <= len(tokens) && equal(tokens[i:i+len(e)], e) {
+				return &Violation{field, "contains a denied word"}
+			}
+		}
+	}
+	return nil
+}
+
+// tokenize splits s into its words, in lower case
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(norm.NFC.String(s)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.Is(unicode.Mn, r)
+	})
+}
+
+func equal(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Service asks an external moderation service, POSTing it
+//
+//	{"field": "name", "text": "..."}
+//
+// and expecting 200 and {"allowed": false, "reason": "..."} for the
+// texts breaking its policy, {"allowed": true} otherwise
+type Service struct {
+	URL string
+	// Client calls the service, bounding the calls by its timeout
+	Client *http.Client
+}
+
+// ErrService is returned when the service fails to answer
+var ErrService = errors.New("moderation service failed")
+
+func (s *Service) Check(ctx context.Context, field, text string) error {
+	body, err := json.Marshal(struct {
+		Field string `json:"field"`
+		Text  string `json:"text"`
+	}{field, text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrService, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("%w: %s", ErrService, resp.Status)
+	}
+	var verdict struct {
+		Allowed *bool  `json:"allowed"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&verdict); err != nil || verdict.Allowed == nil {
+		return fmt.Errorf("%w: unexpected answer", ErrService)
+	}
+	if !*verdict.Allowed {
+		if verdict.Reason == "" {
+			verdict.Reason = "breaks the content policy"
+		}
+		return &Violation{field, verdict.Reason}
+	}
+	return nil
+}
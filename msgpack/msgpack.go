@@ -0,0 +1,346 @@
+// Package msgpack converts JSON documents to and from MessagePack, for
+// the clients preferring a compact binary encoding. The objects keep the
+// order of their members, the integers are written in their shortest
+// form, and the binary strings are read as strings.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// maxDepth bounds the nesting of the documents read
+const maxDepth = 100
+
+var errTruncated = errors.New("msgpack: truncated document")
+
+// FromJSON returns the MessagePack encoding of a JSON document
+func FromJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, dec); err != nil {
+		return nil, fmt.Errorf("msgpack: %w", err)
+	}
+	if dec.More() {
+		return nil, errors.New("msgpack: data after the document")
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeValue writes the next value of dec, walking its tokens so the
+// members of the objects keep their order
+func encodeValue(buf *bytes.Buffer, dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t := tok.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if t {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		writeNumber(buf, t)
+	case string:
+		writeString(buf, t)
+	case json.Delim:
+		var items []json.RawMessage // encoded members, or keys and values
+		for dec.More() {
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				var kb bytes.Buffer
+				writeString(&kb, key.(string))
+				items = append(items, kb.Bytes())
+			}
+			var vb bytes.Buffer
+			if err := encodeValue(&vb, dec); err != nil {
+				return err
+			}
+			items = append(items, vb.Bytes())
+		}
+		if _, err := dec.Token(); err != nil { // the closing delimiter
+			return err
+		}
+		if t == '{' {
+			writeHeader(buf, len(items)/2, 0x80, 0xde)
+		} else {
+			writeHeader(buf, len(items), 0x90, 0xdc)
+		}
+		for _, item := range items {
+			buf.Write(item)
+		}
+	}
+	return nil
+}
+
+// writeHeader writes the header of an array or map of n elements, as a
+// fix one up to 15, or as its 16 or 32 bits form
+func writeHeader(buf *bytes.Buffer, n int, fix, code16 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(code16 + 1)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(0xdb)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+	buf.WriteString(s)
+}
+
+// writeNumber writes n as the shortest integer holding it, or as a
+// float64 when it isn't an integer
+func writeNumber(buf *bytes.Buffer, n json.Number) {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		switch {
+		case i >= 0 && i < 128:
+			buf.WriteByte(byte(i))
+		case i < 0 && i >= -32:
+			buf.WriteByte(byte(int8(i)))
+		case i >= 0 && i <= math.MaxUint8:
+			buf.Write([]byte{0xcc, byte(i)})
+		case i >= 0 && i <= math.MaxUint16:
+			buf.WriteByte(0xcd)
+			buf.Write(binary.BigEndian.AppendUint16(nil, uint16(i)))
+		case i >= 0 && i <= math.MaxUint32:
+			buf.WriteByte(0xce)
+			buf.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+		case i >= math.MinInt8 && i < 0:
+			buf.Write([]byte{0xd0, byte(int8(i))})
+		case i >= math.MinInt16 && i < 0:
+			buf.WriteByte(0xd1)
+			buf.Write(binary.BigEndian.AppendUint16(nil, uint16(int16(i))))
+		case i >= math.MinInt32 && i < 0:
+			buf.WriteByte(0xd2)
+			buf.Write(binary.BigEndian.AppendUint32(nil, uint32(int32(i))))
+		default:
+			buf.WriteByte(0xd3)
+			buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+		}
+		return
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		buf.WriteByte(0xcf)
+		buf.Write(binary.BigEndian.AppendUint64(nil, u))
+		return
+	}
+	f, _ := n.Float64()
+	buf.WriteByte(0xcb)
+	buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+}
+
+// ToJSON returns the JSON of a MessagePack document. The keys of its
+// maps must be strings, and its extension types aren't supported.
+func ToJSON(data []byte) ([]byte, error) {
+	d := &decoder{data: data}
+	var buf bytes.Buffer
+	if err := d.value(&buf, 0); err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("msgpack: data after the document")
+	}
+	return buf.Bytes(), nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+// next returns the next n bytes
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of n bytes
+func (d *decoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// value writes the JSON of the next value to buf
+func (d *decoder) value(buf *bytes.Buffer, depth int) error {
+	if depth > maxDepth {
+		return errors.New("msgpack: document too deep")
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		buf.WriteString(strconv.Itoa(int(c)))
+		return nil
+	case c >= 0xe0:
+		buf.WriteString(strconv.Itoa(int(int8(c))))
+		return nil
+	case c&0xe0 == 0xa0:
+		return d.str(buf, int(c&0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(buf, int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return d.object(buf, int(c&0x0f), depth)
+	}
+	switch c {
+	case 0xc0:
+		buf.WriteString("null")
+	case 0xc2:
+		buf.WriteString("false")
+	case 0xc3:
+		buf.WriteString("true")
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.uint(1 << (c - 0xcc))
+		if err != nil {
+			return err
+		}
+		buf.WriteString(strconv.FormatUint(v, 10))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := d.uint(size)
+		if err != nil {
+			return err
+		}
+		shift := 64 - 8*size // sign extension
+		buf.WriteString(strconv.FormatInt(int64(v<<shift)>>shift, 10))
+	case 0xca, 0xcb:
+		var f float64
+		if c == 0xca {
+			v, err := d.uint(4)
+			if err != nil {
+				return err
+			}
+			f = float64(math.Float32frombits(uint32(v)))
+		} else {
+			v, err := d.uint(8)
+			if err != nil {
+				return err
+			}
+			f = math.Float64frombits(v)
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return errors.New("msgpack: number not representable in JSON")
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		first := 0xd9 // of the strings, the binary strings from 0xc4
+		if c <= 0xc6 {
+			first = 0xc4
+		}
+		n, err := d.uint(1 << (int(c) - first))
+		if err != nil {
+			return err
+		}
+		return d.str(buf, int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return err
+		}
+		return d.array(buf, int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return err
+		}
+		return d.object(buf, int(n), depth)
+	default:
+		return fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+	}
+	return nil
+}
+
+func (d *decoder) str(buf *bytes.Buffer, n int) error {
+	b, err := d.next(n)
+	if err != nil {
+		return err
+	}
+	s, err := json.Marshal(string(b))
+	if err != nil {
+		return err
+	}
+	buf.Write(s)
+	return nil
+}
+
+func (d *decoder) array(buf *bytes.Buffer, n, depth int) error {
+	buf.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := d.value(buf, depth+1); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+func (d *decoder) object(buf *bytes.Buffer, n, depth int) error {
+	buf.WriteByte('{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if d.pos >= len(d.data) {
+			return errTruncated
+		}
+		start := buf.Len()
+		if err := d.value(buf, depth+1); err != nil {
+			return err
+		}
+		if buf.Bytes()[start] != '"' {
+			return errors.New("msgpack: map key not a string")
+		}
+		buf.WriteByte(':')
+		if err := d.value(buf, depth+1); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
@@ -0,0 +1,96 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestFromJSON(t *testing.T) {
+	for _, tc := range []struct {
+		json, hex string
+	}{
+		// the example of msgpack.org
+		{`{"compact":true,"schema":0}`, "82a7636f6d70616374c3a6736368656d6100"},
+		{`null`, "c0"},
+		{`false`, "c2"},
+		{`127`, "7f"},
+		{`128`, "cc80"},
+		{`256`, "cd0100"},
+		{`65536`, "ce00010000"},
+		{`4294967296`, "d30000000100000000"},
+		{`-1`, "ff"},
+		{`-32`, "e0"},
+		{`-33`, "d0df"},
+		{`-129`, "d1ff7f"},
+		{`18446744073709551615`, "cfffffffffffffffff"},
+		{`1.5`, "cb3ff8000000000000"},
+		{`""`, "a0"},
+		{`[1,[2]]`, "9201" + "9102"},
+		{`{}`, "80"},
+	} {
+		got, err := FromJSON([]byte(tc.json))
+		if err != nil {
+			t.Errorf("%s: %v", tc.json, err)
+			continue
+		}
+		if hex.EncodeToString(got) != tc.hex {
+			t.Errorf("%s: %x, want %s", tc.json, got, tc.hex)
+		}
+	}
+}
+
+// the documents are compact JSON, read back as written
+func TestRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	many := "[" + strings.TrimSuffix(strings.Repeat("1,", 20), ",") + "]"
+	for _, doc := range []string{
+		`{"id":"u1","name":"Ada","active":true,"version":3,"tags":["a","b"],"metadata":{"z":"1","a":"2"},"deactivated_at":null}`,
+		`{"users":[{"id":"1"},{"id":"2"}],"next":"abc","score":-2.25}`,
+		`"` + long + `"`,
+		many,
+		`"café 😀"`,
+	} {
+		b, err := FromJSON([]byte(doc))
+		if err != nil {
+			t.Fatalf("%.40s: %v", doc, err)
+		}
+		got, err := ToJSON(b)
+		if err != nil {
+			t.Fatalf("%.40s: %v", doc, err)
+		}
+		if string(got) != doc {
+			t.Errorf("round trip\n got %s\nwant %s", got, doc)
+		}
+	}
+}
+
+func TestFromJSONInvalid(t *testing.T) {
+	for _, doc := range []string{``, `{`, `[1,`, `{"a":1} {}`, `nul`} {
+		if _, err := FromJSON([]byte(doc)); err == nil {
+			t.Errorf("%q: encoded", doc)
+		}
+	}
+}
+
+func TestToJSONMalformed(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x91}, maxDepth+2)
+	for name, doc := range map[string][]byte{
+		"empty":              nil,
+		"truncated string":   {0xa5, 'a', 'b'},
+		"truncated uint32":   {0xce, 0, 0},
+		"truncated array":    {0x92, 0x01},
+		"truncated map":      {0x81, 0xa1, 'a'},
+		"map key not string": {0x81, 0x01, 0x02},
+		"data after":         {0xc0, 0xc0},
+		"reserved type":      {0xc1},
+		"extension":          {0xd4, 0x01, 0x00},
+		"too deep":           append(deep, 0xc0),
+		"huge str32 length":  {0xdb, 0xff, 0xff, 0xff, 0xff},
+	} {
+		if _, err := ToJSON(doc); err == nil {
+			t.Errorf("%s: decoded", name)
+		}
+	}
+}
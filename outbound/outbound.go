@@ -0,0 +1,354 @@
+// Package outbound is the transport of the calls the API makes to other
+// services, as the webhook deliveries, the brokers over HTTP and the
+// remote config stores. It pools the connections, goes through the
+// proxy and the DNS server configured, only calls the hosts allowed,
+// counts and times the calls per host, and stops calling the hosts
+// failing repeatedly for a while, as a circuit breaker. The URLs given by
+// the users go through its public variant, which can't reach the
+// private networks.
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/metrics"
+)
+
+var (
+	// ErrCircuitOpen is returned for the calls to a host whose circuit
+	// is open
+	ErrCircuitOpen = errors.New("circuit open")
+	// ErrHostNotAllowed is returned for the calls to a host out of the
+	// allowed ones
+	ErrHostNotAllowed = errors.New("host not allowed")
+)
+
+// Config tunes the transport. The zero values get the defaults.
+type Config struct {
+	// Proxy is the URL of the proxy of the calls, the one of the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables when empty
+	Proxy string
+	// DNS is the address of the DNS server resolving the hosts called,
+	// as 10.0.0.2:53, the one of the system when empty
+	DNS string
+	// AllowedHosts are the hosts that may be called, any when empty. A
+	// leading *. allows the subdomains of a domain, as *.example.com.
+	AllowedHosts []string
+	// PrivateAllowed are the ranges the public transport may reach
+	// though not public, as 10.1.0.0/16 for receivers of webhooks on the
+	// internal network
+	PrivateAllowed []string
+	// DialTimeout bounds the connection to a host, TLS handshake aside
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake
+	TLSHandshakeTimeout time.Duration
+	// MaxIdleConnsPerHost is the number of idle connections kept per host
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept
+	IdleConnTimeout time.Duration
+	// BreakerFailures is the number of consecutive failures, errors or
+	// 5xx, opening the circuit of a host
+	BreakerFailures int
+	// BreakerCooldown is how long a circuit stays open before a call is
+	// let through to try the host again
+	BreakerCooldown time.Duration
+}
+
+// DefaultConfig is the configuration of the zero values
+var DefaultConfig = Config{
+	DialTimeout:         5 * time.Second,
+	TLSHandshakeTimeout: 5 * time.Second,
+	MaxIdleConnsPerHost: 16,
+	IdleConnTimeout:     90 * time.Second,
+	BreakerFailures:     5,
+	BreakerCooldown:     30 * time.Second,
+}
+
+func (c Config) withDefaults() Config {
+	d := DefaultConfig
+	if c.DialTimeout == 0 {
+		c.DialTimeout = d.DialTimeout
+	}
+	if c.TLSHandshakeTimeout == 0 {
+		c.TLSHandshakeTimeout = d.TLSHandshakeTimeout
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = d.MaxIdleConnsPerHost
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = d.IdleConnTimeout
+	}
+	if c.BreakerFailures == 0 {
+		c.BreakerFailures = d.BreakerFailures
+	}
+	if c.BreakerCooldown == 0 {
+		c.BreakerCooldown = d.BreakerCooldown
+	}
+	return c
+}
+
+// Transport is an http.RoundTripper shared by the outbound calls. The
+// timeouts of the calls as a whole are the ones of their clients, as
+// given by Client.
+type Transport struct {
+	base  *http.Transport
+	proxy func(*http.Request) (*url.URL, error)
+	cfg   Config
+	clock clock.Clock
+	// guard checks the addresses of the public transport, nil otherwise
+	guard  *guard
+	public *Transport // nil for the public transport itself
+
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+	opened   *metrics.CounterVec
+	circuits *circuits
+}
+
+// New returns a transport configured by cfg, its metrics registered on
+// reg
+func New(cfg Config, c clock.Clock, reg *metrics.Registry) (*Transport, error) {
+	cfg = cfg.withDefaults()
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q: expected as in http://proxy:3128", cfg.Proxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}
+	if cfg.DNS != "" {
+		if _, _, err := net.SplitHostPort(cfg.DNS); err != nil {
+			return nil, fmt.Errorf("invalid DNS server %q: expected as in 10.0.0.2:53", cfg.DNS)
+		}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: cfg.DialTimeout}).DialContext(ctx, network, cfg.DNS)
+			},
+		}
+	}
+	for _, h := range cfg.AllowedHosts {
+		if strings.TrimPrefix(h, "*.") == "" || strings.ContainsAny(h, ":/") {
+			return nil, fmt.Errorf("invalid allowed host %q: expected as in api.example.com or *.example.com", h)
+		}
+	}
+	g, err := newGuard(cfg.PrivateAllowed, dialer.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transport{
+		base:  newBase(cfg, proxy, dialer.DialContext),
+		proxy: proxy,
+		cfg:   cfg,
+		clock: c,
+		requests: reg.NewCounterVec("outbound_requests_total",
+			"Outbound HTTP calls, by host and status code, 0 for the errors and the open circuits.", "host", "code"),
+		duration: reg.NewHistogramVec("outbound_request_duration_seconds",
+			"Latency of the outbound HTTP calls, to their response headers.", metrics.DefBuckets, "host"),
+		opened: reg.NewCounterVec("outbound_circuit_opened_total",
+			"Times the circuit of a host opened.", "host"),
+		circuits: &circuits{breakers: map[string]*breaker{}},
+	}
+	public := *t
+	guarded := *dialer
+	guarded.Control = g.control
+	proxies := proxyAddrs(cfg.Proxy)
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if proxies[addr] {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+	public.base, public.guard = newBase(cfg, proxy, dial), g
+	t.public = &public
+	return t, nil
+}
+
+// proxyAddrs returns the addresses of the proxies, the one given or
+// those of the environment, as host:port
+func proxyAddrs(given string) map[string]bool {
+	addrs := map[string]bool{}
+	raws := []string{given}
+	if given == "" {
+		for _, env := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+			raws = append(raws, os.Getenv(env))
+		}
+	}
+	for _, raw := range raws {
+		if raw == "" {
+			continue
+		}
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"https": "443", "socks5": "1080"}[u.Scheme]
+			if port == "" {
+				port = "80"
+			}
+		}
+		addrs[net.JoinHostPort(u.Hostname(), port)] = true
+	}
+	return addrs
+}
+
+// newBase returns the pool of the connections made by dial
+func newBase(cfg Config, proxy func(*http.Request) (*url.URL, error), dial func(context.Context, string, string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// Client returns a client of t whose calls, their bodies included, are
+// bounded by timeout, none when 0
+func (t *Transport) Client(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: t, Timeout: timeout}
+}
+
+// RoundTrip makes the call of req, unless the circuit of its host is
+// open
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if !t.allowed(req.URL.Hostname()) {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, host, ErrHostNotAllowed)
+	}
+	if t.guard != nil {
+		// the connections to a proxy aren't the ones to check
+		if proxy, err := t.proxy(req); err == nil && proxy != nil {
+			if err := t.guard.checkHost(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", req.Method, host, err)
+			}
+		}
+	}
+	b := t.circuits.get(host)
+	if !b.allow(t.clock.Now()) {
+		t.requests.Inc(host, "0")
+		return nil, fmt.Errorf("%s %s: %w", req.Method, host, ErrCircuitOpen)
+	}
+	start := t.clock.Now()
+	resp, err := t.base.RoundTrip(req)
+	t.duration.Observe(t.clock.Now().Sub(start).Seconds(), host)
+	code := "0"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.requests.Inc(host, code)
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+	if b.record(failed, t.clock.Now(), t.cfg) {
+		t.opened.Inc(host)
+	}
+	return resp, err
+}
+
+// allowed tells whether host may be called
+func (t *Transport) allowed(host string) bool {
+	if len(t.cfg.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range t.cfg.AllowedHosts {
+		h = strings.ToLower(h)
+		if domain, ok := strings.CutPrefix(h, "*."); ok {
+			if strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// CloseIdleConnections closes the pooled connections not in use
+func (t *Transport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+	if t.public != nil {
+		t.public.base.CloseIdleConnections()
+	}
+}
+
+// circuits are the breakers of the hosts
+type circuits struct {
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+func (c *circuits) get(host string) *breaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.breakers[host]
+	if !ok {
+		b = &breaker{}
+		c.breakers[host] = b
+	}
+	return b
+}
+
+// breaker is the circuit of a host. Once open it lets a single call
+// through after the cooldown, closing on its success and opening again
+// on its failure.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int // consecutive
+	openUntil time.Time
+	probing   bool // a call is trying the host after the cooldown
+}
+
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record counts the outcome of a call, telling whether it opened the
+// circuit
+func (b *breaker) record(failed bool, now time.Time, cfg Config) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := b.probing
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return false
+	}
+	b.failures++
+	if probe || b.failures >= cfg.BreakerFailures {
+		wasOpen := !b.openUntil.IsZero()
+		b.openUntil = now.Add(cfg.BreakerCooldown)
+		return !wasOpen
+	}
+	return false
+}
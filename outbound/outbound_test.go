@@ -0,0 +1,32 @@
+package outbound
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/metrics"
+)
+
+func TestAllowedHosts(t *testing.T) {
+	tr, err := New(Config{AllowedHosts: []string{"api.example.com", "*.hooks.example.com"}}, clock.System{}, metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]bool{
+		"api.example.com":      true,
+		"API.example.com.":     true,
+		"a.hooks.example.com":  true,
+		"hooks.example.com":    false,
+		"evil.com":             false,
+		"api.example.com.evil": false,
+		"xhooks.example.com":   false,
+	} {
+		if got := tr.allowed(host); got != want {
+			t.Errorf("%s allowed: %t, want %t", host, got, want)
+		}
+	}
+	if _, err := tr.Client(0).Get("http://evil.com/"); !errors.Is(err, ErrHostNotAllowed) {
+		t.Errorf("call of a host not allowed: %v, want ErrHostNotAllowed", err)
+	}
+}
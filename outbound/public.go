@@ -0,0 +1,121 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"syscall"
+)
+
+// ErrPrivateAddress is returned for the calls of the public transport
+// to addresses that aren't public
+var ErrPrivateAddress = errors.New("address not public")
+
+// nonPublic are the ranges the public transport can't reach: private,
+// loopback, link-local, shared, multicast, reserved and documentation
+// addresses, and NAT64 which may embed any of them
+var nonPublic = func() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, p := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24",
+		"192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+		"224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "64:ff9b::/96", "64:ff9b:1::/48", "100::/64",
+		"2001:db8::/32", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		prefixes = append(prefixes, netip.MustParsePrefix(p))
+	}
+	return prefixes
+}()
+
+// guard checks the addresses the public transport connects to
+type guard struct {
+	// allowed are the ranges reachable though not public
+	allowed  []netip.Prefix
+	resolver *net.Resolver
+}
+
+func newGuard(allowed []string, resolver *net.Resolver) (*guard, error) {
+	g := &guard{resolver: resolver}
+	for _, a := range allowed {
+		p, err := netip.ParsePrefix(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private range %q: expected as in 10.1.0.0/16", a)
+		}
+		g.allowed = append(g.allowed, p.Masked())
+	}
+	if g.resolver == nil {
+		g.resolver = net.DefaultResolver
+	}
+	return g, nil
+}
+
+// check fails for the addresses that aren't public, unless allowed
+func (g *guard) check(ip netip.Addr) error {
+	ip = ip.Unmap()
+	for _, p := range g.allowed {
+		if p.Contains(ip) {
+			return nil
+		}
+	}
+	for _, p := range nonPublic {
+		if p.Contains(ip) {
+			return fmt.Errorf("%s: %w", ip, ErrPrivateAddress)
+		}
+	}
+	return nil
+}
+
+// control checks the address of every connection once resolved, so a
+// name can't be rebound to a private address after being checked
+func (g *guard) control(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	return g.check(ap.Addr())
+}
+
+// checkHost resolves host and checks its every address
+func (g *guard) checkHost(ctx context.Context, host string) error {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return g.check(ip)
+	}
+	ips, err := g.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := g.check(ip); err != nil {
+			return fmt.Errorf("%s: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// Public returns the transport of the URLs given by the users, as the
+// webhooks, so the server can't be made to call the services of its own
+// network. It refuses the addresses that aren't public, unless in
+// Config.PrivateAllowed, checking every connection as it is made. Through
+// a proxy the hosts are resolved and checked before each call instead,
+// the proxy resolving them again. It shares the metrics and the circuits
+// of t.
+func (t *Transport) Public() *Transport {
+	if t.public == nil {
+		return t
+	}
+	return t.public
+}
+
+// CheckURL fails with ErrPrivateAddress when the host of u resolves to
+// an address the public transport refuses, for refusing the URLs given
+// by the users early
+func (t *Transport) CheckURL(u *url.URL) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.DialTimeout)
+	defer cancel()
+	return t.Public().guard.checkHost(ctx, u.Hostname())
+}
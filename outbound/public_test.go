@@ -0,0 +1,85 @@
+package outbound
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/metrics"
+)
+
+func TestGuardCheck(t *testing.T) {
+	g, err := newGuard([]string{"10.1.2.3/16"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, public := range map[string]bool{
+		"93.184.216.34":      true,
+		"2606:2800:220:1::1": true,
+		"127.0.0.1":          false,
+		"10.0.0.1":           false,
+		"10.1.200.1":         true, // allowed
+		"172.16.5.4":         false,
+		"192.168.1.1":        false,
+		"169.254.169.254":    false, // cloud metadata
+		"100.64.0.1":         false,
+		"0.0.0.0":            false,
+		"::1":                false,
+		"::ffff:127.0.0.1":   false, // IPv4-mapped
+		"64:ff9b::a00:1":     false, // NAT64 of 10.0.0.1
+		"fd00::1":            false,
+		"fe80::1":            false,
+		"ff02::1":            false,
+	} {
+		err := g.check(netip.MustParseAddr(addr))
+		if public && err != nil {
+			t.Errorf("%s: %v", addr, err)
+		}
+		if !public && !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("%s: %v, want ErrPrivateAddress", addr, err)
+		}
+	}
+	if _, err := newGuard([]string{"10.1.0.0"}, nil); err == nil {
+		t.Error("range without a prefix length accepted")
+	}
+}
+
+func TestPublicTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	tr, err := New(Config{}, clock.System{}, metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := tr.Client(0).Get(srv.URL); err != nil {
+		t.Errorf("call of a loopback address by the private transport: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	// the address is checked when connecting, whatever the URL says
+	if _, err := tr.Public().Client(0).Get(srv.URL); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("call of a loopback address by the public transport: %v, want ErrPrivateAddress", err)
+	}
+	if err := tr.CheckURL(u); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("check of %s: %v, want ErrPrivateAddress", u, err)
+	}
+	if err := tr.CheckURL(&url.URL{Scheme: "https", Host: "93.184.216.34"}); err != nil {
+		t.Errorf("check of a public address: %v", err)
+	}
+
+	allowed, err := New(Config{PrivateAllowed: []string{"127.0.0.0/8"}}, clock.System{}, metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := allowed.Public().Client(0).Get(srv.URL); err != nil {
+		t.Errorf("call of an allowed private range: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
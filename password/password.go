@@ -0,0 +1,97 @@
+// Package password hashes the passwords of the clients, with
+// PBKDF2-HMAC-SHA256 (RFC 8018), into strings as
+// pbkdf2-sha256$600000$<salt>$<hash>, the salt and the hash in base64.
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	scheme = "pbkdf2-sha256"
+	// Iterations is the cost of the hashes made by Hash, as advised by
+	// OWASP for PBKDF2-HMAC-SHA256
+	Iterations = 600000
+	saltLen    = 16
+	keyLen     = sha256.Size
+)
+
+var b64 = base64.RawStdEncoding
+
+// ErrFormat is returned for the hashes not made by Hash
+var ErrFormat = errors.New("password: invalid hash, expected pbkdf2-sha256$<iterations>$<salt>$<hash>")
+
+// Hash returns the hash of password, with a random salt
+func Hash(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, Iterations, keyLen)
+	return fmt.Sprintf("%s$%d$%s$%s", scheme, Iterations, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// Check tells whether password is the one hashed in hash
+func Check(hash, password string) (bool, error) {
+	iterations, salt, key, err := parse(hash)
+	if err != nil {
+		return false, err
+	}
+	got := pbkdf2([]byte(password), salt, iterations, len(key))
+	return subtle.ConstantTimeCompare(got, key) == 1, nil
+}
+
+// Valid checks that hash was made by Hash
+func Valid(hash string) error {
+	_, _, _, err := parse(hash)
+	return err
+}
+
+func parse(hash string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != scheme {
+		return 0, nil, nil, ErrFormat
+	}
+	iterations, err = strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, ErrFormat
+	}
+	salt, errSalt := b64.DecodeString(parts[2])
+	key, errKey := b64.DecodeString(parts[3])
+	if errSalt != nil || errKey != nil || len(key) == 0 {
+		return 0, nil, nil, ErrFormat
+	}
+	return iterations, salt, key, nil
+}
+
+// pbkdf2 derives a key of size bytes from password and salt
+func pbkdf2(password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:size]
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/santisdev/go-restapi.git/server"
+)
+
+// liveSettings are the serve flags the remote config changes while
+// serving, the others needing a restart
+var liveSettings = map[string]bool{
+	"log-level":         true,
+	"trace-sample-rate": true,
+	"page-size":         true,
+	"max-page-size":     true,
+	"max-query-cost":    true,
+	"rate-limits":       true,
+}
+
+// applyRemote applies the live settings of the remote config, the ones
+// it lacks or gets wrong taking the values of the flags
+func applyRemote(settings map[string]string, sf *serveFlags, a *app, srv *server.Server) {
+	level := sf.logLevel
+	sampler := sf.sampler
+	live := server.Live{PageSize: sf.cfg.PageSize, MaxQueryCost: sf.cfg.MaxQueryCost, RateLimits: sf.cfg.RateLimits}
+	for _, name := range sortedKeys(settings) {
+		v := settings[name]
+		if !liveSettings[name] {
+			if sf.fs.Lookup(name) != nil {
+				a.logger.Warn("remote setting ignored: it needs a restart", "setting", name)
+			} else {
+				a.logger.Warn("remote setting ignored: unknown", "setting", name)
+			}
+			continue
+		}
+		var err error
+		switch name {
+		case "log-level":
+			err = level.UnmarshalText([]byte(v))
+		case "trace-sample-rate":
+			var rate float64
+			if rate, err = strconv.ParseFloat(v, 64); err == nil && (rate < 0 || rate > 1) {
+				err = strconv.ErrRange
+			}
+			if err == nil {
+				sampler.Rate = rate
+			}
+		case "page-size":
+			live.PageSize.Default, err = strconv.Atoi(v)
+		case "max-page-size":
+			live.PageSize.Max, err = strconv.Atoi(v)
+		case "max-query-cost":
+			live.MaxQueryCost, err = strconv.Atoi(v)
+		case "rate-limits":
+			var limits map[string]server.RateLimit
+			if limits, err = parseRateLimits(v); err == nil {
+				live.RateLimits = limits
+			}
+		}
+		if err != nil {
+			a.logger.Warn("remote setting ignored: invalid", "setting", name, "value", v, "err", err)
+		}
+	}
+	if err := srv.SetLive(live); err != nil {
+		a.logger.Warn("remote settings ignored", "err", err)
+		live = srv.Live()
+	}
+	a.level.Set(level)
+	a.tracer.SetSampler(sampler)
+	a.logger.Info("remote config applied", slog.Group("settings",
+		"log_level", level.String(), "trace_sample_rate", sampler.Rate,
+		"page_size", live.PageSize.Default, "max_page_size", live.PageSize.Max, "max_query_cost", live.MaxQueryCost, "rate_limits", formatRateLimits(live.RateLimits)))
+}
+
+// formatRateLimits formats limits as the rate-limits flag
+func formatRateLimits(limits map[string]server.RateLimit) string {
+	var parts []string
+	for _, class := range sortedKeys(limits) {
+		l := limits[class]
+		parts = append(parts, fmt.Sprintf("%s=%g:%d", class, l.Rate, l.Burst))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,79 @@
+package remoteconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Consul reads the settings from the KV store of Consul, waiting for
+// their changes with blocking queries
+type Consul struct {
+	Addr   string // as in http://localhost:8500
+	Prefix string
+	Token  string // ACL token, if any
+	Client *http.Client
+}
+
+// Fetch returns the settings, versioned by the index of Consul
+func (c *Consul) Fetch(ctx context.Context) (map[string]string, uint64, error) {
+	return c.get(ctx, 0)
+}
+
+// WaitChange blocks until the index of the settings passes version
+func (c *Consul) WaitChange(ctx context.Context, version uint64) error {
+	_, _, err := c.get(ctx, version)
+	return err
+}
+
+// get lists the keys under the prefix, blocking until the index passes
+// index when not 0
+func (c *Consul) get(ctx context.Context, index uint64) (map[string]string, uint64, error) {
+	q := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", wait.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.Addr+"/v1/kv/"+c.Prefix+"/?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	// the index of an empty prefix is the one of the store
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	settings := map[string]string{}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return settings, next, nil
+	case http.StatusOK:
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, 0, fmt.Errorf("consul: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var pairs []struct {
+		Key   string
+		Value []byte // base64 in the JSON
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, 0, fmt.Errorf("consul: %w", err)
+	}
+	for _, p := range pairs {
+		if name := strings.TrimPrefix(p.Key, c.Prefix+"/"); name != "" && !strings.HasSuffix(name, "/") {
+			settings[name] = string(p.Value)
+		}
+	}
+	return settings, next, nil
+}
@@ -0,0 +1,124 @@
+package remoteconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Etcd reads the settings from etcd through its v3 JSON gateway,
+// waiting for their changes with watches
+type Etcd struct {
+	Addr   string // as in http://localhost:2379
+	Prefix string
+	Client *http.Client
+}
+
+// Fetch returns the settings, versioned by the revision of etcd
+func (e *Etcd) Fetch(ctx context.Context) (map[string]string, uint64, error) {
+	key, end := e.keyRange()
+	var resp struct {
+		Header struct {
+			Revision uint64 `json:"revision,string"`
+		} `json:"header"`
+		KVs []struct {
+			Key   []byte `json:"key"` // base64 in the JSON
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	body, err := e.post(ctx, "/v3/kv/range", map[string]any{"key": key, "range_end": end})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return nil, 0, fmt.Errorf("etcd: %w", err)
+	}
+	settings := map[string]string{}
+	for _, kv := range resp.KVs {
+		if name := strings.TrimPrefix(string(kv.Key), e.Prefix+"/"); name != "" {
+			settings[name] = string(kv.Value)
+		}
+	}
+	return settings, resp.Header.Revision, nil
+}
+
+// WaitChange watches the prefix from the revision after version,
+// returning on its first event
+func (e *Etcd) WaitChange(ctx context.Context, version uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	key, end := e.keyRange()
+	body, err := e.post(ctx, "/v3/watch", map[string]any{"create_request": map[string]any{
+		"key": key, "range_end": end, "start_revision": version + 1,
+	}})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	// the watch streams a message on its creation, then one by batch
+	// of events
+	dec := json.NewDecoder(body)
+	for {
+		var msg struct {
+			Result struct {
+				Events   []json.RawMessage `json:"events"`
+				Canceled bool              `json:"canceled"`
+				Reason   string            `json:"cancel_reason"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil // no change during the wait
+			}
+			return fmt.Errorf("etcd: %w", err)
+		}
+		switch {
+		case msg.Error != nil:
+			return fmt.Errorf("etcd: %s", msg.Error.Message)
+		case msg.Result.Canceled:
+			// the revision was compacted: fetching again catches up
+			return nil
+		case len(msg.Result.Events) > 0:
+			return nil
+		}
+	}
+}
+
+// keyRange returns the range of the keys under the prefix
+func (e *Etcd) keyRange() (key, end []byte) {
+	key = []byte(e.Prefix + "/")
+	end = bytes.Clone(key)
+	end[len(end)-1]++ // '/' + 1
+	return key, end
+}
+
+func (e *Etcd) post(ctx context.Context, path string, v any) (io.ReadCloser, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("etcd: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,94 @@
+// Package remoteconfig watches settings kept in Consul KV or etcd, so a
+// fleet of servers can be reconfigured centrally. The settings are the
+// keys under a prefix, as usersapi/prod/log-level, by name relative to
+// the prefix.
+package remoteconfig
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	initialBackoff = time.Second
+	maxBackoff     = time.Minute
+	// wait is how long a watch waits for a change before asking again
+	wait = 5 * time.Minute
+)
+
+// Source is a store of settings
+type Source interface {
+	// Fetch returns the settings, and a version of them to wait on
+	Fetch(ctx context.Context) (map[string]string, uint64, error)
+	// WaitChange returns once the settings may have changed since the
+	// version, or the wait elapsed
+	WaitChange(ctx context.Context, version uint64) error
+}
+
+// Parse returns the source of a URL, as consul://localhost:8500/usersapi/prod
+// or etcd://localhost:2379/usersapi/prod, the prefix being the path. The
+// +https schemes, as consul+https, connect over TLS. Consul is given the
+// token of CONSUL_HTTP_TOKEN, if any. The calls go through rt, the
+// default transport when nil.
+func Parse(raw string, rt http.RoundTripper) (Source, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	kind, scheme, _ := strings.Cut(u.Scheme, "+")
+	if scheme == "" {
+		scheme = "http"
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if u.Host == "" || prefix == "" || (scheme != "http" && scheme != "https") {
+		return nil, fmt.Errorf("invalid remote config %q: expected as in consul://host:8500/prefix", raw)
+	}
+	addr := scheme + "://" + u.Host
+	client := &http.Client{Transport: rt, Timeout: wait + time.Minute}
+	switch kind {
+	case "consul":
+		return &Consul{Addr: addr, Prefix: prefix, Token: os.Getenv("CONSUL_HTTP_TOKEN"), Client: client}, nil
+	case "etcd":
+		return &Etcd{Addr: addr, Prefix: prefix, Client: client}, nil
+	}
+	return nil, fmt.Errorf("invalid remote config %q: unknown store %q, expected consul or etcd", raw, kind)
+}
+
+// Watch calls apply with the settings of src, then each time they
+// change, until ctx is done. The failures are logged and retried with
+// exponential backoff, apply keeping the last settings meanwhile.
+func Watch(ctx context.Context, src Source, logger *slog.Logger, apply func(map[string]string)) {
+	var last map[string]string
+	backoff := initialBackoff
+	for ctx.Err() == nil {
+		settings, version, err := src.Fetch(ctx)
+		if err == nil && (last == nil || !maps.Equal(settings, last)) {
+			apply(settings)
+			last = settings
+		}
+		if err == nil {
+			err = src.WaitChange(ctx, version)
+		}
+		if err == nil {
+			backoff = initialBackoff
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("remote config unavailable", "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
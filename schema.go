@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// schema is the subset of JSON Schema the config schema uses
+type schema struct {
+	Type        string             `json:"type"`
+	Description string             `json:"description"`
+	Properties  map[string]*schema `json:"properties"`
+	// AdditionalProperties is the schema of the other members, false
+	// forbidding them
+	AdditionalProperties json.RawMessage     `json:"additionalProperties"`
+	Required             []string            `json:"required"`
+	DependentRequired    map[string][]string `json:"dependentRequired"`
+	Not                  *schema             `json:"not"`
+	Items                *schema             `json:"items"`
+	Enum                 []any               `json:"enum"`
+	Minimum              *float64            `json:"minimum"`
+	Maximum              *float64            `json:"maximum"`
+	Pattern              string              `json:"pattern"`
+	Format               string              `json:"format"` // only duration
+	// Flag is the serve flag the setting maps to
+	Flag string `json:"x-flag"`
+	// Secret settings are redacted when printed
+	Secret bool `json:"x-secret"`
+}
+
+// additional returns the schema of the members not in Properties, and
+// whether they are allowed
+func (s *schema) additional() (*schema, bool) {
+	if len(s.AdditionalProperties) == 0 {
+		return &schema{}, true
+	}
+	var allowed bool
+	if json.Unmarshal(s.AdditionalProperties, &allowed) == nil {
+		return &schema{}, allowed
+	}
+	var sub schema
+	if err := json.Unmarshal(s.AdditionalProperties, &sub); err != nil {
+		return &schema{}, true
+	}
+	return &sub, true
+}
+
+// validate returns the errors of v against s, v being decoded with
+// json.Number, each prefixed by the path of the value
+func (s *schema) validate(path string, v any) []error {
+	fail := func(format string, args ...any) []error {
+		return []error{fmt.Errorf("%s: %s", displayPath(path), fmt.Sprintf(format, args...))}
+	}
+	if s.Type != "" && !hasType(v, s.Type) {
+		return fail("expected %s %s, got %s", article(s.Type), s.Type, typeOf(v))
+	}
+	if len(s.Enum) > 0 && !inEnum(v, s.Enum) {
+		options := make([]string, len(s.Enum))
+		for i, e := range s.Enum {
+			options[i] = fmt.Sprint(e)
+		}
+		return fail("%s is not one of %s", formatValue(v), strings.Join(options, ", "))
+	}
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			return fail("%s is below the minimum, %g", v, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fail("%s is above the maximum, %g", v, *s.Maximum)
+		}
+	case string:
+		if s.Format == "duration" {
+			if _, err := time.ParseDuration(v); err != nil {
+				return fail("%q is not a duration, as in \"30s\" or \"5m\"", v)
+			}
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(v) {
+			if s.Description != "" {
+				return fail("%q is invalid: expected %s", v, s.Description)
+			}
+			return fail("%q doesn't match %s", v, s.Pattern)
+		}
+	case map[string]any:
+		return s.validateObject(path, v)
+	case []any:
+		var errs []error
+		for i, item := range v {
+			if s.Items != nil {
+				errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+		return errs
+	}
+	return nil
+}
+
+func (s *schema) validateObject(path string, obj map[string]any) []error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", displayPath(path), fmt.Sprintf(format, args...)))
+	}
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			fail("%s is required", name)
+		}
+	}
+	for _, name := range sortedKeys(s.DependentRequired) {
+		if _, ok := obj[name]; !ok {
+			continue
+		}
+		for _, dep := range s.DependentRequired[name] {
+			if _, ok := obj[dep]; !ok {
+				fail("%s is required with %s", dep, name)
+			}
+		}
+	}
+	if s.Not != nil && len(s.Not.Required) > 1 {
+		present := true
+		for _, name := range s.Not.Required {
+			_, ok := obj[name]
+			present = present && ok
+		}
+		if present {
+			fail("%s are mutually exclusive, set only one", strings.Join(s.Not.Required, " and "))
+		}
+	}
+	extra, allowed := s.additional()
+	for _, name := range sortedKeys(obj) {
+		sub, ok := s.Properties[name]
+		switch {
+		case ok:
+		case allowed:
+			sub = extra
+		default:
+			fail("unknown setting %q; the settings here are %s", name, strings.Join(sortedKeys(s.Properties), ", "))
+			continue
+		}
+		errs = append(errs, sub.validate(joinPath(path, name), obj[name])...)
+	}
+	return errs
+}
+
+func hasType(v any, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	}
+	return true
+}
+
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "an array"
+	case string:
+		return fmt.Sprintf("the string %q", v)
+	case bool:
+		return fmt.Sprintf("the boolean %t", v)
+	case json.Number:
+		return "the number " + v.String()
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func article(typ string) string {
+	if strings.ContainsAny(typ[:1], "aeiou") {
+		return "an"
+	}
+	return "a"
+}
+
+func inEnum(v any, enum []any) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatValue(v any) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprint(v)
+}
+
+// joinPath appends a member to a path, quoting the names which aren't
+// identifiers, as the routes
+func joinPath(path, name string) string {
+	if !identRe.MatchString(name) {
+		return fmt.Sprintf("%s[%q]", path, name)
+	}
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+var identRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func displayPath(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return path
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/webhooks"
+)
+
+// adminHandler serves the operational endpoints
+type adminHandler struct {
+	*deps
+	inflight  *inflight
+	dedup     *dedup
+	retention *retention
+	holds     *legalHolds
+	webhooks  *webhooks.Dispatcher
+	insights  *queryInsights
+	apiKeys   *APIKeys // nil unless authenticating by API key
+	usage     *keyAnalytics
+	meter     *usageMeter
+	// configSHA256 is the checksum of the configuration, kept in the
+	// state archives
+	configSHA256 string
+}
+
+// routes is the route table of the admin endpoints
+func (h *adminHandler) routes() []route {
+	return append([]route{
+		{http.MethodGet, "/admin/state", "Export the server state", scopeAdmin, rateAdmin, policyBlob, h.ExportState},
+		{http.MethodPut, "/admin/state", "Import a server state", scopeAdmin, rateAdmin, policyNoStore, h.ImportState},
+		{http.MethodGet, "/admin/routes", "List the routes", scopeAdmin, rateAdmin, policyNoStore, h.Routes},
+		{http.MethodGet, "/admin/inflight", "Count the requests in flight", scopeAdmin, rateAdmin, policyNoStore, h.Inflight},
+		{http.MethodGet, "/admin/duplicates", "Report the likely duplicate users", scopeAdmin, rateAdmin, policyNoStore, h.Duplicates},
+		{http.MethodGet, "/admin/retention", "Report the last purges of the records past retention", scopeAdmin, rateAdmin, policyNoStore, h.RetentionReports},
+		{http.MethodPost, "/admin/retention/purge", "Purge the records past retention now, or preview it", scopeAdmin, rateAdmin, policyNoStore, h.PurgeRetention},
+		{http.MethodGet, "/admin/legal-holds", "List the tenants and users under a legal hold", scopeAdmin, rateAdmin, policyNoStore, h.LegalHolds},
+		{http.MethodPut, "/admin/legal-holds/tenants/{tenant}", "Place a legal hold on the users of a tenant", scopeAdmin, rateAdmin, policyNoStore, h.PlaceTenantHold},
+		{http.MethodDelete, "/admin/legal-holds/tenants/{tenant}", "Release the legal hold of a tenant", scopeAdmin, rateAdmin, policyNoStore, h.ReleaseTenantHold},
+		{http.MethodGet, "/admin/legal-holds/audit", "List the audit trail of the legal holds", scopeAdmin, rateAdmin, policyNoStore, h.HoldAudit},
+		{http.MethodGet, "/admin/query-insights", "Report the listings by shape, with their full scans", scopeAdmin, rateAdmin, policyNoStore, h.QueryInsights},
+		{http.MethodGet, "/admin/api-keys", "List the API keys, without their secrets", scopeAdmin, rateAdmin, policyNoStore, h.APIKeys},
+		{http.MethodGet, "/admin/analytics/apikeys", "Report the requests, error rates and top routes of each API key", scopeAdmin, rateAdmin, policyNoStore, h.KeyAnalytics},
+		{http.MethodGet, "/admin/usage", "Report the monthly usage of each API key, for billing", scopeAdmin, rateAdmin, policyNoStore, h.Usage},
+	}, h.webhookRoutes()...)
+}
+
+// Routes lists every route served by the API
+func (h *adminHandler) Routes(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := json.Marshal(Routes())
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Inflight reports the requests being served per route, including
+// while the server drains them on shutdown
+func (h *adminHandler) Inflight(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := json.Marshal(h.inflight.report())
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// ExportState streams the state archive of the server
+func (h *adminHandler) ExportState(w http.ResponseWriter, r *http.Request) {
+	users, rev, err := h.store.List(r.Context(), store.Query{}, store.Strong)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	st := State{Rev: rev, ConfigSHA256: h.configSHA256, Users: users, Webhooks: h.webhooks.Export()}
+	if h.apiKeys != nil {
+		st.APIKeys = h.apiKeys.Export()
+	}
+	var buf bytes.Buffer
+	if err := writeState(&buf, st, h.clock.Now()); err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.Header().Set("content-type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="state.tar.gz"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// ImportState replaces the server state by the one of the archive in
+// the request body: the users, the webhook subscriptions and the API
+// keys, the ones it holds none of being kept. An archive exported under
+// another configuration is imported with a warning.
+func (h *adminHandler) ImportState(w http.ResponseWriter, r *http.Request) {
+	st, err := ReadState(r.Body)
+	if err != nil {
+		badRequest(w, r)
+		return
+	}
+	// no hold changes until the state is replaced
+	h.holds.mu.Lock()
+	defer h.holds.mu.Unlock()
+	if !h.keepHolds(w, r, st.Users) {
+		return
+	}
+
+	// the webhooks and keys are restored first, as they may be refused,
+	// and put back when the users can't be replaced
+	subs := h.webhooks.Export()
+	if st.Webhooks != nil {
+		if err := h.webhooks.Restore(st.Webhooks); err != nil {
+			invalid(w, r, err.Error())
+			return
+		}
+	}
+	var keys []StoredAPIKey
+	if h.apiKeys != nil && st.APIKeys != nil {
+		keys = h.apiKeys.Export()
+		if err := h.apiKeys.Restore(st.APIKeys); err != nil {
+			h.webhooks.Restore(subs)
+			if errors.Is(err, errKeysNotSaved) {
+				internalServerError(w, r)
+				return
+			}
+			invalid(w, r, err.Error())
+			return
+		}
+	}
+	ctx := h.withEvent(r.Context(), events.UsersReplaced, func(store.User) any {
+		return struct {
+			Count int `json:"count"`
+		}{len(st.Users)}
+	})
+	rev, err := h.store.Replace(ctx, st.Users)
+	if err != nil {
+		h.webhooks.Restore(subs)
+		if keys != nil {
+			if err := h.apiKeys.Restore(keys); err != nil {
+				h.logger.ErrorContext(r.Context(), "API keys not put back", "err", err)
+			}
+		}
+		storeError(w, r, err)
+		return
+	}
+	if st.ConfigSHA256 != "" && st.ConfigSHA256 != h.configSHA256 {
+		h.logger.WarnContext(r.Context(), "state imported from another configuration", "config_sha256", st.ConfigSHA256)
+		w.Header().Set("Warning", `299 - "state exported under another configuration"`)
+	}
+	setRev(w, rev)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+)
+
+const (
+	maxAnalyticsClients = 1000           // clients tracked by the analytics
+	analyticsBucket     = time.Minute    // resolution of the windows
+	maxAnalyticsWindow  = 24 * time.Hour // longest window reported
+	defaultAnalytics    = time.Hour      // window reported unless asked
+	topRoutes           = 5              // routes reported per client
+)
+
+// keyAnalytics counts the requests of the authenticated clients, by
+// the subject of their identity as the name of their API key, per
+// minute over the last day
+type keyAnalytics struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	clients map[string]*clientRequests
+}
+
+// clientRequests are the requests of a client, by minute, the minutes
+// without requests left out
+type clientRequests struct {
+	buckets []requestBucket // oldest first
+}
+
+// requestBucket are the requests of a client in a minute
+type requestBucket struct {
+	minute       int64 // since the epoch
+	requests     int
+	clientErrors int            // 4xx
+	serverErrors int            // 5xx
+	routes       map[string]int // by "METHOD /path"
+}
+
+func newKeyAnalytics(c clock.Clock) *keyAnalytics {
+	return &keyAnalytics{clock: c, clients: map[string]*clientRequests{}}
+}
+
+// record counts a request of client to rt answered with status.
+// Clients past maxAnalyticsClients are dropped.
+func (ka *keyAnalytics) record(client string, rt route, status int) {
+	minute := ka.clock.Now().Unix() / int64(analyticsBucket/time.Second)
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	c, ok := ka.clients[client]
+	if !ok {
+		if len(ka.clients) >= maxAnalyticsClients {
+			ka.sweep(minute)
+			if len(ka.clients) >= maxAnalyticsClients {
+				return
+			}
+		}
+		c = &clientRequests{}
+		ka.clients[client] = c
+	}
+	if n := len(c.buckets); n == 0 || c.buckets[n-1].minute != minute {
+		c.drop(minute)
+		c.buckets = append(c.buckets, requestBucket{minute: minute, routes: map[string]int{}})
+	}
+	b := &c.buckets[len(c.buckets)-1]
+	b.requests++
+	switch {
+	case status >= http.StatusInternalServerError:
+		b.serverErrors++
+	case status >= http.StatusBadRequest:
+		b.clientErrors++
+	}
+	b.routes[rt.method+" "+rt.path]++
+}
+
+// drop forgets the buckets out of the longest window at minute
+func (c *clientRequests) drop(minute int64) {
+	oldest := minute - int64(maxAnalyticsWindow/analyticsBucket) + 1
+	i := 0
+	for i < len(c.buckets) && c.buckets[i].minute < oldest {
+		i++
+	}
+	c.buckets = c.buckets[i:]
+}
+
+// sweep forgets the clients without requests in the longest window
+func (ka *keyAnalytics) sweep(minute int64) {
+	for client, c := range ka.clients {
+		if c.drop(minute); len(c.buckets) == 0 {
+			delete(ka.clients, client)
+		}
+	}
+}
+
+// ClientAnalytics are the requests of a client over a window
+type ClientAnalytics struct {
+	Client       string  `json:"client"`
+	Requests     int     `json:"requests"`
+	ClientErrors int     `json:"client_errors"`
+	ServerErrors int     `json:"server_errors"`
+	ErrorRate    float64 `json:"error_rate"` // of the 4xx and 5xx
+	// TopRoutes are the routes the client calls the most
+	TopRoutes []RouteCount `json:"top_routes"`
+}
+
+// RouteCount is the requests to a route
+type RouteCount struct {
+	Route    string `json:"route"`
+	Requests int    `json:"requests"`
+}
+
+// report returns the requests of the clients over the last window, the
+// busiest clients first
+func (ka *keyAnalytics) report(window time.Duration) []ClientAnalytics {
+	now := ka.clock.Now().Unix() / int64(analyticsBucket/time.Second)
+	since := now - int64(window/analyticsBucket) + 1
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	report := []ClientAnalytics{}
+	for client, c := range ka.clients {
+		a := ClientAnalytics{Client: client}
+		routes := map[string]int{}
+		for _, b := range c.buckets {
+			if b.minute < since || b.minute > now {
+				continue
+			}
+			a.Requests += b.requests
+			a.ClientErrors += b.clientErrors
+			a.ServerErrors += b.serverErrors
+			for rt, n := range b.routes {
+				routes[rt] += n
+			}
+		}
+		if a.Requests == 0 {
+			continue
+		}
+		a.ErrorRate = float64(a.ClientErrors+a.ServerErrors) / float64(a.Requests)
+		for rt, n := range routes {
+			a.TopRoutes = append(a.TopRoutes, RouteCount{rt, n})
+		}
+		sort.Slice(a.TopRoutes, func(i, j int) bool {
+			if a.TopRoutes[i].Requests != a.TopRoutes[j].Requests {
+				return a.TopRoutes[i].Requests > a.TopRoutes[j].Requests
+			}
+			return a.TopRoutes[i].Route < a.TopRoutes[j].Route
+		})
+		a.TopRoutes = a.TopRoutes[:min(topRoutes, len(a.TopRoutes))]
+		report = append(report, a)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Requests != report[j].Requests {
+			return report[i].Requests > report[j].Requests
+		}
+		return report[i].Client < report[j].Client
+	})
+	return report
+}
+
+// KeyAnalytics reports the requests of each API key, or token subject,
+// over the window of ?window=, an hour unless set and at most a day:
+// their count, error rate and top routes, the busiest keys first
+func (h *adminHandler) KeyAnalytics(w http.ResponseWriter, r *http.Request) {
+	window := defaultAnalytics
+	if v := r.URL.Query().Get("window"); v != "" {
+		var err error
+		if window, err = time.ParseDuration(v); err != nil || window < analyticsBucket || window > maxAnalyticsWindow {
+			invalid(w, r, "window: expected a duration from 1m to 24h")
+			return
+		}
+	}
+	jsonBytes, err := json.Marshal(struct {
+		Window string            `json:"window"`
+		Keys   []ClientAnalytics `json:"keys"`
+	}{window.String(), h.usage.report(window)})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestKeyAnalytics(t *testing.T) {
+	h, clk := newTestServer(t, DefaultConfig(), testKeys)
+	for _, req := range []struct{ method, path, body string }{
+		{http.MethodGet, "/users", ""},
+		{http.MethodPost, "/users", `{"name":"Ada"}`},
+		{http.MethodGet, "/users", ""},
+		{http.MethodGet, "/users/nobody", ""},
+		{http.MethodGet, "/users", ""},
+	} {
+		do(h, req.method, req.path, req.body, apiKeyHeader, editorKey)
+	}
+	do(h, http.MethodGet, "/users", "") // unauthenticated, not reported
+
+	report := func(query string) []ClientAnalytics {
+		t.Helper()
+		w := do(h, http.MethodGet, "/admin/analytics/apikeys"+query, "", apiKeyHeader, adminKey)
+		var body struct {
+			Keys []ClientAnalytics `json:"keys"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("analytics%s: %d %s", query, w.Code, w.Body)
+		}
+		return body.Keys
+	}
+	keys := report("")
+	if len(keys) != 1 {
+		t.Fatalf("keys %+v, want the editor alone", keys)
+	}
+	editor := keys[0]
+	if editor.Client != "editor" || editor.Requests != 5 || editor.ClientErrors != 1 || editor.ServerErrors != 0 || editor.ErrorRate != 0.2 {
+		t.Errorf("editor %+v, want 5 requests, 1 of them a 4xx", editor)
+	}
+	if len(editor.TopRoutes) != 3 || editor.TopRoutes[0] != (RouteCount{"GET /users", 3}) {
+		t.Errorf("top routes %+v, want GET /users first", editor.TopRoutes)
+	}
+
+	// the requests fall out of the window as it rolls, the reports of
+	// the admin being counted too
+	clk.Advance(30 * time.Minute)
+	if keys := report("?window=15m"); len(keys) != 0 {
+		t.Errorf("keys of the last 15m %+v, want none", keys)
+	}
+	keys = report("?window=24h")
+	if len(keys) != 2 || keys[0].Client != "editor" || keys[1].Client != "admin" || keys[1].Requests != 2 {
+		t.Errorf("keys of the day %+v, want the editor, then the admin's 2 reports", keys)
+	}
+	if w := do(h, http.MethodGet, "/admin/analytics/apikeys?window=48h", "", apiKeyHeader, adminKey); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("window of 2 days: %d, want 422", w.Code)
+	}
+}
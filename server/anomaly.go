@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/metrics"
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+// Anomalies configures the detection of the spikes of the creates and
+// deletes of the clients, by API key or token subject, or else by IP
+// address. Each window, the writes of a client are compared to its
+// usual count, the moving average of its previous windows.
+type Anomalies struct {
+	// Window is the time the writes are counted over, zero disabling the
+	// detection
+	Window time.Duration
+	// Factor is how many times its usual count a client must write in a
+	// window to be flagged, DefaultAnomalies.Factor unless set
+	Factor float64
+	// MinCount is the fewest writes of a window flagged, so the clients
+	// writing little aren't, DefaultAnomalies.MinCount unless set
+	MinCount int
+	// Throttle rate limits the writes of the flagged clients for
+	// ThrottleFor, when set
+	Throttle    RateLimit
+	ThrottleFor time.Duration
+}
+
+// DefaultAnomalies are the thresholds of the detection
+var DefaultAnomalies = Anomalies{Factor: 5, MinCount: 20, ThrottleFor: 10 * time.Minute}
+
+func (a Anomalies) validate() error {
+	if a.Window < 0 || a.Factor < 0 || a.MinCount < 0 || a.ThrottleFor < 0 {
+		return errors.New("invalid anomaly detection: negative threshold")
+	}
+	if a.Throttle != (RateLimit{}) {
+		return a.Throttle.validate()
+	}
+	return nil
+}
+
+// anomalyOps are the operations watched, by route
+var anomalyOps = map[string]string{
+	"POST /users":        "create",
+	"DELETE /users/{id}": "delete",
+}
+
+// smoothing is the weight of the last window in the usual count
+const smoothing = 0.3
+
+// anomalyDetector flags the clients writing far more than usual
+type anomalyDetector struct {
+	cfg     Anomalies
+	clock   clock.Clock
+	logger  *slog.Logger
+	limiter RateLimiter
+	publish func(ctx context.Context, typ, subject string, data any)
+	flagged *metrics.CounterVec
+
+	mu        sync.Mutex
+	counts    map[string]*writeCount // by operation and client
+	throttled map[string]time.Time   // the clients throttled, until when
+	calls     int                    // since the last sweep
+}
+
+// writeCount are the writes of a client in the current window
+type writeCount struct {
+	start   time.Time
+	count   int
+	usual   float64
+	flagged bool // in the current window
+}
+
+// Anomaly is the alert of a client writing far more than usual, as
+// published in the traffic.anomaly events
+type Anomaly struct {
+	Client    string          `json:"client"`
+	Operation string          `json:"operation"`
+	Count     int             `json:"count"`
+	Usual     float64         `json:"usual"`
+	Window    string          `json:"window"`
+	Throttled *timestamp.Time `json:"throttled_until,omitempty"`
+}
+
+func newAnomalyDetector(cfg Anomalies, c clock.Clock, logger *slog.Logger) *anomalyDetector {
+	if cfg.Factor == 0 {
+		cfg.Factor = DefaultAnomalies.Factor
+	}
+	if cfg.MinCount == 0 {
+		cfg.MinCount = DefaultAnomalies.MinCount
+	}
+	if cfg.ThrottleFor == 0 {
+		cfg.ThrottleFor = DefaultAnomalies.ThrottleFor
+	}
+	return &anomalyDetector{cfg: cfg, clock: c, logger: logger,
+		counts: map[string]*writeCount{}, throttled: map[string]time.Time{}}
+}
+
+// observe counts the request of rt, alerting when its client crosses
+// the thresholds, once a window
+func (d *anomalyDetector) observe(r *http.Request, rt route) {
+	op, ok := anomalyOps[rt.method+" "+rt.path]
+	if !ok {
+		return
+	}
+	client := clientKey(r)
+	now := d.clock.Now()
+	d.mu.Lock()
+	if d.calls++; d.calls >= sweepEvery {
+		d.sweep(now)
+	}
+	c, ok := d.counts[op+"/"+client]
+	if !ok {
+		c = &writeCount{start: now}
+		d.counts[op+"/"+client] = c
+	}
+	c.roll(now, d.cfg.Window)
+	c.count++
+	if c.flagged || c.count < d.cfg.MinCount || float64(c.count) < d.cfg.Factor*max(c.usual, 1) {
+		d.mu.Unlock()
+		return
+	}
+	c.flagged = true
+	a := Anomaly{Client: client, Operation: op, Count: c.count, Usual: c.usual, Window: d.cfg.Window.String()}
+	if d.cfg.Throttle != (RateLimit{}) {
+		d.throttled[client] = now.Add(d.cfg.ThrottleFor)
+		until := timestamp.New(now.Add(d.cfg.ThrottleFor).UTC())
+		a.Throttled = &until
+	}
+	d.mu.Unlock()
+
+	d.logger.WarnContext(r.Context(), "traffic anomaly", "client", client, "operation", op,
+		"count", a.Count, "usual", a.Usual, "window", a.Window, "throttled", a.Throttled != nil)
+	d.flagged.Inc(op)
+	if d.publish != nil {
+		d.publish(r.Context(), events.TrafficAnomaly, client, a)
+	}
+}
+
+// roll moves c to the window of now, averaging the counts of the
+// windows past into the usual count
+func (c *writeCount) roll(now time.Time, window time.Duration) {
+	for i := 0; now.Sub(c.start) >= window; i++ {
+		if i == 64 {
+			// idle long enough for the usual count to be nothing
+			c.start, c.usual = now, 0
+			break
+		}
+		c.usual = (1-smoothing)*c.usual + smoothing*float64(c.count)
+		c.start = c.start.Add(window)
+		c.count, c.flagged = 0, false
+	}
+}
+
+// throttle returns the rate limit of the client, while throttled
+func (d *anomalyDetector) throttle(client string) (RateLimit, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, ok := d.throttled[client]
+	if !ok {
+		return RateLimit{}, false
+	}
+	if !d.clock.Now().Before(until) {
+		delete(d.throttled, client)
+		return RateLimit{}, false
+	}
+	return d.cfg.Throttle, true
+}
+
+// sweep drops the counts of the clients idle long enough to have no
+// usual count left
+func (d *anomalyDetector) sweep(now time.Time) {
+	d.calls = 0
+	for key, c := range d.counts {
+		if now.Sub(c.start) >= 64*d.cfg.Window {
+			delete(d.counts, key)
+		}
+	}
+	for client, until := range d.throttled {
+		if !now.Before(until) {
+			delete(d.throttled, client)
+		}
+	}
+}
+
+// clientKey identifies the client of r by the subject of its identity,
+// as the name of its API key, or else by its IP address
+func clientKey(r *http.Request) string {
+	if id, ok := IdentityFrom(r.Context()); ok && id.Subject != "" {
+		return "sub:" + id.Subject
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + r.RemoteAddr
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/events"
+)
+
+func TestAnomalies(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Anomalies = Anomalies{Window: time.Minute, Factor: 2, MinCount: 3,
+		Throttle: RateLimit{Rate: 1, Burst: 1}, ThrottleFor: 10 * time.Minute}
+	bus := events.NewMemory()
+	published := recordedEvents(bus)
+	h, clk := newTestServer(t, cfg, WithEventBus(bus))
+
+	anomalies := func() []Anomaly {
+		var got []Anomaly
+		for _, e := range published() {
+			if e.Type != events.TrafficAnomaly {
+				continue
+			}
+			var a Anomaly
+			if err := json.Unmarshal(e.Data, &a); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, a)
+		}
+		return got
+	}
+
+	createUser(t, h, "Ada")
+	createUser(t, h, "Bob")
+	if got := anomalies(); len(got) != 0 {
+		t.Fatalf("flagged under the min count: %+v", got)
+	}
+	createUser(t, h, "Cy")
+	got := anomalies()
+	if len(got) != 1 || got[0].Client != "ip:192.0.2.1" || got[0].Operation != "create" || got[0].Count != 3 || got[0].Throttled == nil {
+		t.Fatalf("anomalies %+v, want the third create flagged and throttled", got)
+	}
+
+	// throttled to the burst of the limit, the reads let through
+	createUser(t, h, "Dee")
+	w := do(h, http.MethodPost, "/users", `{"name":"Eve"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("create past the throttle: %d %v, want 429 with Retry-After", w.Code, w.Header())
+	}
+	if w := do(h, http.MethodGet, "/users", ""); w.Code != http.StatusOK {
+		t.Errorf("list while throttled: %d, want 200", w.Code)
+	}
+	if got := anomalies(); len(got) != 1 {
+		t.Errorf("flagged %d times in a window, want once", len(got))
+	}
+
+	clk.Advance(10 * time.Minute)
+	createUser(t, h, "Eve")
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+	"github.com/santisdev/go-restapi.git/wire"
+)
+
+const (
+	// apiKeyHeader carries the API key of the requests
+	apiKeyHeader = "X-API-Key"
+	// minAPIKeyLen is the shortest key accepted, in bytes
+	minAPIKeyLen = 16
+)
+
+// APIKey is a key a client authenticates with, in the X-API-Key header
+type APIKey struct {
+	// Name names the client, as the subject of its identity and in the
+	// logs of its requests
+	Name string `json:"name"`
+	// Key is the secret the client sends, at least 16 bytes long
+	Key wire.Secret `json:"key,omitempty"`
+	// Scopes are the scopes granted to the client, as users:read,
+	// users:write or admin
+	Scopes []string `json:"scopes,omitempty"`
+	// Roles are the roles granted to the client, as viewer, editor,
+	// tenant-admin or admin
+	Roles []string `json:"roles,omitempty"`
+	// Tenant is the tenant of the client, whose tenant admins manage its
+	// key, if any
+	Tenant string `json:"tenant,omitempty"`
+	// User is the id of the user the key is of, as for the invited
+	// users, the key being refused once the user is deactivated or
+	// deleted
+	User      string         `json:"user,omitempty"`
+	CreatedAt timestamp.Time `json:"created_at"`
+}
+
+var (
+	// ErrDuplicateKey is returned when adding a key whose name or
+	// secret is already taken
+	ErrDuplicateKey = errors.New("duplicate API key")
+	// ErrUnknownKey is returned for the keys not found by name
+	ErrUnknownKey = errors.New("unknown API key")
+	// errKeysNotSaved is returned when the keys managed while serving
+	// can't be saved, the change being undone
+	errKeysNotSaved = errors.New("API keys not saved")
+)
+
+// APIKeys is the Authenticator of the clients by their API key. Keys
+// may be added and revoked while serving, as by the tenant admins,
+// which is kept in a file across restarts when set.
+type APIKeys struct {
+	mu     sync.RWMutex
+	keys   []APIKey            // without their secrets, by name
+	byHash map[[32]byte]APIKey // by the SHA-256 of their secret
+
+	users      store.UserStore         // looks up the users of the keys, when set
+	file       string                  // keeps the managed keys, when set
+	configured map[string]StoredAPIKey // the keys given to NewAPIKeys, by name
+	managed    managedKeys
+}
+
+// managedKeys are the changes to the keys made while serving: the keys
+// added, by the SHA-256 of their secret so the file holds none, and the
+// configured keys given roles or revoked
+type managedKeys struct {
+	Added   []StoredAPIKey      `json:"added"`
+	Roles   map[string][]string `json:"roles,omitempty"`
+	Revoked []string            `json:"revoked,omitempty"`
+}
+
+// StoredAPIKey is a key without its secret, as kept in the managed keys
+// file and the state archives
+type StoredAPIKey struct {
+	APIKey
+	KeySHA256 string `json:"key_sha256"`
+}
+
+// NewAPIKeys returns the authenticator of keys. The names and the
+// secrets must be unique.
+func NewAPIKeys(keys []APIKey) (*APIKeys, error) {
+	a := &APIKeys{byHash: map[[32]byte]APIKey{}, configured: map[string]StoredAPIKey{}}
+	for _, k := range keys {
+		if err := a.add(k); err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256([]byte(k.Key))
+		k.Key = ""
+		a.configured[k.Name] = StoredAPIKey{k, hex.EncodeToString(hash[:])}
+	}
+	return a, nil
+}
+
+// persist keeps the keys managed while serving in file, applying the
+// changes it holds to the configured keys. The changes to the keys no
+// longer configured are dropped.
+func (a *APIKeys) persist(file string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.file = file
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var m managedKeys
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("API keys file %s: %w", file, err)
+	}
+	for _, name := range m.Revoked {
+		if _, ok := a.configured[name]; ok {
+			a.revoke(name)
+			a.managed.Revoked = append(a.managed.Revoked, name)
+		}
+	}
+	for name, roles := range m.Roles {
+		if _, ok := a.configured[name]; ok && checkRoles(roles) == nil && a.setRoles(name, roles) == nil {
+			if a.managed.Roles == nil {
+				a.managed.Roles = map[string][]string{}
+			}
+			a.managed.Roles[name] = roles
+		}
+	}
+	for _, k := range m.Added {
+		var hash [32]byte
+		if n, err := hex.Decode(hash[:], []byte(k.KeySHA256)); err != nil || n != len(hash) {
+			return fmt.Errorf("API keys file %s: key %q: invalid key_sha256", file, k.Name)
+		}
+		if err := a.addHash(k.APIKey, hash); err != nil {
+			return fmt.Errorf("API keys file %s: %w", file, err)
+		}
+		a.managed.Added = append(a.managed.Added, k)
+	}
+	return nil
+}
+
+// keysSnapshot is the state of the keys before a change, restored when
+// it can't be saved
+type keysSnapshot struct {
+	keys    []APIKey
+	byHash  map[[32]byte]APIKey
+	managed managedKeys
+}
+
+func (a *APIKeys) snapshot() keysSnapshot {
+	return keysSnapshot{slices.Clone(a.keys), maps.Clone(a.byHash), managedKeys{
+		Added:   slices.Clone(a.managed.Added),
+		Roles:   maps.Clone(a.managed.Roles),
+		Revoked: slices.Clone(a.managed.Revoked),
+	}}
+}
+
+// save writes the managed keys to the file, when set, through a
+// temporary file so a crash leaves the previous one, restoring snap
+// when it fails. a.mu is held.
+func (a *APIKeys) save(snap keysSnapshot) error {
+	if a.file == "" {
+		return nil
+	}
+	b, err := json.Marshal(a.managed)
+	if err == nil {
+		if err = os.WriteFile(a.file+".tmp", b, 0o600); err == nil {
+			err = os.Rename(a.file+".tmp", a.file)
+		}
+	}
+	if err != nil {
+		a.keys, a.byHash, a.managed = snap.keys, snap.byHash, snap.managed
+		return fmt.Errorf("%w: %s: %v", errKeysNotSaved, a.file, err)
+	}
+	return nil
+}
+
+// Add adds k, failing with ErrDuplicateKey when its name or secret is
+// taken, and undoing it when it can't be saved
+func (a *APIKeys) Add(k APIKey) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	snap := a.snapshot()
+	if err := a.add(k); err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(k.Key))
+	stored := k
+	stored.Key = ""
+	a.managed.Added = append(a.managed.Added, StoredAPIKey{stored, hex.EncodeToString(hash[:])})
+	return a.save(snap)
+}
+
+func (a *APIKeys) add(k APIKey) error {
+	if k.Name != "" && len(k.Key) < minAPIKeyLen {
+		return fmt.Errorf("API key %q: shorter than %d bytes", k.Name, minAPIKeyLen)
+	}
+	return a.addHash(k, sha256.Sum256([]byte(k.Key)))
+}
+
+// addHash adds k by the SHA-256 of its secret
+func (a *APIKeys) addHash(k APIKey, hash [32]byte) error {
+	if k.Name == "" {
+		return errors.New("API key with no name")
+	}
+	if err := checkRoles(k.Roles); err != nil {
+		return fmt.Errorf("API key %q: %w", k.Name, err)
+	}
+	i, found := slices.BinarySearchFunc(a.keys, k.Name, func(k APIKey, name string) int { return strings.Compare(k.Name, name) })
+	if found {
+		return fmt.Errorf("API key %q: %w: name", k.Name, ErrDuplicateKey)
+	}
+	// the keys are looked up by hash, so the lookups don't leak how
+	// much of a key a guess got right
+	if _, ok := a.byHash[hash]; ok {
+		return fmt.Errorf("API key %q: %w: key", k.Name, ErrDuplicateKey)
+	}
+	a.byHash[hash] = k
+	k.Key = ""
+	a.keys = slices.Insert(a.keys, i, k)
+	return nil
+}
+
+// Revoke removes the key named name, failing with ErrUnknownKey when
+// there's none, and undoing it when it can't be saved
+func (a *APIKeys) Revoke(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	snap := a.snapshot()
+	if err := a.revoke(name); err != nil {
+		return err
+	}
+	if i := slices.IndexFunc(a.managed.Added, func(k StoredAPIKey) bool { return k.Name == name }); i >= 0 {
+		a.managed.Added = slices.Delete(a.managed.Added, i, i+1)
+	} else {
+		delete(a.managed.Roles, name)
+		a.managed.Revoked = append(a.managed.Revoked, name)
+	}
+	return a.save(snap)
+}
+
+func (a *APIKeys) revoke(name string) error {
+	i, found := slices.BinarySearchFunc(a.keys, name, func(k APIKey, name string) int { return strings.Compare(k.Name, name) })
+	if !found {
+		return ErrUnknownKey
+	}
+	a.keys = slices.Delete(a.keys, i, i+1)
+	for hash, k := range a.byHash {
+		if k.Name == name {
+			delete(a.byHash, hash)
+		}
+	}
+	return nil
+}
+
+// SetRoles replaces the roles of the key named name, failing with
+// ErrUnknownKey when there's none, and undoing it when it can't be
+// saved
+func (a *APIKeys) SetRoles(name string, roles []string) (APIKey, error) {
+	if err := checkRoles(roles); err != nil {
+		return APIKey{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	snap := a.snapshot()
+	if err := a.setRoles(name, roles); err != nil {
+		return APIKey{}, err
+	}
+	if i := slices.IndexFunc(a.managed.Added, func(k StoredAPIKey) bool { return k.Name == name }); i >= 0 {
+		a.managed.Added[i].Roles = roles
+	} else {
+		if a.managed.Roles == nil {
+			a.managed.Roles = map[string][]string{}
+		}
+		a.managed.Roles[name] = roles
+	}
+	if err := a.save(snap); err != nil {
+		return APIKey{}, err
+	}
+	i, _ := slices.BinarySearchFunc(a.keys, name, func(k APIKey, name string) int { return strings.Compare(k.Name, name) })
+	return a.keys[i], nil
+}
+
+func (a *APIKeys) setRoles(name string, roles []string) error {
+	i, found := slices.BinarySearchFunc(a.keys, name, func(k APIKey, name string) int { return strings.Compare(k.Name, name) })
+	if !found {
+		return ErrUnknownKey
+	}
+	a.keys[i].Roles = roles
+	for hash, k := range a.byHash {
+		if k.Name == name {
+			k.Roles = roles
+			a.byHash[hash] = k
+		}
+	}
+	return nil
+}
+
+// Export returns the keys, by name, with the SHA-256 of their secret
+// instead of it, as kept in the state archives
+func (a *APIKeys) Export() []StoredAPIKey {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	keys := make([]StoredAPIKey, 0, len(a.keys))
+	for hash, k := range a.byHash {
+		k.Key = ""
+		keys = append(keys, StoredAPIKey{k, hex.EncodeToString(hash[:])})
+	}
+	slices.SortFunc(keys, func(a, b StoredAPIKey) int { return strings.Compare(a.Name, b.Name) })
+	return keys
+}
+
+// Restore replaces the keys by keys, as exported by Export, undoing it
+// when it can't be saved. The configured keys keep their secret, scopes
+// and tenant, taking only their roles from keys, and are revoked when
+// missing from it.
+func (a *APIKeys) Restore(keys []StoredAPIKey) error {
+	restored := &APIKeys{byHash: map[[32]byte]APIKey{}}
+	var managed managedKeys
+	for _, k := range keys {
+		c, ok := a.configured[k.Name]
+		if ok {
+			roles := k.Roles
+			k = c
+			k.Roles = roles
+			if !slices.Equal(roles, c.Roles) {
+				if managed.Roles == nil {
+					managed.Roles = map[string][]string{}
+				}
+				managed.Roles[k.Name] = roles
+			}
+		}
+		var hash [32]byte
+		if n, err := hex.Decode(hash[:], []byte(k.KeySHA256)); err != nil || n != len(hash) {
+			return fmt.Errorf("API key %q: invalid key_sha256", k.Name)
+		}
+		if err := restored.addHash(k.APIKey, hash); err != nil {
+			return err
+		}
+		if !ok {
+			managed.Added = append(managed.Added, k)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name := range a.configured {
+		if !slices.ContainsFunc(keys, func(k StoredAPIKey) bool { return k.Name == name }) {
+			managed.Revoked = append(managed.Revoked, name)
+		}
+	}
+	slices.Sort(managed.Revoked)
+	snap := a.snapshot()
+	a.keys, a.byHash, a.managed = restored.keys, restored.byHash, managed
+	return a.save(snap)
+}
+
+// Authenticate identifies the client by the key of its X-API-Key
+// header, failing with ErrUnauthenticated when it is missing or
+// unknown, or its user is inactive or deleted
+func (a *APIKeys) Authenticate(r *http.Request) (Identity, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+	a.mu.RLock()
+	k, ok := a.byHash[sha256.Sum256([]byte(key))]
+	a.mu.RUnlock()
+	if !ok {
+		return Identity{}, ErrUnauthenticated
+	}
+	if k.User != "" && a.users != nil {
+		u, _, err := a.users.Get(r.Context(), k.User, store.Strong)
+		if errors.Is(err, store.ErrNotFound) || err == nil && !u.Active {
+			return Identity{}, ErrUnauthenticated
+		}
+		if err != nil {
+			return Identity{}, err
+		}
+	}
+	return Identity{Subject: k.Name, Scopes: k.Scopes, Roles: k.Roles, Tenant: k.Tenant}, nil
+}
+
+// Tenant returns the tenant of the key named name, empty for none. The
+// users of a tenant are the ones whose key, named by their id, is of it.
+func (a *APIKeys) Tenant(name string) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	i, found := slices.BinarySearchFunc(a.keys, name, func(k APIKey, name string) int { return strings.Compare(k.Name, name) })
+	if !found {
+		return ""
+	}
+	return a.keys[i].Tenant
+}
+
+// Keys returns the keys, by name, without their secrets
+func (a *APIKeys) Keys() []APIKey {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return slices.Clone(a.keys)
+}
+
+// APIKeys lists the API keys with their scopes and creation dates,
+// without their secrets
+func (h *adminHandler) APIKeys(w http.ResponseWriter, r *http.Request) {
+	keys := []APIKey{}
+	if h.apiKeys != nil {
+		keys = h.apiKeys.Keys()
+	}
+	for i := range keys {
+		keys[i].CreatedAt = localTime(r, keys[i].CreatedAt)
+	}
+	jsonBytes, err := json.Marshal(keys)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrUnauthenticated is returned by authenticators when a request
+// carries no valid credentials
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Authenticator identifies the client of a request
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// Identity is an authenticated client
+type Identity struct {
+	Subject string
+	Scopes  []string
+	// Roles are the roles granted to the client, as viewer, editor,
+	// tenant-admin or admin, along with the scopes they imply
+	Roles []string
+	// Claims are the claims of the token of the client, if it bore one
+	Claims map[string]any
+	// Tenant is the tenant of the API key of the client, if any
+	Tenant string
+}
+
+// HasScope tells whether the identity was granted scope, itself or by
+// a role. The admin scope grants every other one.
+func (id Identity) HasScope(scope string) bool {
+	scopes := id.Scopes
+	for _, r := range id.Roles {
+		scopes = append(scopes[:len(scopes):len(scopes)], roleScopes[r]...)
+	}
+	for _, s := range scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// anyAuthenticator identifies the clients with the first of its
+// authenticators recognizing their credentials
+type anyAuthenticator []Authenticator
+
+func (as anyAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	for _, a := range as {
+		id, err := a.Authenticate(r)
+		if !errors.Is(err, ErrUnauthenticated) {
+			return id, err
+		}
+	}
+	return Identity{}, ErrUnauthenticated
+}
+
+type identityKey struct{}
+
+// subjectKey holds the *string the subject of the client is recorded in
+// once authenticated, for the middleware outside of the router, as the
+// access log
+type subjectKey struct{}
+
+// IdentityFrom returns the identity of the client of a request, if it
+// was authenticated
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// authorize checks that the client may call rt, having its scope and
+// its role, answering 401 or 403 otherwise, the request of the 403
+// keeping the identity. Without authenticator every route is open.
+func (rr *router) authorize(w http.ResponseWriter, r *http.Request, rt route) (*http.Request, bool) {
+	if rr.auth == nil || rt.scope == scopePublic {
+		return r, true
+	}
+	id, err := rr.auth.Authenticate(r)
+	if errors.Is(err, ErrUnauthenticated) {
+		unauthorized(w, r)
+		return r, false
+	}
+	if err != nil {
+		internalServerError(w, r)
+		return r, false
+	}
+	if subject, ok := r.Context().Value(subjectKey{}).(*string); ok {
+		*subject = id.Subject
+	}
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+	if !id.HasScope(rt.scope) || !id.HasRole(rr.role(rt)) {
+		forbidden(w, r)
+		return r, false
+	}
+	return r, true
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "unauthorized", nil)
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusForbidden, codeForbidden, "forbidden", nil)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// htmlCodec renders the responses as HTML pages for the browsers: the
+// JSON of the resource, links to the users it holds, and forms calling
+// the other routes of its path
+func (rr *router) htmlCodec() codec {
+	return codec{"text/html", func(r *http.Request, rt route, body []byte) ([]byte, error) {
+		page := browserPage{Method: rt.method, Path: r.URL.Path, Summary: rt.summary}
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, body, "", "  "); err != nil {
+			return nil, err
+		}
+		page.JSON = pretty.String()
+		page.Users = userLinks(versionPrefix(r), body)
+		n, _ := rr.match(versionedPath(r))
+		for _, other := range n.routes {
+			if other.method != http.MethodGet {
+				page.Forms = append(page.Forms, browserForm{
+					Method:  other.method,
+					Summary: other.summary,
+					Body:    other.method != http.MethodDelete,
+				})
+			}
+		}
+		var buf bytes.Buffer
+		if err := browserTemplate.Execute(&buf, page); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}, nil}
+}
+
+type browserPage struct {
+	Method, Path, Summary string
+	JSON                  string
+	Users                 []string // hrefs
+	Forms                 []browserForm
+}
+
+type browserForm struct {
+	Method, Summary string
+	Body            bool // whether the route takes a JSON body
+}
+
+// userLinks returns the links to the users listed in a response
+func userLinks(prefix string, body []byte) []string {
+	var doc struct {
+		Users []struct {
+			ID string `json:"id"`
+		} `json:"users"`
+		Value []struct {
+			ID string `json:"id"`
+		} `json:"value"`
+	}
+	if json.Unmarshal(body, &doc) != nil {
+		return nil
+	}
+	var links []string
+	for _, u := range append(doc.Users, doc.Value...) {
+		if u.ID != "" {
+			links = append(links, prefix+"/users/"+url.PathEscape(u.ID))
+		}
+	}
+	return links
+}
+
+var browserTemplate = template.Must(template.New("browser").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Method}} {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+form { border-top: 1px solid #ddd; padding: 1em 0; }
+textarea { width: 100%; height: 8em; font-family: monospace; }
+</style>
+</head>
+<body>
+<nav><a href="/users">users</a> · <a href="/version">version</a> · <a href="/events/schemas">event schemas</a></nav>
+<h1>{{.Method}} {{.Path}}</h1>
+<p>{{.Summary}}</p>
+<pre>{{.JSON}}</pre>
+{{if .Users}}<ul>{{range .Users}}<li><a href="{{.}}">{{.}}</a></li>{{end}}</ul>{{end}}
+{{range .Forms}}
+<form data-method="{{.Method}}">
+<h2>{{.Method}} {{$.Path}}</h2>
+<p>{{.Summary}}</p>
+{{if .Body}}<textarea name="body">{}</textarea>{{end}}
+<button type="submit">{{.Method}}</button>
+<pre class="result"></pre>
+</form>
+{{end}}
+<script>
+for (const form of document.querySelectorAll("form[data-method]")) {
+	form.addEventListener("submit", async (e) => {
+		e.preventDefault();
+		const init = {method: form.dataset.method, headers: {"Accept": "application/json"}};
+		if (form.body) {
+			init.body = form.body.value;
+			init.headers["Content-Type"] = "application/json";
+		}
+		const resp = await fetch(location.pathname, init);
+		form.querySelector(".result").textContent = resp.status + " " + resp.statusText + "\n" + await resp.text();
+	});
+}
+</script>
+</body>
+</html>
+`))
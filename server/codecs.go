@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santisdev/go-restapi.git/canonjson"
+	"github.com/santisdev/go-restapi.git/msgpack"
+)
+
+const (
+	halContentType     = "application/hal+json"
+	msgpackContentType = "application/msgpack"
+	// maxDecodedBody bounds the request bodies converted to JSON
+	maxDecodedBody = 1 << 20
+)
+
+// codec renders the JSON responses of the handlers in another media
+// type, picked from the Accept header of the request, and may read the
+// bodies of the users written in it
+type codec struct {
+	mediaType string
+	// encode converts the JSON body of a successful response of rt
+	encode func(r *http.Request, rt route, body []byte) ([]byte, error)
+	// decode converts a request body to JSON, nil when the media type
+	// is only answered
+	decode func(body []byte) ([]byte, error)
+}
+
+// codecs are the representations offered by default besides JSON
+var codecs = []codec{
+	{halContentType, encodeHAL, nil},
+	{xmlContentType, encodeXML, decodeXMLUser},
+	{msgpackContentType, func(r *http.Request, rt route, body []byte) ([]byte, error) {
+		return msgpack.FromJSON(body)
+	}, msgpack.ToJSON},
+}
+
+// decodedRoutes are the routes whose bodies may be in the media types
+// of the codecs, besides JSON
+var decodedRoutes = map[string]bool{"POST /users": true, "PUT /users/{id}": true}
+
+// Codec is a media type the API speaks besides JSON, converting its
+// JSON documents, as the users, to and from that type
+type Codec interface {
+	MediaType() string
+	// Encode converts the JSON body of a successful response
+	Encode(body []byte) ([]byte, error)
+	// Decode converts the body of a user written to JSON
+	Decode(body []byte) ([]byte, error)
+}
+
+// canonicalCodec rewrites the JSON responses of the routes whose
+// responses are signed or hashed downstream in canonical JSON
+var canonicalCodec = &codec{"application/json", func(r *http.Request, rt route, body []byte) ([]byte, error) {
+	return canonjson.Canonicalize(body)
+}, nil}
+
+// negotiate returns the codec of offered the client prefers to JSON, if
+// any. JSON wins ties and wildcards.
+func negotiate(r *http.Request, offered []codec) *codec {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return nil
+	}
+	type mediaRange struct {
+		typ string
+		q   float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		typ, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{typ, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	for _, mr := range ranges {
+		switch mr.typ {
+		case "application/json", "application/*", "*/*":
+			return nil
+		}
+		for i := range offered {
+			if offered[i].mediaType == mr.typ {
+				return &offered[i]
+			}
+		}
+	}
+	return nil
+}
+
+// decodeBody converts the body of r to JSON for the routes of
+// decodedRoutes, when it is in the media type of a codec reading
+// bodies, answering 400 when it can't be. Bodies of other types are
+// passed through.
+func (rr *router) decodeBody(w http.ResponseWriter, r *http.Request, rt route) (*http.Request, bool) {
+	if !decodedRoutes[rt.method+" "+rt.path] {
+		return r, true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return r, true
+	}
+	for _, c := range rr.codecs {
+		if c.mediaType != mediaType || c.decode == nil {
+			continue
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDecodedBody))
+		if err == nil {
+			body, err = c.decode(body)
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid "+mediaType+" body: "+err.Error(), nil)
+			return r, false
+		}
+		r = r.Clone(r.Context())
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Type", "application/json")
+		return r, true
+	}
+	return r, true
+}
+
+// serve calls the handler of rt, converting its JSON responses. Errors
+// and other media types are passed through.
+func (c *codec) serve(w http.ResponseWriter, r *http.Request, rt route) {
+	buf := newResponseBuffer()
+	for k, v := range w.Header() {
+		buf.header[k] = v
+	}
+	rt.handle(buf, r)
+
+	body := buf.body.Bytes()
+	if buf.status >= 200 && buf.status <= 299 && len(body) > 0 &&
+		strings.HasPrefix(buf.header.Get("content-type"), "application/json") {
+		converted, err := c.encode(r, rt, body)
+		if err != nil {
+			internalServerError(w, r)
+			return
+		}
+		body = converted
+		contentType := c.mediaType
+		if strings.HasPrefix(contentType, "text/") {
+			contentType += "; charset=utf-8"
+		}
+		buf.header.Set("content-type", contentType)
+	}
+	for k, v := range buf.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(buf.status)
+	w.Write(body)
+}
+
+// encodeHAL renders a response as HAL: users get links to themselves
+// and to their actions, listings embed them, and every other document
+// links to the request
+func encodeHAL(r *http.Request, rt route, body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	self := halLinks{"self": {Href: r.URL.RequestURI()}}
+
+	var doc map[string]any
+	switch v := v.(type) {
+	case map[string]any:
+		doc = v
+	case []any:
+		doc = map[string]any{"_embedded": map[string]any{"items": v}}
+	default:
+		return body, nil
+	}
+	if !strings.HasPrefix(rt.path, "/users") {
+		doc["_links"] = self
+		return json.Marshal(doc)
+	}
+
+	prefix := versionPrefix(r)
+	if isUser(doc) {
+		halUser(prefix, doc)
+		return json.Marshal(doc)
+	}
+	for _, key := range []string{"users", "value", "target", "source"} {
+		switch embedded := doc[key].(type) {
+		case []any:
+			for _, e := range embedded {
+				if u, ok := e.(map[string]any); ok && isUser(u) {
+					halUser(prefix, u)
+				}
+			}
+		case map[string]any:
+			if isUser(embedded) {
+				halUser(prefix, embedded)
+			}
+		default:
+			continue
+		}
+		if doc["_embedded"] == nil {
+			doc["_embedded"] = map[string]any{}
+		}
+		name := key
+		if key == "value" {
+			name = "users" // the OData listings
+		}
+		doc["_embedded"].(map[string]any)[name] = doc[key]
+		delete(doc, key)
+	}
+	doc["_links"] = self
+	return json.Marshal(doc)
+}
+
+type halLink struct {
+	Href string `json:"href"`
+}
+
+type halLinks map[string]halLink
+
+// isUser tells whether a decoded document is a user
+func isUser(doc map[string]any) bool {
+	_, hasID := doc["id"].(string)
+	_, hasVersion := doc["version"]
+	return hasID && hasVersion
+}
+
+// halUser adds the links of a user to its document, under the prefix
+// of the version of the API
+func halUser(prefix string, u map[string]any) {
+	href := prefix + "/users/" + url.PathEscape(u["id"].(string))
+	links := halLinks{
+		"self":  {Href: href},
+		"merge": {Href: href + "/merge"},
+		"lock":  {Href: href + "/lock"},
+	}
+	if active, _ := u["active"].(bool); active {
+		links["deactivate"] = halLink{Href: href + "/deactivate"}
+	} else {
+		links["activate"] = halLink{Href: href + "/activate"}
+	}
+	if into, ok := u["merged_into"].(string); ok && into != "" {
+		links["merged-into"] = halLink{Href: prefix + "/users/" + url.PathEscape(into)}
+	}
+	u["_links"] = links
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                                             "",
+		"application/json":                             "",
+		"application/hal+json":                         halContentType,
+		"application/hal+json; charset=utf-8":          halContentType,
+		"application/json, application/hal+json":       "",
+		"application/hal+json, application/json":       halContentType,
+		"application/json;q=0.5, application/hal+json": halContentType,
+		"application/hal+json;q=0.5, */*":              "",
+		"application/hal+json;q=0, text/html":          "",
+		"text/html, application/hal+json;q=0.1":        halContentType,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/users", nil)
+		r.Header.Set("Accept", accept)
+		got := ""
+		if c := negotiate(r, codecs); c != nil {
+			got = c.mediaType
+		}
+		if got != want {
+			t.Errorf("Accept %q negotiated %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestHAL(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	ada := createUser(t, h, "Ada")
+
+	w := do(h, http.MethodGet, "/users/"+ada.ID, "", "Accept", halContentType)
+	if got := w.Header().Get("Content-Type"); got != halContentType {
+		t.Errorf("content type %s, want %s", got, halContentType)
+	}
+	var u struct {
+		Name  string             `json:"name"`
+		Links map[string]halLink `json:"_links"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "Ada" || u.Links["self"].Href != "/v1/users/"+ada.ID || u.Links["deactivate"].Href != "/v1/users/"+ada.ID+"/deactivate" {
+		t.Errorf("got %s", w.Body)
+	}
+	if _, ok := u.Links["activate"]; ok {
+		t.Errorf("the active user links to activate: %s", w.Body)
+	}
+
+	w = do(h, http.MethodGet, "/users", "", "Accept", halContentType)
+	var list struct {
+		Embedded struct {
+			Users []struct {
+				ID    string             `json:"id"`
+				Links map[string]halLink `json:"_links"`
+			} `json:"users"`
+		} `json:"_embedded"`
+		Links map[string]halLink `json:"_links"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Embedded.Users) != 1 || list.Embedded.Users[0].Links["self"].Href != "/v1/users/"+ada.ID || list.Links["self"].Href != "/users" {
+		t.Errorf("got %s", w.Body)
+	}
+
+	w = do(h, http.MethodGet, "/users/42", "", "Accept", halContentType)
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("error answered %d as %s, want a JSON 404", w.Code, w.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressMinSize is the size of the smallest bodies compressed
+// unless set, in bytes
+const DefaultCompressMinSize = 1024
+
+// Compression tells which responses are compressed, for the clients
+// accepting it
+type Compression struct {
+	// MinSize is the size of the smallest bodies compressed, in bytes,
+	// 0 compressing them all. DefaultConfig sets it to
+	// DefaultCompressMinSize, which a negative size also stands for.
+	MinSize int
+	// ContentTypes are the media types compressed, as application/json
+	// or text/* for every text, all of them unless set. The archives,
+	// as application/gzip, are never compressed again.
+	ContentTypes []string
+}
+
+func (c Compression) validate() error {
+	for _, t := range c.ContentTypes {
+		typ, sub, ok := strings.Cut(t, "/")
+		if !ok || typ == "" || typ == "*" || sub == "" {
+			return fmt.Errorf("invalid compressed content type %q: expected as in application/json or text/*", t)
+		}
+	}
+	return nil
+}
+
+// Compressor compresses the responses in a content coding besides
+// gzip, as br with a brotli package
+type Compressor interface {
+	// Encoding is the name of the coding, told in Content-Encoding
+	Encoding() string
+	// NewWriter returns a writer compressing to w, closed at the end of
+	// the response. Its Flush method, when it has one, is called when
+	// the handlers flush.
+	NewWriter(w io.Writer) io.WriteCloser
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Encoding() string { return "gzip" }
+
+func (gzipCompressor) NewWriter(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+
+// compression is how the router compresses the responses
+type compression struct {
+	minSize int
+	types   []string
+	// compressors are the codings offered, by preference when the
+	// clients accept several alike
+	compressors []Compressor
+}
+
+func newCompression(cfg Compression, compressors []Compressor) *compression {
+	c := &compression{minSize: cfg.MinSize, compressors: append(slices.Clone(compressors), gzipCompressor{})}
+	if c.minSize < 0 {
+		c.minSize = DefaultCompressMinSize
+	}
+	for _, t := range cfg.ContentTypes {
+		c.types = append(c.types, strings.ToLower(t))
+	}
+	return c
+}
+
+// negotiate returns the compressor of the coding the Accept-Encoding
+// header prefers, nil when it accepts none
+func (c *compression) negotiate(accept string) Compressor {
+	if accept == "" {
+		return nil
+	}
+	weights := map[string]float64{}
+	for _, enc := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				q = 0
+			}
+		}
+		weights[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+	var best Compressor
+	bestQ := 0.0
+	for _, cp := range c.compressors {
+		q, ok := weights[cp.Encoding()]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = cp, q
+		}
+	}
+	return best
+}
+
+// compresses tells whether the bodies of the content type are
+// compressed
+func (c *compression) compresses(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mt == "application/gzip" || mt == "application/zip" {
+		return false
+	}
+	if len(c.types) == 0 {
+		return true
+	}
+	for _, t := range c.types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok && strings.HasPrefix(mt, prefix+"/") || t == mt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// identityCompressor is a Compressor of a made-up coding, writing the
+// bodies as is
+type identityCompressor struct{}
+
+func (identityCompressor) Encoding() string { return "x-identity" }
+
+func (identityCompressor) NewWriter(w io.Writer) io.WriteCloser { return nopCloser{w} }
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestNegotiateEncoding(t *testing.T) {
+	c := newCompression(Compression{}, []Compressor{identityCompressor{}})
+	for accept, want := range map[string]string{
+		"":                             "",
+		"gzip":                         "gzip",
+		"gzip;q=0":                     "",
+		"deflate":                      "",
+		"*":                            "x-identity",
+		"gzip, x-identity":             "x-identity",
+		"gzip, x-identity;q=0.5":       "gzip",
+		"GZIP ; q=0.8, br":             "gzip",
+		"x-identity;q=0, *;q=0.1":      "gzip",
+		"gzip;q=nope, x-identity;q=0":  "",
+		"x-identity;q=1, gzip;q=1.0":   "x-identity",
+		"br;q=1, gzip;q=0.1, identity": "gzip",
+	} {
+		got := ""
+		if cp := c.negotiate(accept); cp != nil {
+			got = cp.Encoding()
+		}
+		if got != want {
+			t.Errorf("Accept-Encoding %q negotiated %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	createUser(t, h, "Ada")
+	if w := do(h, http.MethodGet, "/users", "", "Accept-Encoding", "gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("a small body was compressed: %v", w.Header())
+	}
+	for i := 0; i < 20; i++ {
+		createUser(t, h, fmt.Sprintf("User %d %s", i, strings.Repeat("x", 40)))
+	}
+
+	w := do(h, http.MethodGet, "/users", "", "Accept-Encoding", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || !slices.Contains(w.Header().Values("Vary"), "Accept-Encoding") {
+		t.Fatalf("a large body: %v, want it gzipped", w.Header())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil || !strings.Contains(string(body), "Ada") {
+		t.Errorf("gunzipped %q, %v", body, err)
+	}
+	if w := do(h, http.MethodGet, "/users", ""); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("compressed for a client accepting no coding: %v", w.Header())
+	}
+
+	// a min size of 0 compresses every body
+	cfg := DefaultConfig()
+	cfg.Compression.MinSize = 0
+	h, _ = newTestServer(t, cfg)
+	createUser(t, h, "Ada")
+	if w := do(h, http.MethodGet, "/users", "", "Accept-Encoding", "gzip"); w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("a small body with a min size of 0: %v, want it gzipped", w.Header())
+	}
+
+	// the media types not listed are sent as is
+	cfg = DefaultConfig()
+	cfg.Compression.ContentTypes = []string{"text/*"}
+	h, _ = newTestServer(t, cfg)
+	for i := 0; i < 20; i++ {
+		createUser(t, h, fmt.Sprintf("User %d %s", i, strings.Repeat("x", 40)))
+	}
+	if w := do(h, http.MethodGet, "/users", "", "Accept-Encoding", "gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("compressed JSON when compressing text/* only: %v", w.Header())
+	}
+}
+
+func TestCompressor(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig(), WithCompressor(identityCompressor{}))
+	for i := 0; i < 20; i++ {
+		createUser(t, h, fmt.Sprintf("User %d %s", i, strings.Repeat("x", 40)))
+	}
+	w := do(h, http.MethodGet, "/users", "", "Accept-Encoding", "gzip, x-identity")
+	if w.Header().Get("Content-Encoding") != "x-identity" || !strings.Contains(w.Body.String(), "User 19") {
+		t.Errorf("compressed as %q, want x-identity", w.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// bounds and tuning of the adaptive concurrency limit
+const (
+	initialConcurrency = 20
+	minConcurrency     = 4
+	maxConcurrency     = 1000
+	// rttTolerance is how much slower than usual requests may get
+	// before the limit shrinks
+	rttTolerance = 2.0
+	// the weights of a new sample in the recent latency and in the
+	// usual one, which follows the changes of the baseline slowly
+	shortSmoothing = 0.1
+	longSmoothing  = 0.01
+)
+
+// limiter caps the requests in flight, adapting the cap to the latency
+// observed: while requests are about as fast as usual the limit grows
+// by its square root, the queue it allows, and as they slow down it
+// shrinks in proportion, shedding the load before the store degrades.
+// This is the gradient algorithm of Netflix's concurrency-limits.
+type limiter struct {
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	shortRTT float64 // recent latency, in seconds
+	longRTT  float64 // usual latency, in seconds
+}
+
+func newLimiter() *limiter {
+	return &limiter{limit: initialConcurrency}
+}
+
+// acquire takes a slot, failing when the limit is reached
+func (l *limiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= int(l.limit) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// release frees a slot, adapting the limit to the latency of the request
+func (l *limiter) release(rtt time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+
+	sample := rtt.Seconds()
+	if sample <= 0 {
+		return
+	}
+	if l.longRTT == 0 {
+		l.shortRTT, l.longRTT = sample, sample
+	} else {
+		l.shortRTT += shortSmoothing * (sample - l.shortRTT)
+		l.longRTT += longSmoothing * (sample - l.longRTT)
+	}
+
+	gradient := math.Max(0.5, math.Min(1, rttTolerance*l.longRTT/l.shortRTT))
+	next := l.limit*gradient + math.Sqrt(l.limit)
+	if next > l.limit && float64(l.inflight) < l.limit/2 {
+		return // too few requests to know whether more would be served as fast
+	}
+	// move gradually, so a single sample can't swing the limit
+	l.limit = math.Max(minConcurrency, math.Min(maxConcurrency, 0.8*l.limit+0.2*next))
+}
+
+// current returns the limit
+func (l *limiter) current() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return math.Floor(l.limit)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// saturate takes every slot of l, returning how many it got
+func saturate(l *limiter) int {
+	n := 0
+	for l.acquire() {
+		n++
+	}
+	return n
+}
+
+// releaseAll frees n slots of l, the requests having taken rtt
+func releaseAll(l *limiter, n int, rtt time.Duration) {
+	for i := 0; i < n; i++ {
+		l.release(rtt)
+	}
+}
+
+func TestLimiterSheds(t *testing.T) {
+	l := newLimiter()
+	if n := saturate(l); n != initialConcurrency {
+		t.Fatalf("acquired %d slots, want %d", n, initialConcurrency)
+	}
+	l.release(0)
+	if !l.acquire() {
+		t.Error("no slot after a release")
+	}
+}
+
+func TestLimiterAdapts(t *testing.T) {
+	l := newLimiter()
+	// a saturated server answering as fast as usual takes more load
+	for i := 0; i < 20; i++ {
+		releaseAll(l, saturate(l), 10*time.Millisecond)
+	}
+	grown := l.current()
+	if grown <= initialConcurrency {
+		t.Fatalf("limit %v, want it grown past %d", grown, initialConcurrency)
+	}
+
+	// then slowing down sheds the load, before the slowness becomes the
+	// usual latency
+	saturate(l)
+	releaseAll(l, 50, time.Second)
+	if got := l.current(); got > grown/2 {
+		t.Errorf("limit %v after slowing down, want it at most halved from %v", got, grown)
+	}
+}
+
+func TestLimiterIdle(t *testing.T) {
+	l := newLimiter()
+	for i := 0; i < 100; i++ {
+		l.acquire()
+		l.release(10 * time.Millisecond)
+	}
+	if got := l.current(); got != initialConcurrency {
+		t.Errorf("limit %v with one request at a time, want it kept at %d", got, initialConcurrency)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+// maxPolicyVersion bounds the policy versions told by the clients, in
+// bytes
+const maxPolicyVersion = 100
+
+// ConsentPolicy makes the users accept the latest version of the terms
+// of service before some operations on them
+type ConsentPolicy struct {
+	// PolicyVersion is the latest version of the terms of service, as
+	// 2024-06
+	PolicyVersion string
+	// Routes are the routes refused with 403 until the user they act on
+	// accepted PolicyVersion, by "METHOD /path" as in
+	// "POST /users/{id}/activate", among the routes of a user
+	Routes []string
+}
+
+func (p ConsentPolicy) validate() error {
+	if len(p.Routes) == 0 {
+		return nil
+	}
+	if p.PolicyVersion == "" {
+		return fmt.Errorf("consent routes need a policy version")
+	}
+	gated := map[string]bool{}
+	for _, rt := range (&userHandler{}).routes() {
+		if strings.Contains(rt.path, "{id}") && !strings.HasSuffix(rt.path, "/consents") {
+			gated[rt.method+" "+rt.path] = true
+		}
+	}
+	for _, rt := range p.Routes {
+		if !gated[rt] {
+			return fmt.Errorf(`invalid consent route %q: expected a route of a user, as "PUT /users/{id}"`, rt)
+		}
+	}
+	return nil
+}
+
+// requireConsent wraps the handlers of the routes of the consent
+// policy, refusing them until the user accepted its latest version
+func (h *userHandler) requireConsent(routes []route) []route {
+	gated := map[string]bool{}
+	for _, rt := range h.consent.Routes {
+		gated[rt] = true
+	}
+	for i, rt := range routes {
+		if gated[rt.method+" "+rt.path] {
+			routes[i].handle = h.consented(rt.handle)
+		}
+	}
+	return routes
+}
+
+// consented answers 403 unless the user of the request accepted the
+// latest version of the terms of service. The users not found are left
+// to next, answering 404.
+func (h *userHandler) consented(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, _, err := h.store.Get(r.Context(), pathParam(r, "id"), store.Strong)
+		if err == nil && !accepted(u, h.consent.PolicyVersion) {
+			writeError(w, r, http.StatusForbidden, codeConsentRequired,
+				"the user must accept the terms of service "+h.consent.PolicyVersion,
+				map[string]string{"policy_version": h.consent.PolicyVersion})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// accepted tells whether u accepted the version of the terms of service
+func accepted(u store.User, version string) bool {
+	for _, c := range u.Consents {
+		if c.PolicyVersion == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Consent records the acceptance of the terms of service by a user,
+// with the address of the client, the body telling the version
+// accepted, as {"policy_version": "2024-06"}, the latest one unless told
+func (h *userHandler) Consent(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		PolicyVersion string `json:"policy_version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		badRequest(w, r)
+		return
+	}
+	if body.PolicyVersion == "" {
+		body.PolicyVersion = h.consent.PolicyVersion
+	}
+	if body.PolicyVersion == "" {
+		invalid(w, r, "policy_version: required")
+		return
+	}
+	if len(body.PolicyVersion) > maxPolicyVersion {
+		invalid(w, r, "policy_version: too long")
+		return
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	c := store.Consent{PolicyVersion: body.PolicyVersion, AcceptedAt: timestamp.New(h.clock.Now()), IP: ip}
+
+	id := pathParam(r, "id")
+	if err := h.locks.check(id, r.Header.Get("X-Lock-Token")); err != nil {
+		locked(w, r)
+		return
+	}
+	u, rev, err := h.modify(r, id, events.UserUpdated, func(u *store.User) bool {
+		// the whole history is kept, as the record of compliance
+		u.Consents = append(u.Consents, c)
+		return true
+	})
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	setRev(w, rev)
+	w.Header().Set("ETag", versionTag(u.Version))
+
+	jsonBytes, err := json.Marshal(c)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+}
+
+// Consents lists the consents of a user, oldest first, telling whether
+// the latest version of the terms of service is accepted
+func (h *userHandler) Consents(w http.ResponseWriter, r *http.Request) {
+	rc, ok := consistency(w, r)
+	if !ok {
+		return
+	}
+	u, rev, err := h.store.Get(r.Context(), pathParam(r, "id"), rc)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if !visible(w, r, u) {
+		return
+	}
+	setRev(w, rev)
+	resp := struct {
+		PolicyVersion string          `json:"policy_version,omitempty"`
+		Accepted      bool            `json:"accepted"`
+		Consents      []store.Consent `json:"consents"`
+	}{h.consent.PolicyVersion, h.consent.PolicyVersion == "" || accepted(u, h.consent.PolicyVersion), u.Consents}
+	if resp.Consents == nil {
+		resp.Consents = []store.Consent{}
+	}
+
+	jsonBytes, err := json.Marshal(resp)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestConsents(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Consent = ConsentPolicy{PolicyVersion: "2024-06", Routes: []string{"POST /users/{id}/activate", "PUT /users/{id}"}}
+	h, _ := newTestServer(t, cfg)
+	u := createUser(t, h, "Ada")
+
+	// the routes of the policy are refused until the latest version is
+	// accepted, the others not
+	w := do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada L."}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeConsentRequired) {
+		t.Fatalf("replacing before consenting: %d %s, want 403", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/users/"+u.ID+"/deactivate", ""); w.Code != http.StatusOK {
+		t.Fatalf("deactivating: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/users/"+u.ID+"/consents", `{"policy_version":"2024-01"}`); w.Code != http.StatusCreated {
+		t.Fatalf("consenting to an older version: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/users/"+u.ID+"/activate", ""); w.Code != http.StatusForbidden {
+		t.Errorf("activating after consenting to an older version: %d %s, want 403", w.Code, w.Body)
+	}
+
+	w = do(h, http.MethodPost, "/users/"+u.ID+"/consents", "")
+	var c store.Consent
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil || w.Code != http.StatusCreated || c.PolicyVersion != "2024-06" || c.IP != "192.0.2.1" {
+		t.Fatalf("consenting: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/users/"+u.ID+"/activate", ""); w.Code != http.StatusOK {
+		t.Errorf("activating: %d %s", w.Code, w.Body)
+	}
+	// writing the user keeps its consents
+	if w := do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada L.","consents":[]}`); w.Code != http.StatusOK {
+		t.Errorf("replacing: %d %s", w.Code, w.Body)
+	}
+
+	w = do(h, http.MethodGet, "/users/"+u.ID+"/consents", "")
+	var list struct {
+		Accepted bool            `json:"accepted"`
+		Consents []store.Consent `json:"consents"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || !list.Accepted || len(list.Consents) != 2 {
+		t.Errorf("consents: %d %s, want both, the latest accepted", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/users/nope/consents", ""); w.Code != http.StatusNotFound {
+		t.Errorf("consenting for no user: %d, want 404", w.Code)
+	}
+}
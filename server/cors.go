@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS lets the browsers call the API from the pages of other origins
+// (Cross-Origin Resource Sharing)
+type CORS struct {
+	// AllowedOrigins are the origins allowed, as https://app.example.com,
+	// a *. allowing the subdomains of a domain, as
+	// https://*.example.com, and "*" any origin. CORS is disabled when
+	// empty.
+	AllowedOrigins []string
+	// AllowedMethods are the methods allowed, DefaultCORS.AllowedMethods
+	// unless set
+	AllowedMethods []string
+	// AllowedHeaders are the request headers allowed besides the simple
+	// ones, DefaultCORS.AllowedHeaders unless set
+	AllowedHeaders []string
+	// AllowCredentials lets the browsers send their cookies and the
+	// Authorization header, which needs the origins to be listed
+	AllowCredentials bool
+	// MaxAge is how long the browsers cache the answers to their
+	// preflight requests, DefaultCORS.MaxAge unless set
+	MaxAge time.Duration
+}
+
+// DefaultCORS has the methods and headers of the routes
+var DefaultCORS = CORS{
+	AllowedMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+	AllowedHeaders: []string{"API-Version", "Authorization", "Content-Type", "If-Match", "If-None-Match", "X-API-Key",
+		"X-Lock-Token", "X-Read-Consistency", "X-Request-Id", "X-Timezone"},
+	MaxAge: 10 * time.Minute,
+}
+
+// corsExposed are the response headers of the API the scripts may read
+var corsExposed = strings.Join([]string{"API-Version", "Content-Disposition", "Content-Language", "ETag", "Location",
+	"Retry-After", "X-Collection-Rev", "X-JWS-Signature", "X-Query-Cost", "X-Quota-Records-Limit",
+	"X-Quota-Records-Remaining", "X-Quota-Requests-Limit", "X-Quota-Requests-Remaining", "X-Quota-Reset",
+	"X-Read-Consistency", "X-Request-Id"}, ", ")
+
+func (c CORS) validate() error {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				return errors.New("invalid CORS: the credentials can't be allowed to any origin")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(o, "*.", "", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("invalid CORS origin %q: expected as in https://app.example.com or https://*.example.com", o)
+		}
+	}
+	if c.MaxAge < 0 {
+		return errors.New("invalid CORS: negative max age")
+	}
+	return nil
+}
+
+// AllowCORS answers the preflight requests of the allowed origins and
+// lets the browsers read the responses of the others. The requests of
+// other origins are served without CORS headers, the browsers keeping
+// their pages from reading the responses.
+func AllowCORS(c CORS) Middleware {
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = DefaultCORS.AllowedMethods
+	}
+	if len(c.AllowedHeaders) == 0 {
+		c.AllowedHeaders = DefaultCORS.AllowedHeaders
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = DefaultCORS.MaxAge
+	}
+	methods := strings.Join(c.AllowedMethods, ", ")
+	headers := strings.Join(c.AllowedHeaders, ", ")
+	maxAge := strconv.Itoa(int(c.MaxAge.Seconds()))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin == "" || !c.allowed(origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if c.AllowedOrigins[0] == "*" && len(c.AllowedOrigins) == 1 {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if c.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+				w.Header().Set("Access-Control-Expose-Headers", corsExposed)
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// allowed tells whether the pages of origin may call the API
+func (c CORS) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range c.AllowedOrigins {
+		o = strings.ToLower(o)
+		if o == "*" || o == origin {
+			return true
+		}
+		// https://*.example.com allows https://app.example.com
+		if prefix, domain, ok := strings.Cut(o, "*."); ok {
+			if rest, ok := strings.CutPrefix(origin, prefix); ok && strings.HasSuffix(rest, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CORS = CORS{AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"}}
+	h, _ := newTestServer(t, cfg)
+
+	preflight := []string{"Origin", "https://app.example.com", "Access-Control-Request-Method", http.MethodPut}
+	w := do(h, http.MethodOptions, "/users/u1", "", preflight...)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Errorf("preflight of an allowed origin: %d %v", w.Code, w.Header())
+	}
+	w = do(h, http.MethodGet, "/users", "", "Origin", "https://eu.example.org")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://eu.example.org" ||
+		w.Header().Get("Access-Control-Expose-Headers") == "" {
+		t.Errorf("request of an allowed subdomain: %d %v", w.Code, w.Header())
+	}
+
+	for _, origin := range []string{"https://evil.example.com", "http://app.example.com", "https://example.org.evil.com"} {
+		for _, headers := range [][]string{
+			{"Origin", origin},
+			{"Origin", origin, "Access-Control-Request-Method", http.MethodPut},
+		} {
+			method := http.MethodGet
+			if len(headers) > 2 {
+				method = http.MethodOptions
+			}
+			w := do(h, method, "/users", "", headers...)
+			for name := range w.Header() {
+				if strings.HasPrefix(name, "Access-Control-") {
+					t.Errorf("%s from %s: %s header, want none", method, origin, name)
+				}
+			}
+		}
+	}
+}
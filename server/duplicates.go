@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+	"github.com/santisdev/go-restapi.git/wire"
+)
+
+// emailKey is the metadata key holding the email of a user
+const emailKey = "email"
+
+// reasons users are reported as duplicates
+const (
+	sameEmail   = "same_email"
+	sameName    = "same_name"
+	similarName = "similar_name"
+)
+
+// duplicate is a pair of users likely to be the same person. Exact
+// duplicates share their email.
+type duplicate struct {
+	// IDs are those of the users, the first created first
+	IDs    [2]string `json:"ids"`
+	Reason string    `json:"reason"`
+	Exact  bool      `json:"exact"`
+	// Merged is set when the pair was merged automatically
+	Merged bool `json:"merged,omitempty"`
+}
+
+// duplicatesReport is the result of a duplicate scan
+type duplicatesReport struct {
+	ScannedAt  timestamp.Time `json:"scanned_at"`
+	Rev        uint64         `json:"rev"`
+	Users      int            `json:"users"`
+	Candidates []duplicate    `json:"candidates"`
+}
+
+// dedup finds the likely duplicate users, periodically when scheduled.
+// The scheduled scans merge the exact duplicates when autoMerge is set.
+type dedup struct {
+	*deps
+	locks     *lockManager
+	autoMerge bool
+
+	mu     sync.Mutex
+	report *duplicatesReport // of the last scan, nil before the first one
+}
+
+// run scans the users every interval until ctx is done
+func (d *dedup) run(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.clock.After(interval):
+		}
+		if _, err := d.scan(ctx, d.autoMerge); err != nil {
+			d.logger.ErrorContext(ctx, "scanning for duplicates", "err", err)
+		}
+	}
+}
+
+// last returns the report of the last scan, scanning now if none ran yet
+func (d *dedup) last(ctx context.Context) (duplicatesReport, error) {
+	d.mu.Lock()
+	report := d.report
+	d.mu.Unlock()
+	if report != nil {
+		return *report, nil
+	}
+	return d.scan(ctx, false)
+}
+
+// scan finds the likely duplicates among the active users, merging the
+// exact ones when merge is set. Users are compared by email, then by
+// name within blocks of users whose names start alike, keeping the scan
+// far from quadratic on large stores.
+func (d *dedup) scan(ctx context.Context, merge bool) (duplicatesReport, error) {
+	users, rev, err := d.store.List(ctx, store.Query{}, store.Strong)
+	if err != nil {
+		return duplicatesReport{}, err
+	}
+	report := duplicatesReport{ScannedAt: timestamp.New(d.clock.Now().UTC()), Rev: rev, Candidates: []duplicate{}}
+	byEmail := map[string][]store.User{}
+	byBlock := map[string][]store.User{}
+	for _, u := range users {
+		if !u.Active || u.MergedInto != "" {
+			continue
+		}
+		report.Users++
+		if email, err := wire.Parse[wire.Email](u.Metadata[emailKey]); err == nil {
+			byEmail[string(email)] = append(byEmail[string(email)], u)
+		}
+		if name := normalizeName(u.Name); name != "" {
+			r, _ := utf8.DecodeRuneInString(name)
+			byBlock[string(r)] = append(byBlock[string(r)], u)
+		}
+	}
+
+	seen := map[[2]string]bool{}
+	byID := map[string]store.User{}
+	add := func(a, b store.User, reason string, exact bool) {
+		if b.CreatedBefore(a) {
+			a, b = b, a
+		}
+		ids := [2]string{a.ID, b.ID}
+		if !seen[ids] {
+			seen[ids] = true
+			byID[a.ID], byID[b.ID] = a, b
+			report.Candidates = append(report.Candidates, duplicate{IDs: ids, Reason: reason, Exact: exact})
+		}
+	}
+	for _, group := range byEmail {
+		for i := range group {
+			for j := i + 1; j < len(group); j++ {
+				add(group[i], group[j], sameEmail, true)
+			}
+		}
+	}
+	for _, group := range byBlock {
+		for i := range group {
+			for j := i + 1; j < len(group); j++ {
+				a, b := normalizeName(group[i].Name), normalizeName(group[j].Name)
+				switch {
+				case a == b:
+					add(group[i], group[j], sameName, false)
+				case similarNames(a, b):
+					add(group[i], group[j], similarName, false)
+				}
+			}
+		}
+	}
+	sort.Slice(report.Candidates, func(i, j int) bool {
+		a, b := report.Candidates[i].IDs, report.Candidates[j].IDs
+		if a[0] != b[0] {
+			return byID[a[0]].CreatedBefore(byID[b[0]])
+		}
+		return byID[a[1]].CreatedBefore(byID[b[1]])
+	})
+
+	if merge {
+		d.mergeExact(ctx, report.Candidates)
+	}
+	d.mu.Lock()
+	d.report = &report
+	d.mu.Unlock()
+	d.logger.InfoContext(ctx, "duplicates scanned", "users", report.Users, "candidates", len(report.Candidates))
+	return report, nil
+}
+
+// mergeExact merges the exact duplicates, the newest user of each pair
+// into the oldest, skipping the users locked for editing
+func (d *dedup) mergeExact(ctx context.Context, candidates []duplicate) {
+	prefer := map[string]string{"name": preferTarget, "metadata": preferTarget, "external_ids": preferTarget}
+	for i, c := range candidates {
+		if !c.Exact || d.locks.check(c.IDs[0], "") != nil || d.locks.check(c.IDs[1], "") != nil {
+			continue
+		}
+		_, _, err := d.merge(ctx, c.IDs[0], c.IDs[1], prefer)
+		if err != nil {
+			d.logger.WarnContext(ctx, "merging duplicates", "target", c.IDs[0], "source", c.IDs[1], "err", err)
+			continue
+		}
+		candidates[i].Merged = true
+	}
+}
+
+// Duplicates reports the likely duplicate users found by the last scan,
+// or by a new one when refresh=true is given. Only the scheduled scans
+// merge users.
+func (h *adminHandler) Duplicates(w http.ResponseWriter, r *http.Request) {
+	var report duplicatesReport
+	var err error
+	if r.URL.Query().Get("refresh") == "true" {
+		report, err = h.dedup.scan(r.Context(), false)
+	} else {
+		report, err = h.dedup.last(r.Context())
+	}
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	report.ScannedAt = localTime(r, report.ScannedAt)
+	jsonBytes, err := json.Marshal(report)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// normalizeName lowercases name and collapses its spaces
+func normalizeName(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// similarNames reports whether a and b are within an edit distance of
+// one per five characters, catching typos and transliterations
+func similarNames(a, b string) bool {
+	ra, rb := []rune(a), []rune(b)
+	limit := max(len(ra), len(rb)) / 5
+	if limit == 0 || abs(len(ra)-len(rb)) > limit {
+		return false
+	}
+	return editDistance(ra, rb) <= limit
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/santisdev/go-restapi.git/idgen"
+)
+
+// error codes, telling the clients why a request failed more precisely
+// than its status
+const (
+	codeBadRequest         = "bad_request"
+	codeUnauthorized       = "unauthorized"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeRouteNotFound      = "route_not_found"
+	codeUserNotFound       = "user_not_found"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeConflict           = "conflict"
+	codeExternalIDInUse    = "external_id_in_use"
+	codePreconditionFailed = "precondition_failed"
+	codeVersionConflict    = "version_conflict"
+	codeVersionRequired    = "version_required"
+	codeFilterTooLarge     = "filter_too_large"
+	codeInvalid            = "invalid_request"
+	codePolicyViolation    = "policy_violation"
+	codeLocked             = "locked"
+	codeQueryTooCostly     = "query_too_costly"
+	codeRateLimited        = "rate_limited"
+	codeQuotaExceeded      = "quota_exceeded"
+	codeUnknownVersion     = "unknown_api_version"
+	codeInvitationGone     = "invitation_gone"
+	codeConsentRequired    = "consent_required"
+	codeLegalHold          = "legal_hold"
+	codeChangesGone        = "changes_gone"
+	codeInternal           = "internal_error"
+	codeUnavailable        = "service_unavailable"
+)
+
+// ErrorResponse is the body of the error responses
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details are specific to the code, as the invalid fields of an
+	// invalid_request
+	Details any `json:"details,omitempty"`
+	// RequestID is the X-Request-Id of the request, to quote when
+	// reporting the error
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeError answers with status and an ErrorResponse
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, details any) {
+	jsonBytes, _ := json.Marshal(ErrorResponse{code, message, details, requestID(r)})
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+type requestIDKey struct{}
+
+// requestIDRe matches the request ids taken from the clients, so they
+// can't inject anything in the logs or responses
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID identifies r by the X-Request-Id it carries, or a new
+// one, echoed in the X-Request-Id of the response. The requests served
+// on behalf of another keep its id.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := requestID(r)
+	if id == "" {
+		if id = r.Header.Get("X-Request-Id"); !requestIDRe.MatchString(id) {
+			id = idgen.Random{}.NewID()
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+	}
+	w.Header().Set("X-Request-Id", id)
+	return r
+}
+
+// requestID returns the id of r, empty outside of the router
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/santisdev/go-restapi.git/events"
+)
+
+// payloadEncoders convert the data of the events to the payloads of the
+// versions other than the current one, keyed by versioned type, while
+// both are emitted. The current versions take the data as is.
+var payloadEncoders = map[string]func(data any) any{}
+
+// EventSchemas lists the schemas of every version of the events,
+// optionally of a single type given by ?type=
+func (h *systemHandler) EventSchemas(w http.ResponseWriter, r *http.Request) {
+	typ := r.URL.Query().Get("type")
+	schemas := []events.Schema{}
+	for _, s := range events.Schemas {
+		if typ == "" || s.Type == typ {
+			schemas = append(schemas, s)
+		}
+	}
+	jsonBytes, err := json.Marshal(schemas)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
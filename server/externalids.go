@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"unicode/utf8"
+)
+
+const (
+	maxExternalSystems = 16
+	maxExternalIDLen   = 256 // in bytes
+)
+
+var (
+	externalSystemRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+)
+
+// checkExternalIDs checks the external ids of a user are well formed.
+// Their uniqueness is enforced by the store.
+func checkExternalIDs(ids map[string]string) error {
+	if len(ids) > maxExternalSystems {
+		return fmt.Errorf("too many external systems: at most %d are allowed", maxExternalSystems)
+	}
+	for system, id := range ids {
+		if !externalSystemRe.MatchString(system) {
+			return fmt.Errorf("invalid external system %q: systems are up to 64 lowercase letters, digits or _.- characters", system)
+		}
+		if id == "" || len(id) > maxExternalIDLen || !utf8.ValidString(id) {
+			return fmt.Errorf("invalid id for external system %q: ids are up to %d bytes of UTF-8", system, maxExternalIDLen)
+		}
+	}
+	return nil
+}
+
+// ByExternalID returns the user known by an id in an external system
+func (h *userHandler) ByExternalID(w http.ResponseWriter, r *http.Request) {
+	rc, ok := consistency(w, r)
+	if !ok {
+		return
+	}
+	u, rev, err := h.store.GetByExternalID(r.Context(), pathParam(r, "system"), pathParam(r, "id"), rc)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if !visible(w, r, u) {
+		return
+	}
+	setRev(w, rev)
+	if notModified(w, r, versionTag(u.Version)) {
+		return
+	}
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func duplicateExternalID(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusConflict, codeExternalIDInUse, "external id already in use", nil)
+}
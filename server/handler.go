@@ -0,0 +1,954 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+	"github.com/santisdev/go-restapi.git/validate"
+)
+
+const (
+	maxModifyAttempts = 5 // of read-modify-write cycles losing races
+
+	defaultWait = 30 * time.Second // long-polling wait when none is given
+	maxWait     = 60 * time.Second
+	retryAfter  = 5 * time.Second // advised to clients when the store is busy
+)
+
+// routes is the route table of the user endpoints
+func (h *userHandler) routes() []route {
+	return h.requireConsent([]route{
+		{http.MethodGet, "/users", "List users", scopeRead, rateRead, policyDynamic, h.List},
+		{http.MethodGet, "/users/changes", "Wait for changes", scopeRead, ratePoll, policyDynamic, h.Changes},
+		{http.MethodGet, "/users/{id}", "Get a user", scopeRead, rateRead, policyDynamic, h.Get},
+		{http.MethodGet, "/users/by-external-id/{system}/{id...}", "Get a user by its id in an external system", scopeRead, rateRead, policyDynamic, h.ByExternalID},
+		{http.MethodPost, "/users", "Create a user", scopeWrite, rateWrite, policyDynamic, h.Create},
+		{http.MethodPut, "/users/{id}", "Replace a user", scopeWrite, rateWrite, policyDynamic, h.Update},
+		{http.MethodPatch, "/users/{id}", "Update some fields of a user", scopeWrite, rateWrite, policyDynamic, h.Patch},
+		{http.MethodDelete, "/users/{id}", "Delete a user", scopeWrite, rateWrite, policyDynamic, h.Delete},
+		{http.MethodPost, "/users/{id}/lock", "Lock a user for editing", scopeWrite, rateWrite, policyDynamic, h.Lock},
+		{http.MethodDelete, "/users/{id}/lock", "Unlock a user", scopeWrite, rateWrite, policyDynamic, h.Unlock},
+		{http.MethodPost, "/users/tags", "Add and remove tags on several users", scopeWrite, rateWrite, policyDynamic, h.BulkTags},
+		{http.MethodPost, "/users/{id}/activate", "Reactivate a user", scopeWrite, rateWrite, policyDynamic, h.Activate},
+		{http.MethodPost, "/users/{id}/deactivate", "Deactivate a user", scopeWrite, rateWrite, policyDynamic, h.Deactivate},
+		{http.MethodPost, "/users/{id}/merge", "Merge another user into a user", scopeWrite, rateWrite, policyDynamic, h.Merge},
+		{http.MethodPost, "/users/{id}/quarantine", "Quarantine a user for abuse triage", scopeAdmin, rateWrite, policyDynamic, h.Quarantine},
+		{http.MethodDelete, "/users/{id}/quarantine", "Release a quarantined user", scopeAdmin, rateWrite, policyDynamic, h.Release},
+		{http.MethodPost, "/users/{id}/legal-hold", "Place a legal hold on a user", scopeAdmin, rateWrite, policyDynamic, h.PlaceHold},
+		{http.MethodDelete, "/users/{id}/legal-hold", "Release the legal hold of a user", scopeAdmin, rateWrite, policyDynamic, h.ReleaseHold},
+		{http.MethodPost, "/users/{id}/consents", "Record the acceptance of the terms of service", scopeWrite, rateWrite, policyDynamic, h.Consent},
+		{http.MethodGet, "/users/{id}/consents", "List the consents of a user", scopeRead, rateRead, policyDynamic, h.Consents},
+	})
+}
+
+type userHandler struct {
+	*deps
+	locks     *lockManager
+	live      *atomic.Pointer[Live]
+	insights  *queryInsights
+	clientIDs bool // the legacy creation under the id of the body
+	limits    validate.Limits
+	filter    *contentFilter // nil unless filtering the content
+	consent   ConsentPolicy
+	holds     *legalHolds
+	// requireVersion refuses the writes not telling the version expected
+	requireVersion bool
+}
+
+func (h *userHandler) List(w http.ResponseWriter, r *http.Request) {
+	rc, ok := consistency(w, r)
+	if !ok {
+		return
+	}
+	yes, no := true, false
+	var status store.Query
+	switch r.URL.Query().Get("status") {
+	case "", "active":
+		status.Active = &yes
+	case "inactive":
+		status.Active = &no
+	case "all":
+	case "quarantined":
+		status.Quarantined = &yes
+	default:
+		badRequest(w, r)
+		return
+	}
+	// the quarantined users are hidden from the client, the listing of
+	// them being empty
+	none := false
+	if !seesQuarantined(r) {
+		none = status.Quarantined != nil
+		status.Quarantined = &no
+	}
+	odata, err := parseOData(r.URL.Query())
+	if err != nil {
+		invalid(w, r, err.Error())
+		return
+	}
+	skip, ok := offset(r)
+	if !ok {
+		badRequest(w, r)
+		return
+	}
+	order, err := parseSort(r.URL.Query().Get("sort"))
+	if err != nil {
+		invalid(w, r, err.Error())
+		return
+	}
+	var after *cursor
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		if after, err = parseCursor(v, order); err == nil && skip > 0 {
+			err = errors.New("cursor: exclusive with offset")
+		}
+		if err != nil {
+			invalid(w, r, err.Error())
+			return
+		}
+	}
+	md, err := metadataQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error(), nil)
+		return
+	}
+	q := store.Query{
+		Tag:      strings.ToLower(r.URL.Query().Get("tag")),
+		Metadata: md,
+	}
+	var filters store.And
+	if odata != nil && odata.filter != nil {
+		filters = append(filters, odata.filter)
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		filters = append(filters, store.Compare{Field: "name", Op: store.Contains, Value: name})
+	}
+	switch len(filters) {
+	case 0:
+	case 1:
+		q.Filter = filters[0]
+	default:
+		q.Filter = filters
+	}
+	est, ok := h.checkQueryCost(w, r, q)
+	if !ok {
+		return
+	}
+	// the store sorts and pages the users, in a stable order so the
+	// pages don't overlap, reading one more to tell whether another
+	// page follows. OData listings are paged by odata.write.
+	page := q
+	page.Active, page.Quarantined = status.Active, status.Quarantined
+	page.Sort = order.Sort
+	limit := pageLimit(r)
+	if odata == nil {
+		if after != nil {
+			page.After = after.user()
+		}
+		page.Limit = skip + limit + 1
+	}
+	if none {
+		page.Limit = 1 // for the revision
+	}
+	start := h.clock.Now()
+	users, rev, err := h.store.List(r.Context(), page, rc)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if none {
+		users = users[:0]
+	}
+	if est != nil {
+		h.insights.record(q, *est, h.clock.Now().Sub(start), h.clock.Now().UTC())
+	}
+	setRev(w, rev)
+	if notModified(w, r, `W/"`+strconv.FormatUint(rev, 10)+`"`) {
+		return
+	}
+	if odata != nil {
+		odata.top = limit
+		odata.write(w, r, users)
+		return
+	}
+	total := 0
+	if !none {
+		if total, err = h.count(r, page.Unpaged(), rc); err != nil {
+			storeError(w, r, err)
+			return
+		}
+	}
+	users = users[min(skip, len(users)):]
+	var next string
+	if limit < len(users) {
+		users = users[:limit]
+		if limit > 0 {
+			next = order.cursor(users[limit-1])
+		}
+	}
+	jsonBytes, err := json.Marshal(struct {
+		Rev        uint64       `json:"rev"`
+		Users      []store.User `json:"users"`
+		Total      int          `json:"total"`
+		NextCursor string       `json:"next_cursor,omitempty"`
+	}{rev, users, total, next})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// count counts the users q selects, listing them when the store can't
+// count them
+func (h *userHandler) count(r *http.Request, q store.Query, rc store.ReadConsistency) (int, error) {
+	if c, ok := unwrap(h.store).(store.Counter); ok {
+		return c.Count(r.Context(), q, rc)
+	}
+	users, _, err := h.store.List(r.Context(), q, rc)
+	return len(users), err
+}
+
+func (h *userHandler) Get(w http.ResponseWriter, r *http.Request) {
+	//Get the user id
+	id := pathParam(r, "id")
+	rc, ok := consistency(w, r)
+	if !ok {
+		return
+	}
+	u, rev, err := h.store.Get(r.Context(), id, rc)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if !visible(w, r, u) {
+		return
+	}
+	setRev(w, rev)
+	if notModified(w, r, versionTag(u.Version)) {
+		return
+	}
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Create creates a user under an id assigned by the server, answering
+// 201 with its location. With Config.ClientUserIDs the id of the body is
+// used instead, replacing any user having it.
+func (h *userHandler) Create(w http.ResponseWriter, r *http.Request) {
+	u := store.User{Active: true}
+	err := json.NewDecoder(r.Body).Decode(&u)
+	if err != nil {
+		badRequest(w, r)
+		return
+	}
+	u.Quarantine, u.Consents, u.LegalHold = nil, nil, nil
+	if !h.clientIDs && u.ID != "" {
+		invalidFields(w, r, "invalid user", validate.Errors{{Field: "id", Rule: "readonly",
+			Message: "is assigned by the server, replace a user with PUT /users/{id} instead"}})
+		return
+	}
+	if !validUser(w, r, &u, h.limits) || !moderated(w, r, h.filter, h.deps, &u) {
+		return
+	}
+	status := http.StatusOK
+	var cur *store.User // the user replaced, if any
+	if h.clientIDs {
+		if err := h.locks.check(u.ID, r.Header.Get("X-Lock-Token")); err != nil {
+			locked(w, r)
+			return
+		}
+		if cur, err = h.replaced(w, r, &u); err != nil {
+			return
+		}
+	} else {
+		u.ID = h.ids.NewID()
+		status = http.StatusCreated
+		w.Header().Set("Location", versionPrefix(r)+"/users/"+url.PathEscape(u.ID))
+	}
+	stampCreation(&u, cur, h.clock.Now())
+	stampDeactivation(&u, cur, h.clock.Now())
+	ctx := h.withUserEvent(r.Context(), events.UserCreated)
+	var rev uint64
+	if cur != nil {
+		u, rev, err = h.store.CompareAndSwap(ctx, u.ID, cur.Version, u)
+	} else {
+		u, rev, err = h.store.Create(ctx, u)
+	}
+	if err != nil {
+		w.Header().Del("Location")
+		storeError(w, r, err)
+		return
+	}
+	setRev(w, rev)
+	w.Header().Set("ETag", versionTag(u.Version))
+
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+
+}
+
+// replaced returns the user u replaces under the legacy creation, nil
+// when there's none, carrying over to u what only the routes of the
+// user change. It answers 409 when that user is held or hidden from the
+// client of r, returning an error.
+func (h *userHandler) replaced(w http.ResponseWriter, r *http.Request, u *store.User) (*store.User, error) {
+	cur, _, err := h.store.Get(r.Context(), u.ID, store.Strong)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return nil, nil
+	case err != nil:
+		storeError(w, r, err)
+		return nil, err
+	case hidden(r, cur):
+		conflict(w, r)
+		return nil, store.ErrConflict
+	}
+	if hold, tenant := h.holds.held(cur); hold != nil {
+		onHold(w, r, hold, tenant)
+		return nil, store.ErrConflict
+	}
+	keepQuarantine(u, cur)
+	u.Consents, u.LegalHold = cur.Consents, cur.LegalHold
+	return &cur, nil
+}
+
+// stampCreation sets when u was created: when cur was, if it is the
+// user u replaces, else now
+func stampCreation(u, cur *store.User, now time.Time) {
+	if cur != nil {
+		u.CreatedAt = cur.CreatedAt
+		return
+	}
+	t := timestamp.New(now.UTC())
+	u.CreatedAt = &t
+}
+
+// Update replaces a user. With the user ETag in If-Match the
+// replacement is conditional, failing with 412 when the user changed
+// since the client read it, and so it is with the version in the body,
+// failing with 409.
+func (h *userHandler) Update(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	pre, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
+	u := store.User{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil || (u.ID != "" && u.ID != id) {
+		badRequest(w, r)
+		return
+	}
+	if !pre.set && u.Version != 0 {
+		pre = precondition{version: u.Version, set: true, inBody: true}
+	}
+	if !h.versioned(w, r, pre) {
+		return
+	}
+	u.Quarantine, u.Consents, u.LegalHold = nil, nil, nil
+	if !validUser(w, r, &u, h.limits) || !moderated(w, r, h.filter, h.deps, &u) {
+		return
+	}
+	if err := h.locks.check(id, r.Header.Get("X-Lock-Token")); err != nil {
+		locked(w, r)
+		return
+	}
+
+	var rev uint64
+	var err error
+	if pre.set {
+		var cur store.User
+		if cur, _, err = h.store.Get(r.Context(), id, store.Strong); err == nil && hidden(r, cur) {
+			err = store.ErrNotFound
+		} else if err == nil {
+			stampCreation(&u, &cur, h.clock.Now())
+			keepQuarantine(&u, cur)
+			u.Consents, u.LegalHold = cur.Consents, cur.LegalHold
+			stampDeactivation(&u, &cur, h.clock.Now())
+			u, rev, err = h.store.CompareAndSwap(h.withUserEvent(r.Context(), events.UserUpdated), id, pre.version, u)
+		}
+	} else {
+		u, rev, err = h.modify(r, id, events.UserUpdated, func(cur *store.User) bool {
+			stampCreation(&u, cur, h.clock.Now())
+			keepQuarantine(&u, *cur)
+			u.Consents, u.LegalHold = cur.Consents, cur.LegalHold
+			stampDeactivation(&u, cur, h.clock.Now())
+			u.Version = cur.Version
+			*cur = u
+			return true
+		})
+	}
+	h.updated(w, r, u, rev, err, pre)
+}
+
+// Patch updates some fields of a user, the body being a JSON merge
+// patch (RFC 7396) of the user. As with Update, If-Match or the version
+// in the patch makes it conditional.
+func (h *userHandler) Patch(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	pre, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
+	var patch json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		badRequest(w, r)
+		return
+	}
+	var told struct {
+		Version *uint64 `json:"version"`
+	}
+	if json.Unmarshal(patch, &told) == nil && !pre.set && told.Version != nil && *told.Version != 0 {
+		pre = precondition{version: *told.Version, set: true, inBody: true}
+	}
+	if !h.versioned(w, r, pre) {
+		return
+	}
+	if err := h.locks.check(id, r.Header.Get("X-Lock-Token")); err != nil {
+		locked(w, r)
+		return
+	}
+
+	for i := 0; ; i++ {
+		cur, _, err := h.store.Get(r.Context(), id, store.Strong)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		if !visible(w, r, cur) {
+			return
+		}
+		if pre.set && cur.Version != pre.version {
+			h.updated(w, r, cur, 0, store.ErrConflict, pre)
+			return
+		}
+		u, err := patchUser(cur, patch)
+		if err != nil {
+			invalid(w, r, err.Error())
+			return
+		}
+		stampCreation(&u, &cur, h.clock.Now())
+		u.Quarantine, u.Consents, u.LegalHold = cur.Quarantine, cur.Consents, cur.LegalHold
+		stampDeactivation(&u, &cur, h.clock.Now())
+		if !validUser(w, r, &u, h.limits) || !moderated(w, r, h.filter, h.deps, &u) {
+			return
+		}
+		u, rev, err := h.store.CompareAndSwap(h.withUserEvent(r.Context(), events.UserUpdated), id, cur.Version, u)
+		if errors.Is(err, store.ErrConflict) && !pre.set && i < maxModifyAttempts-1 {
+			continue
+		}
+		h.updated(w, r, u, rev, err, pre)
+		return
+	}
+}
+
+// updated answers the update of a user with the user saved, or the
+// error saving it. Conflicts of conditional updates fail with the ETag
+// of the current version, with 412 for If-Match and 409 for the version
+// in the body.
+func (h *userHandler) updated(w http.ResponseWriter, r *http.Request, u store.User, rev uint64, err error, pre precondition) {
+	if errors.Is(err, store.ErrConflict) && pre.set {
+		w.Header().Set("ETag", versionTag(u.Version))
+		if pre.inBody {
+			versionConflict(w, r, u.Version)
+		} else {
+			preconditionFailed(w, r)
+		}
+		return
+	}
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	setRev(w, rev)
+	w.Header().Set("ETag", versionTag(u.Version))
+
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// precondition is the version a write expects the user to be at
+type precondition struct {
+	version uint64
+	// set tells a version is expected, the write being conditional
+	set bool
+	// inBody tells the version came in the body rather than If-Match
+	inBody bool
+	// any is If-Match: *, any version matching
+	any bool
+}
+
+// ifMatch reads the version the client expects the user to be at from
+// If-Match, answering 412 when it isn't an ETag of a version. The weak
+// tags, as those of the listings, never match. * matches any version,
+// the user having to exist.
+func ifMatch(w http.ResponseWriter, r *http.Request) (precondition, bool) {
+	v := strings.TrimSpace(r.Header.Get("If-Match"))
+	if v == "" {
+		return precondition{}, true
+	}
+	if v == "*" {
+		return precondition{any: true}, true
+	}
+	expected, err := strconv.ParseUint(strings.Trim(v, `"`), 10, 64)
+	if err != nil {
+		preconditionFailed(w, r)
+		return precondition{}, false
+	}
+	return precondition{version: expected, set: true}, true
+}
+
+// versioned answers 428 when the versions are required and the write
+// tells none, in If-Match or the body
+func (h *userHandler) versioned(w http.ResponseWriter, r *http.Request, pre precondition) bool {
+	if h.requireVersion && !pre.set && !pre.any {
+		writeError(w, r, http.StatusPreconditionRequired, codeVersionRequired,
+			"the version of the user is required, in If-Match or the body", nil)
+		return false
+	}
+	return true
+}
+
+// validUser normalizes u and checks it against the rules of
+// store.User and limits, normalizing its tags and checking its metadata
+// and external ids, and answers 422 listing the invalid fields
+func validUser(w http.ResponseWriter, r *http.Request, u *store.User, limits validate.Limits) bool {
+	normalizeUser(u)
+	var errs validate.Errors
+	if err := limits.Struct(u); err != nil {
+		errors.As(err, &errs)
+	}
+	var err error
+	if u.Tags, err = normalizeTags(u.Tags); err != nil {
+		errs = append(errs, validate.FieldError{Field: "tags", Rule: "format", Message: err.Error()})
+	}
+	if err := checkMetadata(u.Metadata); err != nil {
+		errs = append(errs, validate.FieldError{Field: "metadata", Rule: "format", Message: err.Error()})
+	}
+	if err := checkExternalIDs(u.ExternalIDs); err != nil {
+		errs = append(errs, validate.FieldError{Field: "external_ids", Rule: "format", Message: err.Error()})
+	}
+	if len(errs) > 0 {
+		invalidFields(w, r, "invalid user", errs)
+		return false
+	}
+	return true
+}
+
+// Delete deletes a user for good, where Deactivate keeps it. As with
+// Update, If-Match makes it conditional, failing with 412 when the user
+// changed since the client read it. The users under a legal hold, theirs
+// or their tenant's, answer 409.
+func (h *userHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	//Get the user id
+	id := pathParam(r, "id")
+	pre, ok := ifMatch(w, r)
+	if !ok || !h.versioned(w, r, pre) {
+		return
+	}
+	if err := h.locks.check(id, r.Header.Get("X-Lock-Token")); err != nil {
+		locked(w, r)
+		return
+	}
+
+	var u store.User
+	var rev uint64
+	for i := 0; ; i++ {
+		cur, _, err := h.store.Get(r.Context(), id, store.Strong)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		if !visible(w, r, cur) {
+			return
+		}
+		if hold, tenant := h.holds.held(cur); hold != nil {
+			onHold(w, r, hold, tenant)
+			return
+		}
+		if pre.set && cur.Version != pre.version {
+			w.Header().Set("ETag", versionTag(cur.Version))
+			preconditionFailed(w, r)
+			return
+		}
+		// deleting at the version checked, the hold can't be placed meanwhile
+		u, rev, err = h.store.CompareAndDelete(h.withUserEvent(r.Context(), events.UserDeleted), id, cur.Version)
+		if errors.Is(err, store.ErrConflict) && i < maxModifyAttempts-1 {
+			continue
+		}
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		break
+	}
+	setRev(w, rev)
+
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Changes long-polls the change feed: it answers as soon as there are
+// changes after the "since" revision, or with no changes once "wait" elapses.
+// It answers 410 when the feed no longer holds them all, so the client
+// lists the users again.
+func (h *userHandler) Changes(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since uint64
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			badRequest(w, r)
+			return
+		}
+	}
+	wait := defaultWait
+	if v := q.Get("wait"); v != "" {
+		var err error
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+			badRequest(w, r)
+			return
+		}
+		if wait > maxWait {
+			wait = maxWait
+		}
+	}
+
+	timeout := h.clock.After(wait)
+	changes, rev, changed, err := h.store.ChangesSince(r.Context(), since)
+poll:
+	for err == nil && len(changes) == 0 {
+		select {
+		case <-changed:
+			changes, rev, changed, err = h.store.ChangesSince(r.Context(), since)
+		case <-timeout:
+			break poll
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if errors.Is(err, store.ErrChangesGone) {
+		writeError(w, r, http.StatusGone, codeChangesGone, "changes since "+strconv.FormatUint(since, 10)+" no longer kept: list the users again", nil)
+		return
+	}
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+
+	if limit := pageLimit(r); len(changes) > limit {
+		// the client catches up from the last change of the page
+		changes = changes[:limit]
+		if limit > 0 {
+			rev = changes[limit-1].Rev
+		}
+	}
+	if changes, err = h.withoutHidden(r, changes); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	setRev(w, rev)
+	jsonBytes, err := json.Marshal(struct {
+		Rev     uint64         `json:"rev"`
+		Changes []store.Change `json:"changes"`
+	}{rev, changes})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Lock takes a lease on a user so that only the holder of the returned
+// token, sent back in the X-Lock-Token header, can modify it. Posting
+// again with the token renews the lease.
+func (h *userHandler) Lock(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	req := struct {
+		Owner string `json:"owner"`
+		TTL   string `json:"ttl"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			badRequest(w, r)
+			return
+		}
+	}
+	ttl := defaultLease
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			badRequest(w, r)
+			return
+		}
+		if ttl > maxLease {
+			ttl = maxLease
+		}
+	}
+	if !h.reachable(w, r, id) {
+		return
+	}
+
+	l, err := h.locks.acquire(id, req.Owner, r.Header.Get("X-Lock-Token"), ttl)
+	if errors.Is(err, errLocked) {
+		locked(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	l.ExpiresAt = localTime(r, l.ExpiresAt)
+	jsonBytes, err := json.Marshal(l)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Unlock releases the lease held with the X-Lock-Token header
+func (h *userHandler) Unlock(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	if !h.reachable(w, r, id) {
+		return
+	}
+	switch err := h.locks.release(id, r.Header.Get("X-Lock-Token")); {
+	case errors.Is(err, errNoLease):
+		notFound(w, r)
+	case errors.Is(err, errLocked):
+		locked(w, r)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Activate reactivates a deactivated user
+func (h *userHandler) Activate(w http.ResponseWriter, r *http.Request) {
+	h.setActive(w, r, pathParam(r, "id"), true)
+}
+
+// Deactivate deactivates a user: it stays readable by id but is hidden
+// from the default listing
+func (h *userHandler) Deactivate(w http.ResponseWriter, r *http.Request) {
+	h.setActive(w, r, pathParam(r, "id"), false)
+}
+
+func (h *userHandler) setActive(w http.ResponseWriter, r *http.Request, id string, active bool) {
+	if err := h.locks.check(id, r.Header.Get("X-Lock-Token")); err != nil {
+		locked(w, r)
+		return
+	}
+	typ := events.UserDeactivated
+	if active {
+		typ = events.UserActivated
+	}
+	u, rev, err := h.modify(r, id, typ, func(u *store.User) bool {
+		changed := u.Active != active
+		prev := *u
+		u.Active = active
+		stampDeactivation(u, &prev, h.clock.Now())
+		return changed
+	})
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	setRev(w, rev)
+	w.Header().Set("ETag", versionTag(u.Version))
+
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// modify applies fn to the current user with the given id and saves the
+// result with the event typ, if any, retrying when the user is changed
+// concurrently. fn reports whether it changed the user; when it didn't
+// nothing is saved. The users hidden from the client of r are not found.
+func (h *userHandler) modify(r *http.Request, id, typ string, fn func(u *store.User) bool) (store.User, uint64, error) {
+	ctx := r.Context()
+	if typ != "" {
+		ctx = h.withUserEvent(ctx, typ)
+	}
+	for i := 0; ; i++ {
+		u, rev, err := h.store.Get(ctx, id, store.Strong)
+		if err == nil && hidden(r, u) {
+			return store.User{}, 0, store.ErrNotFound
+		}
+		if err != nil || !fn(&u) {
+			return u, rev, err
+		}
+		saved, rev, err := h.store.CompareAndSwap(ctx, id, u.Version, u)
+		if !errors.Is(err, store.ErrConflict) || i == maxModifyAttempts-1 {
+			return saved, rev, err
+		}
+	}
+}
+
+// consistency reads the consistency requested by the client in the
+// X-Read-Consistency header, answering 400 when it is unknown
+func consistency(w http.ResponseWriter, r *http.Request) (store.ReadConsistency, bool) {
+	var rc store.ReadConsistency
+	switch strings.ToLower(r.Header.Get("X-Read-Consistency")) {
+	case "", "strong":
+		rc = store.Strong
+	case "eventual":
+		rc = store.Eventual
+	default:
+		badRequest(w, r)
+		return store.Strong, false
+	}
+	w.Header().Set("X-Read-Consistency", rc.String())
+	return rc, true
+}
+
+// setRev exposes the collection revision the response reflects
+func setRev(w http.ResponseWriter, rev uint64) {
+	w.Header().Set("X-Collection-Rev", strconv.FormatUint(rev, 10))
+}
+
+// versionTag is the ETag of a user at the given version
+func versionTag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// notModified sets the ETag of a read response and answers 304 when the
+// client copy, identified by If-None-Match, is still current. Listings
+// are tagged with the collection revision, so any change invalidates them.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if tag = strings.TrimSpace(tag); tag == etag || tag == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// storeError answers with the status matching an error of the store
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, store.ErrDuplicate) {
+		duplicateExternalID(w, r)
+		return
+	}
+	switch storeErrorStatus(err) {
+	case http.StatusNotFound:
+		userNotFound(w, r)
+	case http.StatusConflict:
+		conflict(w, r)
+	case http.StatusServiceUnavailable:
+		serviceUnavailable(w, r)
+	default:
+		internalServerError(w, r)
+	}
+}
+
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrConflict), errors.Is(err, store.ErrDuplicate):
+		return http.StatusConflict
+	case errors.Is(err, store.ErrBusy):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, codeNotFound, "not found", nil)
+}
+
+// userNotFound answers a request for a user that doesn't exist, so
+// clients can tell it from a route that doesn't
+func userNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, codeUserNotFound, "user not found", nil)
+}
+
+// methodNotAllowed answers a request whose method isn't served on its
+// path, the caller setting the Allow header
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed", nil)
+}
+
+func badRequest(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusBadRequest, codeBadRequest, "bad request", nil)
+}
+
+func locked(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusLocked, codeLocked, "locked", nil)
+}
+
+// invalid answers 422 with the reason the request was rejected
+func invalid(w http.ResponseWriter, r *http.Request, reason string) {
+	writeError(w, r, http.StatusUnprocessableEntity, codeInvalid, reason, nil)
+}
+
+// invalidFields answers 422 with the fields of the request breaking
+// their rules as details
+func invalidFields(w http.ResponseWriter, r *http.Request, reason string, errs validate.Errors) {
+	writeError(w, r, http.StatusUnprocessableEntity, codeInvalid, reason, errs)
+}
+
+func conflict(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusConflict, codeConflict, "conflict", nil)
+}
+
+func preconditionFailed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusPreconditionFailed, codePreconditionFailed, "precondition failed", nil)
+}
+
+// versionConflict answers 409 with the current version of a user the
+// write didn't expect
+func versionConflict(w http.ResponseWriter, r *http.Request, current uint64) {
+	writeError(w, r, http.StatusConflict, codeVersionConflict, "the user changed since the version told",
+		map[string]uint64{"current_version": current})
+}
+
+func serviceUnavailable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	writeError(w, r, http.StatusServiceUnavailable, codeUnavailable, "service unavailable", nil)
+}
+
+func internalServerError(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusInternalServerError, codeInternal, "internal server error", nil)
+}
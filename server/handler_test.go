@@ -0,0 +1,376 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/validate"
+)
+
+func TestCreateAndDeactivate(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	w := do(h, http.MethodPost, "/users", `{"name":"Ada"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var u store.User
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID == "" || u.Version != 1 || !u.Active {
+		t.Fatalf("created %+v, want an active user at version 1", u)
+	}
+	if got := w.Header().Get("Location"); got != "/v1/users/"+u.ID {
+		t.Errorf("Location %q, want /v1/users/%s", got, u.ID)
+	}
+	if w := do(h, http.MethodPost, "/users", `{"id":"42","name":"Grace"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("creating with an id: %d, want 422", w.Code)
+	}
+
+	w = do(h, http.MethodPost, "/users/"+u.ID+"/deactivate", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("deactivate: %d %s", w.Code, w.Body)
+	}
+	var got store.User
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Active || got.Version != 2 {
+		t.Errorf("deactivated %+v, want inactive at version 2", got)
+	}
+
+	w = do(h, http.MethodGet, "/users/"+u.ID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("get: %d %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("ETag"); got != `"2"` {
+		t.Errorf("ETag %s, want \"2\"", got)
+	}
+	if w := do(h, http.MethodGet, "/users", ""); strings.Contains(w.Body.String(), "Ada") {
+		t.Errorf("default listing %s shows the deactivated user", w.Body)
+	}
+	if w := do(h, http.MethodGet, "/users?status=inactive", ""); !strings.Contains(w.Body.String(), "Ada") {
+		t.Errorf("inactive listing %s misses the deactivated user", w.Body)
+	}
+}
+
+func TestInvalidFields(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	w := do(h, http.MethodPost, "/users", `{"name":" ","tags":["a b"]}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid user: %d %s, want 422", w.Code, w.Body)
+	}
+	var body struct {
+		Details validate.Errors `json:"details"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fe := range body.Details {
+		got = append(got, fe.Field+":"+fe.Rule)
+	}
+	if strings.Join(got, " ") != "name:required tags:format" {
+		t.Errorf("invalid fields %s, want every one of them", w.Body)
+	}
+
+	u := createUser(t, h, "Ada")
+	if w := do(h, http.MethodPatch, "/users/"+u.ID, `{"name":"`+strings.Repeat("a", 201)+`"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("patching a long name: %d, want 422", w.Code)
+	}
+}
+
+func TestUpdateIfMatch(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	u := createUser(t, h, "Ada")
+
+	w := do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada L."}`, "If-Match", `"1"`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("matching If-Match: %d %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("ETag"); got != `"2"` {
+		t.Errorf("ETag %s, want \"2\"", got)
+	}
+
+	// the version 1 is stale now
+	w = do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada K."}`, "If-Match", `"1"`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale If-Match: %d %s, want 412", w.Code, w.Body)
+	}
+	if got := w.Header().Get("ETag"); got != `"2"` {
+		t.Errorf("ETag of the conflict %s, want the current \"2\"", got)
+	}
+
+	w = do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada K."}`, "If-Match", "not-a-version")
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("malformed If-Match: %d, want 412", w.Code)
+	}
+
+	// without If-Match the replacement is unconditional
+	w = do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada K."}`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"3"` {
+		t.Errorf("unconditional PUT: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	bus := events.NewMemory()
+	published := recordedEvents(bus)
+	h := newEventsServer(t, store.NewMemory(nil), bus).Handler()
+	u := createUser(t, h, "Ada")
+	do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada L."}`)
+
+	w := do(h, http.MethodDelete, "/users/"+u.ID, "", "If-Match", `"1"`)
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("stale If-Match: %d %v, want 412 with the current ETag", w.Code, w.Header())
+	}
+	if w := do(h, http.MethodGet, "/users/"+u.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("the user after a stale delete: %d", w.Code)
+	}
+	if w := do(h, http.MethodDelete, "/users/"+u.ID, "", "If-Match", `"2"`); w.Code != http.StatusOK {
+		t.Fatalf("matching If-Match: %d %s", w.Code, w.Body)
+	}
+	if evs := published(); len(evs) != 3 || evs[2].Type != events.UserDeleted {
+		t.Errorf("events %+v, want the delete last", evs)
+	}
+	if w := do(h, http.MethodDelete, "/users/"+u.ID, "", "If-Match", `"2"`); w.Code != http.StatusNotFound {
+		t.Errorf("deleting again: %d, want 404", w.Code)
+	}
+}
+
+func TestVersionInBodyConflict(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	u := createUser(t, h, "Ada")
+	if w := do(h, http.MethodPatch, "/users/"+u.ID, `{"name":"Ada L.","version":1}`); w.Code != http.StatusOK {
+		t.Fatalf("patch at the current version: %d %s", w.Code, w.Body)
+	}
+
+	for _, tc := range []struct {
+		method, body string
+	}{
+		{http.MethodPatch, `{"name":"Ada K.","version":1}`},
+		{http.MethodPut, `{"name":"Ada K.","version":1}`},
+	} {
+		w := do(h, tc.method, "/users/"+u.ID, tc.body)
+		if w.Code != http.StatusConflict {
+			t.Fatalf("%s at a stale version: %d %s, want 409", tc.method, w.Code, w.Body)
+		}
+		var body struct {
+			Code    string            `json:"code"`
+			Details map[string]uint64 `json:"details"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != codeVersionConflict || body.Details["current_version"] != 2 {
+			t.Errorf("%s: %s, want %s with the current version 2", tc.method, w.Body, codeVersionConflict)
+		}
+	}
+}
+
+func TestRequireVersion(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RequireVersion = true
+	h, _ := newTestServer(t, cfg)
+	u := createUser(t, h, "Ada")
+
+	w := do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada L."}`)
+	if w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("no version: %d %s, want 428", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), codeVersionRequired) {
+		t.Errorf("%s, want %s", w.Body, codeVersionRequired)
+	}
+	if w := do(h, http.MethodPatch, "/users/"+u.ID, `{"name":"Ada L."}`); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("patch with no version: %d, want 428", w.Code)
+	}
+	if w := do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada L.","version":1}`); w.Code != http.StatusOK {
+		t.Errorf("version in the body: %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	w := do(h, http.MethodPost, "/users", `{"name":"Ada","tags":["vip"],"metadata":{"plan":"pro","team":"ops"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var u store.User
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+
+	w = do(h, http.MethodPatch, "/users/"+u.ID, `{"name":"Ada L.","metadata":{"team":null}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("patch: %d %s", w.Code, w.Body)
+	}
+	var patched store.User
+	if err := json.Unmarshal(w.Body.Bytes(), &patched); err != nil {
+		t.Fatal(err)
+	}
+	if patched.Name != "Ada L." || len(patched.Tags) != 1 || patched.Metadata["plan"] != "pro" || patched.Metadata["team"] != "" || patched.Version != 2 {
+		t.Errorf("patched %+v, want the name changed and the team removed only", patched)
+	}
+
+	if w := do(h, http.MethodPatch, "/users/"+u.ID, `{"name":"Ada K."}`, "If-Match", `"1"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale patch: %d, want 412", w.Code)
+	}
+	if w := do(h, http.MethodPatch, "/users/"+u.ID, `{"id":"42"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("patching the id: %d %s, want 422", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPatch, "/users/42", `{"name":"Bob"}`); w.Code != http.StatusNotFound {
+		t.Errorf("patching a missing user: %d, want 404", w.Code)
+	}
+}
+
+func TestCreatedAt(t *testing.T) {
+	h, clk := newTestServer(t, DefaultConfig())
+	w := do(h, http.MethodPost, "/users", `{"name":"Ada","created_at":"2000-01-01T00:00:00Z"}`)
+	var u store.User
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	if u.CreatedAt == nil || !u.CreatedAt.Equal(testStart) {
+		t.Fatalf("created_at %v, want %v set by the server", u.CreatedAt, testStart)
+	}
+
+	clk.Advance(time.Hour)
+	for _, req := range []struct{ method, body string }{
+		{http.MethodPut, `{"name":"Ada L.","created_at":"2000-01-01T00:00:00Z"}`},
+		{http.MethodPatch, `{"created_at":"2000-01-01T00:00:00Z"}`},
+	} {
+		w = do(h, req.method, "/users/"+u.ID, req.body)
+		var got store.User
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", req.method, w.Code, w.Body)
+		}
+		if got.CreatedAt == nil || !got.CreatedAt.Equal(testStart) {
+			t.Errorf("%s: created_at %v, want it kept", req.method, got.CreatedAt)
+		}
+	}
+}
+
+func TestListByCreation(t *testing.T) {
+	h, clk := newTestServer(t, DefaultConfig())
+	var want []string
+	for i := 0; i < 11; i++ {
+		want = append(want, createUser(t, h, "User").ID)
+		clk.Advance(time.Minute)
+	}
+	byID := append([]string(nil), want...)
+	sort.Strings(byID)
+	if strings.Join(byID, ",") == strings.Join(want, ",") {
+		t.Fatalf("ids %v in the order of creation, the test needs them not to be", want)
+	}
+
+	var got []string
+	for path := "/users?limit=4"; ; {
+		w := do(h, http.MethodGet, path, "")
+		var page struct {
+			Users      []store.User `json:"users"`
+			Total      int          `json:"total"`
+			NextCursor string       `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", path, w.Code, w.Body)
+		}
+		if page.Total != len(want) {
+			t.Errorf("%s: total %d, want %d", path, page.Total, len(want))
+		}
+		for _, u := range page.Users {
+			got = append(got, u.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		path = "/users?limit=4&cursor=" + page.NextCursor
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("pages by creation %v, want %v", got, want)
+	}
+	if got := listIDs(t, h, "/users?sort=-created&limit=2"); strings.Join(got, ",") != want[10]+","+want[9] {
+		t.Errorf("newest first %v, want %s,%s", got, want[10], want[9])
+	}
+	if got := listIDs(t, h, "/users?sort=id"); strings.Join(got, ",") != strings.Join(byID, ",") {
+		t.Errorf("by id %v, want %v", got, byID)
+	}
+}
+
+func TestDuplicatesOldestFirst(t *testing.T) {
+	h, clk := newTestServer(t, DefaultConfig())
+	var ids []string
+	for _, name := range []string{"Ada", "Zoe", "Bob", "Cy", "Dee", "Eve", "Fay", "Gus", "Hal", "Ivo"} {
+		body := `{"name":"` + name + `"}`
+		if name == "Zoe" || name == "Ivo" {
+			body = `{"name":"` + name + `","metadata":{"email":"zoe@example.com"}}`
+		}
+		w := do(h, http.MethodPost, "/users", body)
+		var u store.User
+		if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil || w.Code != http.StatusCreated {
+			t.Fatalf("creating %s: %d %s", name, w.Code, w.Body)
+		}
+		ids = append(ids, u.ID)
+		clk.Advance(time.Minute)
+	}
+	// the newer user has the smaller id
+	older, newer := ids[1], ids[9]
+	if newer > older {
+		t.Fatalf("ids %s and %s in the order of creation, the test needs them not to be", older, newer)
+	}
+	w := do(h, http.MethodGet, "/admin/duplicates?refresh=true", "")
+	var report duplicatesReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("duplicates: %d %s", w.Code, w.Body)
+	}
+	if len(report.Candidates) != 1 || report.Candidates[0].IDs != [2]string{older, newer} {
+		t.Errorf("candidates %+v, want %s and %s, the oldest first", report.Candidates, older, newer)
+	}
+}
+
+func TestClientUserIDs(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ClientUserIDs = true
+	h, clk := newTestServer(t, cfg, testKeys)
+	if w := do(h, http.MethodPost, "/users", `{"id":"ada","name":"Ada"}`, apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	clk.Advance(time.Hour)
+
+	// the quarantined user is only replaced by the admins, keeping its
+	// quarantine
+	if w := do(h, http.MethodPost, "/users/ada/quarantine", `{"reason":"spam"}`, apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("quarantine: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/users", `{"id":"ada","name":"Eve"}`, apiKeyHeader, editorKey); w.Code != http.StatusConflict {
+		t.Errorf("replacing a hidden user: %d %s, want 409", w.Code, w.Body)
+	}
+	w := do(h, http.MethodPost, "/users", `{"id":"ada","name":"Ada L."}`, apiKeyHeader, adminKey)
+	var u store.User
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("replace: %d %s", w.Code, w.Body)
+	}
+	if u.Quarantine == nil || u.CreatedAt == nil || !u.CreatedAt.Equal(testStart) {
+		t.Errorf("replaced %+v, want its quarantine and created_at kept", u)
+	}
+	if w := do(h, http.MethodDelete, "/users/ada/quarantine", "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("release: %d %s", w.Code, w.Body)
+	}
+
+	// nor is the held one
+	if w := do(h, http.MethodPost, "/users/ada/legal-hold", `{"reason":"case 2024-17"}`, apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("holding: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodPost, "/users", `{"id":"ada","name":"Eve"}`, apiKeyHeader, adminKey)
+	if w.Code != http.StatusConflict || errorCode(t, w) != codeLegalHold {
+		t.Errorf("replacing a held user: %d %s, want 409", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/users/ada", "", apiKeyHeader, adminKey); !strings.Contains(w.Body.String(), "Ada L.") {
+		t.Errorf("held user after the refused replace: %s", w.Body)
+	}
+}
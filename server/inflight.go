@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// drainLogInterval is the period of the drain progress logs on shutdown
+const drainLogInterval = time.Second
+
+// inflight counts the requests being served, per route
+type inflight struct {
+	mu       sync.Mutex
+	counts   map[string]int // by "METHOD /path/{template}"
+	draining bool
+}
+
+func newInflight() *inflight {
+	return &inflight{counts: map[string]int{}}
+}
+
+// start counts a request on rt until the returned function is called
+func (t *inflight) start(rt route) (done func()) {
+	key := rt.method + " " + rt.path
+	t.mu.Lock()
+	t.counts[key]++
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.counts[key]--; t.counts[key] == 0 {
+			delete(t.counts, key)
+		}
+	}
+}
+
+// inflightReport is the state of the requests being served
+type inflightReport struct {
+	Total    int            `json:"total"`
+	Routes   map[string]int `json:"routes"`
+	Draining bool           `json:"draining"`
+}
+
+func (t *inflight) report() inflightReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rep := inflightReport{Routes: make(map[string]int, len(t.counts)), Draining: t.draining}
+	for k, n := range t.counts {
+		rep.Routes[k] = n
+		rep.Total += n
+	}
+	return rep
+}
+
+// drain marks the server as draining and logs the remaining requests
+// until ctx is done
+func (s *Server) drain(ctx context.Context) {
+	s.inflight.mu.Lock()
+	s.inflight.draining = true
+	s.inflight.mu.Unlock()
+
+	ticker := time.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+	for {
+		rep := s.inflight.report()
+		s.logger.Info("draining", "in_flight", rep.Total, "routes", rep.Routes)
+		if rep.Total == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/validate"
+	"github.com/santisdev/go-restapi.git/wire"
+)
+
+const (
+	maxIngestBody          = 1 << 20 // in bytes
+	defaultSignatureHeader = "X-Signature-256"
+)
+
+// IngestSource is a third party whose webhooks upsert users. The users
+// are matched by their external id in the system named after the source.
+type IngestSource struct {
+	// Secret is the HMAC-SHA256 key the payloads are signed with
+	Secret wire.Secret `json:"secret"`
+	// SignatureHeader carries the hex signature of the payloads,
+	// optionally prefixed by "sha256=". X-Signature-256 by default.
+	SignatureHeader string `json:"signature_header,omitempty"`
+	// Mapping maps user fields to the dotted paths of their values in
+	// the payloads, as in "data.user.id", indexes selecting array
+	// elements. The fields are external_id, which is required, name,
+	// active, tags and metadata.<key>.
+	Mapping map[string]string `json:"mapping"`
+}
+
+func (src IngestSource) validate(name string) error {
+	if !externalSystemRe.MatchString(name) {
+		return fmt.Errorf("ingest source %q: invalid name", name)
+	}
+	if src.Secret == "" {
+		return fmt.Errorf("ingest source %q: no secret", name)
+	}
+	if src.Mapping["external_id"] == "" {
+		return fmt.Errorf("ingest source %q: external_id is not mapped", name)
+	}
+	for field := range src.Mapping {
+		switch {
+		case field == "external_id", field == "name", field == "active", field == "tags":
+		case strings.HasPrefix(field, "metadata.") && len(field) > len("metadata."):
+		default:
+			return fmt.Errorf("ingest source %q: unknown field %q", name, field)
+		}
+	}
+	return nil
+}
+
+// verify reports whether signature is the one of payload
+func (src IngestSource) verify(signature string, payload []byte) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(src.Secret))
+	mac.Write(payload)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// apply sets the mapped fields of u from payload. Fields whose path is
+// missing from the payload are left untouched.
+func (src IngestSource) apply(payload any, u *store.User) error {
+	for field, path := range src.Mapping {
+		v, ok := lookupPath(payload, path)
+		if !ok || field == "external_id" {
+			continue
+		}
+		switch {
+		case field == "name":
+			s, ok := scalarString(v)
+			if !ok {
+				return fmt.Errorf("%s: not a string", path)
+			}
+			u.Name = s
+		case field == "active":
+			b, ok := v.(bool)
+			if s, isString := v.(string); isString {
+				b, ok = s == "true", s == "true" || s == "false"
+			}
+			if !ok {
+				return fmt.Errorf("%s: not a boolean", path)
+			}
+			u.Active = b
+		case field == "tags":
+			tags, ok := stringList(v)
+			if !ok {
+				return fmt.Errorf("%s: not a list of strings", path)
+			}
+			u.Tags = tags
+		default:
+			s, ok := scalarString(v)
+			if !ok {
+				return fmt.Errorf("%s: not a string", path)
+			}
+			if u.Metadata == nil {
+				u.Metadata = map[string]string{}
+			}
+			u.Metadata[strings.TrimPrefix(field, "metadata.")] = s
+		}
+	}
+	return nil
+}
+
+// ingestHandler serves the endpoints receiving third-party webhooks
+type ingestHandler struct {
+	*deps
+	locks   *lockManager
+	sources map[string]IngestSource
+	limits  validate.Limits
+	filter  *contentFilter // nil unless filtering the content
+
+	mu sync.Mutex // serializes the upserts, so an external id gets a single user
+}
+
+// routes is the route table of the ingest endpoints. They are public,
+// the payloads being authenticated by their signature.
+func (h *ingestHandler) routes() []route {
+	return []route{
+		{http.MethodPost, "/ingest/{source}", "Upsert a user from the webhook of a third party", scopePublic, rateWrite, policyDynamic, h.Ingest},
+	}
+}
+
+// Ingest upserts the user described by a webhook payload of a source
+func (h *ingestHandler) Ingest(w http.ResponseWriter, r *http.Request) {
+	name := pathParam(r, "source")
+	src, ok := h.sources[name]
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBody))
+	if err != nil {
+		badRequest(w, r)
+		return
+	}
+	header := src.SignatureHeader
+	if header == "" {
+		header = defaultSignatureHeader
+	}
+	if !src.verify(r.Header.Get(header), body) {
+		unauthorized(w, r)
+		return
+	}
+	var payload any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		badRequest(w, r)
+		return
+	}
+	v, _ := lookupPath(payload, src.Mapping["external_id"])
+	externalID, ok := scalarString(v)
+	if !ok || externalID == "" {
+		invalid(w, r, "no external id in the payload")
+		return
+	}
+
+	u, rev, err := h.upsert(r.Context(), name, externalID, src, payload)
+	var invalidErr invalidUserError
+	switch {
+	case errors.As(err, &invalidErr):
+		invalid(w, r, err.Error())
+		return
+	case errors.Is(err, errLocked):
+		locked(w, r)
+		return
+	case err != nil:
+		storeError(w, r, err)
+		return
+	}
+	setRev(w, rev)
+	w.Header().Set("ETag", versionTag(u.Version))
+
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// upsert creates or updates the user having externalID in the system
+// of the source, with the event of the change. Nothing is saved when the
+// payload changes nothing.
+func (h *ingestHandler) upsert(ctx context.Context, system, externalID string, src IngestSource, payload any) (store.User, uint64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := 0; ; i++ {
+		cur, rev, err := h.store.GetByExternalID(ctx, system, externalID, store.Strong)
+		typ := events.UserUpdated
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			typ = events.UserCreated
+			cur.ID = h.ids.NewID()
+			cur.Active = true
+			cur.ExternalIDs = map[string]string{system: externalID}
+			stampCreation(&cur, nil, h.clock.Now())
+		case err != nil:
+			return store.User{}, 0, err
+		default:
+			if err := h.locks.check(cur.ID, ""); err != nil {
+				return store.User{}, 0, err
+			}
+		}
+
+		u := cur
+		u.Metadata = maps.Clone(cur.Metadata)
+		if err := src.apply(payload, &u); err != nil {
+			return store.User{}, 0, invalidUserError{err}
+		}
+		stampCreation(&u, &cur, h.clock.Now())
+		stampDeactivation(&u, &cur, h.clock.Now())
+		normalizeUser(&u)
+		if err = h.limits.Struct(u); err != nil {
+			return store.User{}, 0, invalidUserError{err}
+		}
+		if h.filter != nil {
+			errs, err := h.filter.screen(ctx, &u)
+			if err != nil {
+				return store.User{}, 0, err
+			}
+			if len(errs) > 0 {
+				return store.User{}, 0, invalidUserError{errs}
+			}
+		}
+		if u.Tags, err = normalizeTags(u.Tags); err == nil {
+			err = checkMetadata(u.Metadata)
+		}
+		if err != nil {
+			return store.User{}, 0, invalidUserError{err}
+		}
+		if typ == events.UserUpdated && reflect.DeepEqual(u, cur) {
+			return cur, rev, nil
+		}
+
+		var saved store.User
+		if typ == events.UserCreated {
+			saved, rev, err = h.store.Create(h.withUserEvent(ctx, typ), u)
+		} else {
+			saved, rev, err = h.store.CompareAndSwap(h.withUserEvent(ctx, typ), cur.ID, cur.Version, u)
+		}
+		if !errors.Is(err, store.ErrConflict) || i == maxModifyAttempts-1 {
+			return saved, rev, err
+		}
+	}
+}
+
+// lookupPath returns the value at the dotted path in v, as decoded from
+// JSON
+func lookupPath(v any, path string) (any, bool) {
+	for _, part := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[part]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, v != nil
+}
+
+// scalarString returns v as a string, if it is a string or a number
+func scalarString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
+
+// stringList returns v as a list of strings, a single string being a
+// list of one
+func stringList(v any) ([]string, bool) {
+	if s, ok := v.(string); ok {
+		return []string{s}, true
+	}
+	list, ok := v.([]any)
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, 0, len(list))
+	for _, e := range list {
+		s, ok := scalarString(e)
+		if !ok {
+			return nil, false
+		}
+		strs = append(strs, s)
+	}
+	return strs, true
+}
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/jose"
+	"github.com/santisdev/go-restapi.git/mail"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+	"github.com/santisdev/go-restapi.git/validate"
+	"github.com/santisdev/go-restapi.git/wire"
+)
+
+const (
+	// DefaultInvitationTTL is how long the invitations may be redeemed
+	// unless set
+	DefaultInvitationTTL = 7 * 24 * time.Hour
+	// invitationRetention is how long the invitations are listed once
+	// expired
+	invitationRetention = 30 * 24 * time.Hour
+	// mailTimeout bounds the sending of an invitation
+	mailTimeout = 30 * time.Second
+)
+
+// Invitations lets the admins and tenant admins invite users by email,
+// the users redeeming the link they get to be created with the roles
+// and tenant of their invitation
+type Invitations struct {
+	// Secret signs the tokens of the links, at least 32 bytes long, the
+	// invitations being enabled when it is set
+	Secret wire.Secret
+	// URL is the template of the links, the page of the clients calling
+	// POST /invitations/redeem, as https://app.example.com/join?token={token}
+	URL string
+	// TTL is how long the invitations may be redeemed,
+	// DefaultInvitationTTL unless set
+	TTL time.Duration
+}
+
+func (inv Invitations) validate() error {
+	if inv.Secret == "" {
+		return nil
+	}
+	var errs []error
+	if len(inv.Secret) < 32 {
+		errs = append(errs, errors.New("invalid invitations secret: shorter than 32 bytes"))
+	}
+	if u, err := url.Parse(strings.ReplaceAll(inv.URL, "{token}", "t")); err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		!strings.Contains(inv.URL, "{token}") {
+		errs = append(errs, fmt.Errorf("invalid invitations url %q: expected an http or https url with {token}", inv.URL))
+	}
+	if inv.TTL < 0 {
+		errs = append(errs, errors.New("invalid invitations ttl: negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Mailer sends the emails of the server, as mail.SMTP
+type Mailer interface {
+	Send(ctx context.Context, msg mail.Message) error
+}
+
+// Invitation is an invitation of a user, sent by email
+type Invitation struct {
+	ID    string     `json:"id"`
+	Email wire.Email `json:"email"`
+	// Name is the name of the user, unless the user tells another
+	Name      string         `json:"name,omitempty"`
+	Roles     []string       `json:"roles"`
+	Tenant    string         `json:"tenant,omitempty"`
+	InvitedBy string         `json:"invited_by"`
+	Status    string         `json:"status"` // pending, redeemed, revoked or expired
+	CreatedAt timestamp.Time `json:"created_at"`
+	ExpiresAt timestamp.Time `json:"expires_at"`
+	// RedeemedAt and UserID tell the redemption and the user it created
+	RedeemedAt *timestamp.Time `json:"redeemed_at,omitempty"`
+	UserID     string          `json:"user_id,omitempty"`
+}
+
+// the statuses of the invitations
+const (
+	invitationPending  = "pending"
+	invitationRedeemed = "redeemed"
+	invitationRevoked  = "revoked"
+	invitationExpired  = "expired"
+)
+
+// status returns the status of inv at now
+func (inv Invitation) status(now time.Time) string {
+	if inv.Status == invitationPending && !now.Before(inv.ExpiresAt.Time) {
+		return invitationExpired
+	}
+	return inv.Status
+}
+
+var (
+	errInvitationGone = errors.New("invitation redeemed, revoked or expired")
+	errNoInvitation   = errors.New("unknown invitation")
+)
+
+// invitations are the invitations sent, kept in memory: the ones
+// pending at a restart can't be redeemed anymore
+type invitations struct {
+	mu   sync.Mutex
+	byID map[string]*Invitation
+}
+
+// add adds inv, forgetting the invitations expired long ago
+func (is *invitations) add(inv Invitation, now time.Time) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for id, other := range is.byID {
+		if now.Sub(other.ExpiresAt.Time) > invitationRetention {
+			delete(is.byID, id)
+		}
+	}
+	is.byID[inv.ID] = &inv
+}
+
+// remove forgets the invitation id, as one that couldn't be sent
+func (is *invitations) remove(id string) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	delete(is.byID, id)
+}
+
+// list returns the invitations, the latest first
+func (is *invitations) list(now time.Time) []Invitation {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	list := make([]Invitation, 0, len(is.byID))
+	for _, inv := range is.byID {
+		c := *inv
+		c.Status = inv.status(now)
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt.Time) })
+	return list
+}
+
+// claim marks the pending invitation id redeemed at now, so it is
+// redeemed once only
+func (is *invitations) claim(id string, now time.Time) (Invitation, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	inv, ok := is.byID[id]
+	if !ok {
+		return Invitation{}, errNoInvitation
+	}
+	if inv.status(now) != invitationPending {
+		return Invitation{}, errInvitationGone
+	}
+	at := timestamp.New(now)
+	inv.Status, inv.RedeemedAt = invitationRedeemed, &at
+	return *inv, nil
+}
+
+// redeemed records the user created by the redemption of id, or, when
+// none could be, makes it pending again
+func (is *invitations) redeemed(id, userID string) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if inv, ok := is.byID[id]; ok {
+		if userID == "" {
+			inv.Status, inv.RedeemedAt = invitationPending, nil
+		}
+		inv.UserID = userID
+	}
+}
+
+// revoke revokes the pending invitation id
+func (is *invitations) revoke(id string, now time.Time) error {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	inv, ok := is.byID[id]
+	if !ok {
+		return errNoInvitation
+	}
+	if inv.status(now) != invitationPending {
+		return errInvitationGone
+	}
+	inv.Status = invitationRevoked
+	return nil
+}
+
+// invitationHandler serves the invitations of the users
+type invitationHandler struct {
+	*deps
+	cfg     Invitations
+	signer  *jose.Signer
+	mailer  Mailer
+	apiKeys *APIKeys
+	invites *invitations
+	limits  validate.Limits
+	filter  *contentFilter
+}
+
+func newInvitationHandler(d *deps, cfg Invitations, mailer Mailer, apiKeys *APIKeys) (*invitationHandler, error) {
+	signer, err := jose.NewHMACSigner([]byte(cfg.Secret), "invitations")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultInvitationTTL
+	}
+	return &invitationHandler{deps: d, cfg: cfg, signer: signer, mailer: mailer, apiKeys: apiKeys,
+		invites: &invitations{byID: map[string]*Invitation{}}}, nil
+}
+
+// routes is the route table of the invitations. Redeeming is public,
+// the token of the link authorizing it.
+func (h *invitationHandler) routes() []route {
+	return []route{
+		{http.MethodPost, "/invitations", "Invite a user by email", scopeTenant, rateWrite, policyNoStore, h.Invite},
+		{http.MethodPost, "/invitations/redeem", "Redeem an invitation, creating its user", scopePublic, rateWrite, policyNoStore, h.Redeem},
+		{http.MethodGet, "/admin/invitations", "List the invitations", scopeAdmin, rateAdmin, policyNoStore, h.List},
+		{http.MethodDelete, "/admin/invitations/{id}", "Revoke an invitation", scopeAdmin, rateAdmin, policyNoStore, h.Revoke},
+	}
+}
+
+// Invite invites a user to the tenant of the client, or to the tenant
+// of the body for the admins, with the roles of the body, viewer unless
+// given, emailing the link to redeem the invitation
+func (h *invitationHandler) Invite(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email  wire.Email `json:"email"`
+		Name   string     `json:"name"`
+		Roles  []string   `json:"roles"`
+		Tenant string     `json:"tenant"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	id, _ := IdentityFrom(r.Context())
+	switch {
+	case id.Tenant != "" && body.Tenant != "" && body.Tenant != id.Tenant:
+		forbidden(w, r)
+		return
+	case id.Tenant != "":
+		body.Tenant = id.Tenant
+	case !id.HasRole(RoleAdmin):
+		forbidden(w, r)
+		return
+	}
+	if body.Email == "" {
+		invalid(w, r, "email: required")
+		return
+	}
+	if len(body.Roles) == 0 {
+		body.Roles = []string{RoleViewer}
+	}
+	if !grantable(w, r, body.Roles) {
+		return
+	}
+	now := h.clock.Now().UTC()
+	inv := Invitation{
+		ID:        h.ids.NewID(),
+		Email:     body.Email,
+		Name:      body.Name,
+		Roles:     body.Roles,
+		Tenant:    body.Tenant,
+		InvitedBy: id.Subject,
+		Status:    invitationPending,
+		CreatedAt: timestamp.New(now),
+		ExpiresAt: timestamp.New(now.Add(h.cfg.TTL)),
+	}
+	token, err := h.signer.SignJWT(map[string]any{"jti": inv.ID, "aud": "invitation",
+		"iat": now.Unix(), "exp": inv.ExpiresAt.Unix()})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	h.invites.add(inv, now)
+	link := strings.ReplaceAll(h.cfg.URL, "{token}", url.QueryEscape(token))
+	ctx, cancel := context.WithTimeout(r.Context(), mailTimeout)
+	defer cancel()
+	err = h.mailer.Send(ctx, mail.Message{
+		To:      string(inv.Email),
+		Subject: "You are invited",
+		Body: fmt.Sprintf("%s invited you. Follow this link to accept the invitation before %s:\n\n%s\n",
+			inv.InvitedBy, inv.ExpiresAt.Format(time.RFC1123), link),
+	})
+	if err != nil {
+		h.invites.remove(inv.ID)
+		h.logger.ErrorContext(r.Context(), "sending invitation", "invitation", inv.ID, "err", err)
+		serviceUnavailable(w, r)
+		return
+	}
+	inv.CreatedAt = localTime(r, inv.CreatedAt)
+	inv.ExpiresAt = localTime(r, inv.ExpiresAt)
+	jsonBytes, err := json.Marshal(inv)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+}
+
+// Redeem redeems the invitation of the token of the body, creating its
+// user, named as in the body or else as in the invitation, and an API
+// key of the roles and tenant of the invitation, named by the id of the
+// user. The key is answered with the user, and isn't shown again.
+// Invitations already redeemed, revoked or expired answer 410.
+func (h *invitationHandler) Redeem(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+		Name  string `json:"name"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	now := h.clock.Now().UTC()
+	claims, err := jose.VerifyJWT(body.Token, []*jose.Signer{h.signer}, now)
+	if errors.Is(err, jose.ErrTokenExpired) {
+		writeError(w, r, http.StatusGone, codeInvitationGone, errInvitationGone.Error(), nil)
+		return
+	}
+	id, _ := claims["jti"].(string)
+	if err != nil || claims["aud"] != "invitation" || id == "" {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "invalid invitation token", nil)
+		return
+	}
+	inv, err := h.invites.claim(id, now)
+	if errors.Is(err, errInvitationGone) {
+		writeError(w, r, http.StatusGone, codeInvitationGone, err.Error(), nil)
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "invalid invitation token", nil)
+		return
+	}
+	userID := ""
+	defer func() { h.invites.redeemed(inv.ID, userID) }()
+
+	u := store.User{ID: h.ids.NewID(), Name: body.Name, Active: true, Metadata: map[string]string{emailKey: string(inv.Email)}}
+	if u.Name == "" {
+		u.Name = inv.Name
+	}
+	if !validUser(w, r, &u, h.limits) || !moderated(w, r, h.filter, h.deps, &u) {
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		internalServerError(w, r)
+		return
+	}
+	// the key first, revoked when the user can't be created, so no user
+	// is left without its key
+	key := APIKey{
+		Name:      u.ID,
+		Key:       wire.Secret(base64.RawURLEncoding.EncodeToString(secret)),
+		Roles:     inv.Roles,
+		Tenant:    inv.Tenant,
+		User:      u.ID,
+		CreatedAt: timestamp.New(now),
+	}
+	if err := h.apiKeys.Add(key); err != nil {
+		h.logger.ErrorContext(r.Context(), "adding the API key of an invited user", "invitation", inv.ID, "user", u.ID, "err", err)
+		internalServerError(w, r)
+		return
+	}
+	stampCreation(&u, nil, now)
+	u, rev, err := h.store.Create(h.withUserEvent(r.Context(), events.UserCreated), u)
+	if err != nil {
+		if err := h.apiKeys.Revoke(key.Name); err != nil {
+			h.logger.ErrorContext(r.Context(), "revoking the API key of a user not created", "invitation", inv.ID, "user", key.Name, "err", err)
+		}
+		storeError(w, r, err)
+		return
+	}
+	userID = u.ID
+	setRev(w, rev)
+	w.Header().Set("Location", versionPrefix(r)+"/users/"+url.PathEscape(u.ID))
+	key.CreatedAt = localTime(r, key.CreatedAt)
+	jsonBytes, err := json.Marshal(struct {
+		User   store.User `json:"user"`
+		APIKey APIKey     `json:"api_key"`
+	}{u, key})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+}
+
+// List lists the invitations, the latest first, only those of a
+// status with ?status=pending and the like
+func (h *invitationHandler) List(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", invitationPending, invitationRedeemed, invitationRevoked, invitationExpired:
+	default:
+		invalid(w, r, "status: expected pending, redeemed, revoked or expired")
+		return
+	}
+	list := []Invitation{}
+	for _, inv := range h.invites.list(h.clock.Now().UTC()) {
+		if status == "" || inv.Status == status {
+			inv.CreatedAt = localTime(r, inv.CreatedAt)
+			inv.ExpiresAt = localTime(r, inv.ExpiresAt)
+			list = append(list, inv)
+		}
+	}
+	jsonBytes, err := json.Marshal(list)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Revoke revokes a pending invitation, answering 409 for the ones
+// already redeemed, revoked or expired
+func (h *invitationHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	err := h.invites.revoke(pathParam(r, "id"), h.clock.Now().UTC())
+	switch {
+	case errors.Is(err, errNoInvitation):
+		notFound(w, r)
+	case err != nil:
+		conflict(w, r)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/mail"
+)
+
+// inbox is a Mailer keeping the messages sent
+type inbox struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (in *inbox) Send(ctx context.Context, msg mail.Message) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.sent = append(in.sent, msg)
+	return nil
+}
+
+// token returns the token of the link of the last message sent
+func (in *inbox) token(t *testing.T) string {
+	t.Helper()
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.sent) == 0 {
+		t.Fatal("no invitation sent")
+	}
+	body := in.sent[len(in.sent)-1].Body
+	i := strings.Index(body, "https://")
+	u, err := url.Parse(strings.TrimSpace(body[i:]))
+	if i < 0 || err != nil {
+		t.Fatalf("no link in %q", body)
+	}
+	return u.Query().Get("token")
+}
+
+func newInvitationsServer(t *testing.T) (http.Handler, *inbox, func(time.Duration)) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Invitations = Invitations{Secret: "invitations-secret-0123456789abcdef", URL: "https://app.example.com/join?token={token}", TTL: time.Hour}
+	in := &inbox{}
+	h, clk := newTestServer(t, cfg, tenantKeys, WithMailer(in))
+	return h, in, clk.Advance
+}
+
+func TestInvitations(t *testing.T) {
+	h, in, _ := newInvitationsServer(t)
+
+	w := do(h, http.MethodPost, "/invitations", `{"email":"ann@example.com","name":"Ann","roles":["editor"]}`, apiKeyHeader, acmeKey)
+	var inv Invitation
+	if err := json.Unmarshal(w.Body.Bytes(), &inv); err != nil || w.Code != http.StatusCreated || inv.Tenant != "acme" || inv.Status != invitationPending {
+		t.Fatalf("inviting: %d %s", w.Code, w.Body)
+	}
+	token := in.token(t)
+
+	w = do(h, http.MethodPost, "/invitations/redeem", `{"token":"`+token+`"}`)
+	var redeemed struct {
+		User   struct{ ID, Name string } `json:"user"`
+		APIKey APIKey                    `json:"api_key"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &redeemed); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("redeeming: %d %s", w.Code, w.Body)
+	}
+	if redeemed.User.Name != "Ann" || redeemed.APIKey.Name != redeemed.User.ID || redeemed.APIKey.Tenant != "acme" {
+		t.Errorf("redeemed %+v, want Ann with a key of acme named by her id", redeemed)
+	}
+	if w := do(h, http.MethodPost, "/users", `{"name":"Bob"}`, apiKeyHeader, string(redeemed.APIKey.Key)); w.Code != http.StatusCreated {
+		t.Errorf("creating with the key of the invited: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodGet, "/admin/invitations?status=redeemed", "", apiKeyHeader, adminKey)
+	if !strings.Contains(w.Body.String(), `"user_id":"`+redeemed.User.ID+`"`) {
+		t.Errorf("the redeemed invitations: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestInvitationsRefused(t *testing.T) {
+	h, in, advance := newInvitationsServer(t)
+	invite := func() string {
+		t.Helper()
+		if w := do(h, http.MethodPost, "/invitations", `{"email":"ann@example.com","name":"Ann"}`, apiKeyHeader, acmeKey); w.Code != http.StatusCreated {
+			t.Fatalf("inviting: %d %s", w.Code, w.Body)
+		}
+		return in.token(t)
+	}
+	redeem := func(token string) *http.Response {
+		return do(h, http.MethodPost, "/invitations/redeem", `{"token":"`+token+`"}`).Result()
+	}
+
+	// redeemed once only
+	token := invite()
+	if res := redeem(token); res.StatusCode != http.StatusCreated {
+		t.Fatalf("redeeming: %d", res.StatusCode)
+	}
+	w := do(h, http.MethodPost, "/invitations/redeem", `{"token":"`+token+`"}`)
+	if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), codeInvitationGone) {
+		t.Errorf("redeeming again: %d %s, want 410", w.Code, w.Body)
+	}
+
+	// nor once expired
+	token = invite()
+	advance(time.Hour)
+	if res := redeem(token); res.StatusCode != http.StatusGone {
+		t.Errorf("redeeming once expired: %d, want 410", res.StatusCode)
+	}
+
+	// nor once revoked
+	token = invite()
+	var pending []Invitation
+	json.Unmarshal(do(h, http.MethodGet, "/admin/invitations?status=pending", "", apiKeyHeader, adminKey).Body.Bytes(), &pending)
+	if len(pending) != 1 {
+		t.Fatalf("pending %+v, want the last invitation", pending)
+	}
+	if w := do(h, http.MethodDelete, "/admin/invitations/"+pending[0].ID, "", apiKeyHeader, adminKey); w.Code != http.StatusNoContent {
+		t.Fatalf("revoking: %d %s", w.Code, w.Body)
+	}
+	if res := redeem(token); res.StatusCode != http.StatusGone {
+		t.Errorf("redeeming once revoked: %d, want 410", res.StatusCode)
+	}
+
+	// a forged token is not found
+	if res := redeem(token[:len(token)-2] + "xx"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("redeeming a forged token: %d, want 404", res.StatusCode)
+	}
+	// and a tenant admin invites to its tenant only
+	if w := do(h, http.MethodPost, "/invitations", `{"email":"ann@example.com","tenant":"globex"}`, apiKeyHeader, acmeKey); w.Code != http.StatusForbidden {
+		t.Errorf("inviting to another tenant: %d %s, want 403", w.Code, w.Body)
+	}
+}
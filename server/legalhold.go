@@ -0,0 +1,397 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+// maxHoldReason bounds the reasons of the legal holds, in bytes
+const maxHoldReason = 1000
+
+// the actions of the audit trail of the legal holds
+const (
+	holdPlaced   = "placed"
+	holdReleased = "released"
+)
+
+// holdEvent is an entry of the audit trail of the legal holds, of a
+// user or a tenant
+type holdEvent struct {
+	At     timestamp.Time `json:"at"`
+	Action string         `json:"action"`
+	User   string         `json:"user,omitempty"`
+	Tenant string         `json:"tenant,omitempty"`
+	Reason string         `json:"reason,omitempty"`
+	By     string         `json:"by"`
+}
+
+// tenantHold is the legal hold of a tenant
+type tenantHold struct {
+	Tenant string `json:"tenant"`
+	store.LegalHold
+}
+
+// legalHolds keeps the legal holds of the tenants and the audit trail
+// of every hold, in a file across restarts when set, the trail never
+// being truncated. The holds of the users are kept with them. The users of a tenant are the ones whose
+// API key, named by their id as for the invited users, is of it.
+type legalHolds struct {
+	*deps
+	file    string
+	apiKeys *APIKeys // nil without API keys, the users being of no tenant
+
+	// mu guards the tenants and the audit, and is held while the holds of
+	// the users change, so that they are audited in order
+	mu      sync.Mutex
+	tenants map[string]store.LegalHold
+	audit   []holdEvent // oldest first
+}
+
+// holdsState is the content of the file of the legal holds
+type holdsState struct {
+	Tenants map[string]store.LegalHold `json:"tenants"`
+	Audit   []holdEvent                `json:"audit"`
+}
+
+// newLegalHolds returns the legal holds loaded from file, when set and
+// present
+func newLegalHolds(d *deps, file string, apiKeys *APIKeys) (*legalHolds, error) {
+	lh := &legalHolds{deps: d, file: file, apiKeys: apiKeys, tenants: map[string]store.LegalHold{}}
+	if file == "" {
+		return lh, nil
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return lh, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st holdsState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, errors.New("legal holds file " + file + ": " + err.Error())
+	}
+	if st.Tenants != nil {
+		lh.tenants = st.Tenants
+	}
+	lh.audit = st.Audit
+	return lh, nil
+}
+
+// record appends e to the audit trail and saves the holds, lh.mu being
+// held. The entry isn't appended when the holds can't be saved, the
+// caller undoing the change audited. It is logged too, should the file
+// be lost.
+func (lh *legalHolds) record(ctx context.Context, e holdEvent) error {
+	audit := append(lh.audit, e)
+	if lh.file != "" {
+		b, err := json.Marshal(holdsState{Tenants: lh.tenants, Audit: audit})
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(lh.file+".tmp", b, 0o600); err != nil {
+			return err
+		}
+		if err := os.Rename(lh.file+".tmp", lh.file); err != nil {
+			return err
+		}
+	}
+	lh.audit = audit
+	lh.logger.InfoContext(ctx, "legal hold "+e.Action, "user", e.User, "tenant", e.Tenant, "by", e.By, "reason", e.Reason)
+	return nil
+}
+
+// tenantOf returns the tenant of the user with the given id, empty for
+// none
+func (lh *legalHolds) tenantOf(id string) string {
+	if lh.apiKeys == nil {
+		return ""
+	}
+	return lh.apiKeys.Tenant(id)
+}
+
+// held returns the hold keeping u from being deleted, its own or the
+// one of its tenant, with that tenant, nil when it isn't held
+func (lh *legalHolds) held(u store.User) (*store.LegalHold, string) {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+	return lh.heldLocked(u)
+}
+
+// heldLocked is held with lh.mu held
+func (lh *legalHolds) heldLocked(u store.User) (*store.LegalHold, string) {
+	if u.LegalHold != nil {
+		return u.LegalHold, ""
+	}
+	tenant := lh.tenantOf(u.ID)
+	if tenant == "" {
+		return nil, ""
+	}
+	if hold, ok := lh.tenants[tenant]; ok {
+		return &hold, tenant
+	}
+	return nil, ""
+}
+
+// onHold answers 409 to the deletion of a user under a legal hold
+func onHold(w http.ResponseWriter, r *http.Request, hold *store.LegalHold, tenant string) {
+	msg := "the user is under a legal hold"
+	details := map[string]string{"reason": hold.Reason}
+	if tenant != "" {
+		msg = "the tenant " + tenant + " of the user is under a legal hold"
+		details["tenant"] = tenant
+	}
+	writeError(w, r, http.StatusConflict, codeLegalHold, msg, details)
+}
+
+// readHold reads the reason of a hold from the body, as
+// {"reason": "case 2024-17"}, answering 422 when there's none
+func readHold(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		badRequest(w, r)
+		return "", false
+	}
+	switch {
+	case body.Reason == "":
+		invalid(w, r, "reason: required")
+		return "", false
+	case len(body.Reason) > maxHoldReason:
+		invalid(w, r, "reason: too long")
+		return "", false
+	}
+	return body.Reason, true
+}
+
+// holder returns the subject of the admin of r
+func holder(r *http.Request) string {
+	if id, ok := IdentityFrom(r.Context()); ok && id.Subject != "" {
+		return id.Subject
+	}
+	return "admin"
+}
+
+// PlaceHold places a legal hold on a user, the body giving the reason,
+// as {"reason": "case 2024-17"}. Placing it again replaces the reason.
+func (h *userHandler) PlaceHold(w http.ResponseWriter, r *http.Request) {
+	reason, ok := readHold(w, r)
+	if !ok {
+		return
+	}
+	hold := &store.LegalHold{Reason: reason, By: holder(r), PlacedAt: timestamp.New(h.clock.Now().UTC())}
+	h.setHold(w, r, hold)
+}
+
+// ReleaseHold releases the legal hold of a user
+func (h *userHandler) ReleaseHold(w http.ResponseWriter, r *http.Request) {
+	h.setHold(w, r, nil)
+}
+
+// setHold sets the legal hold of a user, answering 500 and restoring
+// the previous one when the change can't be audited
+func (h *userHandler) setHold(w http.ResponseWriter, r *http.Request, hold *store.LegalHold) {
+	id := pathParam(r, "id")
+	h.holds.mu.Lock()
+	defer h.holds.mu.Unlock()
+	var prev *store.LegalHold
+	changed := false
+	u, rev, err := h.modify(r, id, "", func(u *store.User) bool {
+		prev = u.LegalHold
+		changed = u.LegalHold != nil || hold != nil
+		u.LegalHold = hold
+		return changed
+	})
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if changed {
+		e := holdEvent{At: timestamp.New(h.clock.Now().UTC()), Action: holdPlaced, User: id, By: holder(r)}
+		if hold != nil {
+			e.Reason = hold.Reason
+		} else {
+			e.Action = holdReleased
+		}
+		if err := h.holds.record(r.Context(), e); err != nil {
+			h.logger.ErrorContext(r.Context(), "saving the legal holds", "file", h.holds.file, "err", err)
+			if _, _, err := h.modify(r, id, "", func(u *store.User) bool {
+				u.LegalHold = prev
+				return true
+			}); err != nil {
+				h.logger.ErrorContext(r.Context(), "restoring the legal hold not audited", "user", id, "err", err)
+			}
+			internalServerError(w, r)
+			return
+		}
+	}
+	setRev(w, rev)
+	w.Header().Set("ETag", versionTag(u.Version))
+
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// keepHolds tells whether users, replacing the collection, keep every
+// user under a legal hold, answering 409 listing the ones they don't.
+// The users existing keep their current holds, whatever users tell, so
+// that the holds only change through their routes, audited. h.holds.mu
+// is held.
+func (h *adminHandler) keepHolds(w http.ResponseWriter, r *http.Request, users []store.User) bool {
+	cur, _, err := h.store.List(r.Context(), store.Query{}, store.Strong)
+	if err != nil {
+		storeError(w, r, err)
+		return false
+	}
+	holds := map[string]*store.LegalHold{}
+	for _, u := range cur {
+		holds[u.ID] = u.LegalHold
+	}
+	kept := map[string]bool{}
+	for i, u := range users {
+		kept[u.ID] = true
+		if hold, ok := holds[u.ID]; ok {
+			users[i].LegalHold = hold
+		}
+	}
+	var dropped []string
+	for _, u := range cur {
+		if hold, _ := h.holds.heldLocked(u); hold != nil && !kept[u.ID] {
+			dropped = append(dropped, u.ID)
+		}
+	}
+	if len(dropped) > 0 {
+		writeError(w, r, http.StatusConflict, codeLegalHold, "the state drops users under a legal hold", map[string][]string{"users": dropped})
+		return false
+	}
+	return true
+}
+
+// LegalHolds lists the tenants and the users under a legal hold
+func (h *adminHandler) LegalHolds(w http.ResponseWriter, r *http.Request) {
+	users, _, err := h.store.List(r.Context(), store.Query{}, store.Strong)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	resp := struct {
+		Tenants []tenantHold `json:"tenants"`
+		Users   []store.User `json:"users"`
+	}{[]tenantHold{}, []store.User{}}
+	for _, u := range users {
+		if u.LegalHold != nil {
+			resp.Users = append(resp.Users, u)
+		}
+	}
+	h.holds.mu.Lock()
+	for tenant, hold := range h.holds.tenants {
+		resp.Tenants = append(resp.Tenants, tenantHold{tenant, hold})
+	}
+	h.holds.mu.Unlock()
+	sort.Slice(resp.Tenants, func(i, j int) bool { return resp.Tenants[i].Tenant < resp.Tenants[j].Tenant })
+
+	jsonBytes, err := json.Marshal(resp)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// PlaceTenantHold places a legal hold on the users of a tenant, the
+// body giving the reason. Placing it again replaces the reason.
+func (h *adminHandler) PlaceTenantHold(w http.ResponseWriter, r *http.Request) {
+	reason, ok := readHold(w, r)
+	if !ok {
+		return
+	}
+	tenant := pathParam(r, "tenant")
+	now := timestamp.New(h.clock.Now().UTC())
+	hold := store.LegalHold{Reason: reason, By: holder(r), PlacedAt: now}
+	h.holds.mu.Lock()
+	prev, had := h.holds.tenants[tenant]
+	h.holds.tenants[tenant] = hold
+	err := h.holds.record(r.Context(), holdEvent{At: now, Action: holdPlaced, Tenant: tenant, Reason: reason, By: hold.By})
+	if err != nil && had {
+		h.holds.tenants[tenant] = prev
+	} else if err != nil {
+		delete(h.holds.tenants, tenant)
+	}
+	h.holds.mu.Unlock()
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "saving the legal holds", "file", h.holds.file, "err", err)
+		internalServerError(w, r)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(tenantHold{tenant, hold})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// ReleaseTenantHold releases the legal hold of a tenant, answering 404
+// when it has none
+func (h *adminHandler) ReleaseTenantHold(w http.ResponseWriter, r *http.Request) {
+	tenant := pathParam(r, "tenant")
+	h.holds.mu.Lock()
+	defer h.holds.mu.Unlock()
+	prev, ok := h.holds.tenants[tenant]
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	delete(h.holds.tenants, tenant)
+	e := holdEvent{At: timestamp.New(h.clock.Now().UTC()), Action: holdReleased, Tenant: tenant, By: holder(r)}
+	if err := h.holds.record(r.Context(), e); err != nil {
+		h.holds.tenants[tenant] = prev
+		h.logger.ErrorContext(r.Context(), "saving the legal holds", "file", h.holds.file, "err", err)
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HoldAudit lists the audit trail of the legal holds, newest first,
+// ?user= or ?tenant= keeping the entries of one
+func (h *adminHandler) HoldAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user, tenant := q.Get("user"), q.Get("tenant")
+	audit := []holdEvent{}
+	h.holds.mu.Lock()
+	for i := len(h.holds.audit) - 1; i >= 0; i-- {
+		e := h.holds.audit[i]
+		if (user == "" || e.User == user) && (tenant == "" || e.Tenant == tenant) {
+			e.At = localTime(r, e.At)
+			audit = append(audit, e)
+		}
+	}
+	h.holds.mu.Unlock()
+
+	jsonBytes, err := json.Marshal(audit)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLegalHold(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig(), testKeys)
+	u := createUser(t, h, "Ada")
+	hold := "/users/" + u.ID + "/legal-hold"
+
+	if w := do(h, http.MethodPost, hold, `{"reason":"case 2024-17"}`, apiKeyHeader, editorKey); w.Code != http.StatusForbidden {
+		t.Errorf("an editor holding: %d, want 403", w.Code)
+	}
+	if w := do(h, http.MethodPost, hold, `{}`, apiKeyHeader, adminKey); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("holding with no reason: %d, want 422", w.Code)
+	}
+	if w := do(h, http.MethodPost, hold, `{"reason":"case 2024-17"}`, apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("holding: %d %s", w.Code, w.Body)
+	}
+	// writing the user keeps its hold
+	if w := do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada L."}`, apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("replacing: %d %s", w.Code, w.Body)
+	}
+
+	// the held user can't be deleted, even by the admins, nor dropped by
+	// a state
+	w := do(h, http.MethodDelete, "/users/"+u.ID, "", apiKeyHeader, adminKey)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), codeLegalHold) || !strings.Contains(w.Body.String(), "case 2024-17") {
+		t.Errorf("deleting a held user: %d %s, want 409", w.Code, w.Body)
+	}
+	var state bytes.Buffer
+	if err := writeState(&state, State{}, testStart); err != nil {
+		t.Fatal(err)
+	}
+	w = do(h, http.MethodPut, "/admin/state", state.String(), apiKeyHeader, adminKey)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), u.ID) {
+		t.Errorf("a state dropping a held user: %d %s, want 409", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/users/"+u.ID, "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("the held user: %d, want 200", w.Code)
+	}
+
+	if w := do(h, http.MethodDelete, hold, "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("releasing: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodDelete, "/users/"+u.ID, "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Errorf("deleting once released: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodGet, "/admin/legal-holds/audit?user="+u.ID, "", apiKeyHeader, adminKey)
+	var audit []holdEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &audit); err != nil || len(audit) != 2 ||
+		audit[0].Action != holdReleased || audit[1].Action != holdPlaced || audit[1].By != "admin" {
+		t.Errorf("audit: %d %s, want the release after the hold by the admin", w.Code, w.Body)
+	}
+}
+
+func TestTenantLegalHold(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Retention = Retention{Rules: map[string]time.Duration{retainDeactivatedUsers: time.Hour}}
+	h, clk := newTestServer(t, cfg, WithAPIKeys([]APIKey{
+		{Name: "admin", Key: adminKey, Roles: []string{RoleAdmin}},
+		{Name: "u1", Key: "ada-key-0123456789ab", Roles: []string{RoleViewer}, Tenant: "acme"},
+	}))
+	ada, bob := createUser(t, h, "Ada"), createUser(t, h, "Bob")
+	if w := do(h, http.MethodPut, "/admin/legal-holds/tenants/acme", `{"reason":"audit"}`, apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("holding acme: %d %s", w.Code, w.Body)
+	}
+
+	// the users of the tenant are held, not the others
+	w := do(h, http.MethodDelete, "/users/"+ada.ID, "", apiKeyHeader, adminKey)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"tenant":"acme"`) {
+		t.Errorf("deleting a user of acme: %d %s, want 409", w.Code, w.Body)
+	}
+	for _, u := range []string{ada.ID, bob.ID} {
+		do(h, http.MethodPost, "/users/"+u+"/deactivate", "", apiKeyHeader, adminKey)
+	}
+	clk.Advance(2 * time.Hour)
+	w = do(h, http.MethodPost, "/admin/retention/purge", "", apiKeyHeader, adminKey)
+	var report retentionReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || len(report.Results) != 1 {
+		t.Fatalf("purging: %d %s", w.Code, w.Body)
+	}
+	if res := report.Results[0]; len(res.Purged) != 1 || res.Purged[0] != bob.ID || len(res.Held) != 1 || res.Held[0] != ada.ID {
+		t.Errorf("purge %+v, want Bob purged and Ada held", res)
+	}
+
+	if w := do(h, http.MethodDelete, "/admin/legal-holds/tenants/acme", "", apiKeyHeader, adminKey); w.Code != http.StatusNoContent {
+		t.Fatalf("releasing acme: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodDelete, "/admin/legal-holds/tenants/acme", "", apiKeyHeader, adminKey); w.Code != http.StatusNotFound {
+		t.Errorf("releasing acme again: %d, want 404", w.Code)
+	}
+	if w := do(h, http.MethodDelete, "/users/"+ada.ID, "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Errorf("deleting once released: %d %s", w.Code, w.Body)
+	}
+}
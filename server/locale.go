@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/timestamp"
+	"github.com/santisdev/go-restapi.git/validate"
+)
+
+// languages are the languages the responses are written in, the first
+// being the default
+var languages = []string{"en"}
+
+// locale is the language and time zone of the responses to a request
+type locale struct {
+	language    string
+	zone        *time.Location
+	epochMillis []string // the clients sending epoch milliseconds
+}
+
+type localeKey struct{}
+
+// localize reads the language of the responses to r from its
+// Accept-Language header and, when the deployment lets the clients
+// choose, their time zone from X-Timezone, as "Europe/Madrid" or
+// "+02:00". The timestamps are otherwise rendered in UTC.
+func (rr *router) localize(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	loc := locale{language: negotiateLanguage(r.Header.Get("Accept-Language")), zone: time.UTC, epochMillis: rr.epochMillis}
+	w.Header().Set("Content-Language", loc.language)
+	w.Header().Add("Vary", "Accept-Language")
+	if rr.timezones {
+		w.Header().Add("Vary", "X-Timezone")
+		if tz := r.Header.Get("X-Timezone"); tz != "" {
+			zone, err := parseZone(tz)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("X-Timezone: %v", err), nil)
+				return r, false
+			}
+			loc.zone = zone
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), localeKey{}, loc)), true
+}
+
+// localTime returns t in the time zone of the responses to r
+func localTime(r *http.Request, t timestamp.Time) timestamp.Time {
+	if loc, ok := r.Context().Value(localeKey{}).(locale); ok {
+		return timestamp.New(t.In(loc.zone))
+	}
+	return timestamp.New(t.UTC())
+}
+
+// decodeJSON reads the JSON body of r into v, answering 400 when it
+// isn't JSON and 422 naming the timestamps that aren't in RFC 3339, or in
+// epoch milliseconds for the legacy clients
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	mode := timestamp.Strict
+	if loc, ok := r.Context().Value(localeKey{}).(locale); ok && slices.Contains(loc.epochMillis, client(r)) {
+		mode = timestamp.EpochMillis
+	}
+	err := timestamp.Decode(r.Body, v, mode)
+	var errs validate.Errors
+	switch {
+	case errors.As(err, &errs):
+		invalidFields(w, r, "invalid timestamps", errs)
+		return false
+	case err != nil:
+		badRequest(w, r)
+		return false
+	}
+	return true
+}
+
+// client names the client of r by the subject of its identity or, when
+// it isn't authenticated, by the product of its User-Agent
+func client(r *http.Request) string {
+	if id, ok := IdentityFrom(r.Context()); ok {
+		return id.Subject
+	}
+	product, _, _ := strings.Cut(r.UserAgent(), "/")
+	return product
+}
+
+// language returns the language of the responses to r
+func language(r *http.Request) string {
+	if loc, ok := r.Context().Value(localeKey{}).(locale); ok {
+		return loc.language
+	}
+	return languages[0]
+}
+
+// negotiateLanguage returns the supported language the client prefers,
+// matching the primary subtag, as en for en-GB
+func negotiateLanguage(header string) string {
+	best, bestQ := languages[0], 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		for _, lang := range languages {
+			if primary == lang && q > bestQ {
+				best, bestQ = lang, q
+			}
+		}
+	}
+	return best
+}
+
+// parseZone returns the time zone of an IANA name, as "Europe/Madrid",
+// or of a UTC offset, as "+02:00"
+func parseZone(tz string) (*time.Location, error) {
+	if tz[0] == '+' || tz[0] == '-' {
+		t, err := time.Parse("-07:00", tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q, expected as in +02:00", tz)
+		}
+		_, offset := t.Zone()
+		return time.FixedZone(tz, offset), nil
+	}
+	zone, err := time.LoadLocation(tz)
+	if err != nil || tz == "Local" {
+		return nil, fmt.Errorf("unknown time zone %q", tz)
+	}
+	return zone, nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/idgen"
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+const (
+	defaultLease = 5 * time.Minute // lease of a lock when none is given
+	maxLease     = time.Hour
+)
+
+var (
+	errLocked  = errors.New("locked by another owner")
+	errNoLease = errors.New("no lock held")
+)
+
+// lease is an exclusive, auto-expiring lock on a user record
+type lease struct {
+	ID        string         `json:"id"`
+	Owner     string         `json:"owner,omitempty"`
+	Token     string         `json:"token"`
+	ExpiresAt timestamp.Time `json:"expires_at"`
+}
+
+// lockManager keeps the record leases in memory. Expired leases are
+// ignored and dropped lazily.
+type lockManager struct {
+	clock  clock.Clock
+	ids    idgen.Generator // of the lease tokens
+	mu     sync.Mutex
+	leases map[string]lease
+}
+
+func newLockManager(c clock.Clock, ids idgen.Generator) *lockManager {
+	return &lockManager{clock: c, ids: ids, leases: map[string]lease{}}
+}
+
+// acquire takes the lock on id for ttl, or renews it when token is the
+// token of the current lease.
+func (l *lockManager) acquire(id, owner, token string, ttl time.Duration) (lease, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	cur, ok := l.leases[id]
+	if ok && now.Before(cur.ExpiresAt.Time) && cur.Token != token {
+		return lease{}, errLocked
+	}
+	if !ok || !now.Before(cur.ExpiresAt.Time) {
+		cur = lease{ID: id, Owner: owner, Token: l.ids.NewID()}
+	}
+	cur.ExpiresAt = timestamp.New(now.Add(ttl))
+	l.leases[id] = cur
+	return cur, nil
+}
+
+// release drops the lease on id held with token
+func (l *lockManager) release(id, token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cur, ok := l.leases[id]
+	if !ok || !l.clock.Now().Before(cur.ExpiresAt.Time) {
+		delete(l.leases, id)
+		return errNoLease
+	}
+	if cur.Token != token {
+		return errLocked
+	}
+	delete(l.leases, id)
+	return nil
+}
+
+// check tells whether token allows writing id: either there's no live
+// lease on it or token is the lease token.
+func (l *lockManager) check(id, token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cur, ok := l.leases[id]
+	if !ok || !l.clock.Now().Before(cur.ExpiresAt.Time) || cur.Token == token {
+		return nil
+	}
+	return errLocked
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/idgen"
+)
+
+func TestLockManager(t *testing.T) {
+	clk := clock.NewFake(testStart)
+	l := newLockManager(clk, &idgen.Sequence{Prefix: "t"})
+	held, err := l.acquire("u1", "ada", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held.Token != "t1" || !held.ExpiresAt.Equal(testStart.Add(time.Minute)) {
+		t.Errorf("lease %+v", held)
+	}
+	if _, err := l.acquire("u1", "bob", "", time.Minute); !errors.Is(err, errLocked) {
+		t.Errorf("acquire of a held lock: %v, want errLocked", err)
+	}
+	if err := l.check("u1", ""); !errors.Is(err, errLocked) {
+		t.Errorf("check without the token: %v, want errLocked", err)
+	}
+	if err := l.check("u1", held.Token); err != nil {
+		t.Errorf("check with the token: %v", err)
+	}
+	if err := l.check("u2", ""); err != nil {
+		t.Errorf("check of an unlocked user: %v", err)
+	}
+
+	// renewing keeps the token and pushes the expiry
+	clk.Advance(30 * time.Second)
+	renewed, err := l.acquire("u1", "ada", held.Token, time.Minute)
+	if err != nil || renewed.Token != held.Token || !renewed.ExpiresAt.Equal(testStart.Add(90*time.Second)) {
+		t.Errorf("renewal: %+v, %v", renewed, err)
+	}
+	if err := l.release("u1", "t9"); !errors.Is(err, errLocked) {
+		t.Errorf("release with another token: %v, want errLocked", err)
+	}
+	if err := l.release("u1", held.Token); err != nil {
+		t.Errorf("release: %v", err)
+	}
+	if err := l.release("u1", held.Token); !errors.Is(err, errNoLease) {
+		t.Errorf("second release: %v, want errNoLease", err)
+	}
+
+	// an expired lease is free to take
+	if _, err := l.acquire("u2", "ada", "", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Minute)
+	if err := l.check("u2", ""); err != nil {
+		t.Errorf("check of an expired lease: %v", err)
+	}
+	if taken, err := l.acquire("u2", "bob", "", time.Minute); err != nil || taken.Owner != "bob" {
+		t.Errorf("acquire of an expired lease: %+v, %v", taken, err)
+	}
+}
+
+func TestLockedWrites(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig(), testKeys)
+	u := createUser(t, h, "Ada")
+	path := "/v1/users/" + u.ID
+	w := do(h, http.MethodPost, path+"/lock", `{"owner":"ada","ttl":"1m"}`, apiKeyHeader, editorKey)
+	if w.Code != http.StatusOK {
+		t.Fatalf("lock: %d %s", w.Code, w.Body)
+	}
+	var l lease
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil || l.Token == "" {
+		t.Fatalf("lease %s: %v", w.Body, err)
+	}
+
+	if w := do(h, http.MethodPut, path, `{"name":"Eve"}`, apiKeyHeader, adminKey); w.Code != http.StatusLocked {
+		t.Errorf("update without the token: %d, want 423", w.Code)
+	}
+	if w := do(h, http.MethodDelete, path, "", apiKeyHeader, adminKey); w.Code != http.StatusLocked {
+		t.Errorf("delete without the token: %d, want 423", w.Code)
+	}
+	if w := do(h, http.MethodPut, path, `{"name":"Ann"}`, apiKeyHeader, adminKey, "X-Lock-Token", l.Token); w.Code != http.StatusOK {
+		t.Errorf("update with the token: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodDelete, path+"/lock", "", apiKeyHeader, editorKey, "X-Lock-Token", l.Token); w.Code != http.StatusNoContent {
+		t.Errorf("unlock: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPut, path, `{"name":"Eve"}`, apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Errorf("update once unlocked: %d %s", w.Code, w.Body)
+	}
+}
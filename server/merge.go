@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+// sides of a merge, giving the precedence of fields set on both users
+const (
+	preferTarget = "target"
+	preferSource = "source"
+)
+
+// mergeRequest is the body of a merge. Prefer tells which user wins
+// the fields set on both, and Fields overrides it per field: name,
+// metadata or external_ids. Tags are always the union of both users.
+type mergeRequest struct {
+	Source string            `json:"source"`
+	Prefer string            `json:"prefer"`
+	Fields map[string]string `json:"fields"`
+}
+
+// merged is the data of the user.merged events
+type merged struct {
+	Target store.User `json:"target"`
+	Source string     `json:"source"`
+}
+
+// Merge merges the source user of the request into the user of the path,
+// for de-duplication workflows. The source is soft-deleted: deactivated,
+// stripped of its external ids, which may move to the target, and
+// pointed at the target by merged_into. Services owning resources of the
+// source re-point them on the user.merged event.
+func (h *userHandler) Merge(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	req := mergeRequest{Prefer: preferTarget}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Source == "" {
+		badRequest(w, r)
+		return
+	}
+	if req.Source == id {
+		invalid(w, r, "a user cannot be merged into itself")
+		return
+	}
+	prefer, err := mergePrecedence(req)
+	if err != nil {
+		invalid(w, r, err.Error())
+		return
+	}
+	token := r.Header.Get("X-Lock-Token")
+	if h.locks.check(id, token) != nil || h.locks.check(req.Source, token) != nil {
+		locked(w, r)
+		return
+	}
+	if !h.reachable(w, r, id, req.Source) {
+		return
+	}
+
+	u, rev, err := h.merge(r.Context(), id, req.Source, prefer)
+	var invalidErr invalidUserError
+	switch {
+	case errors.As(err, &invalidErr):
+		invalid(w, r, err.Error())
+		return
+	case errors.Is(err, errAlreadyMerged):
+		conflict(w, r)
+		return
+	case err != nil:
+		storeError(w, r, err)
+		return
+	}
+	setRev(w, rev)
+	w.Header().Set("ETag", versionTag(u.Version))
+
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// errAlreadyMerged is returned when merging a user already merged into
+// another one
+var errAlreadyMerged = errors.New("user already merged")
+
+// invalidUserError is returned when a change would make a user invalid
+type invalidUserError struct{ error }
+
+// merge merges the user sourceID into targetID, fields set on both
+// users being taken from the side given by prefer
+func (d *deps) merge(ctx context.Context, targetID, sourceID string, prefer map[string]string) (store.User, uint64, error) {
+	target, _, err := d.store.Get(ctx, targetID, store.Strong)
+	if err != nil {
+		return store.User{}, 0, err
+	}
+	source, _, err := d.store.Get(ctx, sourceID, store.Strong)
+	if err != nil {
+		return store.User{}, 0, err
+	}
+	if target.MergedInto != "" || source.MergedInto != "" {
+		return store.User{}, 0, errAlreadyMerged
+	}
+	u, err := mergeUsers(target, source, prefer)
+	if err == nil {
+		err = checkMetadata(u.Metadata)
+	}
+	if err == nil {
+		err = checkExternalIDs(u.ExternalIDs)
+	}
+	if err != nil {
+		return store.User{}, 0, invalidUserError{err}
+	}
+	stampDeactivation(&u, &target, d.clock.Now())
+
+	// the source is retired first, freeing its external ids for the target
+	retired := source
+	retired.Active = false
+	retired.ExternalIDs = nil
+	retired.MergedInto = target.ID
+	stampDeactivation(&retired, &source, d.clock.Now())
+	retired, _, err = d.store.CompareAndSwap(d.withUserEvent(ctx, events.UserDeactivated), source.ID, source.Version, retired)
+	if err != nil {
+		return store.User{}, 0, err
+	}
+	mergedCtx := d.withEvent(ctx, events.UserMerged, func(u store.User) any {
+		if u.Quarantine != nil {
+			return nil
+		}
+		return merged{Target: u, Source: source.ID}
+	})
+	u, rev, err := d.store.CompareAndSwap(mergedCtx, target.ID, target.Version, u)
+	if err != nil {
+		if _, _, rerr := d.store.CompareAndSwap(d.withUserEvent(ctx, events.UserUpdated), source.ID, retired.Version, source); rerr != nil {
+			d.logger.ErrorContext(ctx, "restoring merge source", "source", source.ID, "target", target.ID, "err", rerr)
+		}
+		return store.User{}, 0, err
+	}
+	identity, _ := IdentityFrom(ctx)
+	d.logger.InfoContext(ctx, "users merged", "source", source.ID, "target", u.ID, "by", identity.Subject)
+	return u, rev, nil
+}
+
+// mergePrecedence returns the side winning each mergeable field
+func mergePrecedence(req mergeRequest) (map[string]string, error) {
+	prefer := map[string]string{"name": req.Prefer, "metadata": req.Prefer, "external_ids": req.Prefer}
+	for field, side := range req.Fields {
+		if _, ok := prefer[field]; !ok {
+			return nil, fmt.Errorf("unknown merge field %q", field)
+		}
+		prefer[field] = side
+	}
+	for field, side := range prefer {
+		if side != preferTarget && side != preferSource {
+			return nil, fmt.Errorf("invalid precedence %q for %s: must be %s or %s", side, field, preferTarget, preferSource)
+		}
+	}
+	return prefer, nil
+}
+
+// mergeUsers returns target with the fields of source merged in
+func mergeUsers(target, source store.User, prefer map[string]string) (store.User, error) {
+	var err error
+	u := target
+	if prefer["name"] == preferSource && source.Name != "" || u.Name == "" {
+		u.Name = source.Name
+	}
+	u.Active = target.Active || source.Active
+	if u.Quarantine == nil {
+		// merging doesn't lift the quarantine of the source
+		u.Quarantine = source.Quarantine
+	}
+	if u.Tags, err = normalizeTags(append(append([]string(nil), target.Tags...), source.Tags...)); err != nil {
+		return store.User{}, err
+	}
+	u.Metadata = mergeMaps(target.Metadata, source.Metadata, prefer["metadata"] == preferSource)
+	u.ExternalIDs = mergeMaps(target.ExternalIDs, source.ExternalIDs, prefer["external_ids"] == preferSource)
+	return u, nil
+}
+
+// mergeMaps returns the union of target and source, the values of
+// source winning over those of target when preferSource is set
+func mergeMaps(target, source map[string]string, preferSource bool) map[string]string {
+	if len(target) == 0 && len(source) == 0 {
+		return nil
+	}
+	m := maps.Clone(target)
+	if m == nil {
+		m = map[string]string{}
+	}
+	for k, v := range source {
+		if _, ok := m[k]; !ok || preferSource {
+			m[k] = v
+		}
+	}
+	return m
+}
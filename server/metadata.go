@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxMetadataKeys     = 50
+	maxMetadataKeyLen   = 64   // in bytes
+	maxMetadataValueLen = 512  // in bytes
+	maxMetadataSize     = 8192 // sum of the keys and values, in bytes
+)
+
+var metadataKeyRe = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// checkMetadata checks the metadata of a user is within the limits
+func checkMetadata(md map[string]string) error {
+	if len(md) > maxMetadataKeys {
+		return fmt.Errorf("too many metadata keys: at most %d are allowed", maxMetadataKeys)
+	}
+	size := 0
+	for k, v := range md {
+		if len(k) > maxMetadataKeyLen || !metadataKeyRe.MatchString(k) {
+			return fmt.Errorf("invalid metadata key %q: keys are up to %d letters, digits or _.:- characters", k, maxMetadataKeyLen)
+		}
+		if len(v) > maxMetadataValueLen || !utf8.ValidString(v) {
+			return fmt.Errorf("invalid value for metadata key %q: values are up to %d bytes of UTF-8", k, maxMetadataValueLen)
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxMetadataSize {
+		return fmt.Errorf("metadata too large: at most %d bytes are allowed", maxMetadataSize)
+	}
+	return nil
+}
+
+// metadataQuery reads the metadata filters of a listing: metadata_key=k
+// selects the users having the key k, metadata.k=v those where it is v.
+// An empty v is refused, rather than taken for metadata_key=k.
+func metadataQuery(q url.Values) (map[string]string, error) {
+	md := map[string]string{}
+	for _, k := range q["metadata_key"] {
+		md[k] = ""
+	}
+	for param, vs := range q {
+		if k, ok := strings.CutPrefix(param, "metadata."); ok && len(vs) > 0 {
+			if vs[0] == "" {
+				return nil, fmt.Errorf("%s: empty value, select the users having the key with metadata_key=%s", param, k)
+			}
+			md[k] = vs[0]
+		}
+	}
+	if len(md) == 0 {
+		return nil, nil
+	}
+	return md, nil
+}
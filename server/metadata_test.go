@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestMetadataQuery(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  map[string]string
+	}{
+		{"", nil},
+		{"metadata_key=team", map[string]string{"team": ""}},
+		{"metadata.team=web&metadata_key=city", map[string]string{"team": "web", "city": ""}},
+	} {
+		q, _ := url.ParseQuery(tc.query)
+		md, err := metadataQuery(q)
+		if err != nil || len(md) != len(tc.want) {
+			t.Errorf("%q: %v, %v, want %v", tc.query, md, err, tc.want)
+			continue
+		}
+		for k, v := range tc.want {
+			if got, ok := md[k]; !ok || got != v {
+				t.Errorf("%q: %v, want %v", tc.query, md, tc.want)
+			}
+		}
+	}
+	for _, query := range []string{"metadata.team=", "metadata.team"} {
+		q, _ := url.ParseQuery(query)
+		if md, err := metadataQuery(q); err == nil {
+			t.Errorf("%q: %v, want an error", query, md)
+		}
+	}
+
+	h, _ := newTestServer(t, DefaultConfig())
+	if w := do(h, http.MethodGet, "/users?metadata.team=", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("listing by an empty metadata value: %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Chain returns the middleware applying m in order, the first being the
+// outermost
+func Chain(m ...Middleware) Middleware {
+	return func(h http.Handler) http.Handler {
+		for i := len(m) - 1; i >= 0; i-- {
+			h = m[i](h)
+		}
+		return h
+	}
+}
+
+// Recover answers 500 to the requests whose handler panics, logging the
+// panic with its stack, rather than letting net/http drop the
+// connection. The server recovers outside of the middleware given to
+// it, so their panics are caught too.
+func Recover(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = withRequestID(w, r)
+			rw := &recoverWriter{ResponseWriter: w}
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p) // the handler meant to abort the response
+				}
+				logger.Error("panic serving request", "method", r.Method, "path", r.URL.Path,
+					"request_id", requestID(r), "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+				if !rw.wroteHeader {
+					internalServerError(w, r)
+				}
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// LogRequests logs every request once answered, with its method, path,
+// status, latency, bytes written, remote address, request id and, once
+// authenticated, client. The 5xx are logged as errors.
+func LogRequests(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			r = withRequestID(w, r)
+			var subject string
+			r = r.WithContext(context.WithValue(r.Context(), subjectKey{}, &subject))
+			sw := newStatusWriter(w)
+			next.ServeHTTP(sw, r)
+			level := slog.LevelInfo
+			if sw.status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", sw.status),
+				slog.Duration("latency", time.Since(start)),
+				slog.Int("bytes", sw.bytes),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("request_id", requestID(r)),
+			}
+			if subject != "" {
+				attrs = append(attrs, slog.String("client", subject))
+			}
+			logger.LogAttrs(r.Context(), level, "request", attrs...)
+		})
+	}
+}
+
+// recoverWriter tells whether the response was started, so a panic
+// after it isn't answered twice
+type recoverWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *recoverWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoverWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the wrapped writer
+func (w *recoverWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
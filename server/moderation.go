@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/santisdev/go-restapi.git/moderation"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/validate"
+)
+
+// DefaultFilteredFields are the fields of the users the content filter
+// checks, unless configured
+var DefaultFilteredFields = []string{"name"}
+
+// contentFilter checks the fields of the users written against a
+// content policy
+type contentFilter struct {
+	filter moderation.Filter
+	// fields are the paths of the fields checked, as name, tags,
+	// metadata for all its values or metadata.bio for one
+	fields []string
+	// quarantine quarantines the users breaking the policy rather than
+	// refusing them
+	quarantine bool
+}
+
+// check returns the fields of u breaking the policy, or the error of
+// the filter failing to tell
+func (c *contentFilter) check(ctx context.Context, u store.User) (validate.Errors, error) {
+	var errs validate.Errors
+	for _, f := range c.fields {
+		for _, v := range fieldValues(u, f) {
+			err := c.filter.Check(ctx, v[0], v[1])
+			var violation *moderation.Violation
+			if errors.As(err, &violation) {
+				errs = append(errs, validate.FieldError{Field: violation.Field, Rule: "content", Message: violation.Reason})
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return errs, nil
+}
+
+// screen checks u against the policy, returning the fields breaking
+// it, or quarantining u instead when configured so
+func (c *contentFilter) screen(ctx context.Context, u *store.User) (validate.Errors, error) {
+	errs, err := c.check(ctx, *u)
+	if err != nil || len(errs) == 0 || !c.quarantine {
+		return errs, err
+	}
+	if u.Quarantine == nil {
+		u.Quarantine = &store.Quarantine{Reason: errs.Error(), By: "content-filter"}
+	}
+	return nil, nil
+}
+
+// fieldValues returns the values of the field of u at path, with their
+// own path
+func fieldValues(u store.User, path string) [][2]string {
+	switch {
+	case path == "name":
+		return [][2]string{{"name", u.Name}}
+	case path == "tags":
+		values := make([][2]string, len(u.Tags))
+		for i, t := range u.Tags {
+			values[i] = [2]string{"tags", t}
+		}
+		return values
+	case path == "metadata":
+		keys := make([]string, 0, len(u.Metadata))
+		for k := range u.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		values := make([][2]string, len(keys))
+		for i, k := range keys {
+			values[i] = [2]string{"metadata." + k, u.Metadata[k]}
+		}
+		return values
+	case strings.HasPrefix(path, "metadata."):
+		if v, ok := u.Metadata[strings.TrimPrefix(path, "metadata.")]; ok {
+			return [][2]string{{path, v}}
+		}
+	}
+	return nil
+}
+
+// moderated checks u against the content filter, if any, answering 422
+// listing the fields breaking its policy, or 503 when the filter fails.
+// The filter quarantining rather than refusing sets the quarantine of u.
+func moderated(w http.ResponseWriter, r *http.Request, c *contentFilter, d *deps, u *store.User) bool {
+	if c == nil {
+		return true
+	}
+	errs, err := c.screen(r.Context(), u)
+	if err != nil {
+		d.logger.ErrorContext(r.Context(), "filtering content", "err", err)
+		serviceUnavailable(w, r)
+		return false
+	}
+	if len(errs) > 0 {
+		writeError(w, r, http.StatusUnprocessableEntity, codePolicyViolation, "content policy violation", errs)
+		return false
+	}
+	return true
+}
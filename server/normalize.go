@@ -0,0 +1,46 @@
+package server
+
+import (
+	"maps"
+	"strings"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeUser puts the fields of u given by the clients in their
+// canonical form before they are checked and saved, so the same name or
+// email typed differently is stored alike: the text is trimmed and in
+// Unicode NFC, the spaces within the name collapsed and the email in
+// lower case
+func normalizeUser(u *store.User) {
+	u.Name = strings.Join(strings.Fields(norm.NFC.String(u.Name)), " ")
+	u.Metadata = normalizeValues(u.Metadata, func(k, v string) string {
+		v = strings.TrimSpace(norm.NFC.String(v))
+		if k == emailKey {
+			v = strings.ToLower(v)
+		}
+		return v
+	})
+	u.ExternalIDs = normalizeValues(u.ExternalIDs, func(_, id string) string {
+		return strings.TrimSpace(norm.NFC.String(id))
+	})
+}
+
+// normalizeValues returns m with its values normalized by fn, copied
+// when any changes as m may be the one of a user in the store
+func normalizeValues(m map[string]string, fn func(k, v string) string) map[string]string {
+	var out map[string]string
+	for k, v := range m {
+		if n := fn(k, v); n != v {
+			if out == nil {
+				out = maps.Clone(m)
+			}
+			out[k] = n
+		}
+	}
+	if out == nil {
+		return m
+	}
+	return out
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestNormalizeUser(t *testing.T) {
+	// decomposed: e and a combining acute, A and a combining ring, the
+	// jamos of a Hangul syllable
+	meta := map[string]string{emailKey: " Rene\u0301@Example.com ", "city": "Que\u0301bec"}
+	u := store.User{
+		Name:        "  Rene\u0301 \t Dupont  \u1112\u1161\u11ab ",
+		Metadata:    meta,
+		ExternalIDs: map[string]string{"crm": " A\u030a1 "},
+	}
+	normalizeUser(&u)
+	if want := "Ren\u00e9 Dupont \ud55c"; u.Name != want {
+		t.Errorf("name %q, want %q", u.Name, want)
+	}
+	if want := "ren\u00e9@example.com"; u.Metadata[emailKey] != want {
+		t.Errorf("email %q, want %q", u.Metadata[emailKey], want)
+	}
+	if want := "Qu\u00e9bec"; u.Metadata["city"] != want {
+		t.Errorf("city %q, want %q", u.Metadata["city"], want)
+	}
+	if want := "\u00c51"; u.ExternalIDs["crm"] != want {
+		t.Errorf("external id %q, want %q", u.ExternalIDs["crm"], want)
+	}
+	// the map given is the user's in the store, left alone
+	if meta[emailKey] != " Rene\u0301@Example.com " {
+		t.Errorf("metadata given changed to %q", meta[emailKey])
+	}
+}
@@ -0,0 +1,499 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+const (
+	maxFilterLen   = 2048 // in bytes
+	maxFilterDepth = 16   // of the nested parentheses and not
+)
+
+// odataOptions are the OData query options of a listing, for the BI
+// tools speaking OData: $filter, $orderby, $top, $skip, $select and
+// $count
+type odataOptions struct {
+	filter  store.Filter
+	orderBy []odataOrder
+	top     int // from $top, bounded by the page size of the route
+	skip    int
+	selects []string
+	count   bool
+}
+
+type odataOrder struct {
+	field string
+	desc  bool
+}
+
+// the fields $select can return, as named in the JSON of the users
+var selectable = []string{"id", "name", "active", "tags", "metadata", "external_ids", "merged_into", "version"}
+
+// parseOData reads the OData query options of q, returning nil when
+// there are none
+func parseOData(q url.Values) (*odataOptions, error) {
+	opts := &odataOptions{}
+	found := false
+	for param := range q {
+		switch param {
+		case "$filter", "$orderby", "$top", "$skip", "$select", "$count":
+			found = true
+		default:
+			if strings.HasPrefix(param, "$") {
+				return nil, fmt.Errorf("unsupported query option %s", param)
+			}
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	if s := q.Get("$filter"); s != "" {
+		if len(s) > maxFilterLen {
+			return nil, fmt.Errorf("$filter: longer than %d bytes", maxFilterLen)
+		}
+		f, err := parseFilter(s)
+		if err != nil {
+			return nil, fmt.Errorf("$filter: %w", err)
+		}
+		opts.filter = f
+	}
+	if s := q.Get("$orderby"); s != "" {
+		for _, item := range strings.Split(s, ",") {
+			parts := strings.Fields(item)
+			if len(parts) == 0 || len(parts) > 2 {
+				return nil, fmt.Errorf("$orderby: invalid item %q", item)
+			}
+			field, ok := filterField(parts[0])
+			if !ok || field == "tags" {
+				return nil, fmt.Errorf("$orderby: unknown field %q", parts[0])
+			}
+			o := odataOrder{field: field}
+			if len(parts) == 2 {
+				switch parts[1] {
+				case "asc":
+				case "desc":
+					o.desc = true
+				default:
+					return nil, fmt.Errorf("$orderby: invalid direction %q", parts[1])
+				}
+			}
+			opts.orderBy = append(opts.orderBy, o)
+		}
+	}
+	if s := q.Get("$skip"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("$skip: not a non-negative integer")
+		}
+		opts.skip = n
+	}
+	if s := q.Get("$select"); s != "" {
+		for _, field := range strings.Split(s, ",") {
+			field = strings.TrimSpace(field)
+			if !slices.Contains(selectable, field) {
+				return nil, fmt.Errorf("$select: unknown field %q", field)
+			}
+			opts.selects = append(opts.selects, field)
+		}
+	}
+	switch q.Get("$count") {
+	case "", "false":
+	case "true":
+		opts.count = true
+	default:
+		return nil, fmt.Errorf("$count: not a boolean")
+	}
+	return opts, nil
+}
+
+// write orders, pages and projects the users selected by the
+// filter, answering them as an OData collection
+func (opts *odataOptions) write(w http.ResponseWriter, r *http.Request, users []store.User) {
+	if len(opts.orderBy) > 0 {
+		sort.SliceStable(users, func(i, j int) bool {
+			for _, o := range opts.orderBy {
+				a, _ := store.FieldValue(users[i], o.field)
+				b, _ := store.FieldValue(users[j], o.field)
+				if c, _ := store.CompareValues(a, b); c != 0 {
+					return (c < 0) != o.desc
+				}
+			}
+			return false
+		})
+	}
+	total := len(users)
+	users = users[min(opts.skip, len(users)):]
+	var next string
+	if opts.top < len(users) {
+		users = users[:opts.top]
+		// server-driven paging: the page size is ours, so the client
+		// follows the link for the rest
+		if q := r.URL.Query(); !q.Has("$top") {
+			q.Set("$skip", strconv.Itoa(opts.skip+opts.top))
+			next = r.URL.Path + "?" + q.Encode()
+		}
+	}
+
+	value := make([]any, 0, len(users))
+	for _, u := range users {
+		if len(opts.selects) == 0 {
+			value = append(value, u)
+			continue
+		}
+		b, err := json.Marshal(u)
+		if err != nil {
+			internalServerError(w, r)
+			return
+		}
+		var all, projected map[string]json.RawMessage
+		json.Unmarshal(b, &all)
+		projected = map[string]json.RawMessage{}
+		for _, field := range opts.selects {
+			if v, ok := all[field]; ok {
+				projected[field] = v
+			}
+		}
+		value = append(value, projected)
+	}
+
+	resp := struct {
+		Count    *int   `json:"@odata.count,omitempty"`
+		Value    []any  `json:"value"`
+		NextLink string `json:"@odata.nextLink,omitempty"`
+	}{Value: value, NextLink: next}
+	if opts.count {
+		resp.Count = &total
+	}
+	jsonBytes, err := json.Marshal(resp)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// filterField maps a property path of OData to a field of store.Filter
+func filterField(path string) (string, bool) {
+	switch path {
+	case "id", "name", "active", "version", "tags":
+		return path, true
+	}
+	if k, ok := strings.CutPrefix(path, "metadata/"); ok && k != "" && metadataKeyRe.MatchString(k) {
+		return "metadata." + k, true
+	}
+	return "", false
+}
+
+// parseFilter parses an OData $filter into a store.Filter. It supports
+// the comparisons eq, ne, gt, ge, lt and le, the functions contains,
+// startswith and endswith, and, or, not, parentheses, and any() on the
+// tags, as in tags/any(t: t eq 'vip').
+func parseFilter(s string) (store.Filter, error) {
+	toks, err := lexFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	return f, nil
+}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokString
+	tokNumber
+	tokPunct // ( ) , :
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string // unquoted for strings
+}
+
+func lexFilter(s string) ([]filterToken, error) {
+	var toks []filterToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("(),:", c) >= 0:
+			toks = append(toks, filterToken{tokPunct, string(c)})
+			i++
+		case c == '\'':
+			var b strings.Builder
+			for i++; ; i++ {
+				if i == len(s) {
+					return nil, fmt.Errorf("unterminated string")
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(s[i])
+			}
+			toks = append(toks, filterToken{tokString, b.String()})
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(s) && (s[j] == '.' || (s[j] >= '0' && s[j] <= '9')) {
+				j++
+			}
+			toks = append(toks, filterToken{tokNumber, s[i:j]})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '/' || s[j] == '.' || s[j] == '-' ||
+				unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			toks = append(toks, filterToken{tokIdent, s[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return toks, nil
+}
+
+type filterParser struct {
+	toks  []filterToken
+	pos   int
+	depth int
+}
+
+// nest enters a nested expression, failing past maxFilterDepth. The
+// returned function leaves it.
+func (p *filterParser) nest() (func(), error) {
+	if p.depth == maxFilterDepth {
+		return nil, fmt.Errorf("nested deeper than %d", maxFilterDepth)
+	}
+	p.depth++
+	return func() { p.depth-- }, nil
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos == len(p.toks) {
+		return filterToken{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("unexpected end of filter")
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *filterParser) accept(kind tokenKind, text string) bool {
+	if t, ok := p.peek(); ok && t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(text string) error {
+	if !p.accept(tokPunct, text) {
+		return fmt.Errorf("expected %q", text)
+	}
+	return nil
+}
+
+func (p *filterParser) or() (store.Filter, error) {
+	f, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	or := store.Or{f}
+	for p.accept(tokIdent, "or") {
+		if f, err = p.and(); err != nil {
+			return nil, err
+		}
+		or = append(or, f)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *filterParser) and() (store.Filter, error) {
+	f, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	and := store.And{f}
+	for p.accept(tokIdent, "and") {
+		if f, err = p.unary(); err != nil {
+			return nil, err
+		}
+		and = append(and, f)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *filterParser) unary() (store.Filter, error) {
+	leave, err := p.nest()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	if p.accept(tokIdent, "not") {
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return store.Not{Filter: f}, nil
+	}
+	if p.accept(tokPunct, "(") {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	}
+	return p.predicate("")
+}
+
+// predicate parses a comparison or a function call. Within any(), the
+// lambda variable stands for the tags.
+func (p *filterParser) predicate(variable string) (store.Filter, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind != tokIdent {
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	switch op := store.Op(t.text); op {
+	case store.Contains, store.StartsWith, store.EndsWith:
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		field, err := p.field(variable)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		v, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := v.(string); !ok {
+			return nil, fmt.Errorf("%s: expected a string", op)
+		}
+		return store.Compare{Field: field, Op: op, Value: v}, p.expect(")")
+	}
+	if t.text == "tags/any" && variable == "" {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		v, err := p.next()
+		if err != nil || v.kind != tokIdent {
+			return nil, fmt.Errorf("tags/any: expected a lambda variable")
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		f, err := p.predicate(v.text)
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	}
+	p.pos--
+
+	field, err := p.field(variable)
+	if err != nil {
+		return nil, err
+	}
+	opTok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op := store.Op(opTok.text)
+	switch op {
+	case store.Eq, store.Ne, store.Gt, store.Ge, store.Lt, store.Le:
+	default:
+		return nil, fmt.Errorf("unknown operator %q", opTok.text)
+	}
+	v, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	return store.Compare{Field: field, Op: op, Value: v}, nil
+}
+
+// field parses a property path, or the lambda variable standing for the
+// tags. The tags can only be compared within any().
+func (p *filterParser) field(variable string) (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if t.kind == tokIdent && variable != "" && t.text == variable {
+		return "tags", nil
+	}
+	field, ok := filterField(t.text)
+	if t.kind != tokIdent || !ok || field == "tags" {
+		return "", fmt.Errorf("unknown field %q", t.text)
+	}
+	return field, nil
+}
+
+func (p *filterParser) literal() (any, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t.kind == tokString:
+		return t.text, nil
+	case t.kind == tokNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return n, nil
+	case t.kind == tokIdent && t.text == "true":
+		return true, nil
+	case t.kind == tokIdent && t.text == "false":
+		return false, nil
+	case t.kind == tokIdent && t.text == "null":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("expected a literal, got %q", t.text)
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestParseFilter(t *testing.T) {
+	name := func(op store.Op, v any) store.Compare { return store.Compare{Field: "name", Op: op, Value: v} }
+	tests := []struct {
+		filter string
+		want   store.Filter
+	}{
+		{"name eq 'Ada'", name(store.Eq, "Ada")},
+		{"version ge 2", store.Compare{Field: "version", Op: store.Ge, Value: 2.0}},
+		{"version gt -1.5", store.Compare{Field: "version", Op: store.Gt, Value: -1.5}},
+		{"active eq false", store.Compare{Field: "active", Op: store.Eq, Value: false}},
+		{"metadata/plan ne null", store.Compare{Field: "metadata.plan", Op: store.Ne, Value: nil}},
+		{"startswith(name,'A')", name(store.StartsWith, "A")},
+		{"contains(metadata/team, 'ops')", store.Compare{Field: "metadata.team", Op: store.Contains, Value: "ops"}},
+		{"tags/any(t: t eq 'vip')", store.Compare{Field: "tags", Op: store.Eq, Value: "vip"}},
+
+		// string escapes
+		{"name eq 'O''Brien'", name(store.Eq, "O'Brien")},
+		{"name eq ''''", name(store.Eq, "'")},
+		{"name eq ''", name(store.Eq, "")},
+		{"name eq 'a and b'", name(store.Eq, "a and b")},
+
+		// precedence: not over and over or, parentheses first
+		{"name eq 'a' or name eq 'b' and name eq 'c'",
+			store.Or{name(store.Eq, "a"), store.And{name(store.Eq, "b"), name(store.Eq, "c")}}},
+		{"(name eq 'a' or name eq 'b') and name eq 'c'",
+			store.And{store.Or{name(store.Eq, "a"), name(store.Eq, "b")}, name(store.Eq, "c")}},
+		{"not name eq 'a' and name eq 'b'",
+			store.And{store.Not{Filter: name(store.Eq, "a")}, name(store.Eq, "b")}},
+		{"not (name eq 'a' and name eq 'b')",
+			store.Not{Filter: store.And{name(store.Eq, "a"), name(store.Eq, "b")}}},
+		{"name eq 'a' or name eq 'b' or name eq 'c'",
+			store.Or{name(store.Eq, "a"), name(store.Eq, "b"), name(store.Eq, "c")}},
+		{strings.Repeat("(", maxFilterDepth-1) + "name eq 'a'" + strings.Repeat(")", maxFilterDepth-1), name(store.Eq, "a")},
+	}
+	for _, tt := range tests {
+		got, err := parseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %#v\nwant %#v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterInvalid(t *testing.T) {
+	for _, filter := range []string{
+		// malformed
+		"",
+		"name",
+		"name eq",
+		"name eq 'Ada",
+		"name eq 'Ada' and",
+		"name eq 'Ada')",
+		"(name eq 'Ada'",
+		"name eq 'Ada' name eq 'Bob'",
+		"name like 'Ada'",
+		"name eq Ada",
+		"name eq 1.2.3",
+		"name eq 'a' & name eq 'b'",
+		"startswith(name 'A')",
+		"startswith(name, 1)",
+		"tags/any(t t eq 'vip')",
+		"tags/any(t: t eq 'vip'",
+		// unknown fields
+		"email eq 'ada@example.com'",
+		"metadata/ eq 'x'",
+		"metadata/a b eq 'x'",
+		"tags eq 'vip'",
+		"tags/any(t: u eq 'vip')",
+		"tags/any(t: tags/any(u: u eq 'vip'))",
+		// too deep
+		strings.Repeat("(", maxFilterDepth) + "name eq 'a'" + strings.Repeat(")", maxFilterDepth),
+		strings.Repeat("not ", maxFilterDepth) + "name eq 'a'",
+	} {
+		if f, err := parseFilter(filter); err == nil {
+			t.Errorf("%q parsed as %#v", filter, f)
+		}
+	}
+}
+
+func TestParseOData(t *testing.T) {
+	opts, err := parseOData(url.Values{"status": {"all"}})
+	if err != nil || opts != nil {
+		t.Errorf("no options parsed as %+v, %v", opts, err)
+	}
+	opts, err = parseOData(url.Values{
+		"$orderby": {"metadata/plan desc,name"},
+		"$skip":    {"5"},
+		"$select":  {"id, name"},
+		"$count":   {"true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &odataOptions{
+		orderBy: []odataOrder{{"metadata.plan", true}, {"name", false}},
+		skip:    5,
+		selects: []string{"id", "name"},
+		count:   true,
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %+v, want %+v", opts, want)
+	}
+
+	for _, q := range []url.Values{
+		{"$expand": {"manager"}},
+		{"$orderby": {"tags"}},
+		{"$orderby": {"name up"}},
+		{"$skip": {"-1"}},
+		{"$skip": {"many"}},
+		{"$select": {"secret"}},
+		{"$count": {"yes"}},
+		{"$filter": {strings.Repeat("x", maxFilterLen+1)}},
+	} {
+		if opts, err := parseOData(q); err == nil {
+			t.Errorf("%v parsed as %+v", q, opts)
+		}
+	}
+}
+
+func TestListOData(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	for _, u := range []string{
+		`{"name":"Ada","tags":["vip"],"metadata":{"plan":"pro"}}`,
+		`{"name":"Alan","metadata":{"plan":"free"}}`,
+		`{"name":"Grace","tags":["vip"]}`,
+		`{"name":"Anita","tags":["vip"],"active":false}`,
+	} {
+		if w := do(h, http.MethodPost, "/users", u); w.Code != http.StatusCreated {
+			t.Fatalf("creating %s: %d %s", u, w.Code, w.Body)
+		}
+	}
+
+	q := url.Values{
+		"$filter":  {"startswith(name,'A') and (tags/any(t: t eq 'vip') or metadata/plan eq 'free')"},
+		"$orderby": {"name desc"},
+		"$select":  {"name"},
+		"$top":     {"1"},
+		"$count":   {"true"},
+	}
+	w := do(h, http.MethodGet, "/users?"+q.Encode(), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: %d %s", w.Code, w.Body)
+	}
+	if got, want := w.Body.String(), `{"@odata.count":2,"value":[{"name":"Alan"}]}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// the status still applies
+	q.Set("status", "all")
+	w = do(h, http.MethodGet, "/users?"+q.Encode(), "")
+	var resp struct {
+		Count int `json:"@odata.count"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Count != 3 {
+		t.Errorf("listing every status: %s", w.Body)
+	}
+
+	if w := do(h, http.MethodGet, "/users?$filter="+url.QueryEscape("name eq"), ""); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid filter answered %d, want 422", w.Code)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+const (
+	relayBatch    = 100              // events relayed from the outbox at once
+	relayInterval = 10 * time.Second // between the retries of a failed relay
+)
+
+// withEvent returns ctx giving the writes made with it an event of type
+// typ, whose data is built from the user written. There is none when
+// data returns nil.
+func (d *deps) withEvent(ctx context.Context, typ string, data func(u store.User) any) context.Context {
+	return store.WithEvents(ctx, func(u store.User) ([][]byte, error) {
+		payload := data(u)
+		if payload == nil {
+			return nil, nil
+		}
+		evs, err := d.newEvents(typ, u.ID, payload)
+		if err != nil {
+			return nil, err
+		}
+		encoded := make([][]byte, len(evs))
+		for i, e := range evs {
+			if encoded[i], err = json.Marshal(e); err != nil {
+				return nil, err
+			}
+		}
+		return encoded, nil
+	})
+}
+
+// withUserEvent is withEvent with the user written as data, unless it
+// is quarantined
+func (d *deps) withUserEvent(ctx context.Context, typ string) context.Context {
+	return d.withEvent(ctx, typ, func(u store.User) any {
+		if u.Quarantine != nil {
+			return nil
+		}
+		return u
+	})
+}
+
+// relay publishes the events committed to the outbox of the store until
+// ctx is done, as soon as they are written
+func (d *deps) relay(ctx context.Context, outbox store.Outbox) {
+	for ctx.Err() == nil {
+		n, changed, err := outbox.RelayEvents(ctx, relayBatch, func(data []byte) error {
+			var e events.Event
+			if err := json.Unmarshal(data, &e); err != nil {
+				// dropped, since kept it would block the outbox
+				d.logger.ErrorContext(ctx, "dropping a malformed event of the outbox", "err", err)
+				return nil
+			}
+			return d.bus.Publish(ctx, e)
+		})
+		if err != nil && ctx.Err() == nil {
+			d.logger.ErrorContext(ctx, "relaying the events of the outbox", "err", err)
+		}
+		if n == relayBatch {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-d.clock.After(relayInterval):
+		}
+	}
+}
+
+// publishingStore publishes the events of the writes to a store without
+// an outbox once they are made, failures being logged since the writes
+// succeeded
+type publishingStore struct {
+	store.UserStore
+	bus    events.Bus
+	logger *slog.Logger
+}
+
+func (s publishingStore) Create(ctx context.Context, u store.User) (store.User, uint64, error) {
+	u, rev, err := s.UserStore.Create(ctx, u)
+	if err == nil {
+		s.publish(ctx, u)
+	}
+	return u, rev, err
+}
+
+func (s publishingStore) CompareAndSwap(ctx context.Context, id string, expected uint64, u store.User) (store.User, uint64, error) {
+	u, rev, err := s.UserStore.CompareAndSwap(ctx, id, expected, u)
+	if err == nil {
+		s.publish(ctx, u)
+	}
+	return u, rev, err
+}
+
+func (s publishingStore) Delete(ctx context.Context, id string) (store.User, uint64, error) {
+	u, rev, err := s.UserStore.Delete(ctx, id)
+	if err == nil {
+		s.publish(ctx, u)
+	}
+	return u, rev, err
+}
+
+func (s publishingStore) CompareAndDelete(ctx context.Context, id string, expected uint64) (store.User, uint64, error) {
+	u, rev, err := s.UserStore.CompareAndDelete(ctx, id, expected)
+	if err == nil {
+		s.publish(ctx, u)
+	}
+	return u, rev, err
+}
+
+func (s publishingStore) Replace(ctx context.Context, users []store.User) (uint64, error) {
+	rev, err := s.UserStore.Replace(ctx, users)
+	if err == nil {
+		s.publish(ctx, store.User{})
+	}
+	return rev, err
+}
+
+// publish publishes the events of the write of u made with ctx
+func (s publishingStore) publish(ctx context.Context, u store.User) {
+	encoded, err := store.Events(ctx, u)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "publishing event", "subject", u.ID, "err", err)
+		return
+	}
+	for _, data := range encoded {
+		var e events.Event
+		err := json.Unmarshal(data, &e)
+		if err == nil {
+			err = s.bus.Publish(ctx, e)
+		}
+		if err != nil {
+			s.logger.ErrorContext(ctx, "publishing event", "type", e.SchemaType(), "subject", u.ID, "err", err)
+		}
+	}
+}
+
+// unwrap returns the store under the publishing and the tracing of st,
+// for the checks of its optional interfaces, as store.Pinger
+func unwrap(st store.UserStore) store.UserStore {
+	for {
+		switch w := st.(type) {
+		case publishingStore:
+			st = w.UserStore
+		case tracedStore:
+			st = w.UserStore
+		default:
+			return st
+		}
+	}
+}
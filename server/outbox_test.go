@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/idgen"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/store/sqlite"
+
+	_ "modernc.org/sqlite"
+)
+
+// recordedEvents subscribes to bus, returning the events published
+func recordedEvents(bus events.Bus) func() []events.Event {
+	var mu sync.Mutex
+	var got []events.Event
+	bus.Subscribe(func(e events.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, e)
+	})
+	return func() []events.Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]events.Event(nil), got...)
+	}
+}
+
+func newEventsServer(t *testing.T, st store.UserStore, bus events.Bus) *Server {
+	t.Helper()
+	s, err := New(
+		WithStore(st),
+		WithEventBus(bus),
+		WithClock(clock.NewFake(testStart)),
+		WithIDGenerator(&idgen.Sequence{Prefix: "u"}),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestEventsPublished(t *testing.T) {
+	bus := events.NewMemory()
+	published := recordedEvents(bus)
+	h := newEventsServer(t, store.NewMemory(nil), bus).Handler()
+
+	u := createUser(t, h, "Ada")
+	grace := createUser(t, h, "Grace")
+	// a stale write has no event, nor a write changing nothing
+	if w := do(h, http.MethodPut, "/users/"+u.ID, `{"name":"Ada L."}`, "If-Match", `"0"`); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale update: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/users/"+u.ID+"/activate", ""); w.Code != http.StatusOK {
+		t.Fatalf("activate: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodDelete, "/users/"+u.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	got := published()
+	want := []struct{ typ, subject string }{
+		{events.UserCreated, u.ID}, {events.UserCreated, grace.ID}, {events.UserDeleted, u.ID},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d events published, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].Type != w.typ || got[i].Subject != w.subject {
+			t.Errorf("event %d: %s of %s, want %s of %s", i, got[i].Type, got[i].Subject, w.typ, w.subject)
+		}
+	}
+}
+
+func TestEventsRelayedFromOutbox(t *testing.T) {
+	ctx := context.Background()
+	st, err := sqlite.Open(ctx, sqlite.Config{Path: filepath.Join(t.TempDir(), "users.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	bus := events.NewMemory()
+	published := recordedEvents(bus)
+	s := newEventsServer(t, st, bus)
+	h := s.Handler()
+
+	u := createUser(t, h, "Ada")
+	if got := published(); len(got) != 0 {
+		t.Fatalf("events published before the relay: %+v", got)
+	}
+	// the event was committed with the user, for the relay
+	relayCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		s.relay(relayCtx, st)
+		close(done)
+	}()
+	defer func() {
+		stop()
+		<-done
+	}()
+	waitEvents(t, published, 1)
+	if w := do(h, http.MethodPost, "/users/"+u.ID+"/deactivate", ""); w.Code != http.StatusOK {
+		t.Fatalf("deactivate: %d %s", w.Code, w.Body)
+	}
+	got := waitEvents(t, published, 2)
+	if got[0].Type != events.UserCreated || got[1].Type != events.UserDeactivated || got[1].Subject != u.ID {
+		t.Errorf("events relayed: %+v", got)
+	}
+	if n, _, err := st.RelayEvents(ctx, 10, func([]byte) error { return nil }); n != 0 || err != nil {
+		t.Errorf("events left in the outbox: %d, %v", n, err)
+	}
+}
+
+// waitEvents waits for n events to be published, returning them
+func waitEvents(t *testing.T, published func() []events.Event, n int) []events.Event {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := published()
+		if len(got) >= n {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events published, want %d", len(got), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+// PageSize bounds the number of items in the pages of a route
+type PageSize struct {
+	// Default is the size of the pages when the client gives none
+	Default int
+	// Max is the largest page a client may ask for
+	Max int
+}
+
+// DefaultPageSize is the page size of the routes not configured
+var DefaultPageSize = PageSize{Default: 100, Max: 1000}
+
+func (ps PageSize) validate() error {
+	if ps.Default < 1 || ps.Max < ps.Default {
+		return fmt.Errorf("invalid page size %d, max %d: the default must be positive and at most the max", ps.Default, ps.Max)
+	}
+	return nil
+}
+
+type pageLimitKey struct{}
+
+// pageSize returns the page size of rt
+func (rr *router) pageSize(rt route) PageSize {
+	if ps, ok := rr.pageSizes[rt.method+" "+rt.path]; ok {
+		return ps
+	}
+	return rr.live.Load().PageSize
+}
+
+// limit reads the page size asked for by the limit parameter, or $top
+// for OData, enforcing the maximum of rt. The handlers of the paged
+// routes get it from pageLimit.
+func (rr *router) limit(w http.ResponseWriter, r *http.Request, rt route) (*http.Request, bool) {
+	ps := rr.pageSize(rt)
+	limit := ps.Default
+	for _, param := range []string{"limit", "$top"} {
+		v := r.URL.Query().Get(param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			invalid(w, r, fmt.Sprintf("%s: not a non-negative integer", param))
+			return r, false
+		}
+		if n > ps.Max {
+			invalid(w, r, fmt.Sprintf("%s: pages are at most %d items on this route", param, ps.Max))
+			return r, false
+		}
+		limit = n
+	}
+	return r.WithContext(context.WithValue(r.Context(), pageLimitKey{}, limit)), true
+}
+
+// pageLimit returns the number of items the page of r holds at most
+func pageLimit(r *http.Request) int {
+	if limit, ok := r.Context().Value(pageLimitKey{}).(int); ok {
+		return limit
+	}
+	return DefaultPageSize.Default
+}
+
+// offset reads the number of items to skip before the page, from the
+// offset parameter
+func offset(r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("offset")
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 0
+}
+
+// sortOrder is the order of a listing of users, by the sort parameter:
+// created, id, name, or any of them prefixed by - for the descending
+// order. Ties are broken by id.
+type sortOrder struct {
+	store.Sort
+}
+
+func parseSort(v string) (sortOrder, error) {
+	var o sortOrder
+	o.Field, o.Desc = strings.CutPrefix(v, "-")
+	switch o.Field {
+	case "":
+		o.Field = store.SortCreated
+	case store.SortCreated, store.SortID, store.SortName:
+	default:
+		return o, fmt.Errorf("sort: unknown field %q, expected created, id or name, prefixed by - for the descending order", o.Field)
+	}
+	return o, nil
+}
+
+// cursor is the position of a page in a listing: after the user of the
+// given id, and name or creation time when sorted by them
+type cursor struct {
+	Sort    string          `json:"s"`
+	Name    string          `json:"n,omitempty"`
+	Created *timestamp.Time `json:"c,omitempty"`
+	ID      string          `json:"i"`
+}
+
+// cursor returns the cursor of the page after u
+func (o sortOrder) cursor(u store.User) string {
+	c := cursor{Sort: o.String(), ID: u.ID}
+	switch o.Field {
+	case store.SortName:
+		c.Name = u.Name
+	case store.SortCreated:
+		c.Created = u.CreatedAt
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (o sortOrder) String() string {
+	if o.Desc {
+		return "-" + o.Field
+	}
+	return o.Field
+}
+
+// parseCursor reads a cursor of a listing in the given order
+func parseCursor(v string, order sortOrder) (*cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.ID == "" {
+		return nil, errors.New("cursor: invalid, use the next_cursor of the previous page")
+	}
+	if c.Sort != order.String() {
+		return nil, fmt.Errorf("cursor: for sort=%s, not %s", c.Sort, order)
+	}
+	return &c, nil
+}
+
+// user returns the user at the position of c, as the store reads it
+func (c *cursor) user() *store.User {
+	return &store.User{ID: c.ID, Name: c.Name, CreatedAt: c.Created}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listIDs lists the users at path, with the headers given as name,
+// value pairs, returning their ids
+func listIDs(t *testing.T, h http.Handler, path string, headers ...string) []string {
+	t.Helper()
+	w := do(h, http.MethodGet, path, "", headers...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", path, w.Code, w.Body)
+	}
+	var list struct {
+		Users []struct {
+			ID string `json:"id"`
+		} `json:"users"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(list.Users))
+	for _, u := range list.Users {
+		ids = append(ids, u.ID)
+	}
+	return ids
+}
+
+func TestPageSize(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PageSize = PageSize{Default: 3, Max: 5}
+	cfg.PageSizes = map[string]PageSize{"GET /users/changes": {Default: 2, Max: 2}}
+	h, clk := newTestServer(t, cfg)
+	var ids []string
+	for i := 1; i <= 12; i++ {
+		ids = append(ids, createUser(t, h, "user "+strconv.Itoa(i)).ID)
+		clk.Advance(time.Minute)
+	}
+
+	// the users are listed in the order they were created
+	for path, want := range map[string][]string{
+		"/users":                   ids[:3],
+		"/users?limit=5&offset=8":  ids[8:],
+		"/users?limit=0":           {},
+		"/users?offset=20":         {},
+		"/users?limit=2&offset=10": ids[10:],
+	} {
+		if got := listIDs(t, h, path); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("GET %s listed %v, want %v", path, got, want)
+		}
+	}
+	for path, want := range map[string]int{
+		"/users?limit=6":         http.StatusUnprocessableEntity,
+		"/users?limit=-1":        http.StatusUnprocessableEntity,
+		"/users?offset=x":        http.StatusBadRequest,
+		"/users/changes?limit=3": http.StatusUnprocessableEntity,
+	} {
+		if w := do(h, http.MethodGet, path, ""); w.Code != want {
+			t.Errorf("GET %s answered %d, want %d", path, w.Code, want)
+		}
+	}
+
+	w := do(h, http.MethodGet, "/users/changes?since=0", "")
+	var changes struct {
+		Rev     uint64            `json:"rev"`
+		Changes []json.RawMessage `json:"changes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Changes) != 2 || changes.Rev != 2 {
+		t.Errorf("changes page of %d up to rev %d, want 2 up to rev 2", len(changes.Changes), changes.Rev)
+	}
+
+	w = do(h, http.MethodGet, "/users?$count=true", "")
+	var odata struct {
+		Count    int               `json:"@odata.count"`
+		Value    []json.RawMessage `json:"value"`
+		NextLink string            `json:"@odata.nextLink"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &odata); err != nil {
+		t.Fatal(err)
+	}
+	if odata.Count != 12 || len(odata.Value) != 3 || odata.NextLink != "/users?%24count=true&%24skip=3" {
+		t.Errorf("odata page: %s", w.Body)
+	}
+}
+
+func TestPageSizeInvalid(t *testing.T) {
+	for _, ps := range []PageSize{{Default: 0, Max: 10}, {Default: 10, Max: 5}} {
+		cfg := DefaultConfig()
+		cfg.PageSizes = map[string]PageSize{"GET /users": ps}
+		if _, err := New(WithConfig(cfg)); err == nil {
+			t.Errorf("page size %+v accepted", ps)
+		}
+	}
+}
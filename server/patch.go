@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+// patchUser applies the JSON merge patch (RFC 7396) to u. The id and
+// version of u can't be patched.
+func patchUser(u store.User, patch json.RawMessage) (store.User, error) {
+	var p map[string]any
+	if err := json.Unmarshal(patch, &p); err != nil || p == nil {
+		return u, errors.New("the patch must be a JSON object")
+	}
+	if id, ok := p["id"]; ok && id != u.ID {
+		return u, errors.New("id: can't be changed")
+	}
+	delete(p, "version")
+
+	doc, err := json.Marshal(u)
+	if err != nil {
+		return u, err
+	}
+	var target map[string]any
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return u, err
+	}
+	if doc, err = json.Marshal(mergePatch(target, p)); err != nil {
+		return u, err
+	}
+	var patched store.User
+	if err := json.Unmarshal(doc, &patched); err != nil {
+		return u, errors.New("the patched user is invalid: " + err.Error())
+	}
+	patched.ID, patched.Version = u.ID, u.Version
+	return patched, nil
+}
+
+// mergePatch merges patch into target: null members are removed, objects
+// merged recursively and other values replaced
+func mergePatch(target, patch map[string]any) map[string]any {
+	if target == nil {
+		target = map[string]any{}
+	}
+	for k, v := range patch {
+		switch v := v.(type) {
+		case nil:
+			delete(target, k)
+		case map[string]any:
+			sub, _ := target[k].(map[string]any)
+			target[k] = mergePatch(sub, v)
+		default:
+			target[k] = v
+		}
+	}
+	return target
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// policy is how the responses of a route are compressed and cached
+type policy struct {
+	// compress compresses the responses for the clients accepting it
+	compress bool
+	// maxAge is how long the successful responses may be reused, zero
+	// to have them revalidated every time
+	maxAge time.Duration
+	// public lets shared caches keep the responses
+	public bool
+	// noStore forbids caching the responses at all
+	noStore bool
+}
+
+// the policies of the route tables
+var (
+	// JSON about the users, revalidated with its ETag
+	policyDynamic = policy{compress: true}
+	// sensitive or volatile data, never cached
+	policyNoStore = policy{compress: true, noStore: true}
+	// documents changing only with the deployments
+	policyStatic = policy{compress: true, public: true, maxAge: 5 * time.Minute}
+	// downloads already compressed
+	policyBlob = policy{noStore: true}
+)
+
+// cacheControl returns the Cache-Control of the successful responses
+func (p policy) cacheControl() string {
+	if p.noStore {
+		return "no-store"
+	}
+	cc := "private"
+	if p.public {
+		cc = "public"
+	}
+	if p.maxAge > 0 {
+		return cc + ", max-age=" + strconv.Itoa(int(p.maxAge.Seconds()))
+	}
+	return cc + ", no-cache"
+}
+
+// policyWriter applies the policy of a route to its responses. Errors
+// are never cached.
+type policyWriter struct {
+	http.ResponseWriter
+	policy policy
+	comp   *compression
+	// compressor is the coding the client accepts, nil for none
+	compressor Compressor
+
+	status      int
+	wroteHeader bool // whether the header was sent
+	buf         []byte
+	cw          io.WriteCloser // compressing the body, once started
+}
+
+func newPolicyWriter(w http.ResponseWriter, r *http.Request, p policy, c *compression) *policyWriter {
+	pw := &policyWriter{ResponseWriter: w, policy: p, comp: c, status: http.StatusOK}
+	if p.compress {
+		w.Header().Add("Vary", "Accept-Encoding")
+		pw.compressor = c.negotiate(r.Header.Get("Accept-Encoding"))
+	}
+	return pw
+}
+
+func (w *policyWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// Write holds the body back until it is large enough to be worth
+// compressing
+func (w *policyWriter) Write(b []byte) (int, error) {
+	switch {
+	case w.cw != nil:
+		return w.cw.Write(b)
+	case w.wroteHeader:
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.comp.minSize {
+		if err := w.flushHeader(w.compressible()); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// close sends what is held back, and ends the compressed stream
+func (w *policyWriter) close() {
+	if !w.wroteHeader {
+		w.flushHeader(false)
+	}
+	if w.cw != nil {
+		w.cw.Close()
+	}
+}
+
+// compressible tells whether the response can be compressed
+func (w *policyWriter) compressible() bool {
+	h := w.Header()
+	return w.compressor != nil && h.Get("Content-Encoding") == "" && w.comp.compresses(h.Get("content-type")) &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified
+}
+
+// flushHeader sends the header, then the body held back
+func (w *policyWriter) flushHeader(compress bool) error {
+	w.wroteHeader = true
+	h := w.Header()
+	if w.status >= 200 && w.status <= 299 || w.status == http.StatusNotModified {
+		if h.Get("Cache-Control") == "" {
+			h.Set("Cache-Control", w.policy.cacheControl())
+		}
+	} else {
+		h.Set("Cache-Control", "no-store")
+	}
+	if compress {
+		h.Set("Content-Encoding", w.compressor.Encoding())
+		h.Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if compress {
+		w.cw = w.compressor.NewWriter(w.ResponseWriter)
+		_, err := w.cw.Write(w.buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(w.buf)
+	return err
+}
+
+// Flush sends what is held back, compressed if it may be
+func (w *policyWriter) Flush() {
+	if !w.wroteHeader {
+		w.flushHeader(w.compressible())
+	}
+	if f, ok := w.cw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the wrapped writer
+func (w *policyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
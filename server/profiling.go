@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+)
+
+const (
+	maxLatencySamples = 100_000 // per window of the profiler
+	// minWindowRequests is the least requests a window must have to be
+	// checked, the percentiles of fewer being noise
+	minWindowRequests = 20
+)
+
+// Profiling configures the capture of profiles when the requests get
+// slow or fail. Zero thresholds aren't checked.
+type Profiling struct {
+	// Dir is where the profiles are written, empty disabling the capture
+	Dir string
+	// P99 is the 99th percentile latency over which profiles are taken
+	P99 time.Duration
+	// ErrorRate is the share of requests failing with 5xx over which
+	// profiles are taken
+	ErrorRate float64
+	// Window is the period the latency and errors are measured over,
+	// a minute unless set
+	Window time.Duration
+	// CPU is how long the CPU is profiled, 10 seconds unless set
+	CPU time.Duration
+	// Cooldown is the least time between two captures, 10 minutes
+	// unless set
+	Cooldown time.Duration
+}
+
+func (p Profiling) withDefaults() Profiling {
+	if p.Window == 0 {
+		p.Window = time.Minute
+	}
+	if p.CPU == 0 {
+		p.CPU = 10 * time.Second
+	}
+	if p.Cooldown == 0 {
+		p.Cooldown = 10 * time.Minute
+	}
+	return p
+}
+
+// profiler measures the requests over windows and captures a CPU
+// profile, a heap profile and a goroutine dump when a window crosses
+// the thresholds
+type profiler struct {
+	cfg    Profiling
+	clock  clock.Clock
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	requests  int
+	errors    int
+
+	lastCapture time.Time
+}
+
+func newProfiler(cfg Profiling, c clock.Clock, logger *slog.Logger) *profiler {
+	return &profiler{cfg: cfg.withDefaults(), clock: c, logger: logger}
+}
+
+// observe records a request of the current window
+func (p *profiler) observe(elapsed time.Duration, status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests++
+	if status >= 500 {
+		p.errors++
+	}
+	if len(p.latencies) < maxLatencySamples {
+		p.latencies = append(p.latencies, elapsed)
+	}
+}
+
+// window returns the p99 latency and error rate of the window ending,
+// starting the next one
+func (p *profiler) window() (p99 time.Duration, errorRate float64, requests int) {
+	p.mu.Lock()
+	latencies, requests, errors := p.latencies, p.requests, p.errors
+	p.latencies, p.requests, p.errors = nil, 0, 0
+	p.mu.Unlock()
+	if requests < minWindowRequests {
+		return 0, 0, requests
+	}
+	slices.Sort(latencies)
+	return latencies[len(latencies)*99/100], float64(errors) / float64(requests), requests
+}
+
+// run checks every window until ctx is done, capturing the profiles
+// when the thresholds are crossed, at most once per cooldown
+func (p *profiler) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.clock.After(p.cfg.Window):
+		}
+		p99, errorRate, requests := p.window()
+		slow := p.cfg.P99 > 0 && p99 > p.cfg.P99
+		failing := p.cfg.ErrorRate > 0 && errorRate > p.cfg.ErrorRate
+		if !slow && !failing {
+			continue
+		}
+		now := p.clock.Now()
+		if !p.lastCapture.IsZero() && now.Sub(p.lastCapture) < p.cfg.Cooldown {
+			p.logger.Info("profiles not captured, still cooling down", "p99", p99, "error_rate", errorRate)
+			continue
+		}
+		p.lastCapture = now
+		p.logger.Warn("capturing profiles", "p99", p99, "error_rate", errorRate, "requests", requests, "dir", p.cfg.Dir)
+		if err := p.capture(ctx, now); err != nil {
+			p.logger.Error("capturing profiles", "error", err)
+		}
+	}
+}
+
+// capture writes the goroutine dump, the heap profile, then the CPU
+// profile over cfg.CPU, in files named after now
+func (p *profiler) capture(ctx context.Context, now time.Time) error {
+	if err := os.MkdirAll(p.cfg.Dir, 0o755); err != nil {
+		return err
+	}
+	prefix := filepath.Join(p.cfg.Dir, now.UTC().Format("20060102T150405Z"))
+	if err := writeProfile(prefix+"-goroutines.txt", func(f *os.File) error {
+		return pprof.Lookup("goroutine").WriteTo(f, 2)
+	}); err != nil {
+		return err
+	}
+	if err := writeProfile(prefix+"-heap.pprof", func(f *os.File) error {
+		return pprof.Lookup("heap").WriteTo(f, 0)
+	}); err != nil {
+		return err
+	}
+	return writeProfile(prefix+"-cpu.pprof", func(f *os.File) error {
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err
+		}
+		defer pprof.StopCPUProfile()
+		select {
+		case <-ctx.Done():
+		case <-p.clock.After(p.cfg.CPU):
+		}
+		return nil
+	})
+}
+
+func writeProfile(name string, write func(f *os.File) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return f.Close()
+}
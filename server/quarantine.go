@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+// maxQuarantineReason bounds the reasons given by the admins, in bytes
+const maxQuarantineReason = 1000
+
+// Quarantine hides a user from everyone but the admins, the body giving
+// the reason, as {"reason": "spam"}
+func (h *userHandler) Quarantine(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		badRequest(w, r)
+		return
+	}
+	if len(body.Reason) > maxQuarantineReason {
+		invalid(w, r, "reason: too long")
+		return
+	}
+	by := "admin"
+	if id, ok := IdentityFrom(r.Context()); ok && id.Subject != "" {
+		by = id.Subject
+	}
+	h.setQuarantine(w, r, &store.Quarantine{Reason: body.Reason, By: by})
+}
+
+// Release lifts the quarantine of a user, which is published as updated
+// for the subscribers to catch up with it
+func (h *userHandler) Release(w http.ResponseWriter, r *http.Request) {
+	h.setQuarantine(w, r, nil)
+}
+
+func (h *userHandler) setQuarantine(w http.ResponseWriter, r *http.Request, q *store.Quarantine) {
+	id := pathParam(r, "id")
+	if err := h.locks.check(id, r.Header.Get("X-Lock-Token")); err != nil {
+		locked(w, r)
+		return
+	}
+	// the users quarantined have no events, so only a release has one
+	u, rev, err := h.modify(r, id, events.UserUpdated, func(u *store.User) bool {
+		changed := (u.Quarantine == nil) != (q == nil) || q != nil && *u.Quarantine != *q
+		u.Quarantine = q
+		return changed
+	})
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	setRev(w, rev)
+	w.Header().Set("ETag", versionTag(u.Version))
+
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// seesQuarantined tells whether the client of r may see the quarantined
+// users: the admins, and every client when there's no authentication
+func seesQuarantined(r *http.Request) bool {
+	id, ok := IdentityFrom(r.Context())
+	return !ok || id.HasRole(RoleAdmin)
+}
+
+// hidden tells whether u is hidden from the client of r by its
+// quarantine
+func hidden(r *http.Request, u store.User) bool {
+	return u.Quarantine != nil && !seesQuarantined(r)
+}
+
+// visible tells whether the client of r may see u, answering 404
+// otherwise as if there was none
+func visible(w http.ResponseWriter, r *http.Request, u store.User) bool {
+	if hidden(r, u) {
+		userNotFound(w, r)
+		return false
+	}
+	return true
+}
+
+// reachable tells whether the users exist and the client of r may see
+// them, answering 404 otherwise
+func (h *userHandler) reachable(w http.ResponseWriter, r *http.Request, ids ...string) bool {
+	for _, id := range ids {
+		u, _, err := h.store.Get(r.Context(), id, store.Strong)
+		if err != nil {
+			storeError(w, r, err)
+			return false
+		}
+		if !visible(w, r, u) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutHidden drops the changes of the users hidden from the client
+// of r. The changes of the users deleted since are kept.
+func (h *userHandler) withoutHidden(r *http.Request, changes []store.Change) ([]store.Change, error) {
+	if seesQuarantined(r) {
+		return changes, nil
+	}
+	hide := map[string]bool{}
+	kept := make([]store.Change, 0, len(changes))
+	for _, c := range changes {
+		seen, ok := hide[c.ID]
+		if !ok {
+			u, _, err := h.store.Get(r.Context(), c.ID, store.Strong)
+			if err != nil && !errors.Is(err, store.ErrNotFound) {
+				return nil, err
+			}
+			seen = err == nil && hidden(r, u)
+			hide[c.ID] = seen
+		}
+		if !seen {
+			kept = append(kept, c)
+		}
+	}
+	return kept, nil
+}
+
+// keepQuarantine carries the quarantine of cur over to u, replacing it:
+// the clients can't lift it by writing the user, only the admins
+// releasing it. The quarantine set on u by the content filter is kept.
+func keepQuarantine(u *store.User, cur store.User) {
+	if cur.Quarantine != nil {
+		u.Quarantine = cur.Quarantine
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestQuarantineHidesUser(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig(), testKeys)
+	spam := createUser(t, h, "Spam")
+	ada := createUser(t, h, "Ada")
+	path := "/users/" + spam.ID
+
+	if w := do(h, http.MethodPost, path+"/quarantine", `{"reason":"spam"}`, apiKeyHeader, editorKey); w.Code != http.StatusForbidden {
+		t.Errorf("editor quarantining: %d, want 403", w.Code)
+	}
+	if w := do(h, http.MethodPost, path+"/quarantine", `{"reason":"spam"}`, apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("quarantine: %d %s", w.Code, w.Body)
+	}
+
+	// hidden from the editors, as if there was none
+	w := do(h, http.MethodGet, path, "", apiKeyHeader, editorKey)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("editor get: %d %s, want 404", w.Code, w.Body)
+	}
+	if ids := listIDs(t, h, "/users", apiKeyHeader, editorKey); strings.Join(ids, ",") != ada.ID {
+		t.Errorf("editor listing %v, want only %s", ids, ada.ID)
+	}
+	if ids := listIDs(t, h, "/users?status=quarantined", apiKeyHeader, editorKey); len(ids) != 0 {
+		t.Errorf("editor listing the quarantined %v, want none", ids)
+	}
+
+	// seen by the admins, alone with status=quarantined
+	w = do(h, http.MethodGet, path, "", apiKeyHeader, adminKey)
+	var u store.User
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("admin get: %d %s", w.Code, w.Body)
+	}
+	if u.Quarantine == nil || u.Quarantine.Reason != "spam" || u.Quarantine.By != "admin" {
+		t.Errorf("quarantine %+v, want the reason spam by admin", u.Quarantine)
+	}
+	if ids := listIDs(t, h, "/users?status=quarantined", apiKeyHeader, adminKey); strings.Join(ids, ",") != spam.ID {
+		t.Errorf("quarantined listing %v, want only %s", ids, spam.ID)
+	}
+
+	// kept by the writes, lifted by a release only
+	if w := do(h, http.MethodPut, path, `{"name":"Spam 2"}`, apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, path, "", apiKeyHeader, editorKey); w.Code != http.StatusNotFound {
+		t.Errorf("editor get after an update: %d, want 404", w.Code)
+	}
+	if w := do(h, http.MethodDelete, path+"/quarantine", "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("release: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, path, "", apiKeyHeader, editorKey); w.Code != http.StatusOK {
+		t.Errorf("editor get after the release: %d, want 200", w.Code)
+	}
+}
+
+func TestQuarantineHasNoEvents(t *testing.T) {
+	bus := events.NewMemory()
+	published := recordedEvents(bus)
+	h := newEventsServer(t, store.NewMemory(nil), bus).Handler()
+
+	spam := createUser(t, h, "Spam")
+	path := "/users/" + spam.ID
+	if w := do(h, http.MethodPost, path+"/quarantine", `{"reason":"spam"}`); w.Code != http.StatusOK {
+		t.Fatalf("quarantine: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPatch, path, `{"name":"Spam 2"}`); w.Code != http.StatusOK {
+		t.Fatalf("patch: %d %s", w.Code, w.Body)
+	}
+	// the release is published as an update, for the subscribers to
+	// catch up with the user
+	if w := do(h, http.MethodDelete, path+"/quarantine", ""); w.Code != http.StatusOK {
+		t.Fatalf("release: %d %s", w.Code, w.Body)
+	}
+	var got []string
+	for _, e := range published() {
+		got = append(got, e.Type+" "+e.Subject)
+	}
+	want := events.UserCreated + " " + spam.ID + "," + events.UserUpdated + " " + spam.ID
+	if strings.Join(got, ",") != want {
+		t.Errorf("events %v, want %s", got, want)
+	}
+}
+
+func TestQuarantineHidesChanges(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig(), testKeys)
+	spam := createUser(t, h, "Spam")
+	ada := createUser(t, h, "Ada")
+	if w := do(h, http.MethodPost, "/users/"+spam.ID+"/quarantine", `{"reason":"spam"}`, apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("quarantine: %d %s", w.Code, w.Body)
+	}
+
+	w := do(h, http.MethodGet, "/users/changes?since=0&wait=0s", "", apiKeyHeader, editorKey)
+	if w.Code != http.StatusOK {
+		t.Fatalf("changes: %d %s", w.Code, w.Body)
+	}
+	var feed struct {
+		Changes []store.Change `json:"changes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Changes) != 1 || feed.Changes[0].ID != ada.ID {
+		t.Errorf("changes %+v, want the creation of %s alone", feed.Changes, ada.ID)
+	}
+	// the admins see them all
+	w = do(h, http.MethodGet, "/users/changes?since=0&wait=0s", "", apiKeyHeader, adminKey)
+	if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil || len(feed.Changes) != 3 {
+		t.Errorf("admin changes %s, want 3", w.Body)
+	}
+}
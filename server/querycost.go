@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+const (
+	// DefaultMaxQueryCost is the cost budget of a listing unless set
+	DefaultMaxQueryCost = 1_000_000
+	maxFilterTerms      = 64 // comparisons in a filter
+)
+
+// queryCost estimates the cost of q as the users the store examines
+// times the work per user, which grows with the terms of the filter.
+// Stores unable to estimate their queries have them run unchecked.
+func (h *userHandler) queryCost(r *http.Request, q store.Query) (int, store.Estimate, bool, error) {
+	est, ok := unwrap(h.store).(store.Estimator)
+	if !ok {
+		return 0, store.Estimate{}, false, nil
+	}
+	e, err := est.Estimate(r.Context(), q)
+	if err != nil {
+		return 0, e, false, err
+	}
+	return e.Scanned * (1 + filterTerms(q.Filter)), e, true, nil
+}
+
+// checkQueryCost rejects the listings whose filter is too large, with
+// 413, or whose cost exceeds the budget, with 400, telling the client
+// how to narrow them. It returns the estimate of q, nil when the store
+// can't estimate it.
+func (h *userHandler) checkQueryCost(w http.ResponseWriter, r *http.Request, q store.Query) (*store.Estimate, bool) {
+	if n := filterTerms(q.Filter); n > maxFilterTerms {
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeFilterTooLarge,
+			fmt.Sprintf("filter too large: %d terms, at most %d are allowed", n, maxFilterTerms), nil)
+		return nil, false
+	}
+	cost, e, ok, err := h.queryCost(r, q)
+	if err != nil {
+		storeError(w, r, err)
+		return nil, false
+	}
+	if !ok {
+		return nil, true
+	}
+	w.Header().Set("X-Query-Cost", strconv.Itoa(cost))
+	maxCost := h.live.Load().MaxQueryCost
+	if cost <= maxCost {
+		return &e, true
+	}
+	hint := "simplify the filter"
+	if !e.Indexed {
+		hint = "select the users by tag or metadata key, which are indexed, or simplify the filter"
+	}
+	h.logger.Warn("query rejected", "cost", cost, "max", maxCost, "scanned", e.Scanned, "indexed", e.Indexed)
+	writeError(w, r, http.StatusBadRequest, codeQueryTooCostly,
+		fmt.Sprintf("query too costly: it would examine %d users, cost %d over a budget of %d; %s", e.Scanned, cost, maxCost, hint),
+		map[string]int{"cost": cost, "max_cost": maxCost, "scanned": e.Scanned})
+	return nil, false
+}
+
+// filterTerms counts the comparisons of f, substring ones counting
+// double
+func filterTerms(f store.Filter) int {
+	n := 0
+	eachCompare(f, func(c store.Compare) {
+		switch c.Op {
+		case store.Contains, store.StartsWith, store.EndsWith:
+			n += 2
+		default:
+			n++
+		}
+	})
+	return n
+}
+
+// eachCompare calls fn on the comparisons of f
+func eachCompare(f store.Filter, fn func(store.Compare)) {
+	switch f := f.(type) {
+	case store.And:
+		for _, sub := range f {
+			eachCompare(sub, fn)
+		}
+	case store.Or:
+		for _, sub := range f {
+			eachCompare(sub, fn)
+		}
+	case store.Not:
+		eachCompare(f.Filter, fn)
+	case store.Compare:
+		fn(f)
+	}
+}
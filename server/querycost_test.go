@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFilterTerms(t *testing.T) {
+	for filter, want := range map[string]int{
+		"name eq 'Ada'":        1,
+		"startswith(name,'A')": 2,
+		"name eq 'a' or (active eq true and version gt 1)":   3,
+		"not contains(name,'x') and tags/any(t: t eq 'vip')": 3,
+	} {
+		f, err := parseFilter(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filterTerms(f); got != want {
+			t.Errorf("%s: %d terms, want %d", filter, got, want)
+		}
+	}
+}
+
+func TestQueryCost(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxQueryCost = 15
+	h, _ := newTestServer(t, cfg)
+	for i := 1; i <= 10; i++ {
+		tags := `[]`
+		if i <= 2 {
+			tags = `["vip"]`
+		}
+		do(h, http.MethodPost, "/users", `{"name":"u","tags":`+tags+`}`)
+	}
+
+	for query, want := range map[string]struct {
+		status int
+		cost   string
+	}{
+		"":                    {http.StatusOK, "10"},
+		"tag=vip":             {http.StatusOK, "2"},
+		"$filter=name eq 'u'": {http.StatusBadRequest, "20"},
+		"tag=vip&$filter=name eq 'u' and startswith(name,'u')": {http.StatusOK, "8"},
+	} {
+		q, _ := url.ParseQuery(query)
+		w := do(h, http.MethodGet, "/users?"+q.Encode(), "")
+		if w.Code != want.status || w.Header().Get("X-Query-Cost") != want.cost {
+			t.Errorf("%q answered %d at cost %s, want %d at cost %s", query, w.Code, w.Header().Get("X-Query-Cost"), want.status, want.cost)
+		}
+		if w.Code == http.StatusBadRequest && !strings.Contains(w.Body.String(), "indexed") {
+			t.Errorf("%q rejected without a hint: %s", query, w.Body)
+		}
+	}
+
+	terms := make([]string, maxFilterTerms+1)
+	for i := range terms {
+		terms[i] = "name eq 'u'"
+	}
+	q := url.Values{"tag": {"vip"}, "$filter": {strings.Join(terms, " or ")}}
+	if w := do(h, http.MethodGet, "/users?"+q.Encode(), ""); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("filter of %d terms answered %d, want 413", len(terms), w.Code)
+	}
+}
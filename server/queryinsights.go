@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+const maxQueryShapes = 1000 // shapes tracked by the index advisor
+
+// queryInsight is what the index advisor knows of the listings of a
+// shape: the fields and operators of their selection, whatever the
+// values compared
+type queryInsight struct {
+	Shape     string         `json:"shape"`
+	Count     int            `json:"count"`
+	FullScans int            `json:"full_scans"`
+	Scanned   int            `json:"scanned"` // users examined, over every run
+	Total     time.Duration  `json:"total_ns"`
+	Max       time.Duration  `json:"max_ns"`
+	LastSeen  timestamp.Time `json:"last_seen"`
+	// Suggestion tells how the full scans could be avoided
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// queryInsights records the listings, so operators can see which
+// selections ran without an index and what their full scans cost
+type queryInsights struct {
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	shapes map[string]*queryInsight
+}
+
+func newQueryInsights(logger *slog.Logger) *queryInsights {
+	return &queryInsights{logger: logger, shapes: map[string]*queryInsight{}}
+}
+
+// record adds a listing of q that examined e.Scanned users in elapsed.
+// Shapes past maxQueryShapes are dropped.
+func (qi *queryInsights) record(q store.Query, e store.Estimate, elapsed time.Duration, now time.Time) {
+	shape := queryShape(q)
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	in, ok := qi.shapes[shape]
+	if !ok {
+		if len(qi.shapes) >= maxQueryShapes {
+			return
+		}
+		in = &queryInsight{Shape: shape, Suggestion: suggestIndex(q, e)}
+		qi.shapes[shape] = in
+	}
+	in.Count++
+	in.Scanned += e.Scanned
+	in.Total += elapsed
+	in.Max = max(in.Max, elapsed)
+	in.LastSeen = timestamp.New(now)
+	if !e.Indexed {
+		in.FullScans++
+		if in.FullScans == 1 && shape != "" {
+			qi.logger.Info("query ran without an index", "shape", shape, "scanned", e.Scanned,
+				"duration", elapsed, "suggestion", in.Suggestion)
+		}
+	}
+}
+
+// report returns the insights, the costliest shapes first
+func (qi *queryInsights) report() []queryInsight {
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	report := make([]queryInsight, 0, len(qi.shapes))
+	for _, in := range qi.shapes {
+		report = append(report, *in)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Total > report[j].Total })
+	return report
+}
+
+// queryShape describes the selection of q without its values, as in
+// "metadata_key:email, name eq". Listings selecting nothing have an
+// empty shape.
+func queryShape(q store.Query) string {
+	var terms []string
+	if q.Tag != "" {
+		terms = append(terms, "tag")
+	}
+	for k := range q.Metadata {
+		terms = append(terms, "metadata_key:"+k)
+	}
+	eachCompare(q.Filter, func(c store.Compare) {
+		terms = append(terms, c.Field+" "+string(c.Op))
+	})
+	slices.Sort(terms)
+	return strings.Join(slices.Compact(terms), ", ")
+}
+
+// suggestIndex tells how to avoid the full scans of the listings like q
+func suggestIndex(q store.Query, e store.Estimate) string {
+	if e.Indexed {
+		return ""
+	}
+	if q.Filter == nil {
+		return "unfiltered listing: select the users by tag or metadata key to use an index"
+	}
+	var fields []string
+	eachCompare(q.Filter, func(c store.Compare) { fields = append(fields, c.Field) })
+	slices.Sort(fields)
+	fields = slices.Compact(fields)
+	if slices.Contains(fields, "tags") {
+		return "select the users with the tag parameter, which is indexed, or declare an index on " + strings.Join(fields, ", ")
+	}
+	return "declare an index on " + strings.Join(fields, ", ")
+}
+
+// QueryInsights reports the listings by shape, the costliest first,
+// with the full scans they ran and how to avoid them
+func (h *adminHandler) QueryInsights(w http.ResponseWriter, r *http.Request) {
+	report := h.insights.report()
+	for i := range report {
+		report[i].LastSeen = localTime(r, report[i].LastSeen)
+	}
+	jsonBytes, err := json.Marshal(report)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestQueryShape(t *testing.T) {
+	f, err := parseFilter("name eq 'Ada' or (startswith(name,'A') and version gt 2) or name eq 'Bob'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		q    store.Query
+		want string
+	}{
+		{store.Query{}, ""},
+		{store.Query{Tag: "vip"}, "tag"},
+		{store.Query{Metadata: map[string]string{"plan": "pro"}, Filter: f},
+			"metadata_key:plan, name eq, name startswith, version gt"},
+	} {
+		if got := queryShape(tt.q); got != tt.want {
+			t.Errorf("shape %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestQueryInsights(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	createUser(t, h, "Ada")
+	for _, q := range []url.Values{
+		{"$filter": {"name eq 'Ada'"}},
+		{"$filter": {"name eq 'Bob'"}},
+		{"tag": {"vip"}},
+		{"$filter": {"tags/any(t: t eq 'vip')"}},
+	} {
+		if w := do(h, http.MethodGet, "/users?"+q.Encode(), ""); w.Code != http.StatusOK {
+			t.Fatalf("%v: %d %s", q, w.Code, w.Body)
+		}
+	}
+
+	w := do(h, http.MethodGet, "/admin/query-insights", "")
+	var report []queryInsight
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	shapes := map[string]queryInsight{}
+	for _, in := range report {
+		shapes[in.Shape] = in
+	}
+	if len(shapes) != 3 {
+		t.Errorf("got %s, want 3 shapes", w.Body)
+	}
+	if in := shapes["name eq"]; in.Count != 2 || in.FullScans != 2 || in.Scanned != 2 || in.Suggestion != "declare an index on name" {
+		t.Errorf("name eq: %+v", in)
+	}
+	if in := shapes["tag"]; in.Count != 1 || in.FullScans != 0 || in.Suggestion != "" {
+		t.Errorf("tag: %+v", in)
+	}
+	if in := shapes["tags eq"]; in.FullScans != 1 || in.Suggestion == "" {
+		t.Errorf("tags eq: %+v, want a suggestion of the tag parameter", in)
+	}
+}
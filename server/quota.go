@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/metrics"
+)
+
+// Quota is the usage allowed to a client each month, as metered for
+// the usage reports. Zero values don't limit.
+type Quota struct {
+	// Requests are the requests allowed, the others answered 429
+	Requests int64
+	// Records are the users the client may create, the others refused
+	// with 403
+	Records int64
+}
+
+func (q Quota) validate() error {
+	if q.Requests < 0 || q.Records < 0 {
+		return errors.New("invalid quota: negative limit")
+	}
+	return nil
+}
+
+// quotaThresholds are the shares of its quota, in percent, a client is
+// warned of reaching, once a month each
+var quotaThresholds = []int64{80, 90, 100}
+
+// quotas enforce the quotas of the clients, from their usage metered
+// this month
+type quotas struct {
+	limits   map[string]Quota // by subject, * for the others
+	meter    *usageMeter
+	logger   *slog.Logger
+	publish  func(ctx context.Context, typ, subject string, data any)
+	exceeded *metrics.CounterVec
+
+	mu     sync.Mutex
+	month  string           // of warned
+	warned map[string]int64 // the highest threshold warned, by client and resource
+}
+
+// QuotaWarning is the warning of a client reaching a share of its
+// quota, as published in the quota.warning events
+type QuotaWarning struct {
+	Client    string `json:"client"`
+	Resource  string `json:"resource"` // requests or records
+	Threshold int64  `json:"threshold"`
+	Used      int64  `json:"used"`
+	Limit     int64  `json:"limit"`
+	Month     string `json:"month"`
+}
+
+func newQuotas(limits map[string]Quota, meter *usageMeter) *quotas {
+	return &quotas{limits: limits, meter: meter, logger: meter.logger, warned: map[string]int64{}}
+}
+
+// quota returns the quota of client, if any
+func (qs *quotas) quota(client string) (Quota, bool) {
+	q, ok := qs.limits[client]
+	if !ok {
+		q, ok = qs.limits["*"]
+	}
+	return q, ok && q != (Quota{})
+}
+
+// check tells the client of rt its remaining quota in the X-Quota-*
+// headers, answering 429 once its requests are spent and 403 to the
+// creates once its records are
+func (qs *quotas) check(w http.ResponseWriter, r *http.Request, rt route, client string) bool {
+	q, ok := qs.quota(client)
+	if !ok {
+		return true
+	}
+	used := qs.meter.current(client)
+	now := qs.meter.clock.Now().UTC()
+	reset := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	h := w.Header()
+	h.Set("X-Quota-Reset", reset.Format(time.RFC3339))
+	if q.Requests > 0 {
+		h.Set("X-Quota-Requests-Limit", strconv.FormatInt(q.Requests, 10))
+		h.Set("X-Quota-Requests-Remaining", strconv.FormatInt(max(0, q.Requests-used.Requests-1), 10))
+	}
+	if q.Records > 0 {
+		h.Set("X-Quota-Records-Limit", strconv.FormatInt(q.Records, 10))
+		h.Set("X-Quota-Records-Remaining", strconv.FormatInt(max(0, q.Records-used.Created), 10))
+	}
+	switch {
+	case q.Requests > 0 && used.Requests >= q.Requests:
+		qs.exceeded.Inc("requests")
+		h.Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+		writeError(w, r, http.StatusTooManyRequests, codeQuotaExceeded, "monthly request quota exceeded", nil)
+		return false
+	case q.Records > 0 && used.Created >= q.Records && creatingRoutes[rt.method+" "+rt.path]:
+		qs.exceeded.Inc("records")
+		writeError(w, r, http.StatusForbidden, codeQuotaExceeded, "monthly record quota exceeded", nil)
+		return false
+	}
+	return true
+}
+
+// warn publishes the warning of the highest threshold of its quota
+// client reached, once metered, unless already warned of this month
+func (qs *quotas) warn(ctx context.Context, client string) {
+	q, ok := qs.quota(client)
+	if !ok {
+		return
+	}
+	used := qs.meter.current(client)
+	month := qs.meter.clock.Now().UTC().Format(monthLayout)
+	var warnings []QuotaWarning
+	qs.mu.Lock()
+	if qs.month != month {
+		qs.month, qs.warned = month, map[string]int64{}
+	}
+	for _, res := range []struct {
+		name        string
+		used, limit int64
+	}{{"requests", used.Requests, q.Requests}, {"records", used.Created, q.Records}} {
+		if res.limit == 0 {
+			continue
+		}
+		// a jump over several thresholds warns of the highest
+		key, reached := client+"/"+res.name, int64(0)
+		for _, t := range quotaThresholds {
+			if res.used*100 >= t*res.limit {
+				reached = t
+			}
+		}
+		if reached > qs.warned[key] {
+			qs.warned[key] = reached
+			warnings = append(warnings, QuotaWarning{client, res.name, reached, res.used, res.limit, month})
+		}
+	}
+	qs.mu.Unlock()
+
+	for _, wn := range warnings {
+		qs.logger.WarnContext(ctx, "quota threshold reached", "client", client, "resource", wn.Resource,
+			"threshold", wn.Threshold, "used", wn.Used, "limit", wn.Limit)
+		if qs.publish != nil {
+			qs.publish(ctx, events.QuotaWarning, client, wn)
+		}
+	}
+}
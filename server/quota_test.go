@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/idgen"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestQuotas(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Quotas = map[string]Quota{"editor": {Requests: 10, Records: 2}}
+	bus := events.NewMemory()
+	published := recordedEvents(bus)
+	clk := clock.NewFake(testStart)
+	s, err := New(WithConfig(cfg), WithStore(store.NewMemory(nil)), WithEventBus(bus), WithClock(clk), testKeys,
+		WithIDGenerator(&idgen.Sequence{Prefix: "u"}), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler()
+
+	w := do(h, http.MethodPost, "/users", `{"name":"Ada"}`, apiKeyHeader, editorKey)
+	if w.Code != http.StatusCreated || w.Header().Get("X-Quota-Requests-Remaining") != "9" ||
+		w.Header().Get("X-Quota-Records-Remaining") != "2" || w.Header().Get("X-Quota-Reset") != "2024-07-01T00:00:00Z" {
+		t.Fatalf("first create: %d %v", w.Code, w.Header())
+	}
+	do(h, http.MethodPost, "/users", `{"name":"Bob"}`, apiKeyHeader, editorKey)
+	// past its quota of records, the creates are refused but not the reads
+	w = do(h, http.MethodPost, "/users", `{"name":"Cy"}`, apiKeyHeader, editorKey)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeQuotaExceeded) {
+		t.Fatalf("create past the records: %d %s, want 403", w.Code, w.Body)
+	}
+	for i := 0; i < 7; i++ {
+		if w := do(h, http.MethodGet, "/users", "", apiKeyHeader, editorKey); w.Code != http.StatusOK {
+			t.Fatalf("read within the requests: %d %s", w.Code, w.Body)
+		}
+	}
+	w = do(h, http.MethodGet, "/users", "", apiKeyHeader, editorKey)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("read past the requests: %d %v, want 429", w.Code, w.Header())
+	}
+	// the other keys have no quota
+	if w := do(h, http.MethodGet, "/users", "", apiKeyHeader, adminKey); w.Code != http.StatusOK || w.Header().Get("X-Quota-Reset") != "" {
+		t.Errorf("admin: %d %v, want no quota", w.Code, w.Header())
+	}
+
+	var warned []string
+	for _, e := range published() {
+		if e.Type != events.QuotaWarning {
+			continue
+		}
+		var wn QuotaWarning
+		if err := json.Unmarshal(e.Data, &wn); err != nil {
+			t.Fatal(err)
+		}
+		warned = append(warned, fmt.Sprintf("%s:%d", wn.Resource, wn.Threshold))
+	}
+	if want := "records:100 requests:80 requests:90 requests:100"; strings.Join(warned, " ") != want {
+		t.Errorf("warnings %q, want %q", warned, want)
+	}
+
+	// a new month restores the quota
+	clk.Advance(30 * 24 * time.Hour)
+	if w := do(h, http.MethodPost, "/users", `{"name":"Cy"}`, apiKeyHeader, editorKey); w.Code != http.StatusCreated {
+		t.Errorf("create in July: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/metrics"
+)
+
+// RateLimit is the rate of the requests a client may make to the routes
+// of a rate class, as a token bucket
+type RateLimit struct {
+	// Rate is the requests per second allowed over time, the rate the
+	// bucket refills at
+	Rate float64
+	// Burst is the requests allowed at once, the size of the bucket
+	Burst int
+}
+
+func (l RateLimit) validate() error {
+	if l.Rate <= 0 || l.Burst < 1 {
+		return fmt.Errorf("invalid rate limit %g/s, burst %d: expected a positive rate and burst", l.Rate, l.Burst)
+	}
+	return nil
+}
+
+// rateLimitErrors returns the problems of the limits of the rate
+// classes
+func rateLimitErrors(limits map[string]RateLimit) []error {
+	var errs []error
+	for class, l := range limits {
+		if class != rateRead && class != rateWrite && class != ratePoll && class != rateAdmin {
+			errs = append(errs, fmt.Errorf("unknown rate class %q: expected read, write, poll or admin", class))
+		} else if err := l.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", class, err))
+		}
+	}
+	return errs
+}
+
+// RateLimiter keeps the token buckets of the clients. The
+// implementations keeping them in a shared store, as Redis, limit the
+// clients across the instances of the server.
+type RateLimiter interface {
+	// Allow takes a token from the bucket of key, refilled at limit,
+	// telling whether there was one and otherwise how long until there
+	// is
+	Allow(ctx context.Context, key string, limit RateLimit) (ok bool, retryAfter time.Duration, err error)
+}
+
+// MemoryRateLimiter is the RateLimiter of a single instance, keeping
+// the buckets in memory
+type MemoryRateLimiter struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int // since the last sweep of the full buckets
+}
+
+// bucket is the tokens of a client at a time
+type bucket struct {
+	tokens float64
+	at     time.Time
+	limit  RateLimit
+}
+
+// sweepEvery is the number of calls between the sweeps of the full
+// buckets, which are the same as none
+const sweepEvery = 10000
+
+// NewMemoryRateLimiter returns an in-memory limiter, timed by c
+func NewMemoryRateLimiter(c clock.Clock) *MemoryRateLimiter {
+	return &MemoryRateLimiter{clock: c, buckets: map[string]*bucket{}}
+}
+
+func (m *MemoryRateLimiter) Allow(_ context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	now := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.calls++; m.calls >= sweepEvery {
+		m.sweep(now)
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), at: now}
+		m.buckets[key] = b
+	}
+	b.refill(now, limit)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), nil
+}
+
+// refill adds the tokens earned since the last call, up to the burst
+func (b *bucket) refill(now time.Time, limit RateLimit) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.at).Seconds()*limit.Rate)
+	b.at, b.limit = now, limit
+}
+
+// sweep drops the buckets full by now
+func (m *MemoryRateLimiter) sweep(now time.Time) {
+	m.calls = 0
+	for key, b := range m.buckets {
+		if b.tokens+now.Sub(b.at).Seconds()*b.limit.Rate >= float64(b.limit.Burst) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// rateLimits limits the requests of the clients per rate class, at the
+// limits of the live settings
+type rateLimits struct {
+	limiter RateLimiter
+	logger  *slog.Logger
+	limited *metrics.CounterVec
+}
+
+// rateLimit answers 429 to the clients past the rate limit of the rate
+// class of rt, keyed by clientKey, and to the clients throttled by the
+// anomaly detector past its limit on the writes. The requests are let
+// through when the limiter fails.
+func (rr *router) rateLimit(w http.ResponseWriter, r *http.Request, rt route) bool {
+	key := clientKey(r)
+	if rr.anomalies != nil && rt.rateClass == rateWrite {
+		if limit, ok := rr.anomalies.throttle(key); ok {
+			allowed, retryAfter, err := rr.anomalies.limiter.Allow(r.Context(), "anomaly/"+key, limit)
+			if err != nil {
+				rr.anomalies.logger.ErrorContext(r.Context(), "throttling", "err", err)
+			} else if !allowed {
+				tooManyRequests(w, r, retryAfter)
+				return false
+			}
+		}
+	}
+	limit, ok := rr.live.Load().RateLimits[rt.rateClass]
+	if !ok || rr.rates == nil {
+		return true
+	}
+	allowed, retryAfter, err := rr.rates.limiter.Allow(r.Context(), rt.rateClass+"/"+key, limit)
+	if err != nil {
+		rr.rates.logger.ErrorContext(r.Context(), "rate limiting", "err", err)
+		return true
+	}
+	if allowed {
+		return true
+	}
+	rr.rates.limited.Inc(rt.rateClass)
+	tooManyRequests(w, r, retryAfter)
+	return false
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded", nil)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(testStart)
+	m := NewMemoryRateLimiter(clk)
+	limit := RateLimit{Rate: 2, Burst: 3}
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := m.Allow(ctx, "a", limit); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	ok, retryAfter, err := m.Allow(ctx, "a", limit)
+	if err != nil || ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("past the burst: %t, retry after %s, %v, want refused for 500ms", ok, retryAfter, err)
+	}
+	if ok, _, _ := m.Allow(ctx, "b", limit); !ok {
+		t.Error("another client refused")
+	}
+	clk.Advance(500 * time.Millisecond)
+	if ok, _, _ := m.Allow(ctx, "a", limit); !ok {
+		t.Error("refused once a token refilled")
+	}
+	if ok, _, _ := m.Allow(ctx, "a", limit); ok {
+		t.Error("allowed past the refill")
+	}
+	// the bucket refills up to the burst only
+	clk.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		m.Allow(ctx, "a", limit)
+	}
+	if ok, _, _ := m.Allow(ctx, "a", limit); ok {
+		t.Error("allowed past the burst after a long idle time")
+	}
+}
+
+func TestMemoryRateLimiterSweep(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(testStart)
+	m := NewMemoryRateLimiter(clk)
+	limit := RateLimit{Rate: 1, Burst: 1}
+	m.Allow(ctx, "idle", limit)
+	clk.Advance(time.Second)
+	for i := 1; i < sweepEvery; i++ {
+		m.Allow(ctx, "busy", limit)
+	}
+	if _, ok := m.buckets["idle"]; ok {
+		t.Error("full bucket kept by the sweep")
+	}
+	if _, ok := m.buckets["busy"]; !ok {
+		t.Error("empty bucket dropped by the sweep")
+	}
+}
+
+func TestRateLimitedRoutes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RateLimits = map[string]RateLimit{rateWrite: {Rate: 1, Burst: 1}}
+	h, clk := newTestServer(t, cfg, testKeys)
+	createUser(t, h, "Ada")
+	w := do(h, http.MethodPost, "/v1/users", `{"name":"Bob"}`, apiKeyHeader, adminKey)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("second write: %d, Retry-After %q, want 429 after 1s", w.Code, w.Header().Get("Retry-After"))
+	}
+	if code := errorCode(t, w); code != codeRateLimited {
+		t.Errorf("code %s, want %s", code, codeRateLimited)
+	}
+	if w := do(h, http.MethodGet, "/v1/users", "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Errorf("read past the write limit: %d", w.Code)
+	}
+	clk.Advance(time.Second)
+	createUser(t, h, "Bob")
+}
+
+func TestLiveRateLimits(t *testing.T) {
+	s, err := New(
+		WithStore(store.NewMemory(nil)),
+		WithClock(clock.NewFake(testStart)),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithAPIKeys([]APIKey{{Name: "admin", Key: adminKey, Roles: []string{RoleAdmin}}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler()
+	for i := 0; i < 3; i++ {
+		if w := do(h, http.MethodGet, "/v1/users", "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+			t.Fatalf("read %d without limits: %d", i+1, w.Code)
+		}
+	}
+
+	live := s.Live()
+	live.RateLimits = map[string]RateLimit{rateRead: {Rate: 1, Burst: 1}}
+	if err := s.SetLive(live); err != nil {
+		t.Fatal(err)
+	}
+	do(h, http.MethodGet, "/v1/users", "", apiKeyHeader, adminKey)
+	if w := do(h, http.MethodGet, "/v1/users", "", apiKeyHeader, adminKey); w.Code != http.StatusTooManyRequests {
+		t.Errorf("read past the live limit: %d, want 429", w.Code)
+	}
+
+	live.RateLimits = map[string]RateLimit{"bulk": {Rate: 1, Burst: 1}, rateRead: {Rate: 0, Burst: 1}}
+	if err := s.SetLive(live); err == nil {
+		t.Error("invalid live rate limits set")
+	}
+	live.RateLimits = nil
+	if err := s.SetLive(live); err != nil {
+		t.Fatal(err)
+	}
+	if w := do(h, http.MethodGet, "/v1/users", "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Errorf("read once the limits are lifted: %d", w.Code)
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+	"github.com/santisdev/go-restapi.git/webhooks"
+)
+
+// the kinds of records purged by the retention rules
+const (
+	retainDeactivatedUsers = "deactivated_users"
+	retainDeadLetters      = "dead_letters"
+)
+
+const (
+	// DefaultRetentionInterval is the time between the purges unless set
+	DefaultRetentionInterval = 24 * time.Hour
+	// retentionReports are the reports of purges kept, the newest
+	retentionReports = 30
+)
+
+// Retention purges the records older than the rules keep them, on a
+// schedule
+type Retention struct {
+	// Rules tell how long the records of each kind are kept, by kind:
+	// deactivated_users since their deactivation, dead_letters since
+	// their last failed attempt. The kinds not in it are kept forever.
+	Rules map[string]time.Duration
+	// Interval is the time between the purges,
+	// DefaultRetentionInterval unless set
+	Interval time.Duration
+	// DryRun only reports what the scheduled purges would purge
+	DryRun bool
+}
+
+func (rt Retention) validate() error {
+	var errs []error
+	for kind, d := range rt.Rules {
+		if kind != retainDeactivatedUsers && kind != retainDeadLetters {
+			errs = append(errs, fmt.Errorf("unknown retention kind %q: expected deactivated_users or dead_letters", kind))
+		} else if d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid retention of %s: not positive", kind))
+		}
+	}
+	if rt.Interval < 0 {
+		errs = append(errs, errors.New("invalid retention interval: negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// retentionResult is what a purge did with the records of a kind
+type retentionResult struct {
+	Kind string `json:"kind"`
+	// Before is the time the records purged are older than
+	Before timestamp.Time `json:"before"`
+	// Purged are the ids of the records purged, or that would be in a
+	// dry run
+	Purged []string `json:"purged"`
+	// Skipped are the ids of the records due but locked for editing
+	Skipped []string `json:"skipped,omitempty"`
+	// Held are the ids of the records due but under a legal hold
+	Held []string `json:"held,omitempty"`
+}
+
+// retentionReport is the report of a purge
+type retentionReport struct {
+	RanAt   timestamp.Time    `json:"ran_at"`
+	DryRun  bool              `json:"dry_run"`
+	Results []retentionResult `json:"results"`
+}
+
+// retention purges the records past the rules, periodically when
+// scheduled, keeping the reports of the last purges
+type retention struct {
+	*deps
+	locks    *lockManager
+	webhooks *webhooks.Dispatcher
+	holds    *legalHolds
+	cfg      Retention
+
+	mu      sync.Mutex
+	reports []retentionReport // newest first
+}
+
+// run purges every interval until ctx is done
+func (rt *retention) run(ctx context.Context) {
+	interval := rt.cfg.Interval
+	if interval == 0 {
+		interval = DefaultRetentionInterval
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rt.clock.After(interval):
+		}
+		if _, err := rt.purge(ctx, rt.cfg.DryRun); err != nil {
+			rt.logger.ErrorContext(ctx, "purging the records past retention", "err", err)
+		}
+	}
+}
+
+// purge removes the records older than the rules keep them, only
+// reporting them in a dry run
+func (rt *retention) purge(ctx context.Context, dryRun bool) (retentionReport, error) {
+	now := rt.clock.Now().UTC()
+	report := retentionReport{RanAt: timestamp.New(now), DryRun: dryRun, Results: []retentionResult{}}
+	kinds := make([]string, 0, len(rt.cfg.Rules))
+	for kind := range rt.cfg.Rules {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		res := retentionResult{Kind: kind, Before: timestamp.New(now.Add(-rt.cfg.Rules[kind])), Purged: []string{}}
+		switch kind {
+		case retainDeactivatedUsers:
+			if err := rt.purgeUsers(ctx, &res, dryRun); err != nil {
+				return retentionReport{}, err
+			}
+		case retainDeadLetters:
+			rt.purgeDeadLetters(&res, dryRun)
+		}
+		report.Results = append(report.Results, res)
+		if len(res.Purged) > 0 {
+			rt.logger.InfoContext(ctx, "records past retention purged", "kind", kind, "count", len(res.Purged), "dry_run", dryRun)
+		}
+	}
+	rt.mu.Lock()
+	rt.reports = append([]retentionReport{report}, rt.reports...)
+	if len(rt.reports) > retentionReports {
+		rt.reports = rt.reports[:retentionReports]
+	}
+	rt.mu.Unlock()
+	return report, nil
+}
+
+// purgeUsers deletes the users deactivated before res.Before. The
+// inactive users not yet stamped, as those deactivated before the
+// stamps, are stamped now, starting their retention. The users purged
+// are reported oldest first.
+func (rt *retention) purgeUsers(ctx context.Context, res *retentionResult, dryRun bool) error {
+	users, _, err := rt.store.List(ctx, store.Query{}, store.Strong)
+	if err != nil {
+		return err
+	}
+	var purged []store.User
+	for _, u := range users {
+		switch {
+		case u.Active:
+			continue
+		case u.DeactivatedAt == nil:
+			if !dryRun {
+				stamped := u
+				stampDeactivation(&stamped, nil, rt.clock.Now())
+				if _, _, err := rt.store.CompareAndSwap(ctx, u.ID, u.Version, stamped); err != nil && !errors.Is(err, store.ErrConflict) {
+					return err
+				}
+			}
+			continue
+		case !u.DeactivatedAt.Before(res.Before.Time):
+			continue
+		case rt.locks.check(u.ID, "") != nil:
+			res.Skipped = append(res.Skipped, u.ID)
+			continue
+		}
+		if hold, _ := rt.holds.held(u); hold != nil {
+			res.Held = append(res.Held, u.ID)
+			continue
+		}
+		if !dryRun {
+			// deleting at the version read, the hold can't be placed meanwhile
+			_, _, err := rt.store.CompareAndDelete(rt.withUserEvent(ctx, events.UserDeleted), u.ID, u.Version)
+			if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrConflict) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		purged = append(purged, u)
+	}
+	sort.Slice(purged, func(i, j int) bool { return purged[i].CreatedBefore(purged[j]) })
+	for _, u := range purged {
+		res.Purged = append(res.Purged, u.ID)
+	}
+	return nil
+}
+
+// purgeDeadLetters removes the dead letters dead before res.Before
+func (rt *retention) purgeDeadLetters(res *retentionResult, dryRun bool) {
+	var dead []webhooks.Delivery
+	if dryRun {
+		for _, del := range rt.webhooks.Dead() {
+			if del.DeadAt.Before(res.Before.Time) {
+				dead = append(dead, del)
+			}
+		}
+	} else {
+		dead = rt.webhooks.PurgeDead(res.Before.Time)
+	}
+	for _, del := range dead {
+		res.Purged = append(res.Purged, del.ID)
+	}
+}
+
+// stampDeactivation sets when u was deactivated: when cur was, if it
+// was already inactive, or now. It is cleared on the active users.
+func stampDeactivation(u, cur *store.User, now time.Time) {
+	switch {
+	case u.Active:
+		u.DeactivatedAt = nil
+	case cur != nil && !cur.Active && cur.DeactivatedAt != nil:
+		u.DeactivatedAt = cur.DeactivatedAt
+	default:
+		t := timestamp.New(now.UTC())
+		u.DeactivatedAt = &t
+	}
+}
+
+// RetentionReports lists the reports of the last purges, newest first
+func (h *adminHandler) RetentionReports(w http.ResponseWriter, r *http.Request) {
+	h.retention.mu.Lock()
+	reports := append([]retentionReport{}, h.retention.reports...)
+	h.retention.mu.Unlock()
+	for i := range reports {
+		reports[i].RanAt = localTime(r, reports[i].RanAt)
+	}
+
+	jsonBytes, err := json.Marshal(reports)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// PurgeRetention purges the records past the retention rules now,
+// dry_run=true previewing what would be purged
+func (h *adminHandler) PurgeRetention(w http.ResponseWriter, r *http.Request) {
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			invalid(w, r, "dry_run: expected true or false")
+			return
+		}
+	}
+	report, err := h.retention.purge(r.Context(), dryRun)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	report.RanAt = localTime(r, report.RanAt)
+
+	jsonBytes, err := json.Marshal(report)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Retention = Retention{Rules: map[string]time.Duration{retainDeactivatedUsers: 24 * time.Hour}}
+	h, clk := newTestServer(t, cfg, testKeys)
+	ada, bob, cy := createUser(t, h, "Ada"), createUser(t, h, "Bob"), createUser(t, h, "Cy")
+	deactivate := func(id string) {
+		t.Helper()
+		w := do(h, http.MethodPost, "/users/"+id+"/deactivate", "", apiKeyHeader, adminKey)
+		if w.Code != http.StatusOK {
+			t.Fatalf("deactivating %s: %d %s", id, w.Code, w.Body)
+		}
+	}
+	deactivate(bob.ID)
+	clk.Advance(time.Hour)
+	deactivate(ada.ID)
+	clk.Advance(10 * time.Hour)
+	deactivate(cy.ID)
+	clk.Advance(20 * time.Hour)
+
+	purge := func(query string) retentionResult {
+		t.Helper()
+		w := do(h, http.MethodPost, "/admin/retention/purge"+query, "", apiKeyHeader, adminKey)
+		var report retentionReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK || len(report.Results) != 1 {
+			t.Fatalf("purging%s: %d %s", query, w.Code, w.Body)
+		}
+		return report.Results[0]
+	}
+	// the users past retention are purged, oldest first
+	if res := purge("?dry_run=true"); len(res.Purged) != 2 || res.Purged[0] != ada.ID || res.Purged[1] != bob.ID {
+		t.Errorf("dry run purged %v, want Ada then Bob", res.Purged)
+	}
+	if w := do(h, http.MethodGet, "/users/"+ada.ID, "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Errorf("Ada after the dry run: %d, want 200", w.Code)
+	}
+	if res := purge(""); len(res.Purged) != 2 {
+		t.Errorf("purged %v, want Ada and Bob", res.Purged)
+	}
+	for _, tc := range []struct {
+		id   string
+		want int
+	}{{ada.ID, http.StatusNotFound}, {bob.ID, http.StatusNotFound}, {cy.ID, http.StatusOK}} {
+		if w := do(h, http.MethodGet, "/users/"+tc.id, "", apiKeyHeader, adminKey); w.Code != tc.want {
+			t.Errorf("%s after the purge: %d, want %d", tc.id, w.Code, tc.want)
+		}
+	}
+
+	// reactivating restarts the retention
+	do(h, http.MethodPost, "/users/"+cy.ID+"/activate", "", apiKeyHeader, adminKey)
+	deactivate(cy.ID)
+	clk.Advance(20 * time.Hour)
+	if res := purge(""); len(res.Purged) != 0 {
+		t.Errorf("purged %v, want none", res.Purged)
+	}
+
+	w := do(h, http.MethodGet, "/admin/retention", "", apiKeyHeader, adminKey)
+	var reports []retentionReport
+	if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil || len(reports) != 3 || !reports[2].DryRun || reports[0].DryRun {
+		t.Errorf("reports: %d %s, want the 3 purges, newest first", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/admin/retention/purge?dry_run=maybe", "", apiKeyHeader, adminKey); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("dry_run=maybe: %d, want 422", w.Code)
+	}
+}
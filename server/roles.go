@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// the roles of the clients, each granting what the ones before it grant
+const (
+	// RoleViewer reads the users
+	RoleViewer = "viewer"
+	// RoleEditor reads, creates and changes the users
+	RoleEditor = "editor"
+	// RoleTenantAdmin also manages the API keys, webhooks and usage of
+	// its tenant
+	RoleTenantAdmin = "tenant-admin"
+	// RoleAdmin also deletes and merges the users, and administers the
+	// server
+	RoleAdmin = "admin"
+)
+
+// roleRanks orders the roles, from the least privileged
+var roleRanks = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleTenantAdmin: 3, RoleAdmin: 4}
+
+// scopeRanks are the ranks of the roles of the clients granted scopes
+// rather than roles
+var scopeRanks = map[string]int{scopeRead: 1, scopeWrite: 2, scopeTenant: 3, scopeAdmin: 4}
+
+// roleScopes are the scopes of the clients granted roles rather than
+// scopes
+var roleScopes = map[string][]string{
+	RoleViewer:      {scopeRead},
+	RoleEditor:      {scopeRead, scopeWrite},
+	RoleTenantAdmin: {scopeRead, scopeWrite, scopeTenant},
+	RoleAdmin:       {scopeAdmin},
+}
+
+// RolePolicy declares the role required by some routes, by "METHOD
+// /path" as "DELETE /users/{id}", for the resources needing another
+// role than the one of their method: viewer to read, editor to write,
+// and admin for the routes of the admin scope
+type RolePolicy map[string]string
+
+// DefaultRolePolicy is the policy of the routes the roles of their
+// methods don't fit, the ones removing users being for the admins
+var DefaultRolePolicy = RolePolicy{
+	"DELETE /users/{id}":     RoleAdmin,
+	"POST /users/{id}/merge": RoleAdmin,
+}
+
+// validate checks the roles of p are known
+func (p RolePolicy) validate() error {
+	for rt, role := range p {
+		if err := checkRoles([]string{role}); err != nil {
+			return fmt.Errorf("%s: %w", rt, err)
+		}
+	}
+	return nil
+}
+
+// checkRoles checks roles are known
+func checkRoles(roles []string) error {
+	for _, r := range roles {
+		if roleRanks[r] == 0 {
+			return fmt.Errorf("unknown role %q: expected viewer, editor, tenant-admin or admin", r)
+		}
+	}
+	return nil
+}
+
+// HasRole tells whether the identity was granted role, or a role above
+// it. The clients granted scopes only have the role of their scopes:
+// viewer for users:read, editor for users:write and admin for admin.
+func (id Identity) HasRole(role string) bool {
+	rank := 0
+	for _, r := range id.Roles {
+		rank = max(rank, roleRanks[r])
+	}
+	for _, s := range id.Scopes {
+		rank = max(rank, scopeRanks[s])
+	}
+	return rank >= roleRanks[role]
+}
+
+// role returns the role required by rt, none for the public routes
+func (rr *router) role(rt route) string {
+	if rt.scope == scopePublic {
+		return ""
+	}
+	if role, ok := rr.roles[rt.method+" "+rt.path]; ok {
+		return role
+	}
+	if role, ok := DefaultRolePolicy[rt.method+" "+rt.path]; ok {
+		return role
+	}
+	switch {
+	case rt.scope == scopeAdmin:
+		return RoleAdmin
+	case rt.scope == scopeTenant:
+		return RoleTenantAdmin
+	case rt.method == http.MethodGet || rt.method == http.MethodHead:
+		return RoleViewer
+	}
+	return RoleEditor
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/idgen"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestRoles(t *testing.T) {
+	const viewer, editor, admin = "viewer-key-0123456789", "editor-key-0123456789", "admin-key-0123456789"
+	s, err := New(
+		WithStore(store.NewMemory(nil)),
+		WithClock(clock.NewFake(testStart)),
+		WithIDGenerator(&idgen.Sequence{Prefix: "u"}),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithAPIKeys([]APIKey{
+			{Name: "viewer", Key: viewer, Roles: []string{RoleViewer}},
+			{Name: "editor", Key: editor, Roles: []string{RoleEditor}},
+			{Name: "admin", Key: admin, Roles: []string{RoleAdmin}},
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler()
+	if w := do(h, http.MethodPost, "/users", `{"name":"Ada"}`, apiKeyHeader, editor); w.Code != http.StatusCreated {
+		t.Fatalf("editor creating: %d %s", w.Code, w.Body)
+	}
+
+	for _, tc := range []struct {
+		key, method, path, body string
+		want                    int
+	}{
+		{viewer, http.MethodGet, "/users/u1", "", http.StatusOK},
+		{viewer, http.MethodPost, "/users", `{"name":"Bob"}`, http.StatusForbidden},
+		{viewer, http.MethodPut, "/users/u1", `{"name":"Ada L."}`, http.StatusForbidden},
+		{viewer, http.MethodPatch, "/users/u1", `{"name":"Ada L."}`, http.StatusForbidden},
+		{viewer, http.MethodDelete, "/users/u1", "", http.StatusForbidden},
+		{editor, http.MethodDelete, "/users/u1", "", http.StatusForbidden},
+		{"", http.MethodGet, "/users/u1", "", http.StatusUnauthorized},
+		{admin, http.MethodDelete, "/users/u1", "", http.StatusOK},
+	} {
+		if w := do(h, tc.method, tc.path, tc.body, apiKeyHeader, tc.key); w.Code != tc.want {
+			t.Errorf("%s %s by %q: %d %s, want %d", tc.method, tc.path, tc.key, w.Code, w.Body, tc.want)
+		}
+	}
+}
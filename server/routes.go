@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/jose"
+	"github.com/santisdev/go-restapi.git/metrics"
+	"github.com/santisdev/go-restapi.git/tracing"
+)
+
+// auth scopes required by the routes
+const (
+	scopePublic = "" // no authentication required
+	scopeRead   = "users:read"
+	scopeWrite  = "users:write"
+	scopeAdmin  = "admin"
+	// scopeTenant is granted to the tenant admins, managing the keys,
+	// webhooks and usage of their tenant
+	scopeTenant = "tenant:admin"
+)
+
+// rate classes, grouping routes of similar cost for rate limiting
+const (
+	rateRead  = "read"
+	rateWrite = "write"
+	ratePoll  = "poll" // long-lived requests
+	rateAdmin = "admin"
+)
+
+// route is an entry of a route table, used for dispatching, answering
+// OPTIONS requests and listing the exposed routes
+type route struct {
+	method string
+	// path is the template of the paths of the route, as /users/{id},
+	// a last {name...} segment matching the rest of the path
+	path      string
+	summary   string
+	scope     string
+	rateClass string
+	policy    policy
+	handle    http.HandlerFunc
+}
+
+// Routes describes every route served by the API
+func Routes() []RouteInfo {
+	var infos []RouteInfo
+	for _, v := range allRoutes().versions {
+		for _, rt := range v.routes {
+			infos = append(infos, rt.info(v))
+		}
+	}
+	return infos
+}
+
+// allRoutes returns a router of every route served by the API
+func allRoutes() *router {
+	return newRouter(nil, (&userHandler{}).routes(), (&ingestHandler{}).routes(),
+		(&rpcHandler{}).routes(), (&soapHandler{}).routes(), (&tenantHandler{}).routes(), (&invitationHandler{}).routes(),
+		(&adminHandler{}).routes(), (&systemHandler{}).routes())
+}
+
+// router dispatches the requests over the route tables of the handlers
+type router struct {
+	versions []*apiVersion
+	tree     *node
+	auth     Authenticator
+	tracer   *tracing.Tracer // nil when tracing is disabled
+	inflight *inflight
+	codecs   []codec // the representations offered besides JSON
+	// compression is how the responses are compressed
+	compression *compression
+	duration    *metrics.HistogramVec // nil when metrics are disabled
+
+	pageSizes map[string]PageSize // by "METHOD /path"
+	roles     RolePolicy
+	canonical map[string]bool // the routes answering canonical JSON
+	// writeTimeout is the write timeout of the connections, extended
+	// for the long polls
+	writeTimeout time.Duration
+	signer       *jose.Signer // nil when the responses aren't signed
+	timezones    bool         // whether the clients choose their time zone
+	// epochMillis are the clients sending epoch milliseconds timestamps
+	epochMillis []string
+	live        *atomic.Pointer[Live]
+
+	limiter  *limiter            // nil when the concurrency isn't limited
+	rates    *rateLimits         // nil when the clients aren't rate limited
+	shed     *metrics.CounterVec // nil when metrics are disabled
+	watchdog *watchdog           // nil when disabled
+	profiler *profiler           // nil when disabled
+	// anomalies flags the clients writing far more than usual, nil
+	// when disabled
+	anomalies *anomalyDetector
+	// usage counts the requests of the authenticated clients
+	usage *keyAnalytics
+	// meter counts the monthly usage of the authenticated clients
+	meter *usageMeter
+	// quotas enforce the monthly quotas of the clients, nil without
+	// quotas
+	quotas *quotas
+}
+
+// newRouter returns a router over the given route tables, as the first
+// version of the API, /v1
+func newRouter(auth Authenticator, tables ...[]route) *router {
+	rr := &router{
+		tree:        &node{},
+		auth:        auth,
+		inflight:    newInflight(),
+		codecs:      slices.Clone(codecs),
+		live:        &atomic.Pointer[Live]{},
+		canonical:   map[string]bool{},
+		compression: newCompression(Compression{}, nil),
+	}
+	rr.live.Store(&Live{PageSize: DefaultPageSize, MaxQueryCost: DefaultMaxQueryCost})
+	rr.version("/v1", tables...)
+	return rr
+}
+
+// ServeHTTP calls the handler of the route matching the method and path
+// of the request, once the client is authorized for it. OPTIONS requests
+// are answered from the routes of the path, and the other methods not
+// served on it with 405.
+func (rr *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Add("Vary", "Accept")
+	r = withRequestID(w, r)
+
+	v, path, ok := rr.resolve(w, r)
+	if !ok {
+		return
+	}
+	r = withAPIVersion(r, v)
+	n, params := rr.match(path)
+	if n == nil {
+		writeError(w, r, http.StatusNotFound, codeRouteNotFound, "no route matches "+r.URL.Path, nil)
+		return
+	}
+	if len(params) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+	}
+	for _, rt := range n.routes {
+		if rt.method == r.Method {
+			rr.serve(w, r, rt)
+			return
+		}
+	}
+	if r.Method == http.MethodOptions {
+		options(w, r, v, n.routes)
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allowed(n.routes), ", "))
+	methodNotAllowed(w, r)
+}
+
+// serve calls the handler of rt once the client is authorized for it,
+// tracing and measuring the request, and applying the policy of rt.
+// Requests past the concurrency limit are shed, except the long polls
+// and the admin ones, as are all but the admin ones while the watchdog
+// finds the runtime overloaded.
+func (rr *router) serve(w http.ResponseWriter, r *http.Request, rt route) {
+	defer rr.inflight.start(rt)()
+	sw := newStatusWriter(w)
+	var span *tracing.Span
+	if rr.tracer != nil {
+		r, span = rr.tracer.StartRequest(r, rt.method+" "+rt.path)
+		span.SetAttribute("http.method", rt.method)
+		span.SetAttribute("http.route", rt.path)
+	}
+	defer rr.observe(rt, sw, span, time.Now())
+	var client string // the subject of the client, once authenticated
+	defer func() {
+		if client != "" && rr.usage != nil {
+			rr.usage.record(client, rt, sw.status)
+		}
+		if client != "" && rr.meter != nil {
+			rr.meter.record(client, rt, sw.status, sw.bytes)
+		}
+		if client != "" && rr.quotas != nil {
+			rr.quotas.warn(r.Context(), client)
+		}
+	}()
+	pw := newPolicyWriter(sw, r, rt.policy, rr.compression)
+	defer pw.close()
+	if rr.watchdog != nil && rr.watchdog.overloaded.Load() && rt.rateClass != rateAdmin {
+		if rr.shed != nil {
+			rr.shed.Inc(rt.method, rt.path)
+		}
+		serviceUnavailable(pw, r)
+		return
+	}
+	if rr.limiter != nil && rt.rateClass != ratePoll && rt.rateClass != rateAdmin {
+		if !rr.limiter.acquire() {
+			if rr.shed != nil {
+				rr.shed.Inc(rt.method, rt.path)
+			}
+			serviceUnavailable(pw, r)
+			return
+		}
+		defer func(start time.Time) { rr.limiter.release(time.Since(start)) }(time.Now())
+	}
+
+	if rt.rateClass == ratePoll && rr.writeTimeout > 0 {
+		// the buffers of the internal requests have no deadline to extend
+		http.NewResponseController(pw).SetWriteDeadline(time.Now().Add(maxWait + rr.writeTimeout))
+	}
+
+	r, ok := rr.localize(pw, r)
+	if ok {
+		r, ok = rr.authorize(pw, r, rt)
+	}
+	if id, found := IdentityFrom(r.Context()); found {
+		client = id.Subject
+	}
+	if ok {
+		ok = rr.rateLimit(pw, r, rt)
+	}
+	if ok && client != "" && rr.quotas != nil {
+		ok = rr.quotas.check(pw, r, rt, client)
+	}
+	if ok && rr.anomalies != nil {
+		rr.anomalies.observe(r, rt)
+	}
+	if ok {
+		r, ok = rr.limit(pw, r, rt)
+	}
+	if ok {
+		r, ok = rr.decodeBody(pw, r, rt)
+	}
+	if !ok {
+		return
+	}
+	handle := rt.handle
+	if c := negotiate(r, rr.codecs); c != nil {
+		handle = func(w http.ResponseWriter, r *http.Request) { c.serve(w, r, rt) }
+	} else if rr.canonical[rt.method+" "+rt.path] {
+		handle = func(w http.ResponseWriter, r *http.Request) { canonicalCodec.serve(w, r, rt) }
+	}
+	if rr.signer != nil {
+		rr.sign(pw, r, handle)
+	} else {
+		handle(pw, r)
+	}
+}
+
+// observe records the outcome of a request on its span and in the
+// latency histogram, the trace id of sampled requests being kept as
+// exemplar so slow buckets lead to their traces. The profiler sees all
+// but the long polls, whose latency is the wait.
+func (rr *router) observe(rt route, w *statusWriter, span *tracing.Span, start time.Time) {
+	if span != nil {
+		span.SetAttribute("http.status_code", w.status)
+		if w.status >= http.StatusInternalServerError {
+			span.SetError()
+		}
+		span.Finish()
+	}
+	elapsed := time.Since(start)
+	if rr.duration != nil {
+		var exemplar []string
+		if span != nil && span.Context.Sampled {
+			exemplar = []string{"trace_id", span.Context.TraceID.String()}
+		}
+		rr.duration.ObserveWithExemplar(elapsed.Seconds(), exemplar,
+			rt.method, rt.path, strconv.Itoa(w.status))
+	}
+	if rr.profiler != nil && rt.rateClass != ratePoll {
+		rr.profiler.observe(elapsed, w.status)
+	}
+}
+
+// RouteInfo is the public description of a route
+type RouteInfo struct {
+	Method string `json:"method"`
+	// Path is the template of the paths of the route under its version,
+	// as /v1/users/{id}
+	Path      string `json:"path"`
+	Version   string `json:"version"`
+	Summary   string `json:"summary"`
+	Scope     string `json:"scope"`
+	RateClass string `json:"rate_class"`
+	// CacheControl is the Cache-Control of the successful responses
+	CacheControl string `json:"cache_control"`
+	Compressed   bool   `json:"compressed"`
+}
+
+func (rt route) info(v *apiVersion) RouteInfo {
+	return RouteInfo{rt.method, v.prefix + rt.path, v.name(), rt.summary, rt.scope, rt.rateClass,
+		rt.policy.cacheControl(), rt.policy.compress}
+}
+
+// options answers an OPTIONS request with the methods allowed on the path.
+// Clients asking for JSON also get the metadata of the matching routes.
+func options(w http.ResponseWriter, r *http.Request, v *apiVersion, matched []route) {
+	allow := allowed(matched)
+	infos := make([]RouteInfo, 0, len(matched))
+	for _, rt := range matched {
+		infos = append(infos, rt.info(v))
+	}
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Del("content-type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	jsonBytes, err := json.Marshal(struct {
+		Path   string      `json:"path"`
+		Allow  []string    `json:"allow"`
+		Routes []RouteInfo `json:"routes"`
+	}{r.URL.Path, allow, infos})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// allowed returns the methods allowed on the path of routes, sorted
+func allowed(routes []route) []string {
+	allow := []string{http.MethodOptions}
+	for _, rt := range routes {
+		if !slices.Contains(allow, rt.method) {
+			allow = append(allow, rt.method)
+		}
+	}
+	sort.Strings(allow)
+	return allow
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const maxRPCBatch = 100
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcServerError    = -32000 // the call failed, data.status tells why
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"` // absent for notifications
+}
+
+type rpcResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError        `json:"error,omitempty"`
+	ID      json.RawMessage  `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// rpcCall is the HTTP request a JSON-RPC or SOAP operation maps to
+type rpcCall struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// rpcMethods map the JSON-RPC methods to the routes of the API, from
+// their params
+var rpcMethods = map[string]func(params json.RawMessage) (rpcCall, error){
+	"users.list": func(params json.RawMessage) (rpcCall, error) {
+		var p struct {
+			Status string `json:"status"`
+			Tag    string `json:"tag"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return rpcCall{}, err
+		}
+		q := url.Values{}
+		if p.Status != "" {
+			q.Set("status", p.Status)
+		}
+		if p.Tag != "" {
+			q.Set("tag", p.Tag)
+		}
+		return rpcCall{method: http.MethodGet, path: "/users", query: q}, nil
+	},
+	"users.get":    idCall(http.MethodGet, "/users/%s"),
+	"users.delete": idCall(http.MethodDelete, "/users/%s"),
+	"users.create": func(params json.RawMessage) (rpcCall, error) {
+		return rpcCall{method: http.MethodPost, path: "/users", body: params}, nil
+	},
+	"users.update": func(params json.RawMessage) (rpcCall, error) {
+		var p struct {
+			ID      string          `json:"id"`
+			Version uint64          `json:"version"`
+			User    json.RawMessage `json:"user"`
+		}
+		if err := decodeParams(params, &p); err != nil || p.ID == "" || p.Version == 0 || p.User == nil {
+			return rpcCall{}, fmt.Errorf("id, version and user are required")
+		}
+		return rpcCall{
+			method: http.MethodPut,
+			path:   "/users/" + url.PathEscape(p.ID),
+			header: http.Header{"If-Match": {versionTag(p.Version)}},
+			body:   p.User,
+		}, nil
+	},
+	"users.activate":   idCall(http.MethodPost, "/users/%s/activate"),
+	"users.deactivate": idCall(http.MethodPost, "/users/%s/deactivate"),
+	"users.merge": func(params json.RawMessage) (rpcCall, error) {
+		var p struct {
+			ID string `json:"id"`
+			mergeRequest
+		}
+		if err := decodeParams(params, &p); err != nil || p.ID == "" {
+			return rpcCall{}, fmt.Errorf("id and source are required")
+		}
+		body, _ := json.Marshal(p.mergeRequest)
+		return rpcCall{method: http.MethodPost, path: "/users/" + url.PathEscape(p.ID) + "/merge", body: body}, nil
+	},
+}
+
+// idCall maps the methods taking the id of a user as only param
+func idCall(method, path string) func(json.RawMessage) (rpcCall, error) {
+	return func(params json.RawMessage) (rpcCall, error) {
+		var p struct {
+			ID string `json:"id"`
+		}
+		if err := decodeParams(params, &p); err != nil || p.ID == "" {
+			return rpcCall{}, fmt.Errorf("id is required")
+		}
+		return rpcCall{method: method, path: fmt.Sprintf(path, url.PathEscape(p.ID))}, nil
+	}
+}
+
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	return json.Unmarshal(params, v)
+}
+
+// rpcHandler serves the API over JSON-RPC 2.0, calling the routes of
+// the router for every method so they behave as their HTTP counterparts
+type rpcHandler struct {
+	router *router
+}
+
+// routes is the route table of the JSON-RPC endpoint. It is public,
+// every call being authorized as the route it maps to.
+func (h *rpcHandler) routes() []route {
+	return []route{
+		{http.MethodPost, "/rpc", "Call the API over JSON-RPC 2.0", scopePublic, rateWrite, policyDynamic, h.RPC},
+	}
+}
+
+// RPC answers a JSON-RPC request or batch. Notifications get no
+// response, a batch made of them only gets a 204.
+func (h *rpcHandler) RPC(w http.ResponseWriter, r *http.Request) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		writeRPC(w, r, rpcFailure(nil, rpcParseError, "parse error"))
+		return
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] != '[' {
+		resp, ok := h.call(r, raw)
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeRPC(w, r, resp)
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(raw, &batch); err != nil || len(batch) == 0 || len(batch) > maxRPCBatch {
+		writeRPC(w, r, rpcFailure(nil, rpcInvalidRequest, "invalid request"))
+		return
+	}
+	resps := make([]rpcResponse, 0, len(batch))
+	for _, req := range batch {
+		if resp, ok := h.call(r, req); ok {
+			resps = append(resps, resp)
+		}
+	}
+	if len(resps) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeRPC(w, r, resps)
+}
+
+// call calls the route of a JSON-RPC request on behalf of r, returning
+// false for notifications
+func (h *rpcHandler) call(r *http.Request, raw json.RawMessage) (rpcResponse, bool) {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcFailure(nil, rpcInvalidRequest, "invalid request"), true
+	}
+	notification := req.ID == nil
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		return rpcFailure(req.ID, rpcMethodNotFound, "method not found"), !notification
+	}
+	call, err := method(req.Params)
+	if err != nil {
+		return rpcFailure(req.ID, rpcInvalidParams, "invalid params: "+err.Error()), !notification
+	}
+
+	rec, err := h.router.dispatch(r, call)
+	if err != nil {
+		return rpcFailure(req.ID, rpcInternalError, "internal error"), !notification
+	}
+	if rec.status >= 200 && rec.status <= 299 {
+		result := json.RawMessage("null")
+		if rec.body.Len() > 0 {
+			result = rec.body.Bytes()
+		}
+		return rpcResponse{JSONRPC: "2.0", Result: &result, ID: req.ID}, !notification
+	}
+	var body ErrorResponse
+	json.Unmarshal(rec.body.Bytes(), &body)
+	if body.Message == "" {
+		body.Message = http.StatusText(rec.status)
+	}
+	resp := rpcFailure(req.ID, rpcServerError, body.Message)
+	resp.Error.Data = struct {
+		Status  int    `json:"status"`
+		Code    string `json:"code,omitempty"`
+		Details any    `json:"details,omitempty"`
+	}{rec.status, body.Code, body.Details}
+	return resp, !notification
+}
+
+// dispatch serves call on behalf of r, as a request of the same client
+// to the same version of the API, returning the buffered response
+func (rr *router) dispatch(r *http.Request, call rpcCall) (*responseBuffer, error) {
+	target := versionPrefix(r) + call.path
+	if len(call.query) > 0 {
+		target += "?" + call.query.Encode()
+	}
+	sub, err := http.NewRequestWithContext(r.Context(), call.method, target, bytes.NewReader(call.body))
+	if err != nil {
+		return nil, err
+	}
+	sub.Header = r.Header.Clone()
+	sub.Header.Del("If-Match")
+	sub.Header.Del("If-None-Match")
+	sub.Header.Del("Accept-Encoding")
+	// the responses are read as JSON, whatever the client accepts
+	sub.Header.Set("Accept", "application/json")
+	for k, v := range call.header {
+		sub.Header[k] = v
+	}
+	sub.RemoteAddr = r.RemoteAddr
+	rec := newResponseBuffer()
+	rr.ServeHTTP(rec, sub)
+	return rec, nil
+}
+
+func rpcFailure(id json.RawMessage, code int, message string) rpcResponse {
+	return rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: code, Message: message}, ID: id}
+}
+
+func writeRPC(w http.ResponseWriter, r *http.Request, v any) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
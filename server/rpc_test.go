@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestRPC(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	w := do(h, http.MethodPost, "/rpc", `{"jsonrpc":"2.0","method":"users.create","params":{"name":"Ada"},"id":1}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var resp rpcResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil || string(resp.ID) != "1" {
+		t.Fatalf("create answered %s", w.Body)
+	}
+
+	w = do(h, http.MethodPost, "/rpc", `[
+		{"jsonrpc":"2.0","method":"users.get","params":{"id":"u1"},"id":"get"},
+		{"jsonrpc":"2.0","method":"users.deactivate","params":{"id":"u1"}},
+		{"jsonrpc":"2.0","method":"users.get","params":{"id":"u42"},"id":"missing"},
+		{"jsonrpc":"2.0","method":"users.get","id":"no params"},
+		{"jsonrpc":"2.0","method":"users.nope","id":"unknown"},
+		{"method":"users.get","id":"no version"}
+	]`)
+	var resps []rpcResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil {
+		t.Fatalf("batch answered %d %s: %v", w.Code, w.Body, err)
+	}
+	if len(resps) != 5 {
+		t.Fatalf("%d responses, want one per request but the notification", len(resps))
+	}
+	var u struct {
+		Name string `json:"name"`
+	}
+	if resps[0].Result == nil || json.Unmarshal(*resps[0].Result, &u) != nil || u.Name != "Ada" {
+		t.Errorf("get answered %+v", resps[0])
+	}
+	for i, want := range []int{rpcServerError, rpcInvalidParams, rpcMethodNotFound, rpcInvalidRequest} {
+		if got := resps[i+1]; got.Error == nil || got.Error.Code != want {
+			t.Errorf("response %s: %+v, want the error %d", got.ID, got.Error, want)
+		}
+	}
+	if data, _ := resps[1].Error.Data.(map[string]any); data["status"] != float64(http.StatusNotFound) {
+		t.Errorf("missing user answered %+v, want the status 404 in data", resps[1].Error)
+	}
+
+	w = do(h, http.MethodGet, "/users?status=inactive", "")
+	var inactive struct {
+		Users []struct {
+			ID string `json:"id"`
+		} `json:"users"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &inactive); err != nil || len(inactive.Users) != 1 {
+		t.Errorf("the notification wasn't called: %s", w.Body)
+	}
+
+	if w := do(h, http.MethodPost, "/rpc", `{"jsonrpc":"2.0","method":"users.deactivate","params":{"id":"u1"}}`); w.Code != http.StatusNoContent {
+		t.Errorf("notification answered %d, want 204", w.Code)
+	}
+	w = do(h, http.MethodPost, "/rpc", `{"jsonrpc"`)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error == nil || resp.Error.Code != rpcParseError {
+		t.Errorf("malformed request answered %s", w.Body)
+	}
+}
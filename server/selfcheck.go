@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+const selfCheckTimeout = 5 * time.Second // of each check reaching out
+
+// statuses of the checks
+const (
+	checkOK      = "ok"
+	checkWarn    = "warn"
+	checkFail    = "fail"
+	checkSkipped = "skipped"
+)
+
+// Check is the outcome of a startup check
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // ok, warn, fail or skipped
+	Detail string `json:"detail,omitempty"`
+}
+
+// SelfCheck checks that the server can start: its configuration, the
+// store, its migrations, the port and the TLS certificate
+func (s *Server) SelfCheck(ctx context.Context) []Check {
+	return []Check{
+		s.checkConfig(),
+		s.checkStore(ctx),
+		s.checkMigrations(ctx),
+		s.checkPort(),
+		s.checkTLS(),
+	}
+}
+
+// selfCheck runs and logs the self-check, failing when a check does
+// and the config asks to fail fast
+func (s *Server) selfCheck(ctx context.Context) error {
+	var failed []string
+	for _, c := range s.SelfCheck(ctx) {
+		level := slog.LevelInfo
+		switch c.Status {
+		case checkWarn:
+			level = slog.LevelWarn
+		case checkFail:
+			level = slog.LevelError
+			failed = append(failed, c.Name)
+		}
+		s.logger.Log(ctx, level, "self-check", "check", c.Name, "status", c.Status, "detail", c.Detail)
+	}
+	if len(failed) > 0 && s.cfg.FailFast {
+		return fmt.Errorf("self-check failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// readiness checks the server can serve: its store is reachable and it
+// isn't shutting down nor shedding the load
+func (s *Server) readiness(ctx context.Context) []Check {
+	checks := []Check{s.checkStore(ctx)}
+	serving := Check{Name: "serving", Status: checkOK}
+	switch {
+	case s.inflight != nil && s.inflight.report().Draining:
+		serving = Check{"serving", checkFail, "shutting down"}
+	case s.watchdog != nil && s.watchdog.overloaded.Load():
+		serving = Check{"serving", checkFail, "shedding the load, the runtime being over the watchdog thresholds"}
+	}
+	return append(checks, serving)
+}
+
+// checkConfig reports the settings having no effect without others,
+// the invalid ones failing New
+func (s *Server) checkConfig() Check {
+	var warnings []string
+	if wd := s.cfg.Watchdog; wd.Interval == 0 && (wd.Goroutines > 0 || wd.HeapBytes > 0 || wd.GCPause > 0 || wd.Shed || wd.RestartAfter > 0) {
+		warnings = append(warnings, "watchdog thresholds set without an interval: the watchdog is disabled")
+	}
+	if p := s.cfg.Profiling; p.Dir != "" && p.P99 == 0 && p.ErrorRate == 0 {
+		warnings = append(warnings, "profiling directory set without thresholds: no profile will be captured")
+	}
+	if len(warnings) > 0 {
+		return Check{"config", checkWarn, strings.Join(warnings, "; ")}
+	}
+	return Check{Name: "config", Status: checkOK}
+}
+
+func (s *Server) checkStore(ctx context.Context) Check {
+	p, ok := unwrap(s.store).(store.Pinger)
+	if !ok {
+		return Check{"store", checkSkipped, fmt.Sprintf("%T can't be pinged", unwrap(s.store))}
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	if err := p.Ping(ctx); err != nil {
+		return Check{"store", checkFail, err.Error()}
+	}
+	return Check{Name: "store", Status: checkOK}
+}
+
+func (s *Server) checkMigrations(ctx context.Context) Check {
+	m, ok := unwrap(s.store).(store.Migrator)
+	if !ok {
+		return Check{"migrations", checkSkipped, "the store has no schema"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	pending, err := m.PendingMigrations(ctx)
+	if err != nil {
+		return Check{"migrations", checkFail, err.Error()}
+	}
+	if len(pending) > 0 {
+		return Check{"migrations", checkFail, "pending: " + strings.Join(pending, ", ") + "; run the migrate command"}
+	}
+	return Check{Name: "migrations", Status: checkOK}
+}
+
+// checkPort tells whether the address can be listened on, unless the
+// server was given its listener
+func (s *Server) checkPort() Check {
+	if s.listener != nil {
+		return Check{"port", checkOK, "listening on " + s.listener.Addr().String()}
+	}
+	l, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return Check{"port", checkFail, err.Error()}
+	}
+	l.Close()
+	return Check{"port", checkOK, s.cfg.Addr + " available"}
+}
+
+// checkTLS reports the certificates expired or about to
+func (s *Server) checkTLS() Check {
+	if s.certs == nil {
+		return Check{"tls", checkSkipped, "the server serves plain HTTP"}
+	}
+	c := Check{Name: "tls", Status: checkOK}
+	var details []string
+	for _, st := range s.certs.report() {
+		details = append(details, fmt.Sprintf("%s %s: %s, %.0f days left", st.Name, st.Subject, st.Status, st.DaysLeft))
+		switch {
+		case st.Status == "expired":
+			c.Status = checkFail
+		case st.Status == checkWarn && c.Status == checkOK:
+			c.Status = checkWarn
+		}
+	}
+	c.Detail = strings.Join(details, "; ")
+	return c
+}
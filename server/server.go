@@ -0,0 +1,1004 @@
+// Package server implements the users API. It can be run on its own or
+// embedded in another program through Handler.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/acme"
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/idgen"
+	"github.com/santisdev/go-restapi.git/jose"
+	"github.com/santisdev/go-restapi.git/metrics"
+	"github.com/santisdev/go-restapi.git/moderation"
+	"github.com/santisdev/go-restapi.git/outbound"
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+	"github.com/santisdev/go-restapi.git/tracing"
+	"github.com/santisdev/go-restapi.git/validate"
+	"github.com/santisdev/go-restapi.git/webhooks"
+)
+
+// DefaultTimeouts are the timeouts of the connections, unless set
+var DefaultTimeouts = Timeouts{
+	ReadHeader:    5 * time.Second,
+	Read:          30 * time.Second,
+	Write:         30 * time.Second,
+	Idle:          2 * time.Minute,
+	ShutdownGrace: 10 * time.Second,
+}
+
+// Timeouts bound the connections of the clients, so slow or idle ones
+// don't hold them forever, and the shutdown
+type Timeouts struct {
+	// ReadHeader and Read bound the reading of the headers, and of the
+	// whole request
+	ReadHeader time.Duration
+	Read       time.Duration
+	// Write bounds the writing of the responses, from the end of the
+	// headers. The long polls are given their wait on top.
+	Write time.Duration
+	// Idle bounds the wait for the next request on a kept-alive
+	// connection
+	Idle time.Duration
+	// ShutdownGrace is the time Run waits for the in-flight requests
+	// on shutdown, before closing their connections
+	ShutdownGrace time.Duration
+}
+
+// Config holds the settings of a Server
+type Config struct {
+	// Addr is the address Run listens on, unless a listener is given
+	Addr string
+	// DuplicateScan is the interval between the scans for duplicate
+	// users. Zero disables the scheduled scans.
+	DuplicateScan time.Duration
+	// AutoMergeDuplicates makes the scans merge the exact duplicates
+	AutoMergeDuplicates bool
+	// Retention purges the deactivated users and the dead letters once
+	// older than its rules, when they are set
+	Retention Retention
+	// ClientUserIDs keeps the legacy creation of the users, under the id
+	// of the body, replacing any user having it. By default the server
+	// assigns the ids, rejecting the bodies setting one.
+	ClientUserIDs bool
+	// RequireVersion makes the writes of the users tell the version they
+	// expect, in If-Match or the body, answering 428 otherwise
+	RequireVersion bool
+	// EventSource is the CloudEvents source of the events delivered to
+	// the webhooks, a URI reference identifying this API
+	EventSource string
+	// SOAP enables the SOAP facade on /soap, for the consumers that
+	// can't speak JSON
+	SOAP bool
+	// Browser renders the resources as HTML pages to the browsers, with
+	// forms calling the routes, for exploring the API in development
+	Browser bool
+	// PageSize bounds the pages of the routes not in PageSizes
+	PageSize PageSize
+	// PageSizes bounds the pages of some routes, by "METHOD /path"
+	PageSizes map[string]PageSize
+	// Roles are the roles required by some routes, over
+	// DefaultRolePolicy
+	Roles RolePolicy
+	// Compression tells which responses are compressed, for the clients
+	// accepting gzip or the codings of WithCompressor
+	Compression Compression
+	// CanonicalJSON are the routes, by "METHOD /path", whose successful
+	// responses are written in canonical JSON (RFC 8785), for the clients
+	// signing or hashing them
+	CanonicalJSON []string
+	// ContentFilterFields are the fields of the users checked by the
+	// content filter, by path as name, tags, metadata for all its values
+	// or metadata.bio for one, DefaultFilteredFields unless set
+	ContentFilterFields []string
+	// QuarantineFlagged quarantines the users breaking the policy of the
+	// content filter rather than refusing them
+	QuarantineFlagged bool
+	// MaxFieldLength bounds the strings of the fields without a max
+	// rule, in characters, validate.DefaultMaxLength unless set
+	MaxFieldLength int
+	// FieldMaxLengths bound the strings of some fields of the users, by
+	// their path as name, replacing their max rule
+	FieldMaxLengths map[string]int
+	// MaxQueryCost is the budget of a listing, in users examined times
+	// the terms of its filter
+	MaxQueryCost int
+	// AdaptiveConcurrency caps the requests in flight, adapting the cap
+	// to their latency, and sheds the others with 503
+	AdaptiveConcurrency bool
+	// Watchdog checks the goroutines, heap and GC pauses of the server
+	Watchdog Watchdog
+	// Profiling captures profiles when the requests get slow or fail
+	Profiling Profiling
+	// Timezones renders the timestamps of the responses in the time zone
+	// the clients ask for in X-Timezone. They are otherwise in UTC.
+	Timezones bool
+	// EpochMillisClients are the legacy clients whose request bodies may
+	// hold their timestamps as epoch milliseconds rather than in RFC
+	// 3339, by the subject of their identity or, without authentication,
+	// by the product of their User-Agent, as legacy-sync for
+	// legacy-sync/2.1
+	EpochMillisClients []string
+	// FailFast stops Run before serving when the startup self-check
+	// fails
+	FailFast bool
+	// TLS serves HTTPS, when its certificate is set
+	TLS TLS
+	// AccessLog logs every request, with its status and latency
+	AccessLog bool
+	// Signing signs the response bodies, when its key is set
+	Signing Signing
+	// RateLimits limit the requests of every client, by rate class: read,
+	// write, poll or admin. The classes not in it aren't limited. SetLive
+	// changes them while serving.
+	RateLimits map[string]RateLimit
+	// CORS lets the browsers call the API from other origins, when its
+	// origins are set
+	CORS CORS
+	// Anomalies flags the clients creating or deleting far more users
+	// than usual, when its window is set
+	Anomalies Anomalies
+	// Quotas limit the requests and creates of the clients each month,
+	// by the subject of their identity, * standing for the others
+	Quotas map[string]Quota
+	// Invitations lets the admins and tenant admins invite users by
+	// email, when its secret is set, which needs a mailer and the API
+	// keys
+	Invitations Invitations
+	// Consent refuses some operations on the users until they accept
+	// the latest version of the terms of service
+	Consent ConsentPolicy
+	// UsageFile keeps the monthly usage of the API keys across restarts,
+	// when set
+	UsageFile string
+	// ManagedKeysFile keeps the API keys added, given roles and revoked
+	// while serving, as by the tenant admins, across restarts, when set.
+	// It needs the API keys.
+	ManagedKeysFile string
+	// LegalHoldsFile keeps the legal holds of the tenants and the audit
+	// trail of the holds across restarts, when set
+	LegalHoldsFile string
+	// Timeouts bound the connections and the shutdown, zero values
+	// standing for DefaultTimeouts
+	Timeouts Timeouts
+}
+
+// Validate returns the errors of the settings out of range, zero
+// values standing for the defaults
+func (c Config) Validate() error {
+	var errs []error
+	if c.PageSize != (PageSize{}) {
+		errs = append(errs, c.PageSize.validate())
+	}
+	for rt, ps := range c.PageSizes {
+		if err := ps.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rt, err))
+		}
+	}
+	if err := c.Roles.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, rateLimitErrors(c.RateLimits)...)
+	if err := c.CORS.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Anomalies.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for client, q := range c.Quotas {
+		if err := q.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client, err))
+		}
+	}
+	if err := c.Invitations.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Compression.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Retention.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Consent.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, f := range c.ContentFilterFields {
+		if f != "name" && f != "tags" && f != "metadata" && !strings.HasPrefix(f, "metadata.") {
+			errs = append(errs, fmt.Errorf("invalid content filter field %q: expected name, tags, metadata or metadata.<key>", f))
+		}
+	}
+	if c.MaxFieldLength < 0 {
+		errs = append(errs, fmt.Errorf("invalid max field length %d: negative", c.MaxFieldLength))
+	}
+	for f, n := range c.FieldMaxLengths {
+		if n < 1 {
+			errs = append(errs, fmt.Errorf("invalid max length %d of %s: not positive", n, f))
+		}
+	}
+	if c.MaxQueryCost < 0 {
+		errs = append(errs, fmt.Errorf("invalid max query cost %d: negative", c.MaxQueryCost))
+	}
+	if r := c.Profiling.ErrorRate; r < 0 || r > 1 {
+		errs = append(errs, fmt.Errorf("invalid profiling error rate %g: not between 0 and 1", r))
+	}
+	if p := c.Profiling; p.P99 < 0 || p.Window < 0 || p.CPU < 0 || p.Cooldown < 0 {
+		errs = append(errs, errors.New("invalid profiling: negative duration"))
+	}
+	if wd := c.Watchdog; wd.Interval < 0 || wd.Goroutines < 0 || wd.GCPause < 0 || wd.RestartAfter < 0 {
+		errs = append(errs, errors.New("invalid watchdog: negative threshold"))
+	}
+	if t := c.Timeouts; t.ReadHeader < 0 || t.Read < 0 || t.Write < 0 || t.Idle < 0 || t.ShutdownGrace < 0 {
+		errs = append(errs, errors.New("invalid timeouts: negative duration"))
+	}
+	if err := c.TLS.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// withDefaults returns t, its zero timeouts set to DefaultTimeouts
+func (t Timeouts) withDefaults() Timeouts {
+	if t.ReadHeader == 0 {
+		t.ReadHeader = DefaultTimeouts.ReadHeader
+	}
+	if t.Read == 0 {
+		t.Read = DefaultTimeouts.Read
+	}
+	if t.Write == 0 {
+		t.Write = DefaultTimeouts.Write
+	}
+	if t.Idle == 0 {
+		t.Idle = DefaultTimeouts.Idle
+	}
+	if t.ShutdownGrace == 0 {
+		t.ShutdownGrace = DefaultTimeouts.ShutdownGrace
+	}
+	return t
+}
+
+// DefaultConfig returns the settings used when none are given
+func DefaultConfig() Config {
+	return Config{
+		Addr:         "localhost:8080",
+		EventSource:  webhooks.DefaultSource,
+		PageSize:     DefaultPageSize,
+		MaxQueryCost: DefaultMaxQueryCost,
+		Timeouts:     DefaultTimeouts,
+		AccessLog:    true,
+		Compression:  Compression{MinSize: DefaultCompressMinSize},
+	}
+}
+
+// Middleware wraps the handler of the API
+type Middleware func(http.Handler) http.Handler
+
+// Option customizes a Server
+type Option func(*Server) error
+
+// WithConfig sets the settings of the server
+func WithConfig(cfg Config) Option {
+	return func(s *Server) error {
+		s.cfg = cfg
+		return nil
+	}
+}
+
+// WithStore sets the store of the users, an empty memory store by default
+func WithStore(st store.UserStore) Option {
+	return func(s *Server) error {
+		s.store = st
+		return nil
+	}
+}
+
+// WithLogger sets the logger, slog.Default() by default
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithClock sets the clock, the system one by default
+func WithClock(c clock.Clock) Option {
+	return func(s *Server) error {
+		s.clock = c
+		return nil
+	}
+}
+
+// WithIDGenerator sets the generator of identifiers, random ones by default
+func WithIDGenerator(g idgen.Generator) Option {
+	return func(s *Server) error {
+		s.ids = g
+		return nil
+	}
+}
+
+// WithEventBus sets the bus the change events are published on, an
+// in-process one by default
+func WithEventBus(b events.Bus) Option {
+	return func(s *Server) error {
+		s.bus = b
+		return nil
+	}
+}
+
+// WithTracer traces the requests with t. Requests aren't traced by
+// default.
+func WithTracer(t *tracing.Tracer) Option {
+	return func(s *Server) error {
+		s.tracer = t
+		return nil
+	}
+}
+
+// WithMetrics registers the metrics of the server in reg, served on
+// /metrics. By default the server has its own registry.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(s *Server) error {
+		s.metrics = reg
+		return nil
+	}
+}
+
+// WithAuth makes the server authenticate the clients of every
+// non-public route with a. By default no authentication is done.
+func WithAuth(a Authenticator) Option {
+	return func(s *Server) error {
+		s.auth = a
+		return nil
+	}
+}
+
+// WithAPIKeys authenticates the clients by their API key, listed on
+// /admin/api-keys, besides the other authenticators
+func WithAPIKeys(keys []APIKey) Option {
+	return func(s *Server) error {
+		a, err := NewAPIKeys(keys)
+		if err != nil {
+			return err
+		}
+		s.apiKeys = a
+		return nil
+	}
+}
+
+// WithTokens issues JWTs to the clients logging in on /auth/login with
+// the credentials of creds, and authenticates the requests bearing them,
+// besides the other authenticators
+func WithTokens(t Tokens, creds CredentialStore) Option {
+	return func(s *Server) error {
+		if creds == nil {
+			return errors.New("tokens: no credential store")
+		}
+		s.tokens, s.creds = &t, creds
+		return nil
+	}
+}
+
+// WithContentFilter checks the fields of the users created and updated
+// against the policy of f, as a moderation.WordList, refusing the users
+// breaking it with 422 and the policy_violation code, or quarantining
+// them with Config.QuarantineFlagged
+func WithContentFilter(f moderation.Filter) Option {
+	return func(s *Server) error {
+		s.filter = f
+		return nil
+	}
+}
+
+// WithRateLimiter keeps the buckets of the rate limits in l, as one
+// shared by the instances of the server. By default they are kept in
+// memory.
+func WithRateLimiter(l RateLimiter) Option {
+	return func(s *Server) error {
+		s.limiter = l
+		return nil
+	}
+}
+
+// WithMiddleware wraps the handler of the API with m, the first
+// middleware being the outermost
+func WithMiddleware(m ...Middleware) Option {
+	return func(s *Server) error {
+		s.middleware = append(s.middleware, m...)
+		return nil
+	}
+}
+
+// WithIngestSources accepts the webhooks of the given third parties on
+// /ingest/{source}, the sources being keyed by name
+func WithIngestSources(sources map[string]IngestSource) Option {
+	return func(s *Server) error {
+		for name, src := range sources {
+			if err := src.validate(name); err != nil {
+				return err
+			}
+		}
+		s.ingest = sources
+		return nil
+	}
+}
+
+// WithWebhooks delivers the events to the webhook subscriptions with d.
+// By default the server has its own dispatcher.
+func WithWebhooks(d *webhooks.Dispatcher) Option {
+	return func(s *Server) error {
+		s.webhooks = d
+		return nil
+	}
+}
+
+// WithUsageUploader uploads the usage report of each month past with
+// u, as a CSV file, once the month is over
+func WithUsageUploader(u UsageUploader) Option {
+	return func(s *Server) error {
+		s.uploader = u
+		return nil
+	}
+}
+
+// WithCompressor offers the content coding of c besides gzip, to the
+// clients accepting it in their Accept-Encoding header, preferred to
+// gzip and to the codings given before when accepted alike
+func WithCompressor(c Compressor) Option {
+	return func(s *Server) error {
+		s.compressors = append([]Compressor{c}, s.compressors...)
+		return nil
+	}
+}
+
+// WithCodec offers the media type of c besides JSON, to the clients
+// preferring it in their Accept header, and reads the users written in
+// it
+func WithCodec(c Codec) Option {
+	return func(s *Server) error {
+		s.codecs = append(s.codecs, codec{c.MediaType(), func(r *http.Request, rt route, body []byte) ([]byte, error) {
+			return c.Encode(body)
+		}, c.Decode})
+		return nil
+	}
+}
+
+// WithMailer sends the emails of the server, as the invitations, with m
+func WithMailer(m Mailer) Option {
+	return func(s *Server) error {
+		s.mailer = m
+		return nil
+	}
+}
+
+// WithTransport makes the webhook deliveries of the server's own
+// dispatcher go through the public variant of t, refusing the URLs of
+// the private networks. By default the server has its own transport.
+func WithTransport(t *outbound.Transport) Option {
+	return func(s *Server) error {
+		s.transport = t
+		return nil
+	}
+}
+
+// WithListener makes Run serve on l instead of listening on Config.Addr
+func WithListener(l net.Listener) Option {
+	return func(s *Server) error {
+		s.listener = l
+		return nil
+	}
+}
+
+// deps are the injected dependencies, shared by the handlers
+type deps struct {
+	logger *slog.Logger
+	store  store.UserStore
+	clock  clock.Clock
+	ids    idgen.Generator
+	bus    events.Bus
+}
+
+// Server is an instance of the users API
+type Server struct {
+	deps
+	cfg        Config
+	auth       Authenticator
+	apiKeys    *APIKeys // nil unless authenticating by API key
+	tokens     *Tokens  // nil unless tokens are issued
+	creds      CredentialStore
+	tracer     *tracing.Tracer
+	metrics    *metrics.Registry
+	transport  *outbound.Transport
+	middleware []Middleware
+	signer     *jose.Signer // nil when the responses aren't signed
+	listener   net.Listener
+	inflight   *inflight
+	dedup      *dedup
+	retention  *retention
+	holds      *legalHolds
+	ingest     map[string]IngestSource
+	filter     moderation.Filter
+	limiter    RateLimiter
+	webhooks   *webhooks.Dispatcher
+	uploader   UsageUploader // nil unless the usage reports are uploaded
+	mailer     Mailer        // nil unless emails are sent
+	codecs     []codec       // offered besides the default ones
+	// compressors are the codings offered besides gzip
+	compressors []Compressor
+	meter       *usageMeter
+	watchdog    *watchdog // nil when disabled
+	profiler    *profiler // nil when disabled
+	tlsConfig   *tls.Config
+	certs       *certWatch    // nil without TLS
+	acme        *acme.Manager // nil unless the certificate is from ACME
+	live        *atomic.Pointer[Live]
+	handler     http.Handler
+}
+
+// Live holds the settings which can change while serving
+type Live struct {
+	PageSize     PageSize
+	MaxQueryCost int
+	// RateLimits are the limits of the rate classes, as
+	// Config.RateLimits
+	RateLimits map[string]RateLimit
+}
+
+func (l Live) validate() error {
+	if l.MaxQueryCost < 1 {
+		return fmt.Errorf("invalid max query cost %d: not positive", l.MaxQueryCost)
+	}
+	if errs := rateLimitErrors(l.RateLimits); len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return l.PageSize.validate()
+}
+
+// Live returns the settings which can change while serving
+func (s *Server) Live() Live {
+	return *s.live.Load()
+}
+
+// SetLive changes the settings which can change while serving, the
+// requests being served keeping the previous ones
+func (s *Server) SetLive(l Live) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+	s.live.Store(&l)
+	return nil
+}
+
+// New returns a server customized by opts
+func New(opts ...Option) (*Server, error) {
+	s := &Server{cfg: DefaultConfig()}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.cfg.Addr == "" {
+		s.cfg.Addr = DefaultConfig().Addr
+	}
+	if s.cfg.PageSize == (PageSize{}) {
+		s.cfg.PageSize = DefaultPageSize
+	}
+	if s.cfg.MaxQueryCost <= 0 {
+		s.cfg.MaxQueryCost = DefaultMaxQueryCost
+	}
+	s.cfg.Timeouts = s.cfg.Timeouts.withDefaults()
+	if err := s.cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	if s.store == nil {
+		s.store = store.NewMemory(nil)
+	}
+	if s.tracer != nil {
+		s.store = tracedStore{s.store, s.tracer}
+	}
+	if s.clock == nil {
+		s.clock = clock.System{}
+	}
+	if s.ids == nil {
+		s.ids = idgen.Random{}
+	}
+	if s.bus == nil {
+		s.bus = events.NewMemory()
+	}
+	if _, ok := unwrap(s.store).(store.Outbox); !ok {
+		s.store = publishingStore{s.store, s.bus, s.logger}
+	}
+	if s.metrics == nil {
+		s.metrics = metrics.NewRegistry()
+	}
+	if s.transport == nil {
+		t, err := outbound.New(outbound.Config{}, s.clock, s.metrics)
+		if err != nil {
+			return nil, err
+		}
+		s.transport = t
+	}
+	if s.webhooks == nil {
+		s.webhooks = webhooks.New(s.clock, s.ids, s.logger)
+		s.webhooks.Client.Transport = s.transport.Public()
+		s.webhooks.CheckURL = s.transport.CheckURL
+		if s.cfg.EventSource != "" {
+			s.webhooks.Source = s.cfg.EventSource
+		}
+	}
+	s.bus.Subscribe(s.webhooks.Handle)
+	if k := s.cfg.Signing; k.KeyFile != "" {
+		signer, err := jose.LoadSigner(k.KeyFile, k.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		s.signer = signer
+	}
+	var auths anyAuthenticator
+	if s.auth != nil {
+		auths = append(auths, s.auth)
+	}
+	if s.apiKeys != nil {
+		auths = append(auths, s.apiKeys)
+	}
+	var issuer *tokens
+	if s.tokens != nil {
+		var err error
+		if issuer, err = newTokens(*s.tokens, s.creds, s.clock, s.ids); err != nil {
+			return nil, err
+		}
+		auths = append(auths, issuer)
+	}
+	switch len(auths) {
+	case 0:
+	case 1:
+		s.auth = auths[0]
+	default:
+		s.auth = auths
+	}
+	if t := s.cfg.TLS; t.enabled() {
+		if t.ExpiryWarning == 0 {
+			t.ExpiryWarning = DefaultExpiryWarning
+		}
+		if len(t.ACME.Domains) > 0 {
+			m, err := t.newACME(s.transport, s.logger)
+			if err != nil {
+				return nil, err
+			}
+			s.acme = m
+			s.tlsConfig = &tls.Config{GetCertificate: s.acme.GetCertificate, MinVersion: tls.VersionTLS12}
+			s.certs = &certWatch{acme: s.acme, clock: s.clock, warning: t.ExpiryWarning}
+		} else {
+			cfg, certs, err := t.load()
+			if err != nil {
+				return nil, err
+			}
+			s.tlsConfig = cfg
+			s.certs = &certWatch{certs: certs, clock: s.clock, warning: t.ExpiryWarning}
+		}
+		s.metrics.NewGaugeFunc("tls_serving_certificate_expiry_days", "Days until the serving certificate expires.",
+			func() float64 { return s.certs.daysLeft("serving") })
+		if t.ClientCAFile != "" {
+			s.metrics.NewGaugeFunc("tls_client_ca_expiry_days", "Days until the first client CA expires.",
+				func() float64 { return s.certs.daysLeft("client_ca") })
+		}
+	}
+
+	if s.apiKeys != nil {
+		s.apiKeys.users = s.store
+	}
+	if s.cfg.ManagedKeysFile != "" {
+		if s.apiKeys == nil {
+			return nil, errors.New("the managed keys file needs the API keys")
+		}
+		if err := s.apiKeys.persist(s.cfg.ManagedKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	locks := newLockManager(s.clock, s.ids)
+	s.dedup = &dedup{deps: &s.deps, locks: locks, autoMerge: s.cfg.AutoMergeDuplicates}
+	holds, err := newLegalHolds(&s.deps, s.cfg.LegalHoldsFile, s.apiKeys)
+	if err != nil {
+		return nil, err
+	}
+	s.holds = holds
+	s.retention = &retention{deps: &s.deps, locks: locks, webhooks: s.webhooks, holds: s.holds, cfg: s.cfg.Retention}
+	insights := newQueryInsights(s.logger)
+	usage := newKeyAnalytics(s.clock)
+	meter, err := newUsageMeter(&s.deps, s.cfg.UsageFile, s.uploader)
+	if err != nil {
+		return nil, err
+	}
+	s.meter = meter
+	admin := &adminHandler{deps: &s.deps, dedup: s.dedup, retention: s.retention, holds: s.holds, webhooks: s.webhooks, insights: insights, apiKeys: s.apiKeys,
+		usage: usage, meter: meter, configSHA256: configChecksum(s.cfg)}
+	s.live = &atomic.Pointer[Live]{}
+	s.live.Store(&Live{PageSize: s.cfg.PageSize, MaxQueryCost: s.cfg.MaxQueryCost, RateLimits: s.cfg.RateLimits})
+	limits := validate.Limits{MaxLength: s.cfg.MaxFieldLength, Fields: s.cfg.FieldMaxLengths}
+	var filter *contentFilter
+	if s.filter != nil {
+		filter = &contentFilter{filter: s.filter, fields: s.cfg.ContentFilterFields, quarantine: s.cfg.QuarantineFlagged}
+		if len(filter.fields) == 0 {
+			filter.fields = DefaultFilteredFields
+		}
+	}
+	users := &userHandler{deps: &s.deps, locks: locks, live: s.live, insights: insights,
+		clientIDs: s.cfg.ClientUserIDs, limits: limits, filter: filter, consent: s.cfg.Consent, holds: s.holds,
+		requireVersion: s.cfg.RequireVersion}
+	ingest := &ingestHandler{deps: &s.deps, locks: locks, sources: s.ingest, limits: limits, filter: filter}
+	rpc := &rpcHandler{}
+	soap := &soapHandler{}
+	tables := [][]route{users.routes(), ingest.routes(), rpc.routes()}
+	if s.cfg.SOAP {
+		tables = append(tables, soap.routes())
+	}
+	system := &systemHandler{metrics: s.metrics, certs: s.certs, signer: s.signer, ready: s.readiness}
+	if issuer != nil {
+		tables = append(tables, (&tokenHandler{tokens: issuer}).routes())
+		system.tokenKeys = issuer.keys
+	}
+	if s.apiKeys != nil {
+		tenant := &tenantHandler{deps: &s.deps, apiKeys: s.apiKeys, webhooks: s.webhooks, meter: meter}
+		s.webhooks.TenantOf = s.apiKeys.Tenant
+		tables = append(tables, tenant.routes())
+	}
+	if s.cfg.Invitations.Secret != "" {
+		if s.mailer == nil || s.apiKeys == nil {
+			return nil, errors.New("invitations need a mailer and the API keys")
+		}
+		invites, err := newInvitationHandler(&s.deps, s.cfg.Invitations, s.mailer, s.apiKeys)
+		if err != nil {
+			return nil, err
+		}
+		invites.limits, invites.filter = limits, filter
+		tables = append(tables, invites.routes())
+	}
+	tables = append(tables, admin.routes(), system.routes())
+	rr := newRouter(s.auth, tables...)
+	rpc.router = rr
+	soap.router = rr
+	rr.codecs = append(rr.codecs, s.codecs...)
+	rr.compression = newCompression(s.cfg.Compression, s.compressors)
+	if s.cfg.Browser {
+		rr.codecs = append(rr.codecs, rr.htmlCodec())
+	}
+	rr.live = s.live
+	rr.timezones = s.cfg.Timezones
+	rr.epochMillis = s.cfg.EpochMillisClients
+	rr.pageSizes = s.cfg.PageSizes
+	rr.roles = s.cfg.Roles
+	rr.usage = usage
+	rr.meter = s.meter
+	rr.writeTimeout = s.cfg.Timeouts.Write
+	rr.signer = s.signer
+	for _, rt := range s.cfg.CanonicalJSON {
+		rr.canonical[rt] = true
+	}
+	rr.tracer = s.tracer
+	rr.duration = s.metrics.NewHistogramVec("http_request_duration_seconds",
+		"Latency of the HTTP requests.", metrics.DefBuckets, "method", "route", "code")
+	s.metrics.NewGaugeFunc("http_requests_in_flight", "Requests being served.", func() float64 {
+		return float64(rr.inflight.report().Total)
+	})
+	if s.cfg.Watchdog.Interval > 0 {
+		s.watchdog = &watchdog{cfg: s.cfg.Watchdog, clock: s.clock, logger: s.logger}
+		rr.watchdog = s.watchdog
+	}
+	if p := s.cfg.Profiling; p.Dir != "" && (p.P99 > 0 || p.ErrorRate > 0) {
+		s.profiler = newProfiler(p, s.clock, s.logger)
+		rr.profiler = s.profiler
+	}
+	// set up without limits too, which SetLive may add
+	if s.limiter == nil {
+		s.limiter = NewMemoryRateLimiter(s.clock)
+	}
+	rr.rates = &rateLimits{limiter: s.limiter, logger: s.logger,
+		limited: s.metrics.NewCounterVec("http_requests_rate_limited_total",
+			"Requests refused to clients past their rate limit, by rate class.", "class")}
+	if s.cfg.Anomalies.Window > 0 {
+		rr.anomalies = newAnomalyDetector(s.cfg.Anomalies, s.clock, s.logger)
+		rr.anomalies.limiter = s.limiter
+		rr.anomalies.publish = s.deps.publish
+		rr.anomalies.flagged = s.metrics.NewCounterVec("http_traffic_anomalies_total",
+			"Clients flagged for writing far more than usual, by operation.", "operation")
+	}
+	if len(s.cfg.Quotas) > 0 {
+		rr.quotas = newQuotas(s.cfg.Quotas, s.meter)
+		rr.quotas.publish = s.deps.publish
+		rr.quotas.exceeded = s.metrics.NewCounterVec("http_quota_exceeded_total",
+			"Requests refused to clients past their monthly quota, by resource.", "resource")
+	}
+	if s.cfg.AdaptiveConcurrency {
+		rr.limiter = newLimiter()
+		s.metrics.NewGaugeFunc("http_concurrency_limit", "Requests allowed in flight.", rr.limiter.current)
+	}
+	if rr.limiter != nil || rr.watchdog != nil {
+		rr.shed = s.metrics.NewCounterVec("http_requests_shed_total",
+			"Requests refused to shed the load.", "method", "route")
+	}
+	s.inflight = rr.inflight
+	admin.inflight = rr.inflight
+	builtin := []Middleware{Recover(s.logger)}
+	if len(s.cfg.CORS.AllowedOrigins) > 0 {
+		builtin = append(builtin, AllowCORS(s.cfg.CORS))
+	}
+	if s.cfg.AccessLog {
+		builtin = append([]Middleware{LogRequests(s.logger)}, builtin...)
+	}
+	s.handler = Chain(append(builtin, s.middleware...)...)(rr)
+	return s, nil
+}
+
+// Bus returns the bus the change events are published on
+func (s *Server) Bus() events.Bus {
+	return s.bus
+}
+
+// Handler returns the handler of the API, which can be mounted on the
+// root of another mux
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Run serves the API until ctx is done, then shuts down gracefully
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.selfCheck(ctx); err != nil {
+		return err
+	}
+	t := s.cfg.Timeouts
+	srv := &http.Server{
+		Addr:              s.cfg.Addr,
+		Handler:           s.Handler(),
+		TLSConfig:         s.tlsConfig,
+		ReadHeaderTimeout: t.ReadHeader,
+		ReadTimeout:       t.Read,
+		WriteTimeout:      t.Write,
+		IdleTimeout:       t.Idle,
+	}
+	errc := make(chan error, 2)
+	var redirect *http.Server
+	if addr := s.cfg.TLS.RedirectAddr; addr != "" || s.acme != nil {
+		if addr == "" {
+			addr = ":80"
+		}
+		var h http.Handler = redirectHTTPS(s.cfg.Addr)
+		if s.acme != nil {
+			h = s.acme.HTTPHandler(h)
+		}
+		redirect = &http.Server{Addr: addr, Handler: h, ReadHeaderTimeout: t.ReadHeader, IdleTimeout: t.Idle}
+		go func() {
+			if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+				errc <- fmt.Errorf("redirect listener: %w", err)
+			}
+		}()
+	}
+	if s.acme != nil {
+		jobCtx, stopJob := context.WithCancel(ctx)
+		defer stopJob()
+		go s.acme.Run(jobCtx)
+	}
+	go func() {
+		switch {
+		case s.listener != nil && s.tlsConfig != nil:
+			errc <- srv.ServeTLS(s.listener, "", "")
+		case s.listener != nil:
+			errc <- srv.Serve(s.listener)
+		case s.tlsConfig != nil:
+			errc <- srv.ListenAndServeTLS("", "")
+		default:
+			errc <- srv.ListenAndServe()
+		}
+	}()
+
+	s.logger.Info("serving", "addr", s.cfg.Addr, "tls", s.tlsConfig != nil)
+	if s.cfg.DuplicateScan > 0 {
+		jobCtx, stopJob := context.WithCancel(ctx)
+		defer stopJob()
+		go s.dedup.run(jobCtx, s.cfg.DuplicateScan)
+	}
+	if outbox, ok := unwrap(s.store).(store.Outbox); ok {
+		jobCtx, stopJob := context.WithCancel(ctx)
+		defer stopJob()
+		go s.relay(jobCtx, outbox)
+	}
+	if len(s.cfg.Retention.Rules) > 0 {
+		jobCtx, stopJob := context.WithCancel(ctx)
+		defer stopJob()
+		go s.retention.run(jobCtx)
+	}
+	if s.profiler != nil {
+		jobCtx, stopJob := context.WithCancel(ctx)
+		defer stopJob()
+		go s.profiler.run(jobCtx)
+	}
+	jobCtx, stopMeter := context.WithCancel(ctx)
+	defer stopMeter()
+	go s.meter.run(jobCtx)
+	restartc := make(chan struct{})
+	if s.watchdog != nil {
+		jobCtx, stopJob := context.WithCancel(ctx)
+		defer stopJob()
+		go s.watchdog.run(jobCtx, func() { close(restartc) })
+	}
+
+	restarting := false
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	case <-restartc:
+		restarting = true
+	}
+	s.logger.Info("shutting down", "grace", t.ShutdownGrace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), t.ShutdownGrace)
+	defer cancel()
+	drainCtx, stopDrain := context.WithCancel(shutdownCtx)
+	defer stopDrain()
+	go s.drain(drainCtx)
+
+	if redirect != nil {
+		redirect.Shutdown(shutdownCtx)
+	}
+	err := srv.Shutdown(shutdownCtx)
+	if rep := s.inflight.report(); err != nil {
+		s.logger.Warn("drain incomplete", "in_flight", rep.Total, "routes", rep.Routes, "err", err)
+	} else {
+		s.logger.Info("drained")
+	}
+	s.webhooks.Close()
+	if err := s.meter.save(); err != nil {
+		s.logger.Error("saving the usage", "file", s.cfg.UsageFile, "err", err)
+	}
+	if restarting {
+		return errors.Join(ErrWatchdogRestart, err)
+	}
+	return err
+}
+
+// publish emits an event about the resource subject, with data as
+// payload, once per emitted version of its type. Failures are logged
+// since the change itself succeeded. The events of the writes of users
+// are given to the store instead, by withEvent.
+func (d *deps) publish(ctx context.Context, typ, subject string, data any) {
+	evs, err := d.newEvents(typ, subject, data)
+	if err != nil {
+		d.logger.ErrorContext(ctx, "publishing event", "type", typ, "subject", subject, "err", err)
+	}
+	for _, e := range evs {
+		if err := d.bus.Publish(ctx, e); err != nil {
+			d.logger.ErrorContext(ctx, "publishing event", "type", e.SchemaType(), "subject", subject, "err", err)
+		}
+	}
+}
+
+// newEvents returns the events about the resource subject, with data as
+// payload, one per emitted version of its type
+func (d *deps) newEvents(typ, subject string, data any) ([]events.Event, error) {
+	var evs []events.Event
+	for _, version := range events.EmittedVersions(typ) {
+		e := events.Event{ID: d.ids.NewID(), Type: typ, Time: timestamp.New(d.clock.Now().UTC()), Subject: subject, Version: version}
+		payload := data
+		if encode, ok := payloadEncoders[e.SchemaType()]; ok {
+			payload = encode(data)
+		}
+		var err error
+		if e.Data, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+		evs = append(evs, e)
+	}
+	return evs, nil
+}
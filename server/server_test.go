@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/idgen"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+var testStart = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// the keys the clients of the servers of testKeys authenticate with
+const (
+	adminKey  = "admin-key-0123456789"
+	editorKey = "editor-key-0123456789"
+)
+
+// testKeys authenticates the clients of a test server by adminKey and
+// editorKey
+var testKeys = WithAPIKeys([]APIKey{
+	{Name: "admin", Key: adminKey, Roles: []string{RoleAdmin}},
+	{Name: "editor", Key: editorKey, Roles: []string{RoleEditor}},
+})
+
+// newTestServer returns the handler of a server on a memory store, with
+// a fake clock and the ids u1, u2..., configured by cfg and opts
+func newTestServer(t *testing.T, cfg Config, opts ...Option) (http.Handler, *clock.Fake) {
+	t.Helper()
+	clk := clock.NewFake(testStart)
+	s, err := New(append([]Option{
+		WithConfig(cfg),
+		WithStore(store.NewMemory(nil)),
+		WithClock(clk),
+		WithIDGenerator(&idgen.Sequence{Prefix: "u"}),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Handler(), clk
+}
+
+// do serves the request, the headers given as name, value pairs
+func do(h http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// errorCode returns the code of the error answered in w
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body %q: %v", w.Body, err)
+	}
+	return body.Code
+}
+
+// createUser creates a user named name, as the admin on the servers of
+// testKeys, returning it
+func createUser(t *testing.T, h http.Handler, name string) store.User {
+	t.Helper()
+	w := do(h, http.MethodPost, "/users", `{"name":"`+name+`"}`, apiKeyHeader, adminKey)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating %s: %d %s", name, w.Code, w.Body)
+	}
+	var u store.User
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/santisdev/go-restapi.git/jose"
+)
+
+// signatureHeader carries the detached JWS of the response bodies
+const signatureHeader = "X-JWS-Signature"
+
+// Signing signs the response bodies, so the consumers can verify them
+// wherever they were relayed
+type Signing struct {
+	// KeyFile is the PEM file of the private key, P-256, Ed25519 or RSA,
+	// the responses being signed when it is set
+	KeyFile string
+	// KeyID names the key in the signatures, its RFC 7638 thumbprint
+	// unless set
+	KeyID string
+}
+
+// sign calls handle, then signs the body of its response, held back
+// meanwhile, in the X-JWS-Signature header. The signature is over the
+// body as the handler wrote it, before any compression.
+func (rr *router) sign(w http.ResponseWriter, r *http.Request, handle http.HandlerFunc) {
+	buf := newResponseBuffer()
+	for k, v := range w.Header() {
+		buf.header[k] = v
+	}
+	handle(buf, r)
+
+	body := buf.body.Bytes()
+	for k, v := range buf.header {
+		w.Header()[k] = v
+	}
+	if len(body) > 0 {
+		jws, err := rr.signer.SignDetached(body)
+		if err != nil {
+			internalServerError(w, r)
+			return
+		}
+		w.Header().Set(signatureHeader, jws)
+	}
+	w.WriteHeader(buf.status)
+	w.Write(body)
+}
+
+// JWKS serves the public keys verifying the signatures of the responses
+// and the tokens
+func (h *systemHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := json.Marshal(jose.JWKS{Keys: h.jwks()})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// jwks returns the public keys of the signatures, the HS256 secrets of
+// the tokens aside
+func (h *systemHandler) jwks() []jose.JWK {
+	var keys []jose.JWK
+	if h.signer != nil {
+		keys = append(keys, h.signer.JWK())
+	}
+	for _, k := range h.tokenKeys {
+		if jwk := k.JWK(); jwk.Kty != "" {
+			keys = append(keys, jwk)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+const (
+	soapEnvNS   = "http://schemas.xmlsoap.org/soap/envelope/"
+	soapNS      = "urn:usersapi"
+	soapContent = "text/xml; charset=utf-8"
+)
+
+// soapHandler is a SOAP 1.1 facade over the user routes, for the
+// consumers that can't speak JSON
+type soapHandler struct {
+	router *router
+}
+
+// routes is the route table of the SOAP facade. It is public, every
+// operation being authorized as the route it maps to.
+func (h *soapHandler) routes() []route {
+	return []route{
+		{http.MethodGet, "/soap", "Get the WSDL of the SOAP facade", scopePublic, rateRead, policyStatic, h.WSDL},
+		{http.MethodPost, "/soap", "Call a SOAP operation", scopePublic, rateWrite, policyDynamic, h.SOAP},
+	}
+}
+
+// soapUser is a user in the SOAP messages
+type soapUser struct {
+	ID      string   `xml:"id"`
+	Name    string   `xml:"name"`
+	Active  bool     `xml:"active"`
+	Tags    []string `xml:"tags>tag,omitempty"`
+	Version uint64   `xml:"version"`
+}
+
+func toSOAPUser(u store.User) soapUser {
+	return soapUser{u.ID, u.Name, u.Active, u.Tags, u.Version}
+}
+
+type getUserRequest struct {
+	ID string `xml:"id"`
+}
+
+type listUsersRequest struct {
+	Status string `xml:"status"`
+	Tag    string `xml:"tag"`
+}
+
+type createUserRequest struct {
+	User struct {
+		ID     string   `xml:"id"`
+		Name   string   `xml:"name"`
+		Active *bool    `xml:"active"`
+		Tags   []string `xml:"tags>tag"`
+	} `xml:"user"`
+}
+
+// soapEnvelope is a SOAP message, its body being the XML of Content
+type soapEnvelope struct {
+	XMLName xml.Name `xml:"soap:Envelope"`
+	NS      string   `xml:"xmlns:soap,attr"`
+	Body    struct {
+		Content any `xml:",any"`
+	} `xml:"soap:Body"`
+}
+
+type soapFault struct {
+	XMLName xml.Name `xml:"soap:Fault"`
+	Code    string   `xml:"faultcode"`
+	String  string   `xml:"faultstring"`
+}
+
+// SOAP calls the operation in the body of the envelope: GetUser,
+// ListUsers or CreateUser
+func (h *soapHandler) SOAP(w http.ResponseWriter, r *http.Request) {
+	var env struct {
+		Body struct {
+			Inner []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&env); err != nil {
+		writeSOAPFault(w, "soap:Client", "malformed envelope")
+		return
+	}
+	var op struct{ XMLName xml.Name }
+	if err := xml.Unmarshal(env.Body.Inner, &op); err != nil {
+		writeSOAPFault(w, "soap:Client", "no operation in the body")
+		return
+	}
+
+	var call rpcCall
+	switch op.XMLName.Local {
+	case "GetUser":
+		var req getUserRequest
+		if xml.Unmarshal(env.Body.Inner, &req) != nil || req.ID == "" {
+			writeSOAPFault(w, "soap:Client", "id is required")
+			return
+		}
+		call = rpcCall{method: http.MethodGet, path: "/users/" + url.PathEscape(req.ID)}
+	case "ListUsers":
+		var req listUsersRequest
+		if xml.Unmarshal(env.Body.Inner, &req) != nil {
+			writeSOAPFault(w, "soap:Client", "invalid request")
+			return
+		}
+		q := url.Values{}
+		if req.Status != "" {
+			q.Set("status", req.Status)
+		}
+		if req.Tag != "" {
+			q.Set("tag", req.Tag)
+		}
+		call = rpcCall{method: http.MethodGet, path: "/users", query: q}
+	case "CreateUser":
+		var req createUserRequest
+		if xml.Unmarshal(env.Body.Inner, &req) != nil {
+			writeSOAPFault(w, "soap:Client", "invalid user")
+			return
+		}
+		body, _ := json.Marshal(req.User)
+		call = rpcCall{method: http.MethodPost, path: "/users", body: body}
+	default:
+		writeSOAPFault(w, "soap:Client", fmt.Sprintf("unknown operation %q", op.XMLName.Local))
+		return
+	}
+
+	rec, err := h.router.dispatch(r, call)
+	if err != nil {
+		writeSOAPFault(w, "soap:Server", "internal error")
+		return
+	}
+	if rec.status < 200 || rec.status > 299 {
+		var body ErrorResponse
+		json.Unmarshal(rec.body.Bytes(), &body)
+		code := "soap:Client"
+		if rec.status >= http.StatusInternalServerError {
+			code = "soap:Server"
+		}
+		writeSOAPFault(w, code, body.Message)
+		return
+	}
+
+	var resp any
+	switch op.XMLName.Local {
+	case "GetUser", "CreateUser":
+		var u store.User
+		if json.Unmarshal(rec.body.Bytes(), &u) != nil {
+			writeSOAPFault(w, "soap:Server", "internal error")
+			return
+		}
+		resp = struct {
+			XMLName xml.Name
+			User    soapUser `xml:"user"`
+		}{xml.Name{Space: soapNS, Local: op.XMLName.Local + "Response"}, toSOAPUser(u)}
+	case "ListUsers":
+		var list struct {
+			Users []store.User `json:"users"`
+		}
+		if json.Unmarshal(rec.body.Bytes(), &list) != nil {
+			writeSOAPFault(w, "soap:Server", "internal error")
+			return
+		}
+		users := make([]soapUser, 0, len(list.Users))
+		for _, u := range list.Users {
+			users = append(users, toSOAPUser(u))
+		}
+		resp = struct {
+			XMLName xml.Name   `xml:"urn:usersapi ListUsersResponse"`
+			Users   []soapUser `xml:"users>user"`
+		}{Users: users}
+	}
+	writeSOAP(w, http.StatusOK, resp)
+}
+
+func writeSOAP(w http.ResponseWriter, status int, content any) {
+	env := soapEnvelope{NS: soapEnvNS}
+	env.Body.Content = content
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(env); err != nil {
+		status = http.StatusInternalServerError
+		buf.Reset()
+	}
+	w.Header().Set("content-type", soapContent)
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// writeSOAPFault answers a fault, with a 500 status as required by SOAP
+// 1.1
+func writeSOAPFault(w http.ResponseWriter, code, reason string) {
+	writeSOAP(w, http.StatusInternalServerError, soapFault{Code: code, String: reason})
+}
+
+// WSDL describes the SOAP facade, its address being the one the WSDL
+// was fetched from
+func (h *soapHandler) WSDL(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	var addr bytes.Buffer
+	xml.EscapeText(&addr, []byte(scheme+"://"+r.Host+"/soap"))
+	w.Header().Set("content-type", soapContent)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, wsdl, addr.String())
+}
+
+const wsdl = xml.Header + `<definitions name="Users" targetNamespace="urn:usersapi"
+	xmlns="http://schemas.xmlsoap.org/wsdl/"
+	xmlns:soap="http://schemas.xmlsoap.org/wsdl/soap/"
+	xmlns:tns="urn:usersapi"
+	xmlns:xsd="http://www.w3.org/2001/XMLSchema">
+	<types>
+		<xsd:schema targetNamespace="urn:usersapi" elementFormDefault="unqualified">
+			<xsd:complexType name="User">
+				<xsd:sequence>
+					<xsd:element name="id" type="xsd:string" minOccurs="0"/>
+					<xsd:element name="name" type="xsd:string"/>
+					<xsd:element name="active" type="xsd:boolean" minOccurs="0"/>
+					<xsd:element name="tags" minOccurs="0">
+						<xsd:complexType>
+							<xsd:sequence>
+								<xsd:element name="tag" type="xsd:string" minOccurs="0" maxOccurs="unbounded"/>
+							</xsd:sequence>
+						</xsd:complexType>
+					</xsd:element>
+					<xsd:element name="version" type="xsd:unsignedLong" minOccurs="0"/>
+				</xsd:sequence>
+			</xsd:complexType>
+			<xsd:element name="GetUser">
+				<xsd:complexType><xsd:sequence><xsd:element name="id" type="xsd:string"/></xsd:sequence></xsd:complexType>
+			</xsd:element>
+			<xsd:element name="GetUserResponse">
+				<xsd:complexType><xsd:sequence><xsd:element name="user" type="tns:User"/></xsd:sequence></xsd:complexType>
+			</xsd:element>
+			<xsd:element name="ListUsers">
+				<xsd:complexType>
+					<xsd:sequence>
+						<xsd:element name="status" type="xsd:string" minOccurs="0"/>
+						<xsd:element name="tag" type="xsd:string" minOccurs="0"/>
+					</xsd:sequence>
+				</xsd:complexType>
+			</xsd:element>
+			<xsd:element name="ListUsersResponse">
+				<xsd:complexType>
+					<xsd:sequence>
+						<xsd:element name="users">
+							<xsd:complexType>
+								<xsd:sequence><xsd:element name="user" type="tns:User" minOccurs="0" maxOccurs="unbounded"/></xsd:sequence>
+							</xsd:complexType>
+						</xsd:element>
+					</xsd:sequence>
+				</xsd:complexType>
+			</xsd:element>
+			<xsd:element name="CreateUser">
+				<xsd:complexType><xsd:sequence><xsd:element name="user" type="tns:User"/></xsd:sequence></xsd:complexType>
+			</xsd:element>
+			<xsd:element name="CreateUserResponse">
+				<xsd:complexType><xsd:sequence><xsd:element name="user" type="tns:User"/></xsd:sequence></xsd:complexType>
+			</xsd:element>
+		</xsd:schema>
+	</types>
+	<message name="GetUserInput"><part name="parameters" element="tns:GetUser"/></message>
+	<message name="GetUserOutput"><part name="parameters" element="tns:GetUserResponse"/></message>
+	<message name="ListUsersInput"><part name="parameters" element="tns:ListUsers"/></message>
+	<message name="ListUsersOutput"><part name="parameters" element="tns:ListUsersResponse"/></message>
+	<message name="CreateUserInput"><part name="parameters" element="tns:CreateUser"/></message>
+	<message name="CreateUserOutput"><part name="parameters" element="tns:CreateUserResponse"/></message>
+	<portType name="UsersPortType">
+		<operation name="GetUser"><input message="tns:GetUserInput"/><output message="tns:GetUserOutput"/></operation>
+		<operation name="ListUsers"><input message="tns:ListUsersInput"/><output message="tns:ListUsersOutput"/></operation>
+		<operation name="CreateUser"><input message="tns:CreateUserInput"/><output message="tns:CreateUserOutput"/></operation>
+	</portType>
+	<binding name="UsersBinding" type="tns:UsersPortType">
+		<soap:binding style="document" transport="http://schemas.xmlsoap.org/soap/http"/>
+		<operation name="GetUser"><soap:operation soapAction="urn:usersapi#GetUser"/><input><soap:body use="literal"/></input><output><soap:body use="literal"/></output></operation>
+		<operation name="ListUsers"><soap:operation soapAction="urn:usersapi#ListUsers"/><input><soap:body use="literal"/></input><output><soap:body use="literal"/></output></operation>
+		<operation name="CreateUser"><soap:operation soapAction="urn:usersapi#CreateUser"/><input><soap:body use="literal"/></input><output><soap:body use="literal"/></output></operation>
+	</binding>
+	<service name="Users">
+		<port name="UsersPort" binding="tns:UsersBinding"><soap:address location="%s"/></port>
+	</service>
+</definitions>
+`
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// soapCall posts the operation op in an envelope
+func soapCall(h http.Handler, op string) *http.Response {
+	body := `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>` + op + `</soap:Body></soap:Envelope>`
+	return do(h, http.MethodPost, "/soap", body, "Content-Type", soapContent).Result()
+}
+
+// soapResponse decodes the body of a SOAP response into v
+func soapResponse(t *testing.T, resp *http.Response, v any) {
+	t.Helper()
+	var env struct {
+		Body struct {
+			Inner []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatal(err)
+	}
+	if err := xml.Unmarshal(env.Body.Inner, v); err != nil {
+		t.Fatalf("%s: %v", env.Body.Inner, err)
+	}
+}
+
+func TestSOAP(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SOAP = true
+	h, _ := newTestServer(t, cfg)
+
+	resp := soapCall(h, `<CreateUser xmlns="urn:usersapi"><user><name>Ada</name><tags><tag>vip</tag></tags></user></CreateUser>`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create: %d", resp.StatusCode)
+	}
+	resp = soapCall(h, `<GetUser xmlns="urn:usersapi"><id>u1</id></GetUser>`)
+	var got struct {
+		User soapUser `xml:"user"`
+	}
+	soapResponse(t, resp, &got)
+	if got.User.Name != "Ada" || !got.User.Active || len(got.User.Tags) != 1 || got.User.Version != 1 {
+		t.Errorf("got %+v", got.User)
+	}
+
+	resp = soapCall(h, `<ListUsers xmlns="urn:usersapi"><tag>vip</tag></ListUsers>`)
+	var list struct {
+		Users []soapUser `xml:"users>user"`
+	}
+	soapResponse(t, resp, &list)
+	if len(list.Users) != 1 || list.Users[0].ID != "u1" {
+		t.Errorf("listed %+v", list.Users)
+	}
+
+	for op, want := range map[string]string{
+		`<GetUser xmlns="urn:usersapi"><id>u42</id></GetUser>`:      "soap:Client",
+		`<GetUser xmlns="urn:usersapi"/>`:                           "soap:Client",
+		`<DeleteUser xmlns="urn:usersapi"><id>u1</id></DeleteUser>`: "soap:Client",
+	} {
+		resp := soapCall(h, op)
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("%s answered %d, want the 500 of a fault", op, resp.StatusCode)
+		}
+		var fault struct {
+			Code string `xml:"faultcode"`
+		}
+		soapResponse(t, resp, &fault)
+		if fault.Code != want {
+			t.Errorf("%s: fault %+v, want %s", op, fault, want)
+		}
+	}
+}
+
+func TestWSDL(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SOAP = true
+	h, _ := newTestServer(t, cfg)
+	w := do(h, http.MethodGet, "/soap?wsdl", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<soap:address location="http://example.com/soap"/>`) {
+		t.Errorf("wsdl: %d %s", w.Code, w.Body)
+	}
+
+	h, _ = newTestServer(t, DefaultConfig())
+	if w := do(h, http.MethodGet, "/soap?wsdl", ""); w.Code != http.StatusNotFound {
+		t.Errorf("disabled facade answered %d, want 404", w.Code)
+	}
+}
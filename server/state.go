@@ -0,0 +1,203 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+	"github.com/santisdev/go-restapi.git/webhooks"
+)
+
+// stateFormat is the version of the state archive layout. Format 1
+// archives, holding the users only, are still read, their users without
+// an active field being active: they predate the deactivation.
+const stateFormat = 2
+
+// the state archive (state.tar.gz) holds a manifest followed by one
+// JSON file per kind of server state
+const (
+	manifestFile = "manifest.json"
+	usersFile    = "users.json"
+	webhooksFile = "webhooks.json"
+	apiKeysFile  = "api_keys.json" // when authenticating by API key
+)
+
+// stateManifest describes a state archive. Files maps every file of the
+// archive to its SHA-256 checksum, and ConfigSHA256 is the checksum of
+// the configuration of the server exporting it.
+type stateManifest struct {
+	Format       int               `json:"format"`
+	CreatedAt    timestamp.Time    `json:"created_at"`
+	Rev          uint64            `json:"rev"`
+	ConfigSHA256 string            `json:"config_sha256,omitempty"`
+	Files        map[string]string `json:"files"`
+}
+
+// State is the content of a state archive. Webhooks and APIKeys are nil
+// when the archive holds none, as for the format 1 archives.
+type State struct {
+	Rev          uint64
+	ConfigSHA256 string
+	Users        []store.User
+	// Webhooks are the webhook subscriptions, with their secrets
+	Webhooks []webhooks.Subscription
+	// APIKeys are the API keys, without their secrets
+	APIKeys []StoredAPIKey
+}
+
+// configChecksum is the SHA-256 of the configuration cfg, telling apart
+// the archives exported under another one
+func configChecksum(cfg Config) string {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeState(w io.Writer, st State, now time.Time) error {
+	files := map[string][]byte{}
+	names := []string{usersFile, webhooksFile}
+	var err error
+	if files[usersFile], err = json.Marshal(st.Users); err != nil {
+		return err
+	}
+	if st.Webhooks == nil {
+		st.Webhooks = []webhooks.Subscription{}
+	}
+	if files[webhooksFile], err = json.Marshal(st.Webhooks); err != nil {
+		return err
+	}
+	if st.APIKeys != nil {
+		if files[apiKeysFile], err = json.Marshal(st.APIKeys); err != nil {
+			return err
+		}
+		names = append(names, apiKeysFile)
+	}
+
+	m := stateManifest{
+		Format:       stateFormat,
+		CreatedAt:    timestamp.New(now.UTC()),
+		Rev:          st.Rev,
+		ConfigSHA256: st.ConfigSHA256,
+		Files:        map[string]string{},
+	}
+	for name, b := range files {
+		sum := sha256.Sum256(b)
+		m.Files[name] = hex.EncodeToString(sum[:])
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, b []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: m.CreatedAt.Time}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	if err := add(manifestFile, manifest); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := add(name, files[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadState reads a state archive, checking it against its manifest
+func ReadState(r io.Reader) (State, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return State{}, err
+	}
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return State{}, err
+		}
+		if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+			return State{}, err
+		}
+	}
+
+	var m stateManifest
+	if err := json.Unmarshal(files[manifestFile], &m); err != nil {
+		return State{}, fmt.Errorf("reading manifest: %w", err)
+	}
+	if m.Format != 1 && m.Format != stateFormat {
+		return State{}, fmt.Errorf("unsupported state format %d", m.Format)
+	}
+	for name, want := range m.Files {
+		b, ok := files[name]
+		if !ok {
+			return State{}, fmt.Errorf("missing %s", name)
+		}
+		sum := sha256.Sum256(b)
+		if hex.EncodeToString(sum[:]) != want {
+			return State{}, fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+
+	st := State{Rev: m.Rev, ConfigSHA256: m.ConfigSHA256}
+	read := func(name string, v any) error {
+		b, ok := files[name]
+		if !ok {
+			return errors.New("missing " + name)
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			return fmt.Errorf("reading %s: %w", name, err)
+		}
+		return nil
+	}
+	if err := read(usersFile, &st.Users); err != nil {
+		return State{}, err
+	}
+	if m.Format == 1 {
+		var active []struct {
+			Active *bool `json:"active"`
+		}
+		if err := read(usersFile, &active); err != nil {
+			return State{}, err
+		}
+		for i, a := range active {
+			if a.Active == nil {
+				st.Users[i].Active = true
+			}
+		}
+		return st, nil
+	}
+	if err := read(webhooksFile, &st.Webhooks); err != nil {
+		return State{}, err
+	}
+	if _, ok := files[apiKeysFile]; ok {
+		if err := read(apiKeysFile, &st.APIKeys); err != nil {
+			return State{}, err
+		}
+	}
+	return st, nil
+}
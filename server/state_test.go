@@ -0,0 +1,205 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/webhooks"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	st := State{
+		Rev:          7,
+		ConfigSHA256: configChecksum(DefaultConfig()),
+		Users:        []store.User{{ID: "u1", Name: "Ada", Active: true, Version: 2}},
+		Webhooks:     []webhooks.Subscription{{ID: "w1", URL: "https://hooks.example.com/", Secret: "s3cret"}},
+		APIKeys:      []StoredAPIKey{{APIKey{Name: "ci", Roles: []string{RoleEditor}}, strings.Repeat("ab", 32)}},
+	}
+	var buf bytes.Buffer
+	if err := writeState(&buf, st, testStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Rev != 7 || got.ConfigSHA256 != st.ConfigSHA256 {
+		t.Errorf("rev %d, config %s", got.Rev, got.ConfigSHA256)
+	}
+	if len(got.Users) != 1 || got.Users[0].Name != "Ada" || got.Users[0].Version != 2 {
+		t.Errorf("users %+v", got.Users)
+	}
+	if len(got.Webhooks) != 1 || got.Webhooks[0].Secret != "s3cret" {
+		t.Errorf("webhooks %+v, want them with their secret", got.Webhooks)
+	}
+	if len(got.APIKeys) != 1 || got.APIKeys[0].KeySHA256 != st.APIKeys[0].KeySHA256 {
+		t.Errorf("API keys %+v", got.APIKeys)
+	}
+}
+
+// archive returns a state archive of files, with a manifest of format
+func archive(t *testing.T, format int, files map[string]string) []byte {
+	t.Helper()
+	m := stateManifest{Format: format, Files: map[string]string{}}
+	for name, content := range files {
+		sum := sha256.Sum256([]byte(content))
+		m.Files[name] = hex.EncodeToString(sum[:])
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	add := func(name, content string) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, content)
+	}
+	add(manifestFile, string(manifest))
+	for name, content := range files {
+		add(name, content)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestReadStateFormat1(t *testing.T) {
+	users := `[{"id":"1","name":"Ada"},{"id":"2","name":"Bob","active":false}]`
+	st, err := ReadState(bytes.NewReader(archive(t, 1, map[string]string{usersFile: users})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Users) != 2 || st.Webhooks != nil || st.APIKeys != nil {
+		t.Fatalf("state %+v, want the users only", st)
+	}
+	// archives from before the deactivation have no active field
+	if !st.Users[0].Active {
+		t.Error("user without an active field restored inactive")
+	}
+	if st.Users[1].Active {
+		t.Error("deactivated user restored active")
+	}
+}
+
+func TestReadStateInvalid(t *testing.T) {
+	valid := archive(t, stateFormat, map[string]string{usersFile: `[]`, webhooksFile: `[]`})
+	if _, err := ReadState(bytes.NewReader(valid)); err != nil {
+		t.Fatalf("valid archive: %v", err)
+	}
+
+	for name, b := range map[string][]byte{
+		"not gzip":         []byte("users"),
+		"unknown format":   archive(t, 3, map[string]string{usersFile: `[]`, webhooksFile: `[]`}),
+		"no webhooks":      archive(t, stateFormat, map[string]string{usersFile: `[]`}),
+		"no users":         archive(t, stateFormat, map[string]string{webhooksFile: `[]`}),
+		"users not a list": archive(t, stateFormat, map[string]string{usersFile: `{}`, webhooksFile: `[]`}),
+	} {
+		if _, err := ReadState(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: read", name)
+		}
+	}
+}
+
+func TestReadStateChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeState(&buf, State{Users: []store.User{{ID: "u1", Name: "Ada"}}}, testStart); err != nil {
+		t.Fatal(err)
+	}
+	// rewrite the archive with another users.json under the same manifest
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var out bytes.Buffer
+	gzw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gzw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(tr)
+		if hdr.Name == usersFile {
+			b = bytes.Replace(b, []byte("Ada"), []byte("Eve"), 1)
+		}
+		hdr.Size = int64(len(b))
+		tw.WriteHeader(hdr)
+		tw.Write(b)
+	}
+	tw.Close()
+	gzw.Close()
+	if _, err := ReadState(&out); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("tampered users.json: %v, want a checksum mismatch", err)
+	}
+}
+
+func TestStateExportImport(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig(), testKeys)
+	createUser(t, h, "Ada")
+
+	if w := do(h, http.MethodGet, "/v1/admin/state", "", apiKeyHeader, editorKey); w.Code != http.StatusForbidden {
+		t.Errorf("export by an editor: %d, want 403", w.Code)
+	}
+	w := do(h, http.MethodGet, "/v1/admin/state", "", apiKeyHeader, adminKey)
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", w.Code, w.Body)
+	}
+	st, err := ReadState(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Users) != 1 || st.Webhooks == nil || len(st.APIKeys) != 2 || st.ConfigSHA256 == "" {
+		t.Fatalf("exported %+v", st)
+	}
+	for _, k := range st.APIKeys {
+		if k.Key != "" || k.KeySHA256 == "" {
+			t.Errorf("key %s exported with its secret or no hash", k.Name)
+		}
+	}
+
+	// a fresh server restores the users, without its editor key
+	h2, _ := newTestServer(t, DefaultConfig(), testKeys)
+	st.APIKeys = st.APIKeys[:1]
+	if st.APIKeys[0].Name != "admin" {
+		t.Fatalf("first key %s, want admin", st.APIKeys[0].Name)
+	}
+	var buf bytes.Buffer
+	if err := writeState(&buf, st, testStart); err != nil {
+		t.Fatal(err)
+	}
+	w = do(h2, http.MethodPut, "/v1/admin/state", buf.String(), apiKeyHeader, adminKey, "Content-Type", "application/gzip")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("import: %d %s", w.Code, w.Body)
+	}
+	if warning := w.Header().Get("Warning"); warning != "" {
+		t.Errorf("warning %q importing under the same configuration", warning)
+	}
+	if w := do(h2, http.MethodGet, "/v1/users/u1", "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Errorf("imported user: %d", w.Code)
+	}
+	if w := do(h2, http.MethodGet, "/v1/users/u1", "", apiKeyHeader, editorKey); w.Code != http.StatusUnauthorized {
+		t.Errorf("editor key missing from the archive: %d, want 401", w.Code)
+	}
+
+	w = do(h, http.MethodPut, "/v1/admin/state", "not an archive", apiKeyHeader, adminKey)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("import of a bad archive: %d, want 400", w.Code)
+	}
+}
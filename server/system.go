@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/santisdev/go-restapi.git/jose"
+	"github.com/santisdev/go-restapi.git/metrics"
+)
+
+// systemHandler serves the endpoints about the server itself
+type systemHandler struct {
+	metrics *metrics.Registry
+	certs   *certWatch   // nil without TLS
+	signer  *jose.Signer // nil when the responses aren't signed
+	// tokenKeys verify the tokens, the public ones being published
+	tokenKeys []*jose.Signer
+	// ready checks the dependencies the server needs to serve
+	ready func(ctx context.Context) []Check
+}
+
+// routes is the route table of the system endpoints
+func (h *systemHandler) routes() []route {
+	table := []route{
+		{http.MethodGet, "/version", "Get the build information", scopePublic, rateRead, policyStatic, h.Version},
+		{http.MethodGet, "/healthz", "Tell whether the server is alive, with the expiry of its certificates", scopePublic, rateRead, policyNoStore, h.Healthz},
+		{http.MethodGet, "/readyz", "Tell whether the server is ready to serve, with the status of its dependencies", scopePublic, rateRead, policyNoStore, h.Readyz},
+		{http.MethodGet, "/metrics", "Get the metrics in Prometheus or OpenMetrics format", scopePublic, rateRead, policyNoStore, h.Metrics},
+		{http.MethodGet, "/events/schemas", "List the schemas of the event payloads", scopePublic, rateRead, policyStatic, h.EventSchemas},
+	}
+	if len(h.jwks()) > 0 {
+		table = append(table, route{http.MethodGet, "/.well-known/jwks.json", "Get the keys verifying the signatures of the responses and the tokens", scopePublic, rateRead, policyStatic, h.JWKS})
+	}
+	return table
+}
+
+func (h *systemHandler) Version(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := json.Marshal(GetBuildInfo())
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Metrics exposes the metrics, in the OpenMetrics format with exemplars
+// when the scraper accepts it
+func (h *systemHandler) Metrics(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("content-type", metrics.OpenMetricsFormat)
+	} else {
+		w.Header().Set("content-type", metrics.PrometheusFormat)
+	}
+	w.WriteHeader(http.StatusOK)
+	h.metrics.Write(w, openMetrics)
+}
+
+// Healthz tells the server is alive. Its status is warn while a
+// certificate is about to expire, or expired.
+func (h *systemHandler) Healthz(w http.ResponseWriter, r *http.Request) {
+	health := struct {
+		Status  string `json:"status"`
+		Details struct {
+			TLS []CertStatus `json:"tls,omitempty"`
+		} `json:"details"`
+	}{Status: checkOK}
+	if h.certs != nil {
+		health.Details.TLS = h.certs.report()
+		for i, st := range health.Details.TLS {
+			if st.Status != checkOK {
+				health.Status = checkWarn
+			}
+			health.Details.TLS[i].NotAfter = localTime(r, st.NotAfter)
+		}
+	}
+	jsonBytes, err := json.Marshal(health)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Readyz tells whether the server is ready to serve, answering 503 when
+// a check fails, as while the store is unreachable or the server shuts
+// down, for the load balancers to route the requests to other instances
+func (h *systemHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	ready := struct {
+		Status string  `json:"status"`
+		Checks []Check `json:"checks"`
+	}{Status: checkOK, Checks: h.ready(r.Context())}
+	status := http.StatusOK
+	for _, c := range ready.Checks {
+		if c.Status == checkFail {
+			ready.Status, status = checkFail, http.StatusServiceUnavailable
+		}
+	}
+	jsonBytes, err := json.Marshal(ready)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
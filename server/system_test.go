@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+// downStore is a store whose pings fail
+type downStore struct {
+	*store.Memory
+}
+
+func (downStore) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestReadyz(t *testing.T) {
+	readyz := func(s *Server) (int, map[string]Check) {
+		t.Helper()
+		w := do(s.Handler(), http.MethodGet, "/readyz", "")
+		var body struct {
+			Status string  `json:"status"`
+			Checks []Check `json:"checks"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("readyz body %s: %v", w.Body, err)
+		}
+		checks := map[string]Check{}
+		for _, c := range body.Checks {
+			checks[c.Name] = c
+		}
+		if (body.Status == checkOK) != (w.Code == http.StatusOK) {
+			t.Errorf("status %s answered with %d", body.Status, w.Code)
+		}
+		return w.Code, checks
+	}
+	newServer := func(st store.UserStore, cfg Config) *Server {
+		s, err := New(WithConfig(cfg), WithStore(st), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	code, checks := readyz(newServer(store.NewMemory(nil), DefaultConfig()))
+	if code != http.StatusOK || checks["store"].Status != checkOK || checks["serving"].Status != checkOK {
+		t.Errorf("ready server: %d %+v", code, checks)
+	}
+
+	code, checks = readyz(newServer(downStore{store.NewMemory(nil)}, DefaultConfig()))
+	if code != http.StatusServiceUnavailable || checks["store"].Status != checkFail || checks["store"].Detail != "connection refused" {
+		t.Errorf("unreachable store: %d %+v", code, checks)
+	}
+	if checks["serving"].Status != checkOK {
+		t.Errorf("unreachable store: serving %+v", checks["serving"])
+	}
+
+	cfg := DefaultConfig()
+	cfg.Watchdog = Watchdog{Interval: time.Second, Shed: true}
+	s := newServer(store.NewMemory(nil), cfg)
+	s.watchdog.overloaded.Store(true)
+	if w := do(s.Handler(), http.MethodGet, "/readyz", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("shedding server: %d %s, want 503", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+const (
+	maxTags     = 32   // per user
+	maxTagLen   = 64   // in bytes
+	maxBulkTags = 1000 // users per bulk request
+)
+
+var (
+	tagRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._:-]*$`)
+)
+
+// normalizeTags lowercases, deduplicates and sorts tags, checking they
+// are within the limits
+func normalizeTags(tags []string) ([]string, error) {
+	seen := map[string]bool{}
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if len(t) > maxTagLen || !tagRe.MatchString(t) {
+			return nil, fmt.Errorf("invalid tag %q: tags are up to %d letters, digits or ._:- characters", t, maxTagLen)
+		}
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("too many tags: at most %d are allowed", maxTags)
+	}
+	sort.Strings(out)
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// BulkTags adds and removes tags on several users at once. Each user is
+// updated on its own, the response giving the outcome per user.
+func (h *userHandler) BulkTags(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		IDs    []string `json:"ids"`
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
+		badRequest(w, r)
+		return
+	}
+	if len(req.IDs) > maxBulkTags {
+		invalid(w, r, fmt.Sprintf("at most %d users can be tagged at once", maxBulkTags))
+		return
+	}
+	add, err := normalizeTags(req.Add)
+	if err == nil {
+		_, err = normalizeTags(req.Remove)
+	}
+	if err != nil {
+		invalid(w, r, err.Error())
+		return
+	}
+	remove := map[string]bool{}
+	for _, t := range req.Remove {
+		remove[strings.ToLower(strings.TrimSpace(t))] = true
+	}
+
+	type result struct {
+		ID     string      `json:"id"`
+		Status int         `json:"status"`
+		User   *store.User `json:"user,omitempty"`
+	}
+	results := make([]result, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		if err := h.locks.check(id, r.Header.Get("X-Lock-Token")); err != nil {
+			results = append(results, result{ID: id, Status: http.StatusLocked})
+			continue
+		}
+		var tagErr error
+		u, _, err := h.modify(r, id, events.UserUpdated, func(u *store.User) bool {
+			tags := append([]string{}, add...)
+			for _, t := range u.Tags {
+				if !remove[t] {
+					tags = append(tags, t)
+				}
+			}
+			if tags, tagErr = normalizeTags(tags); tagErr != nil {
+				return false
+			}
+			changed := strings.Join(tags, ",") != strings.Join(u.Tags, ",")
+			u.Tags = tags
+			return changed
+		})
+		switch {
+		case tagErr != nil:
+			results = append(results, result{ID: id, Status: http.StatusUnprocessableEntity})
+		case err != nil:
+			results = append(results, result{ID: id, Status: storeErrorStatus(err)})
+		default:
+			results = append(results, result{ID: id, Status: http.StatusOK, User: &u})
+		}
+	}
+
+	jsonBytes, err := json.Marshal(struct {
+		Results []result `json:"results"`
+	}{results})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
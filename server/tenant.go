@@ -0,0 +1,311 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/santisdev/go-restapi.git/timestamp"
+	"github.com/santisdev/go-restapi.git/webhooks"
+	"github.com/santisdev/go-restapi.git/wire"
+)
+
+// keyNamePattern are the names of the keys added by the tenant admins
+var keyNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// tenantRoles are the roles the tenant admins may grant
+var tenantRoles = map[string]bool{RoleViewer: true, RoleEditor: true, RoleTenantAdmin: true}
+
+// tenantHandler serves the self-service of the tenant admins, each
+// limited to the API keys, webhooks and usage of their tenant. The
+// keys of a tenant are its members.
+type tenantHandler struct {
+	*deps
+	apiKeys  *APIKeys
+	webhooks *webhooks.Dispatcher
+	meter    *usageMeter
+}
+
+// routes is the route table of the tenant self-service
+func (h *tenantHandler) routes() []route {
+	return []route{
+		{http.MethodGet, "/tenant/api-keys", "List the API keys of the tenant", scopeTenant, rateRead, policyNoStore, h.Keys},
+		{http.MethodPost, "/tenant/api-keys", "Add an API key to the tenant", scopeTenant, rateWrite, policyNoStore, h.AddKey},
+		{http.MethodPut, "/tenant/api-keys/{name}/roles", "Set the roles of an API key of the tenant", scopeTenant, rateWrite, policyNoStore, h.SetRoles},
+		{http.MethodDelete, "/tenant/api-keys/{name}", "Revoke an API key of the tenant", scopeTenant, rateWrite, policyNoStore, h.RevokeKey},
+		{http.MethodGet, "/tenant/webhooks", "List the webhook subscriptions of the tenant", scopeTenant, rateRead, policyNoStore, h.Webhooks},
+		{http.MethodPost, "/tenant/webhooks", "Subscribe a webhook for the tenant", scopeTenant, rateWrite, policyNoStore, h.Subscribe},
+		{http.MethodDelete, "/tenant/webhooks/{id}", "Unsubscribe a webhook of the tenant", scopeTenant, rateWrite, policyNoStore, h.Unsubscribe},
+		{http.MethodGet, "/tenant/usage", "Report the monthly usage of the API keys of the tenant", scopeTenant, rateRead, policyNoStore, h.Usage},
+	}
+}
+
+// tenantOf returns the tenant of the client, answering 403 to the ones
+// of none, as the platform admins
+func tenantOf(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, _ := IdentityFrom(r.Context())
+	if id.Tenant == "" {
+		forbidden(w, r)
+		return "", false
+	}
+	return id.Tenant, true
+}
+
+// key returns the key of the tenant named by the path, answering 404
+// when the tenant has none
+func (h *tenantHandler) key(w http.ResponseWriter, r *http.Request, tenant string) (APIKey, bool) {
+	name := pathParam(r, "name")
+	for _, k := range h.apiKeys.Keys() {
+		if k.Name == name && k.Tenant == tenant {
+			return k, true
+		}
+	}
+	notFound(w, r)
+	return APIKey{}, false
+}
+
+// Keys lists the API keys of the tenant, without their secrets
+func (h *tenantHandler) Keys(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := tenantOf(w, r)
+	if !ok {
+		return
+	}
+	keys := []APIKey{}
+	for _, k := range h.apiKeys.Keys() {
+		if k.Tenant == tenant {
+			k.CreatedAt = localTime(r, k.CreatedAt)
+			keys = append(keys, k)
+		}
+	}
+	jsonBytes, err := json.Marshal(keys)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// AddKey adds a key to the tenant from its name and roles, viewer
+// unless given, answering it with its secret, which isn't shown again
+func (h *tenantHandler) AddKey(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := tenantOf(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Name  string   `json:"name"`
+		Roles []string `json:"roles"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if !keyNamePattern.MatchString(body.Name) {
+		invalid(w, r, "name: expected 1 to 64 letters, digits, dots, dashes or underscores")
+		return
+	}
+	if len(body.Roles) == 0 {
+		body.Roles = []string{RoleViewer}
+	}
+	if !grantable(w, r, body.Roles) {
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		internalServerError(w, r)
+		return
+	}
+	k := APIKey{
+		Name:      body.Name,
+		Key:       wire.Secret(base64.RawURLEncoding.EncodeToString(secret)),
+		Roles:     body.Roles,
+		Tenant:    tenant,
+		CreatedAt: timestamp.New(h.clock.Now().UTC()),
+	}
+	if err := h.apiKeys.Add(k); errors.Is(err, ErrDuplicateKey) {
+		conflict(w, r)
+		return
+	} else if errors.Is(err, errKeysNotSaved) {
+		h.logger.ErrorContext(r.Context(), "saving the API keys", "err", err)
+		internalServerError(w, r)
+		return
+	} else if err != nil {
+		invalid(w, r, err.Error())
+		return
+	}
+	k.CreatedAt = localTime(r, k.CreatedAt)
+	jsonBytes, err := json.Marshal(k)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+}
+
+// SetRoles replaces the roles of a key of the tenant, as in
+// {"roles": ["editor"]}
+func (h *tenantHandler) SetRoles(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := tenantOf(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Roles []string `json:"roles"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if len(body.Roles) == 0 {
+		invalid(w, r, "roles: expected at least one")
+		return
+	}
+	if !grantable(w, r, body.Roles) {
+		return
+	}
+	k, ok := h.key(w, r, tenant)
+	if !ok {
+		return
+	}
+	k, err := h.apiKeys.SetRoles(k.Name, body.Roles)
+	if errors.Is(err, ErrUnknownKey) {
+		notFound(w, r)
+		return
+	} else if err != nil {
+		h.logger.ErrorContext(r.Context(), "saving the API keys", "err", err)
+		internalServerError(w, r)
+		return
+	}
+	k.CreatedAt = localTime(r, k.CreatedAt)
+	jsonBytes, err := json.Marshal(k)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// RevokeKey revokes a key of the tenant, its client being refused at
+// once
+func (h *tenantHandler) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := tenantOf(w, r)
+	if !ok {
+		return
+	}
+	k, ok := h.key(w, r, tenant)
+	if !ok {
+		return
+	}
+	if err := h.apiKeys.Revoke(k.Name); errors.Is(err, ErrUnknownKey) {
+		notFound(w, r)
+		return
+	} else if err != nil {
+		h.logger.ErrorContext(r.Context(), "saving the API keys", "err", err)
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// grantable tells whether the tenant admins may grant roles, answering
+// 422 otherwise
+func grantable(w http.ResponseWriter, r *http.Request, roles []string) bool {
+	for _, role := range roles {
+		if !tenantRoles[role] {
+			invalid(w, r, "roles: expected viewer, editor or tenant-admin")
+			return false
+		}
+	}
+	return true
+}
+
+// Webhooks lists the webhook subscriptions of the tenant
+func (h *tenantHandler) Webhooks(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := tenantOf(w, r)
+	if !ok {
+		return
+	}
+	subs := []webhooks.Subscription{}
+	for _, s := range h.webhooks.Subscriptions() {
+		if s.Tenant == tenant {
+			s.CreatedAt = localTime(r, s.CreatedAt)
+			subs = append(subs, s)
+		}
+	}
+	jsonBytes, err := json.Marshal(subs)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Subscribe adds a webhook subscription of the tenant, as the admins do,
+// answering 201 with its location
+func (h *tenantHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := tenantOf(w, r)
+	if !ok {
+		return
+	}
+	var sub webhooks.Subscription
+	if !decodeJSON(w, r, &sub) {
+		return
+	}
+	sub.Tenant = tenant
+	sub, err := h.webhooks.Subscribe(sub)
+	if err != nil {
+		invalid(w, r, err.Error())
+		return
+	}
+	sub.Secret = ""
+	sub.CreatedAt = localTime(r, sub.CreatedAt)
+	jsonBytes, err := json.Marshal(sub)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.Header().Set("Location", "/tenant/webhooks/"+url.PathEscape(sub.ID))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+}
+
+// Unsubscribe removes a webhook subscription of the tenant, answering
+// 404 for the ones of the others
+func (h *tenantHandler) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := tenantOf(w, r)
+	if !ok {
+		return
+	}
+	id := pathParam(r, "id")
+	for _, s := range h.webhooks.Subscriptions() {
+		if s.ID == id && s.Tenant == tenant {
+			if err := h.webhooks.Unsubscribe(id); err == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	}
+	notFound(w, r)
+}
+
+// Usage reports the monthly usage of the keys of the tenant, as
+// /admin/usage does of every key
+func (h *tenantHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := tenantOf(w, r)
+	if !ok {
+		return
+	}
+	members := map[string]bool{}
+	for _, k := range h.apiKeys.Keys() {
+		if k.Tenant == tenant {
+			members[k.Name] = true
+		}
+	}
+	serveUsage(w, r, h.meter, func(key string) bool { return members[key] })
+}
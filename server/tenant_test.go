@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/webhooks"
+)
+
+const acmeKey, globexKey = "acme-key-0123456789", "globex-key-0123456789"
+
+// tenantKeys are the keys of the tenant admins of acme and globex,
+// along with an admin of none
+var tenantKeys = WithAPIKeys([]APIKey{
+	{Name: "admin", Key: adminKey, Roles: []string{RoleAdmin}},
+	{Name: "acme-admin", Key: acmeKey, Roles: []string{RoleTenantAdmin}, Tenant: "acme"},
+	{Name: "globex-admin", Key: globexKey, Roles: []string{RoleTenantAdmin}, Tenant: "globex"},
+})
+
+func TestTenantKeys(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig(), tenantKeys)
+
+	w := do(h, http.MethodPost, "/tenant/api-keys", `{"name":"acme-ci","roles":["editor"]}`, apiKeyHeader, acmeKey)
+	var k APIKey
+	if err := json.Unmarshal(w.Body.Bytes(), &k); err != nil || w.Code != http.StatusCreated || k.Key == "" || k.Tenant != "acme" {
+		t.Fatalf("adding a key: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/users", "", apiKeyHeader, string(k.Key)); w.Code != http.StatusOK {
+		t.Errorf("the new key: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodGet, "/tenant/api-keys", "", apiKeyHeader, globexKey)
+	var keys []APIKey
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil || len(keys) != 1 || keys[0].Name != "globex-admin" {
+		t.Errorf("the keys of globex: %d %s, want its admin alone", w.Code, w.Body)
+	}
+
+	// the keys of another tenant, or of none, are not found
+	for _, tc := range []struct{ method, path, body string }{
+		{http.MethodPut, "/tenant/api-keys/acme-ci/roles", `{"roles":["viewer"]}`},
+		{http.MethodDelete, "/tenant/api-keys/acme-ci", ""},
+		{http.MethodDelete, "/tenant/api-keys/admin", ""},
+	} {
+		if w := do(h, tc.method, tc.path, tc.body, apiKeyHeader, globexKey); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s by globex: %d %s, want 404", tc.method, tc.path, w.Code, w.Body)
+		}
+	}
+	if w := do(h, http.MethodPost, "/tenant/api-keys", `{"name":"root","roles":["admin"]}`, apiKeyHeader, acmeKey); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("granting admin: %d %s, want 422", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/tenant/api-keys", "", apiKeyHeader, adminKey); w.Code != http.StatusForbidden {
+		t.Errorf("the platform admin: %d %s, want 403", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodDelete, "/tenant/api-keys/acme-ci", "", apiKeyHeader, acmeKey); w.Code != http.StatusNoContent {
+		t.Fatalf("revoking: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/users", "", apiKeyHeader, string(k.Key)); w.Code != http.StatusUnauthorized {
+		t.Errorf("the revoked key: %d, want 401", w.Code)
+	}
+}
+
+func TestTenantWebhooks(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig(), tenantKeys)
+
+	w := do(h, http.MethodPost, "/tenant/webhooks", `{"url":"https://93.184.216.34/acme"}`, apiKeyHeader, acmeKey)
+	var sub webhooks.Subscription
+	if err := json.Unmarshal(w.Body.Bytes(), &sub); err != nil || w.Code != http.StatusCreated || sub.Tenant != "acme" ||
+		w.Header().Get("Location") != "/tenant/webhooks/"+sub.ID {
+		t.Fatalf("subscribing: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodGet, "/tenant/webhooks", "", apiKeyHeader, globexKey)
+	if w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Errorf("the webhooks of globex: %d %s, want none", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodDelete, "/tenant/webhooks/"+sub.ID, "", apiKeyHeader, globexKey); w.Code != http.StatusNotFound {
+		t.Errorf("unsubscribing acme by globex: %d %s, want 404", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodDelete, "/tenant/webhooks/"+sub.ID, "", apiKeyHeader, acmeKey); w.Code != http.StatusNoContent {
+		t.Errorf("unsubscribing: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/acme"
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/outbound"
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+// DefaultExpiryWarning is how long before their expiry the certificates
+// are reported, unless set
+const DefaultExpiryWarning = 30 * 24 * time.Hour
+
+// TLS configures HTTPS serving
+type TLS struct {
+	// CertFile and KeyFile are the PEM files of the serving certificate
+	// and its key, HTTPS being served when they are set
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the PEM file of the CAs the client certificates
+	// are verified with, if any
+	ClientCAFile string
+	// ExpiryWarning is how long before their expiry the certificates
+	// are reported, DefaultExpiryWarning unless set
+	ExpiryWarning time.Duration
+	// ACME obtains and renews the serving certificate from an ACME CA,
+	// as Let's Encrypt, when its domains are set, instead of the files
+	ACME ACME
+	// RedirectAddr serves plain HTTP on this address, as :80,
+	// redirecting the requests to HTTPS and answering the challenges of
+	// the ACME CA. It is :80 with ACME unless set.
+	RedirectAddr string
+}
+
+// ACME configures the certificates obtained from an ACME CA
+type ACME struct {
+	// Domains are the names of the certificate, which must resolve to
+	// the server for the CA to validate them on port 80
+	Domains []string
+	// Email is the contact of the account, if set
+	Email string
+	// CacheDir keeps the account key and the certificate across restarts
+	CacheDir string
+	// DirectoryURL is the directory of the CA, acme.LetsEncrypt unless
+	// set, as its staging directory while testing
+	DirectoryURL string
+}
+
+// enabled tells whether HTTPS is served
+func (t TLS) enabled() bool {
+	return t.CertFile != "" || t.KeyFile != "" || len(t.ACME.Domains) > 0
+}
+
+func (t TLS) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") || (t.ClientCAFile != "" && t.CertFile == "") {
+		return errors.New("invalid TLS: a certificate needs its key, and client CAs a certificate")
+	}
+	if a := t.ACME; len(a.Domains) > 0 && (t.CertFile != "" || a.CacheDir == "") {
+		return errors.New("invalid TLS: ACME needs a cache directory, and no certificate file")
+	}
+	if t.RedirectAddr != "" && !t.enabled() {
+		return errors.New("invalid TLS: redirecting to HTTPS needs a certificate or ACME")
+	}
+	return nil
+}
+
+// newACME returns the manager of the certificate of the ACME CA, the
+// cached one loaded. The CA is called through transport, as the other
+// services.
+func (t TLS) newACME(transport *outbound.Transport, logger *slog.Logger) (*acme.Manager, error) {
+	m := &acme.Manager{
+		Domains:      t.ACME.Domains,
+		Email:        t.ACME.Email,
+		CacheDir:     t.ACME.CacheDir,
+		DirectoryURL: t.ACME.DirectoryURL,
+		Client:       transport.Client(30 * time.Second),
+		Logger:       logger,
+	}
+	return m, m.Load()
+}
+
+// redirectHTTPS redirects the requests to the same URL over HTTPS, on
+// the port of addr, the address HTTPS is served on
+func redirectHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// certInfo is a certificate whose expiry is watched
+type certInfo struct {
+	name     string // serving or client_ca
+	subject  string
+	notAfter time.Time
+}
+
+// load returns the config of the TLS listener and the certificates to
+// watch
+func (t TLS) load() (*tls.Config, []certInfo, error) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, nil, errors.New("tls: both a certificate and a key are needed")
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tls: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("tls: %s: %w", t.CertFile, err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	certs := []certInfo{{"serving", leaf.Subject.String(), leaf.NotAfter}}
+	if t.ClientCAFile == "" {
+		return cfg, certs, nil
+	}
+
+	b, err := os.ReadFile(t.ClientCAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tls: %w", err)
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tls: %s: %w", t.ClientCAFile, err)
+		}
+		cfg.ClientCAs.AddCert(ca)
+		certs = append(certs, certInfo{"client_ca", ca.Subject.String(), ca.NotAfter})
+	}
+	if len(certs) == 1 {
+		return nil, nil, fmt.Errorf("tls: %s: no certificate found", t.ClientCAFile)
+	}
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, certs, nil
+}
+
+// CertStatus reports the expiry of a certificate
+type CertStatus struct {
+	Name     string         `json:"name"` // serving or client_ca
+	Subject  string         `json:"subject"`
+	NotAfter timestamp.Time `json:"not_after"`
+	DaysLeft float64        `json:"days_left"`
+	Status   string         `json:"status"` // ok, warn or expired
+}
+
+// certWatch tells how far the certificates are from their expiry
+type certWatch struct {
+	certs   []certInfo
+	acme    *acme.Manager // the serving certificate, when set
+	clock   clock.Clock
+	warning time.Duration
+}
+
+func (cw *certWatch) report() []CertStatus {
+	now := cw.clock.Now()
+	certs := cw.certs
+	if cw.acme != nil {
+		if leaf := cw.acme.Leaf(); leaf != nil {
+			certs = append([]certInfo{{"serving", leaf.Subject.String(), leaf.NotAfter}}, certs...)
+		}
+	}
+	report := make([]CertStatus, 0, len(certs))
+	for _, c := range certs {
+		left := c.notAfter.Sub(now)
+		st := CertStatus{Name: c.name, Subject: c.subject, NotAfter: timestamp.New(c.notAfter), DaysLeft: left.Hours() / 24, Status: checkOK}
+		switch {
+		case left <= 0:
+			st.Status = "expired"
+		case left <= cw.warning:
+			st.Status = checkWarn
+		}
+		report = append(report, st)
+	}
+	return report
+}
+
+// daysLeft returns the days until the first expiry of the certificates
+// with the given name
+func (cw *certWatch) daysLeft(name string) float64 {
+	days := 0.0
+	first := true
+	for _, st := range cw.report() {
+		if st.Name == name && (first || st.DaysLeft < days) {
+			days, first = st.DaysLeft, false
+		}
+	}
+	return days
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/metrics"
+	"github.com/santisdev/go-restapi.git/outbound"
+)
+
+func TestACMEThroughOutboundTransport(t *testing.T) {
+	transport, err := outbound.New(outbound.Config{AllowedHosts: []string{"hooks.example.com"}}, clock.NewFake(testStart), metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg := TLS{ACME: ACME{Domains: []string{"api.example.com"}, CacheDir: t.TempDir(), DirectoryURL: "https://ca.example.com/directory"}}
+	m, err := tlsCfg.newACME(transport, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Obtain(context.Background()); !errors.Is(err, outbound.ErrHostNotAllowed) {
+		t.Errorf("call of a CA out of the allowed hosts: %v, want ErrHostNotAllowed", err)
+	}
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/idgen"
+	"github.com/santisdev/go-restapi.git/jose"
+	"github.com/santisdev/go-restapi.git/password"
+	"github.com/santisdev/go-restapi.git/validate"
+	"github.com/santisdev/go-restapi.git/wire"
+)
+
+// DefaultTokenTTL is the lifetime of the tokens unless set
+const DefaultTokenTTL = 15 * time.Minute
+
+// Tokens issues JWTs to the clients logging in on /auth/login, and
+// authenticates the requests bearing them
+type Tokens struct {
+	// Keys sign and verify the tokens. A key is rotated by adding the
+	// new one, making it active, then removing the old one once the
+	// tokens it signed expired.
+	Keys []TokenKey `json:"keys"`
+	// Active is the id of the key signing the new tokens, the first one
+	// unless set. The others only verify the tokens they signed.
+	Active string `json:"active,omitempty"`
+	// TTL is the lifetime of the tokens, DefaultTokenTTL unless set
+	TTL time.Duration `json:"-"`
+	// Issuer is the iss claim of the tokens, checked on the tokens
+	// received, "usersapi" unless set
+	Issuer string `json:"issuer,omitempty"`
+}
+
+// TokenKey is a key of the tokens, a secret signing them as HS256 or a
+// private key as RS256
+type TokenKey struct {
+	// ID names the key in the kid header of the tokens
+	ID string `json:"id"`
+	// Secret is the HS256 secret, at least 32 bytes long
+	Secret wire.Secret `json:"secret,omitempty"`
+	// KeyFile is the PEM file of the RSA private key, its public key
+	// being served on /.well-known/jwks.json
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+// signer returns the signer of k
+func (k TokenKey) signer() (*jose.Signer, error) {
+	switch {
+	case k.ID == "":
+		return nil, errors.New("token key with no id")
+	case (k.Secret == "") == (k.KeyFile == ""):
+		return nil, fmt.Errorf("token key %q: exactly one of the secret and the key file must be set", k.ID)
+	case k.Secret != "":
+		return jose.NewHMACSigner([]byte(k.Secret), k.ID)
+	}
+	s, err := jose.LoadSigner(k.KeyFile, k.ID)
+	if err != nil {
+		return nil, fmt.Errorf("token key %q: %w", k.ID, err)
+	}
+	if s.Alg() != "RS256" {
+		return nil, fmt.Errorf("token key %q: %s key, expected RSA", k.ID, s.Alg())
+	}
+	return s, nil
+}
+
+// CredentialStore checks the credentials of the clients logging in
+type CredentialStore interface {
+	// Verify returns the identity of the client of username once its
+	// password checked, failing with ErrUnauthenticated when they
+	// don't match
+	Verify(ctx context.Context, username, password string) (Identity, error)
+}
+
+// Credential is the username and password of a client, as kept in a
+// credentials file
+type Credential struct {
+	Username string `json:"username"`
+	// PasswordHash is the hash of the password by `usersapi
+	// hash-password`, as pbkdf2-sha256$600000$<salt>$<hash>
+	PasswordHash string `json:"password_hash"`
+	// Scopes are granted to the tokens of the client
+	Scopes []string `json:"scopes,omitempty"`
+	// Roles are granted to the tokens of the client, as viewer, editor
+	// or admin
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Credentials is the CredentialStore of a list of credentials
+type Credentials struct {
+	byName map[string]Credential
+}
+
+// NewCredentials returns the store of creds, whose usernames must be
+// unique
+func NewCredentials(creds []Credential) (*Credentials, error) {
+	c := &Credentials{byName: map[string]Credential{}}
+	for _, cred := range creds {
+		if cred.Username == "" {
+			return nil, errors.New("credential with no username")
+		}
+		if _, ok := c.byName[cred.Username]; ok {
+			return nil, fmt.Errorf("credential %q: duplicate username", cred.Username)
+		}
+		if err := password.Valid(cred.PasswordHash); err != nil {
+			return nil, fmt.Errorf("credential %q: %w", cred.Username, err)
+		}
+		if err := checkRoles(cred.Roles); err != nil {
+			return nil, fmt.Errorf("credential %q: %w", cred.Username, err)
+		}
+		c.byName[cred.Username] = cred
+	}
+	return c, nil
+}
+
+var (
+	// unknownUserHash is checked for the unknown usernames, so they
+	// take as long as the known ones
+	unknownUserHash     string
+	unknownUserHashOnce sync.Once
+)
+
+func (c *Credentials) Verify(ctx context.Context, username, pw string) (Identity, error) {
+	cred, ok := c.byName[username]
+	if !ok {
+		unknownUserHashOnce.Do(func() { unknownUserHash, _ = password.Hash("") })
+		password.Check(unknownUserHash, pw)
+		return Identity{}, ErrUnauthenticated
+	}
+	match, err := password.Check(cred.PasswordHash, pw)
+	if err != nil {
+		return Identity{}, err
+	}
+	if !match {
+		return Identity{}, ErrUnauthenticated
+	}
+	return Identity{Subject: cred.Username, Scopes: cred.Scopes, Roles: cred.Roles}, nil
+}
+
+// tokens issues and verifies the tokens of a Tokens configuration
+type tokens struct {
+	cfg    Tokens
+	keys   []*jose.Signer
+	active *jose.Signer
+	creds  CredentialStore
+	clock  clock.Clock
+	ids    idgen.Generator
+}
+
+func newTokens(cfg Tokens, creds CredentialStore, c clock.Clock, ids idgen.Generator) (*tokens, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, errors.New("tokens: no key")
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultTokenTTL
+	}
+	if cfg.Issuer == "" {
+		cfg.Issuer = "usersapi"
+	}
+	t := &tokens{cfg: cfg, creds: creds, clock: c, ids: ids}
+	for _, k := range cfg.Keys {
+		s, err := k.signer()
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range t.keys {
+			if other.KeyID() == k.ID {
+				return nil, fmt.Errorf("token key %q: duplicate id", k.ID)
+			}
+		}
+		t.keys = append(t.keys, s)
+		if k.ID == cfg.Active || (cfg.Active == "" && t.active == nil) {
+			t.active = s
+		}
+	}
+	if t.active == nil {
+		return nil, fmt.Errorf("tokens: unknown active key %q", cfg.Active)
+	}
+	return t, nil
+}
+
+// Authenticate identifies the client by the token of its
+// Authorization header, as Bearer <token>, its claims going with its
+// identity
+func (t *tokens) Authenticate(r *http.Request) (Identity, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return Identity{}, ErrUnauthenticated
+	}
+	claims, err := jose.VerifyJWT(strings.TrimSpace(token), t.keys, t.clock.Now())
+	if err != nil {
+		return Identity{}, ErrUnauthenticated
+	}
+	sub, _ := claims["sub"].(string)
+	if iss, _ := claims["iss"].(string); iss != t.cfg.Issuer || sub == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+	scope, _ := claims["scope"].(string)
+	var roles []string
+	if rs, ok := claims["roles"].([]any); ok {
+		for _, r := range rs {
+			if r, ok := r.(string); ok {
+				roles = append(roles, r)
+			}
+		}
+	}
+	return Identity{Subject: sub, Scopes: strings.Fields(scope), Roles: roles, Claims: claims}, nil
+}
+
+// issue returns a token of id signed by the active key
+func (t *tokens) issue(id Identity) (string, error) {
+	now := t.clock.Now()
+	claims := map[string]any{
+		"iss":   t.cfg.Issuer,
+		"sub":   id.Subject,
+		"scope": strings.Join(id.Scopes, " "),
+		"iat":   now.Unix(),
+		"nbf":   now.Unix(),
+		"exp":   now.Add(t.cfg.TTL).Unix(),
+		"jti":   t.ids.NewID(),
+	}
+	if len(id.Roles) > 0 {
+		claims["roles"] = id.Roles
+	}
+	return t.active.SignJWT(claims)
+}
+
+// tokenHandler serves the login of the clients
+type tokenHandler struct {
+	tokens *tokens
+}
+
+// routes is the route table of the login
+func (h *tokenHandler) routes() []route {
+	return []route{
+		{http.MethodPost, "/auth/login", "Log in with a username and password, for a token", scopePublic, rateWrite, policyNoStore, h.Login},
+	}
+}
+
+// Login checks the username and password of the body against the
+// credential store, answering a token of the client, or 401
+func (h *tokenHandler) Login(w http.ResponseWriter, r *http.Request) {
+	var login struct {
+		Username string `json:"username" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+		badRequest(w, r)
+		return
+	}
+	if err := validate.Struct(login); err != nil {
+		var errs validate.Errors
+		errors.As(err, &errs)
+		invalidFields(w, r, "invalid login", errs)
+		return
+	}
+	id, err := h.tokens.creds.Verify(r.Context(), login.Username, login.Password)
+	if errors.Is(err, ErrUnauthenticated) {
+		unauthorized(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	token, err := h.tokens.issue(id)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	jsonBytes, err := json.Marshal(struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"` // in seconds
+		Scope       string `json:"scope"`
+	}{token, "Bearer", int(h.tokens.cfg.TTL.Seconds()), strings.Join(id.Scopes, " ")})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
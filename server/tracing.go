@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/tracing"
+)
+
+// tracedStore traces the calls to a store as child spans of the
+// request, named store.<operation>
+type tracedStore struct {
+	store.UserStore
+	tracer *tracing.Tracer
+}
+
+// start starts the span of op, returning the function ending it
+func (s tracedStore) start(ctx context.Context, op string) (context.Context, func(error)) {
+	ctx, span := s.tracer.Start(ctx, "store."+op)
+	span.SetAttribute("db.operation", op)
+	return ctx, func(err error) {
+		if err != nil && !errors.Is(err, store.ErrNotFound) && !errors.Is(err, store.ErrConflict) {
+			span.SetAttribute("error.message", err.Error())
+			span.SetError()
+		}
+		span.Finish()
+	}
+}
+
+func (s tracedStore) List(ctx context.Context, q store.Query, rc store.ReadConsistency) ([]store.User, uint64, error) {
+	ctx, end := s.start(ctx, "List")
+	users, rev, err := s.UserStore.List(ctx, q, rc)
+	end(err)
+	return users, rev, err
+}
+
+func (s tracedStore) Get(ctx context.Context, id string, rc store.ReadConsistency) (store.User, uint64, error) {
+	ctx, end := s.start(ctx, "Get")
+	u, rev, err := s.UserStore.Get(ctx, id, rc)
+	end(err)
+	return u, rev, err
+}
+
+func (s tracedStore) GetByExternalID(ctx context.Context, system, id string, rc store.ReadConsistency) (store.User, uint64, error) {
+	ctx, end := s.start(ctx, "GetByExternalID")
+	u, rev, err := s.UserStore.GetByExternalID(ctx, system, id, rc)
+	end(err)
+	return u, rev, err
+}
+
+func (s tracedStore) Create(ctx context.Context, u store.User) (store.User, uint64, error) {
+	ctx, end := s.start(ctx, "Create")
+	u, rev, err := s.UserStore.Create(ctx, u)
+	end(err)
+	return u, rev, err
+}
+
+func (s tracedStore) CompareAndSwap(ctx context.Context, id string, expected uint64, u store.User) (store.User, uint64, error) {
+	ctx, end := s.start(ctx, "CompareAndSwap")
+	u, rev, err := s.UserStore.CompareAndSwap(ctx, id, expected, u)
+	end(err)
+	return u, rev, err
+}
+
+func (s tracedStore) Delete(ctx context.Context, id string) (store.User, uint64, error) {
+	ctx, end := s.start(ctx, "Delete")
+	u, rev, err := s.UserStore.Delete(ctx, id)
+	end(err)
+	return u, rev, err
+}
+
+func (s tracedStore) CompareAndDelete(ctx context.Context, id string, expected uint64) (store.User, uint64, error) {
+	ctx, end := s.start(ctx, "CompareAndDelete")
+	u, rev, err := s.UserStore.CompareAndDelete(ctx, id, expected)
+	end(err)
+	return u, rev, err
+}
+
+func (s tracedStore) Replace(ctx context.Context, users []store.User) (uint64, error) {
+	ctx, end := s.start(ctx, "Replace")
+	rev, err := s.UserStore.Replace(ctx, users)
+	end(err)
+	return rev, err
+}
+
+func (s tracedStore) ChangesSince(ctx context.Context, rev uint64) ([]store.Change, uint64, <-chan struct{}, error) {
+	ctx, end := s.start(ctx, "ChangesSince")
+	changes, cur, next, err := s.UserStore.ChangesSince(ctx, rev)
+	end(err)
+	return changes, cur, next, err
+}
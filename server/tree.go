@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// node is a segment of the path templates of the routes. A path is
+// matched against the static children of the nodes first, then against
+// their parameter, then against their rest parameter, so /users/changes
+// wins over /users/{id}.
+type node struct {
+	static map[string]*node
+	param  *node // {name}, matching any non-empty segment
+	rest   *node // {name...}, matching the rest of the path
+	name   string
+	routes []route // one by method
+}
+
+// add adds rt to the tree under prefix, panicking when its method is already served on
+// its path or when its parameters are named differently than the ones of
+// the other routes
+func (n *node) add(prefix string, rt route) {
+	segments := splitPath(prefix + rt.path)
+	for i, seg := range segments {
+		name, isParam := strings.CutPrefix(seg, "{")
+		if !isParam {
+			if n.static == nil {
+				n.static = map[string]*node{}
+			}
+			if n.static[seg] == nil {
+				n.static[seg] = &node{}
+			}
+			n = n.static[seg]
+			continue
+		}
+		name = strings.TrimSuffix(name, "}")
+		child := &n.param
+		if rest, ok := strings.CutSuffix(name, "..."); ok {
+			if i != len(segments)-1 {
+				panic(fmt.Sprintf("route %s %s: {%s} must be the last segment", rt.method, rt.path, name))
+			}
+			name, child = rest, &n.rest
+		}
+		if *child == nil {
+			*child = &node{name: name}
+		}
+		if (*child).name != name {
+			panic(fmt.Sprintf("route %s %s: parameter {%s} was named {%s} by another route", rt.method, rt.path, name, (*child).name))
+		}
+		n = *child
+	}
+	for _, other := range n.routes {
+		if other.method == rt.method {
+			panic(fmt.Sprintf("route %s %s: already served by %s", rt.method, rt.path, other.path))
+		}
+	}
+	n.routes = append(n.routes, rt)
+}
+
+// match returns the node of the routes serving the escaped path, with
+// the values of its parameters, or nil when there's none
+func (rr *router) match(path string) (*node, map[string]string) {
+	params := map[string]string{}
+	n := rr.tree.match(splitPath(path), params)
+	if n == nil {
+		return nil, nil
+	}
+	return n, params
+}
+
+// match returns the node serving the escaped segments, backtracking when
+// a static segment leads to no route
+func (n *node) match(segments []string, params map[string]string) *node {
+	if len(segments) == 0 {
+		if len(n.routes) == 0 {
+			return nil
+		}
+		return n
+	}
+	seg, err := url.PathUnescape(segments[0])
+	if err != nil {
+		return nil
+	}
+	if child := n.static[seg]; child != nil {
+		if found := child.match(segments[1:], params); found != nil {
+			return found
+		}
+	}
+	if n.param != nil && seg != "" {
+		if found := n.param.match(segments[1:], params); found != nil {
+			params[n.param.name] = seg
+			return found
+		}
+	}
+	if n.rest != nil && len(n.rest.routes) > 0 {
+		rest, err := url.PathUnescape(strings.Join(segments, "/"))
+		if err != nil || rest == "" {
+			return nil
+		}
+		params[n.rest.name] = rest
+		return n.rest
+	}
+	return nil
+}
+
+// splitPath returns the segments of a path, ignoring its leading and
+// trailing slashes
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+type pathParamsKey struct{}
+
+// pathParam returns the value of a parameter of the path template of the
+// route serving r, as the id of /users/{id}
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+const (
+	usageMonths = 13          // months kept by the meter
+	usageSave   = time.Minute // interval of the saves and uploads
+	monthLayout = "2006-01"
+)
+
+var monthPattern = regexp.MustCompile(`^\d{4}-(0[1-9]|1[0-2])$`)
+
+// creatingRoutes are the routes creating a record, metered as stored
+// and refused past the quota of records
+var creatingRoutes = map[string]bool{
+	"POST /users": true,
+}
+
+// UsageUploader stores the usage report of each month past, as the
+// aws.Uploader does in an S3 bucket
+type UsageUploader interface {
+	Upload(ctx context.Context, name string, body []byte, contentType string) error
+}
+
+// KeyUsage is the usage of an API key, or token subject, over a month,
+// as billed
+type KeyUsage struct {
+	Key      string `json:"key"`
+	Requests int64  `json:"requests"`
+	// Created and Deleted are the records the key stored and removed
+	Created int64 `json:"records_created"`
+	Deleted int64 `json:"records_deleted"`
+	// Egress are the bytes of the response bodies
+	Egress int64 `json:"egress_bytes"`
+}
+
+// UsageReport is the usage of a month
+type UsageReport struct {
+	Month       string         `json:"month"`
+	GeneratedAt timestamp.Time `json:"generated_at"`
+	// StoredRecords are the records in the store when generated
+	StoredRecords int        `json:"stored_records"`
+	Keys          []KeyUsage `json:"keys"`
+}
+
+// usageMeter counts the usage of the authenticated clients by month,
+// for billing. It is kept in a file across restarts, when set.
+type usageMeter struct {
+	*deps
+	file     string
+	uploader UsageUploader // nil unless the reports are uploaded
+
+	mu       sync.Mutex
+	months   map[string]map[string]*KeyUsage // by month and client
+	uploaded string                          // the last month uploaded
+	dirty    bool                            // since the last save
+	saving   sync.Mutex                      // held writing the file
+}
+
+// usageState is the content of the file of the meter
+type usageState struct {
+	Months   map[string]map[string]*KeyUsage `json:"months"`
+	Uploaded string                          `json:"uploaded,omitempty"`
+}
+
+// newUsageMeter returns a meter loaded from file, when set and present
+func newUsageMeter(d *deps, file string, uploader UsageUploader) (*usageMeter, error) {
+	m := &usageMeter{deps: d, file: file, uploader: uploader, months: map[string]map[string]*KeyUsage{}}
+	if file == "" {
+		return m, nil
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st usageState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, errors.New("usage file " + file + ": " + err.Error())
+	}
+	if st.Months != nil {
+		m.months = st.Months
+	}
+	m.uploaded = st.Uploaded
+	return m, nil
+}
+
+// record counts a request of client to rt, answered with status and
+// n bytes of body. The successful creates of a user count a stored
+// record, its successful deletes a removed one.
+func (m *usageMeter) record(client string, rt route, status, n int) {
+	month := m.clock.Now().UTC().Format(monthLayout)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, ok := m.months[month]
+	if !ok {
+		keys = map[string]*KeyUsage{}
+		m.months[month] = keys
+		m.prune()
+	}
+	k, ok := keys[client]
+	if !ok {
+		k = &KeyUsage{Key: client}
+		keys[client] = k
+	}
+	k.Requests++
+	k.Egress += int64(n)
+	switch {
+	case status >= http.StatusMultipleChoices:
+	case creatingRoutes[rt.method+" "+rt.path]:
+		k.Created++
+	case rt.method == http.MethodDelete && rt.path == "/users/{id}":
+		k.Deleted++
+	}
+	m.dirty = true
+}
+
+// current returns the usage of client this month
+func (m *usageMeter) current(client string) KeyUsage {
+	month := m.clock.Now().UTC().Format(monthLayout)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k, ok := m.months[month][client]; ok {
+		return *k
+	}
+	return KeyUsage{Key: client}
+}
+
+// prune forgets the months past the last usageMonths
+func (m *usageMeter) prune() {
+	months := make([]string, 0, len(m.months))
+	for month := range m.months {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+	for _, month := range months[:max(0, len(months)-usageMonths)] {
+		delete(m.months, month)
+	}
+}
+
+// report returns the usage of month, the busiest keys first
+func (m *usageMeter) report(ctx context.Context, month string) (UsageReport, error) {
+	users, _, err := m.store.List(ctx, store.Query{}, store.Eventual)
+	if err != nil {
+		return UsageReport{}, err
+	}
+	rep := UsageReport{Month: month, GeneratedAt: timestamp.New(m.clock.Now().UTC()), StoredRecords: len(users), Keys: []KeyUsage{}}
+	m.mu.Lock()
+	for _, k := range m.months[month] {
+		rep.Keys = append(rep.Keys, *k)
+	}
+	m.mu.Unlock()
+	sort.Slice(rep.Keys, func(i, j int) bool {
+		if rep.Keys[i].Requests != rep.Keys[j].Requests {
+			return rep.Keys[i].Requests > rep.Keys[j].Requests
+		}
+		return rep.Keys[i].Key < rep.Keys[j].Key
+	})
+	return rep, nil
+}
+
+// csv renders rep with a row per key, and a last one of key * with the
+// totals and the stored records
+func (rep UsageReport) csv() []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"month", "key", "requests", "records_created", "records_deleted", "egress_bytes", "stored_records"})
+	var total KeyUsage
+	for _, k := range rep.Keys {
+		w.Write([]string{rep.Month, k.Key, itoa(k.Requests), itoa(k.Created), itoa(k.Deleted), itoa(k.Egress), ""})
+		total.Requests += k.Requests
+		total.Created += k.Created
+		total.Deleted += k.Deleted
+		total.Egress += k.Egress
+	}
+	w.Write([]string{rep.Month, "*", itoa(total.Requests), itoa(total.Created), itoa(total.Deleted), itoa(total.Egress),
+		strconv.Itoa(rep.StoredRecords)})
+	w.Flush()
+	return buf.Bytes()
+}
+
+func itoa(n int64) string { return strconv.FormatInt(n, 10) }
+
+// run saves the meter and uploads the report of the month past, once
+// over, every usageSave until ctx is done
+func (m *usageMeter) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.clock.After(usageSave):
+		}
+		if m.uploader != nil {
+			m.upload(ctx)
+		}
+		if err := m.save(); err != nil {
+			m.logger.ErrorContext(ctx, "saving the usage", "file", m.file, "err", err)
+		}
+	}
+}
+
+// upload uploads the report of the previous month, unless it already
+// was. Failures are retried on the next run.
+func (m *usageMeter) upload(ctx context.Context) {
+	now := m.clock.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0).Format(monthLayout)
+	m.mu.Lock()
+	done := m.uploaded >= month
+	m.mu.Unlock()
+	if done {
+		return
+	}
+	rep, err := m.report(ctx, month)
+	if err == nil {
+		err = m.uploader.Upload(ctx, "usage-"+month+".csv", rep.csv(), "text/csv")
+	}
+	if err != nil {
+		m.logger.ErrorContext(ctx, "uploading the usage report", "month", month, "err", err)
+		return
+	}
+	m.logger.InfoContext(ctx, "usage report uploaded", "month", month, "keys", len(rep.Keys))
+	m.mu.Lock()
+	m.uploaded, m.dirty = month, true
+	m.mu.Unlock()
+}
+
+// save writes the meter to its file, when set and changed, through a
+// temporary file so a crash leaves the previous one
+func (m *usageMeter) save() error {
+	m.saving.Lock()
+	defer m.saving.Unlock()
+	m.mu.Lock()
+	if m.file == "" || !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(usageState{Months: m.months, Uploaded: m.uploaded})
+	m.dirty = false
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.file+".tmp", b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(m.file+".tmp", m.file)
+}
+
+// Usage reports the usage of each API key, or token subject, over the
+// month of ?month=, as 2026-01, the current one unless set: its
+// requests, records created and deleted and egressed bytes. It is JSON
+// unless ?format=csv.
+func (h *adminHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	serveUsage(w, r, h.meter, nil)
+}
+
+// serveUsage serves the usage report of the month and in the format of
+// the query, of the keys keep tells, all when nil
+func serveUsage(w http.ResponseWriter, r *http.Request, meter *usageMeter, keep func(key string) bool) {
+	q := r.URL.Query()
+	month := q.Get("month")
+	if month == "" {
+		month = meter.clock.Now().UTC().Format(monthLayout)
+	} else if !monthPattern.MatchString(month) {
+		invalid(w, r, "month: expected a month, as 2026-01")
+		return
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		invalid(w, r, "format: expected json or csv")
+		return
+	}
+	rep, err := meter.report(r.Context(), month)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if keep != nil {
+		rep.Keys = slices.DeleteFunc(rep.Keys, func(k KeyUsage) bool { return !keep(k.Key) })
+	}
+	if format == "csv" {
+		w.Header().Set("content-type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage-`+month+`.csv"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write(rep.csv())
+		return
+	}
+	jsonBytes, err := json.Marshal(rep)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestUsage(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig(), testKeys)
+	do(h, http.MethodPost, "/users", `{"name":"Ada"}`, apiKeyHeader, editorKey)
+	do(h, http.MethodPost, "/users", `{"name":"Bob"}`, apiKeyHeader, editorKey)
+	do(h, http.MethodGet, "/users", "", apiKeyHeader, editorKey)
+	if w := do(h, http.MethodDelete, "/users/u1", "", apiKeyHeader, adminKey); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+
+	w := do(h, http.MethodGet, "/admin/usage", "", apiKeyHeader, adminKey)
+	var rep UsageReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("usage: %d %s", w.Code, w.Body)
+	}
+	if rep.Month != "2024-06" || rep.StoredRecords != 1 || len(rep.Keys) != 2 {
+		t.Fatalf("report %+v, want June with 1 record and 2 keys", rep)
+	}
+	editor, admin := rep.Keys[0], rep.Keys[1]
+	if editor.Key != "editor" || editor.Requests != 3 || editor.Created != 2 || editor.Deleted != 0 || editor.Egress == 0 {
+		t.Errorf("editor %+v, want 3 requests creating 2 records", editor)
+	}
+	if admin.Key != "admin" || admin.Requests != 1 || admin.Created != 0 || admin.Deleted != 1 {
+		t.Errorf("admin %+v, want 1 request deleting a record", admin)
+	}
+
+	w = do(h, http.MethodGet, "/admin/usage?month=2024-06&format=csv", "", apiKeyHeader, adminKey)
+	rows := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") || len(rows) != 4 {
+		t.Fatalf("csv: %d %v %q", w.Code, w.Header(), rows)
+	}
+	// the JSON report counts among the requests of the admin
+	if !strings.HasPrefix(rows[3], "2024-06,*,5,2,1,") || !strings.HasSuffix(rows[3], ",1") {
+		t.Errorf("totals %q, want 5 requests, 2 records created, 1 deleted and 1 stored", rows[3])
+	}
+	if w := do(h, http.MethodGet, "/admin/usage?month=2024-13", "", apiKeyHeader, adminKey); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("month 13: %d, want 422", w.Code)
+	}
+}
+
+// uploads records the reports uploaded, by name
+type uploads map[string]string
+
+func (u uploads) Upload(ctx context.Context, name string, body []byte, contentType string) error {
+	u[name] = string(body)
+	return nil
+}
+
+func TestUsageUploadAndFile(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UsageFile = filepath.Join(t.TempDir(), "usage.json")
+	clk := clock.NewFake(testStart)
+	up := uploads{}
+	newServer := func() *Server {
+		s, err := New(WithConfig(cfg), WithStore(store.NewMemory(nil)), WithClock(clk), WithUsageUploader(up), testKeys,
+			WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := newServer()
+	do(s.Handler(), http.MethodPost, "/users", `{"name":"Ada"}`, apiKeyHeader, editorKey)
+
+	// the report of a month is uploaded once it is over, and only once
+	ctx := context.Background()
+	s.meter.upload(ctx)
+	if _, ok := up["usage-2024-06.csv"]; ok || len(up) != 1 {
+		t.Fatalf("uploads %v during June, want the May report alone", up)
+	}
+	clk.Advance(30 * 24 * time.Hour)
+	s.meter.upload(ctx)
+	if csv := up["usage-2024-06.csv"]; !strings.Contains(csv, "2024-06,editor,1,1,0,") {
+		t.Fatalf("uploads %v, want the June report", up)
+	}
+	if err := s.meter.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// kept across restarts, along with the last upload
+	clear(up)
+	s = newServer()
+	s.meter.upload(ctx)
+	if len(up) != 0 {
+		t.Errorf("uploaded %v again after a restart", up)
+	}
+	rep, err := s.meter.report(ctx, "2024-06")
+	if err != nil || len(rep.Keys) != 1 || rep.Keys[0].Created != 1 {
+		t.Errorf("June after a restart: %+v, %v", rep, err)
+	}
+}
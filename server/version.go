@@ -0,0 +1,56 @@
+package server
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// build information, set at build time with
+//
+//	-ldflags "-X $PKG.version=1.2.3 -X $PKG.commit=$(git rev-parse HEAD) -X $PKG.buildDate=$(date -u +%FT%TZ)"
+//
+// where $PKG is github.com/santisdev/go-restapi.git/server.
+// When left unset they are filled from the information the Go toolchain
+// embeds in the binary, when available.
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// GetBuildInfo returns the build information of the running binary
+func GetBuildInfo() BuildInfo {
+	bi := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if bi.Version == "" && info.Main.Version != "(devel)" {
+			bi.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && bi.Commit == "":
+				bi.Commit = s.Value
+			case s.Key == "vcs.time" && bi.BuildDate == "":
+				bi.BuildDate = s.Value
+			}
+		}
+	}
+	if bi.Version == "" {
+		bi.Version = "dev"
+	}
+	return bi
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// apiVersion is a version of the API, its routes served under its
+// prefix, as /v1/users
+type apiVersion struct {
+	prefix string // as /v1
+	routes []route
+}
+
+// name is the name of v, as v1, told in the API-Version headers
+func (v *apiVersion) name() string {
+	return strings.TrimPrefix(v.prefix, "/")
+}
+
+type apiVersionKey struct{}
+
+// version adds a version of the API served under prefix, as "/v2". It
+// serves the routes of the previous version but the ones of tables,
+// which add routes or replace those of the same method and path, so a
+// version only brings the handlers whose representations change. The
+// first version is also served at the unversioned paths. It panics
+// when a table repeats a route.
+func (rr *router) version(prefix string, tables ...[]route) {
+	replaced := map[string]bool{}
+	for _, t := range tables {
+		for _, rt := range t {
+			replaced[rt.method+" "+rt.path] = true
+		}
+	}
+	v := &apiVersion{prefix: prefix}
+	if len(rr.versions) > 0 {
+		for _, rt := range rr.versions[len(rr.versions)-1].routes {
+			if !replaced[rt.method+" "+rt.path] {
+				v.routes = append(v.routes, rt)
+			}
+		}
+	}
+	for _, t := range tables {
+		v.routes = append(v.routes, t...)
+	}
+	for _, rt := range v.routes {
+		rr.tree.add(prefix, rt)
+	}
+	rr.versions = append(rr.versions, v)
+}
+
+// resolve returns the version of the API r asks for, with the path of
+// the route it asks for under that version: the version of the prefix
+// of its path, or else the one of its API-Version header, the first
+// version unless told. Unknown versions answer 400.
+func (rr *router) resolve(w http.ResponseWriter, r *http.Request) (*apiVersion, string, bool) {
+	path := r.URL.EscapedPath()
+	for _, v := range rr.versions {
+		if path == v.prefix || strings.HasPrefix(path, v.prefix+"/") {
+			w.Header().Set("API-Version", v.name())
+			return v, path, true
+		}
+	}
+	w.Header().Add("Vary", "API-Version")
+	v := rr.versions[0]
+	if name := r.Header.Get("API-Version"); name != "" {
+		v = rr.lookupVersion(name)
+		if v == nil {
+			writeError(w, r, http.StatusBadRequest, codeUnknownVersion, "unknown API version "+name, nil)
+			return nil, "", false
+		}
+	}
+	w.Header().Set("API-Version", v.name())
+	return v, v.prefix + path, true
+}
+
+// lookupVersion returns the version named name, as v2 or 2, or nil
+func (rr *router) lookupVersion(name string) *apiVersion {
+	name = strings.TrimPrefix(strings.ToLower(name), "v")
+	for _, v := range rr.versions {
+		if v.name() == "v"+name {
+			return v
+		}
+	}
+	return nil
+}
+
+// withAPIVersion returns r serving the version v of the API
+func withAPIVersion(r *http.Request, v *apiVersion) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v))
+}
+
+// versionedPath returns the escaped path of r under the prefix of its
+// version, as the routes are matched
+func versionedPath(r *http.Request) string {
+	prefix := versionPrefix(r)
+	return prefix + strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+}
+
+// versionPrefix returns the prefix of the version of the API serving
+// r, as /v1, for the paths of the links to the resources. It is empty
+// outside of the router.
+func versionPrefix(r *http.Request) string {
+	if v, ok := r.Context().Value(apiVersionKey{}).(*apiVersion); ok {
+		return v.prefix
+	}
+	return ""
+}
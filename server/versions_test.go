@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestVersionedPaths(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	w := do(h, http.MethodPost, "/v1/users", `{"name":"Ada"}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/v1/users/u1" || w.Header().Get("API-Version") != "v1" {
+		t.Fatalf("creating under /v1: %d %v", w.Code, w.Header())
+	}
+
+	for _, tc := range []struct {
+		path, version string
+		want          int
+	}{
+		{"/v1/users/u1", "", http.StatusOK},
+		// the version of the path wins over the header
+		{"/v1/users/u1", "v9", http.StatusOK},
+		{"/users/u1", "", http.StatusOK},
+		{"/users/u1", "v1", http.StatusOK},
+		{"/users/u1", "1", http.StatusOK},
+		{"/users/u1", "v9", http.StatusBadRequest},
+		{"/v9/users/u1", "", http.StatusNotFound},
+	} {
+		w := do(h, http.MethodGet, tc.path, "", "API-Version", tc.version)
+		if w.Code != tc.want {
+			t.Errorf("%s as %q: %d %s, want %d", tc.path, tc.version, w.Code, w.Body, tc.want)
+			continue
+		}
+		if w.Code == http.StatusOK && w.Header().Get("API-Version") != "v1" {
+			t.Errorf("%s as %q: API-Version %q, want v1", tc.path, tc.version, w.Header().Get("API-Version"))
+		}
+		if unversioned := !strings.HasPrefix(tc.path, "/v1/"); unversioned != slices.Contains(w.Header().Values("Vary"), "API-Version") {
+			t.Errorf("%s: Vary %q", tc.path, w.Header().Values("Vary"))
+		}
+	}
+	if w := do(h, http.MethodGet, "/users/u1", "", "API-Version", "v9"); !strings.Contains(w.Body.String(), codeUnknownVersion) {
+		t.Errorf("an unknown version: %s, want %s", w.Body, codeUnknownVersion)
+	}
+}
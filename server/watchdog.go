@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+)
+
+// ErrWatchdogRestart is returned by Run when the watchdog stopped the
+// server, for its supervisor to restart it
+var ErrWatchdogRestart = errors.New("watchdog: runtime thresholds breached, restarting")
+
+// Watchdog are the thresholds of the runtime watchdog. Zero thresholds
+// aren't checked.
+type Watchdog struct {
+	// Interval is the time between the checks, zero disabling the
+	// watchdog
+	Interval time.Duration
+	// Goroutines is the most goroutines running at once
+	Goroutines int
+	// HeapBytes is the largest heap in use
+	HeapBytes uint64
+	// GCPause is the longest garbage collection pause
+	GCPause time.Duration
+	// Shed refuses the requests with 503 while a threshold is breached,
+	// except the admin ones
+	Shed bool
+	// RestartAfter stops the server once the thresholds have been
+	// breached that long, Run returning ErrWatchdogRestart. Zero never
+	// restarts.
+	RestartAfter time.Duration
+}
+
+// watchdog checks the runtime against its thresholds
+type watchdog struct {
+	cfg    Watchdog
+	clock  clock.Clock
+	logger *slog.Logger
+
+	overloaded    atomic.Bool // whether the requests are to be shed
+	numGC         uint32      // at the previous check
+	breachedSince time.Time
+}
+
+// run checks the runtime every interval until ctx is done, calling
+// restart once the thresholds have been breached for RestartAfter
+func (wd *watchdog) run(ctx context.Context, restart func()) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wd.clock.After(wd.cfg.Interval):
+		}
+		breaches := wd.check()
+		if len(breaches) == 0 {
+			if !wd.breachedSince.IsZero() {
+				wd.logger.Info("runtime back within the watchdog thresholds")
+			}
+			wd.breachedSince = time.Time{}
+			wd.overloaded.Store(false)
+			continue
+		}
+
+		now := wd.clock.Now()
+		if wd.breachedSince.IsZero() {
+			wd.breachedSince = now
+		}
+		wd.logger.Warn("runtime over the watchdog thresholds", append(breaches,
+			"since", wd.breachedSince, "shedding", wd.cfg.Shed)...)
+		wd.overloaded.Store(wd.cfg.Shed)
+		if wd.cfg.RestartAfter > 0 && now.Sub(wd.breachedSince) >= wd.cfg.RestartAfter {
+			wd.logger.Error("watchdog restarting the server", "breached_for", now.Sub(wd.breachedSince))
+			restart()
+			return
+		}
+	}
+}
+
+// check returns the thresholds breached, as log attributes of the
+// value observed
+func (wd *watchdog) check() []any {
+	var breaches []any
+	if n := runtime.NumGoroutine(); wd.cfg.Goroutines > 0 && n > wd.cfg.Goroutines {
+		breaches = append(breaches, "goroutines", n)
+	}
+	if wd.cfg.HeapBytes == 0 && wd.cfg.GCPause == 0 {
+		return breaches
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if wd.cfg.HeapBytes > 0 && ms.HeapAlloc > wd.cfg.HeapBytes {
+		breaches = append(breaches, "heap_bytes", ms.HeapAlloc)
+	}
+	// the longest pause of the cycles since the previous check, within
+	// the last 256 the runtime keeps
+	var longest time.Duration
+	for gc := max(wd.numGC, ms.NumGC-min(ms.NumGC, uint32(len(ms.PauseNs)))); gc < ms.NumGC; gc++ {
+		longest = max(longest, time.Duration(ms.PauseNs[gc%uint32(len(ms.PauseNs))]))
+	}
+	wd.numGC = ms.NumGC
+	if wd.cfg.GCPause > 0 && longest > wd.cfg.GCPause {
+		breaches = append(breaches, "gc_pause", longest)
+	}
+	return breaches
+}
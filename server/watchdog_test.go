@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestWatchdogRestarts(t *testing.T) {
+	clk := clock.NewFake(testStart)
+	wd := &watchdog{
+		// the test alone runs more than one goroutine
+		cfg:    Watchdog{Interval: time.Second, Goroutines: 1, Shed: true, RestartAfter: 5 * time.Second},
+		clock:  clk,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	restarted := make(chan struct{})
+	go wd.run(context.Background(), func() { close(restarted) })
+
+	for {
+		select {
+		case <-restarted:
+			if !wd.overloaded.Load() {
+				t.Error("not shedding while over the thresholds")
+			}
+			if got := clk.Now().Sub(wd.breachedSince); got < wd.cfg.RestartAfter {
+				t.Errorf("restarted after %v, want %v", got, wd.cfg.RestartAfter)
+			}
+			return
+		case <-time.After(time.Millisecond):
+			clk.Advance(time.Second)
+		}
+	}
+}
+
+func TestWatchdogWithinThresholds(t *testing.T) {
+	wd := &watchdog{cfg: Watchdog{Goroutines: 1 << 20, HeapBytes: 1 << 40, GCPause: time.Hour}}
+	if breaches := wd.check(); len(breaches) != 0 {
+		t.Errorf("breached %v", breaches)
+	}
+	wd.cfg.HeapBytes = 1
+	if breaches := wd.check(); len(breaches) != 2 || breaches[0] != "heap_bytes" {
+		t.Errorf("breached %v, want the heap", breaches)
+	}
+}
+
+func TestWatchdogSheds(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Watchdog = Watchdog{Interval: time.Second, Shed: true}
+	s, err := New(WithConfig(cfg), WithStore(store.NewMemory(nil)),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.watchdog.overloaded.Store(true)
+	for path, want := range map[string]int{
+		"/users":          http.StatusServiceUnavailable,
+		"/admin/inflight": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s answered %d, want %d", path, w.Code, want)
+		}
+	}
+}
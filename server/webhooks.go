@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/santisdev/go-restapi.git/webhooks"
+)
+
+const maxBulkRedeliver = 1000 // dead letters redelivered per request
+
+// webhookRoutes is the route table of the webhook administration
+func (h *adminHandler) webhookRoutes() []route {
+	return []route{
+		{http.MethodGet, "/admin/webhooks", "List the webhook subscriptions", scopeAdmin, rateAdmin, policyNoStore, h.Webhooks},
+		{http.MethodPost, "/admin/webhooks", "Subscribe a webhook", scopeAdmin, rateAdmin, policyNoStore, h.Subscribe},
+		{http.MethodDelete, "/admin/webhooks/{id}", "Unsubscribe a webhook", scopeAdmin, rateAdmin, policyNoStore, h.Unsubscribe},
+		{http.MethodGet, "/admin/webhooks/dead", "List the webhook deliveries that failed for good", scopeAdmin, rateAdmin, policyNoStore, h.DeadLetters},
+		{http.MethodGet, "/admin/webhooks/dead/{id}", "Inspect a failed webhook delivery", scopeAdmin, rateAdmin, policyNoStore, h.DeadLetter},
+		{http.MethodPost, "/admin/webhooks/dead/{id}/redeliver", "Redeliver a failed webhook delivery", scopeAdmin, rateAdmin, policyNoStore, h.Redeliver},
+		{http.MethodPost, "/admin/webhooks/dead/redeliver", "Redeliver several failed webhook deliveries", scopeAdmin, rateAdmin, policyNoStore, h.BulkRedeliver},
+	}
+}
+
+func (h *adminHandler) Webhooks(w http.ResponseWriter, r *http.Request) {
+	subs := h.webhooks.Subscriptions()
+	for i := range subs {
+		subs[i].CreatedAt = localTime(r, subs[i].CreatedAt)
+	}
+	jsonBytes, err := json.Marshal(subs)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Subscribe adds a webhook subscription from its url, event types,
+// signing secret and encryption key
+func (h *adminHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	var sub webhooks.Subscription
+	if !decodeJSON(w, r, &sub) {
+		return
+	}
+	sub, err := h.webhooks.Subscribe(sub)
+	if err != nil {
+		invalid(w, r, err.Error())
+		return
+	}
+	sub.Secret = ""
+	sub.CreatedAt = localTime(r, sub.CreatedAt)
+	jsonBytes, err := json.Marshal(sub)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func (h *adminHandler) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	if err := h.webhooks.Unsubscribe(pathParam(r, "id")); err != nil {
+		notFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeadLetters lists the deliveries that exhausted their attempts
+func (h *adminHandler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	dead := h.webhooks.Dead()
+	dead = dead[:min(pageLimit(r), len(dead))]
+	for i := range dead {
+		dead[i].DeadAt = localTime(r, dead[i].DeadAt)
+	}
+	jsonBytes, err := json.Marshal(dead)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// DeadLetter returns a failed delivery, with the event it carries
+func (h *adminHandler) DeadLetter(w http.ResponseWriter, r *http.Request) {
+	del, err := h.webhooks.DeadLetter(pathParam(r, "id"))
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	del.DeadAt = localTime(r, del.DeadAt)
+	jsonBytes, err := json.Marshal(del)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// Redeliver delivers a dead letter again, in the background
+func (h *adminHandler) Redeliver(w http.ResponseWriter, r *http.Request) {
+	err := h.webhooks.Redeliver(pathParam(r, "id"))
+	switch {
+	case errors.Is(err, webhooks.ErrNotFound):
+		notFound(w, r)
+	case errors.Is(err, webhooks.ErrClosed):
+		serviceUnavailable(w, r)
+	case err != nil:
+		internalServerError(w, r)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status": "redelivering"}`))
+	}
+}
+
+// BulkRedeliver delivers again the dead letters of the ids given, or
+// all of them when none is, reporting the outcome per id
+func (h *adminHandler) BulkRedeliver(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if (err != nil && !errors.Is(err, io.EOF)) || len(req.IDs) > maxBulkRedeliver {
+		badRequest(w, r)
+		return
+	}
+	if len(req.IDs) == 0 {
+		for _, del := range h.webhooks.Dead() {
+			req.IDs = append(req.IDs, del.ID)
+		}
+	}
+	type result struct {
+		ID     string `json:"id"`
+		Status int    `json:"status"`
+	}
+	results := make([]result, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		status := http.StatusAccepted
+		switch err := h.webhooks.Redeliver(id); {
+		case errors.Is(err, webhooks.ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, webhooks.ErrClosed):
+			status = http.StatusServiceUnavailable
+		case err != nil:
+			status = http.StatusInternalServerError
+		}
+		results = append(results, result{id, status})
+	}
+	jsonBytes, err := json.Marshal(struct {
+		Results []result `json:"results"`
+	}{results})
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
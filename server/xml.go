@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const xmlContentType = "application/xml"
+
+// xmlNamePattern matches the member names written as XML elements, the
+// others being written as <entry key="...">
+var xmlNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+// encodeXML renders a response as XML: a user as <user>, any other
+// document as <response>, the members of the objects as elements, in
+// the order of their names, and the items of the arrays as elements
+// named by the singular of the array, as the <tag> of <tags>
+func encodeXML(r *http.Request, rt route, body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	root := "response"
+	switch v := v.(type) {
+	case map[string]any:
+		if isUser(v) {
+			root = "user"
+		}
+	case []any:
+		root = "items"
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	if err := writeXML(enc, root, "", v); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeXML writes v as the element name, or as an entry of that key
+// when the name isn't one of XML
+func writeXML(enc *xml.Encoder, name, key string, v any) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if key != "" {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}}
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		names := make([]string, 0, len(v))
+		for n := range v {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			var err error
+			if xmlNamePattern.MatchString(n) && !strings.HasPrefix(strings.ToLower(n), "xml") {
+				err = writeXML(enc, n, "", v[n])
+			} else {
+				err = writeXML(enc, "entry", n, v[n])
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case []any:
+		item := "item"
+		if s, ok := strings.CutSuffix(name, "s"); ok && s != "" {
+			item = s
+		}
+		for _, e := range v {
+			if err := writeXML(enc, item, "", e); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(xmlText(v))); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// xmlText returns the text of a string, number or boolean
+func xmlText(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// xmlNode is an element of an XML document read
+type xmlNode struct {
+	XMLName xml.Name
+	Key     string    `xml:"key,attr"`
+	Text    string    `xml:",chardata"`
+	Nodes   []xmlNode `xml:",any"`
+}
+
+// decodeXMLUser returns the JSON of a user written in XML, as encodeXML
+// writes them: a <user> of the fields of the user, its <tags> of <tag>,
+// and its <metadata> and <external_ids> of elements named by their keys
+// or of <entry key="...">
+func decodeXMLUser(body []byte) ([]byte, error) {
+	var root xmlNode
+	if err := xml.Unmarshal(body, &root); err != nil {
+		return nil, err
+	}
+	if root.XMLName.Local != "user" {
+		return nil, errors.New("expected a <user> element")
+	}
+	doc := map[string]any{}
+	for _, n := range root.Nodes {
+		field := n.XMLName.Local
+		switch field {
+		case "active":
+			b, err := strconv.ParseBool(strings.TrimSpace(n.Text))
+			if err != nil {
+				return nil, errors.New("active: expected true or false")
+			}
+			doc[field] = b
+		case "version":
+			v, err := strconv.ParseUint(strings.TrimSpace(n.Text), 10, 64)
+			if err != nil {
+				return nil, errors.New("version: expected a number")
+			}
+			doc[field] = v
+		case "tags":
+			tags := []string{}
+			for _, t := range n.Nodes {
+				tags = append(tags, t.Text)
+			}
+			doc[field] = tags
+		case "quarantine", "consents", "deactivated_at", "legal_hold":
+			// set by the server only
+		case "metadata", "external_ids":
+			entries := map[string]string{}
+			for _, e := range n.Nodes {
+				key := e.XMLName.Local
+				if key == "entry" && e.Key != "" {
+					key = e.Key
+				}
+				entries[key] = e.Text
+			}
+			doc[field] = entries
+		default:
+			doc[field] = n.Text
+		}
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/msgpack"
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+func TestXML(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	body := `<user><name>Ada</name><tags><tag>math</tag></tags><metadata><team>core</team><entry key="crm:id">7</entry></metadata></user>`
+	w := do(h, http.MethodPost, "/users", body, "Content-Type", xmlContentType, "Accept", xmlContentType)
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != xmlContentType {
+		t.Fatalf("creating in XML: %d %v %s", w.Code, w.Header(), w.Body)
+	}
+	for _, want := range []string{"<user>", "<name>Ada</name>", "<tags><tag>math</tag></tags>", `<entry key="crm:id">7</entry>`, "<team>core</team>"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("answered %s, want %s", w.Body, want)
+		}
+	}
+
+	w = do(h, http.MethodGet, "/users", "", "Accept", xmlContentType)
+	if !strings.Contains(w.Body.String(), "<response>") || !strings.Contains(w.Body.String(), "<users><user>") {
+		t.Errorf("listed %s, want a <response> of <users>", w.Body)
+	}
+	// the errors stay JSON
+	for _, tc := range []struct{ method, path, body string }{
+		{http.MethodGet, "/users/nope", ""},
+		{http.MethodPost, "/users", "<user><name>Ada"},
+		{http.MethodPost, "/users", "<account><name>Ada</name></account>"},
+	} {
+		w := do(h, tc.method, tc.path, tc.body, "Content-Type", xmlContentType, "Accept", xmlContentType)
+		if w.Code < 400 || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s %q: %d %v, want a JSON error", tc.method, tc.path, tc.body, w.Code, w.Header())
+		}
+	}
+}
+
+func TestMessagePack(t *testing.T) {
+	h, _ := newTestServer(t, DefaultConfig())
+	body, err := msgpack.FromJSON([]byte(`{"name":"Ada","tags":["math"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := do(h, http.MethodPost, "/users", string(body), "Content-Type", msgpackContentType, "Accept", msgpackContentType)
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != msgpackContentType {
+		t.Fatalf("creating in MessagePack: %d %v", w.Code, w.Header())
+	}
+	doc, err := msgpack.ToJSON(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u store.User
+	if err := json.Unmarshal(doc, &u); err != nil || u.ID != "u1" || u.Name != "Ada" || len(u.Tags) != 1 {
+		t.Errorf("answered %s, want Ada", doc)
+	}
+	if w := do(h, http.MethodPost, "/users", "\xc1", "Content-Type", msgpackContentType); w.Code != http.StatusBadRequest {
+		t.Errorf("an unreadable body: %d %s, want 400", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,12 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/store/storetest"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.UserStore { return store.NewMemory(nil) })
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// maxReaders bounds the number of concurrent holders of a read lock
+const maxReaders = 1024
+
+// ctxRWMutex is a readers-writer lock whose acquisition can be abandoned
+// when a context is done
+type ctxRWMutex struct {
+	w chan struct{} // serializes writers
+	r chan struct{} // one slot per reader, all of them for a writer
+}
+
+func newCtxRWMutex() *ctxRWMutex {
+	return &ctxRWMutex{
+		w: make(chan struct{}, 1),
+		r: make(chan struct{}, maxReaders),
+	}
+}
+
+func (l *ctxRWMutex) RLock(ctx context.Context) error {
+	select {
+	case l.r <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *ctxRWMutex) RUnlock() {
+	<-l.r
+}
+
+func (l *ctxRWMutex) Lock(ctx context.Context) error {
+	select {
+	case l.w <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for i := 0; i < maxReaders; i++ {
+		select {
+		case l.r <- struct{}{}:
+		case <-ctx.Done():
+			for ; i > 0; i-- {
+				<-l.r
+			}
+			<-l.w
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (l *ctxRWMutex) Unlock() {
+	for i := 0; i < maxReaders; i++ {
+		<-l.r
+	}
+	<-l.w
+}
+
+// withLockWait bounds the time spent waiting for a lock by wait, unless
+// ctx already has an earlier deadline.
+func withLockWait(ctx context.Context, wait time.Duration) (context.Context, context.CancelFunc) {
+	if d, ok := ctx.Deadline(); ok && time.Until(d) < wait {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, wait)
+}
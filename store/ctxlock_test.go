@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCtxRWMutexGivesUp(t *testing.T) {
+	l := newCtxRWMutex()
+	ctx := context.Background()
+	if err := l.RLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := l.Lock(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lock while read-held: %v, want DeadlineExceeded", err)
+	}
+	// the writer giving up gave back the reader slots it took
+	if err := l.RLock(ctx); err != nil {
+		t.Fatalf("read lock after a writer gave up: %v", err)
+	}
+	l.RUnlock()
+	l.RUnlock()
+	if err := l.Lock(ctx); err != nil {
+		t.Fatalf("lock once released: %v", err)
+	}
+	short, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := l.RLock(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("read lock while write-held: %v, want DeadlineExceeded", err)
+	}
+	l.Unlock()
+	if err := l.RLock(ctx); err != nil {
+		t.Errorf("read lock once the writer left: %v", err)
+	}
+}
+
+func TestWithLockWait(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, stop := withLockWait(ctx, time.Hour)
+	defer stop()
+	if d, _ := got.Deadline(); d.After(time.Now().Add(time.Second)) {
+		t.Errorf("deadline %v past the one of the context", d)
+	}
+	got, stop = withLockWait(context.Background(), 10*time.Millisecond)
+	defer stop()
+	if d, ok := got.Deadline(); !ok || d.After(time.Now().Add(10*time.Millisecond)) {
+		t.Errorf("deadline %v, %t, want the wait", d, ok)
+	}
+}
+
+func TestMemoryBusy(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory(map[string]User{"1": {ID: "1", Name: "Ada"}})
+	if err := s.lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.global.Unlock()
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := s.Get(short, "1", Strong); !errors.Is(err, ErrBusy) {
+		t.Errorf("get while the collection is locked: %v, want ErrBusy", err)
+	}
+	if err := s.Ping(short); !errors.Is(err, ErrBusy) {
+		t.Errorf("ping while the collection is locked: %v, want ErrBusy", err)
+	}
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"strings"
+)
+
+// Filter is a boolean expression over the fields of the users, built by
+// the API from the filters of the clients. Stores evaluate it with
+// Match, or translate it to their own query language.
+type Filter interface {
+	Match(u User) bool
+}
+
+// And matches the users matched by all its filters
+type And []Filter
+
+func (f And) Match(u User) bool {
+	for _, sub := range f {
+		if !sub.Match(u) {
+			return false
+		}
+	}
+	return true
+}
+
+// Or matches the users matched by any of its filters
+type Or []Filter
+
+func (f Or) Match(u User) bool {
+	for _, sub := range f {
+		if sub.Match(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// Not matches the users its filter doesn't match
+type Not struct {
+	Filter Filter
+}
+
+func (f Not) Match(u User) bool {
+	return !f.Filter.Match(u)
+}
+
+// Op is the operator of a comparison
+type Op string
+
+const (
+	Eq         Op = "eq"
+	Ne         Op = "ne"
+	Gt         Op = "gt"
+	Ge         Op = "ge"
+	Lt         Op = "lt"
+	Le         Op = "le"
+	Contains   Op = "contains"
+	StartsWith Op = "startswith"
+	EndsWith   Op = "endswith"
+)
+
+// Compare compares a field of the users to a value. The fields are id,
+// name, active, version, tags and metadata.<key>. A comparison on tags
+// holds when it holds for any of the tags. Values are strings, bools,
+// float64s or nil, nil matching the missing fields.
+type Compare struct {
+	Field string
+	Op    Op
+	Value any
+}
+
+func (f Compare) Match(u User) bool {
+	if f.Field == "tags" {
+		for _, t := range u.Tags {
+			if compare(t, f.Op, f.Value) {
+				return true
+			}
+		}
+		return false
+	}
+	v, _ := FieldValue(u, f.Field)
+	return compare(v, f.Op, f.Value)
+}
+
+// FieldValue returns the value of a scalar field of u, as a string, a
+// bool or a float64, and whether the field is known. Missing metadata
+// keys are nil.
+func FieldValue(u User, field string) (any, bool) {
+	switch field {
+	case "id":
+		return u.ID, true
+	case "name":
+		return u.Name, true
+	case "active":
+		return u.Active, true
+	case "version":
+		return float64(u.Version), true
+	}
+	if k, ok := strings.CutPrefix(field, "metadata."); ok && k != "" {
+		if v, ok := u.Metadata[k]; ok {
+			return v, true
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+// CompareValues orders two field values, nil first, then false before
+// true, numbers and strings. It returns -1, 0 or +1, and false when the
+// values are of different types and not nil.
+func CompareValues(a, b any) (int, bool) {
+	switch {
+	case a == nil && b == nil:
+		return 0, true
+	case a == nil:
+		return -1, true
+	case b == nil:
+		return 1, true
+	}
+	switch a := a.(type) {
+	case string:
+		b, ok := b.(string)
+		return strings.Compare(a, b), ok
+	case float64:
+		b, ok := b.(float64)
+		switch {
+		case !ok:
+			return 0, false
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		b, ok := b.(bool)
+		switch {
+		case !ok:
+			return 0, false
+		case a == b:
+			return 0, true
+		case b:
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+func compare(v any, op Op, want any) bool {
+	switch op {
+	case Contains, StartsWith, EndsWith:
+		s, ok := v.(string)
+		sub, wantOK := want.(string)
+		if !ok || !wantOK {
+			return false
+		}
+		switch op {
+		case Contains:
+			return strings.Contains(s, sub)
+		case StartsWith:
+			return strings.HasPrefix(s, sub)
+		}
+		return strings.HasSuffix(s, sub)
+	}
+	c, ok := CompareValues(v, want)
+	switch op {
+	case Eq:
+		return ok && c == 0
+	case Ne:
+		return !ok || c != 0
+	}
+	// orderings never hold against null, as in OData
+	if !ok || v == nil || want == nil {
+		return false
+	}
+	switch op {
+	case Gt:
+		return c > 0
+	case Ge:
+		return c >= 0
+	case Lt:
+		return c < 0
+	case Le:
+		return c <= 0
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// index maps keys, such as tags, to the ids of the users having them
+type index struct {
+	mu sync.RWMutex
+	m  map[string]map[string]struct{}
+}
+
+func newIndex() *index {
+	return &index{m: map[string]map[string]struct{}{}}
+}
+
+// update moves id from the entries of the old keys to the new ones
+func (x *index) update(id string, old, new []string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, k := range old {
+		delete(x.m[k], id)
+		if len(x.m[k]) == 0 {
+			delete(x.m, k)
+		}
+	}
+	for _, k := range new {
+		if x.m[k] == nil {
+			x.m[k] = map[string]struct{}{}
+		}
+		x.m[k][id] = struct{}{}
+	}
+}
+
+// lookup returns the ids having key, sorted
+func (x *index) lookup(key string) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	ids := make([]string, 0, len(x.m[key]))
+	for id := range x.m[key] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// count returns the number of ids having key
+func (x *index) count(key string) int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.m[key])
+}
+
+// uniqueIndex maps keys, such as external ids, to the single user
+// having them
+type uniqueIndex struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func newUniqueIndex() *uniqueIndex {
+	return &uniqueIndex{m: map[string]string{}}
+}
+
+// claim moves id from the old keys to the new ones, failing with
+// ErrDuplicate and changing nothing when a new key belongs to another id
+func (x *uniqueIndex) claim(id string, old, new []string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, k := range new {
+		if owner, ok := x.m[k]; ok && owner != id {
+			return ErrDuplicate
+		}
+	}
+	for _, k := range old {
+		delete(x.m, k)
+	}
+	for _, k := range new {
+		x.m[k] = id
+	}
+	return nil
+}
+
+func (x *uniqueIndex) lookup(key string) (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	id, ok := x.m[key]
+	return id, ok
+}
@@ -0,0 +1,387 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxChanges = 1000 // number of changes kept for the change feed
+
+// maxLockWait bounds the time a request waits for a store lock
+const maxLockWait = 5 * time.Second
+
+// Memory keeps the users in memory. Records are spread over shards,
+// each with its own lock, so writes to different users don't wait for
+// each other. The global lock is taken for reading by single-record
+// operations and listings, which read-lock every shard for a consistent
+// snapshot, and for writing by the replacement of the collection.
+type Memory struct {
+	shards [numShards]shard
+	global *ctxRWMutex //mutex to manage concurrently reading and writting
+	tags   *index
+	meta   *index // of the metadata keys
+	ext    *uniqueIndex
+
+	feedMu  sync.Mutex // guards the fields below
+	rev     uint64
+	changes []Change      // last maxChanges changes, oldest first
+	changed chan struct{} // closed and replaced on every change
+}
+
+const numShards = 32
+
+type shard struct {
+	sync.RWMutex
+	m map[string]User
+}
+
+// NewMemory returns a memory store holding the users of m
+func NewMemory(m map[string]User) *Memory {
+	s := &Memory{
+		global:  newCtxRWMutex(),
+		tags:    newIndex(),
+		meta:    newIndex(),
+		ext:     newUniqueIndex(),
+		changed: make(chan struct{}),
+	}
+	for i := range s.shards {
+		s.shards[i].m = map[string]User{}
+	}
+	for id, u := range m {
+		if u.Version == 0 {
+			u.Version = 1
+		}
+		s.shard(id).m[id] = u
+		s.ext.claim(id, nil, externalKeys(u))
+		s.index(id, User{}, u)
+	}
+	return s
+}
+
+// index updates the indexes on a change of user id from old to new
+func (s *Memory) index(id string, old, new User) {
+	s.tags.update(id, old.Tags, new.Tags)
+	s.meta.update(id, metadataKeys(old), metadataKeys(new))
+}
+
+// rlock takes the global lock for reading, giving up with ErrBusy after
+// maxLockWait or when the context deadline passes
+func (s *Memory) rlock(ctx context.Context) error {
+	ctx, cancel := withLockWait(ctx, maxLockWait)
+	defer cancel()
+	return lockErr(s.global.RLock(ctx))
+}
+
+// lock takes the global lock for writing, like rlock
+func (s *Memory) lock(ctx context.Context) error {
+	ctx, cancel := withLockWait(ctx, maxLockWait)
+	defer cancel()
+	return lockErr(s.global.Lock(ctx))
+}
+
+func lockErr(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrBusy
+	}
+	return err
+}
+
+// shard returns the shard holding id
+func (s *Memory) shard(id string) *shard {
+	return &s.shards[shardOf(id)]
+}
+
+// shardOf returns the index of the shard holding id
+func shardOf(id string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return h.Sum32() % numShards
+}
+
+func (s *Memory) List(ctx context.Context, q Query, rc ReadConsistency) ([]User, uint64, error) {
+	if err := s.rlock(ctx); err != nil {
+		return nil, 0, err
+	}
+	defer s.global.RUnlock()
+	// read-locking every shard, in order, gives a consistent snapshot
+	// while letting the other readers in
+	for i := range s.shards {
+		s.shards[i].RLock()
+		defer s.shards[i].RUnlock()
+	}
+	users := []User{}
+	s.each(q, func(u User) { users = append(users, u) })
+	return q.page(users), s.revision(), nil
+}
+
+// Count counts the users selected by q
+func (s *Memory) Count(ctx context.Context, q Query, rc ReadConsistency) (int, error) {
+	if err := s.rlock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.global.RUnlock()
+	for i := range s.shards {
+		s.shards[i].RLock()
+		defer s.shards[i].RUnlock()
+	}
+	n := 0
+	s.each(q, func(User) { n++ })
+	return n, nil
+}
+
+// each calls fn on the users selected by q, in no order. The shards
+// must be read-locked.
+func (s *Memory) each(q Query, fn func(User)) {
+	var ids []string
+	if x, key := s.indexFor(q); x != nil {
+		ids = x.lookup(key)
+	}
+	if ids != nil {
+		for _, id := range ids {
+			if u := s.shard(id).m[id]; q.Match(u) {
+				fn(u)
+			}
+		}
+		return
+	}
+	for i := range s.shards {
+		for _, u := range s.shards[i].m {
+			if q.Match(u) {
+				fn(u)
+			}
+		}
+	}
+}
+
+// Ping fails when the store is locked for longer than ctx allows
+func (s *Memory) Ping(ctx context.Context) error {
+	if err := s.rlock(ctx); err != nil {
+		return err
+	}
+	s.global.RUnlock()
+	return nil
+}
+
+// Estimate counts the users List would examine for q
+func (s *Memory) Estimate(ctx context.Context, q Query) (Estimate, error) {
+	if err := s.rlock(ctx); err != nil {
+		return Estimate{}, err
+	}
+	defer s.global.RUnlock()
+	if x, key := s.indexFor(q); x != nil {
+		return Estimate{Scanned: x.count(key), Indexed: true}, nil
+	}
+	n := 0
+	for i := range s.shards {
+		s.shards[i].RLock()
+		n += len(s.shards[i].m)
+		s.shards[i].RUnlock()
+	}
+	return Estimate{Scanned: n}, nil
+}
+
+// indexFor returns the index and key narrowing q the most, if any: the
+// one of the tag, else the one of the rarest metadata key
+func (s *Memory) indexFor(q Query) (*index, string) {
+	if q.Tag != "" {
+		return s.tags, q.Tag
+	}
+	var best string
+	found := false
+	for k := range q.Metadata {
+		if !found || s.meta.count(k) < s.meta.count(best) {
+			best, found = k, true
+		}
+	}
+	if !found {
+		return nil, ""
+	}
+	return s.meta, best
+}
+
+func (s *Memory) Get(ctx context.Context, id string, rc ReadConsistency) (User, uint64, error) {
+	if err := s.rlock(ctx); err != nil {
+		return User{}, 0, err
+	}
+	defer s.global.RUnlock()
+	sh := s.shard(id)
+	sh.RLock()
+	defer sh.RUnlock()
+	u, ok := sh.m[id]
+	if !ok {
+		return User{}, s.revision(), ErrNotFound
+	}
+	return u, s.revision(), nil
+}
+
+func (s *Memory) GetByExternalID(ctx context.Context, system, id string, rc ReadConsistency) (User, uint64, error) {
+	if err := s.rlock(ctx); err != nil {
+		return User{}, 0, err
+	}
+	defer s.global.RUnlock()
+	uid, ok := s.ext.lookup(externalKey(system, id))
+	if !ok {
+		return User{}, s.revision(), ErrNotFound
+	}
+	sh := s.shard(uid)
+	sh.RLock()
+	defer sh.RUnlock()
+	u, ok := sh.m[uid]
+	if !ok {
+		return User{}, s.revision(), ErrNotFound
+	}
+	return u, s.revision(), nil
+}
+
+func (s *Memory) Create(ctx context.Context, u User) (User, uint64, error) {
+	if err := s.rlock(ctx); err != nil {
+		return User{}, 0, err
+	}
+	defer s.global.RUnlock()
+	sh := s.shard(u.ID)
+	sh.Lock()
+	defer sh.Unlock()
+	old := sh.m[u.ID]
+	if err := s.ext.claim(u.ID, externalKeys(old), externalKeys(u)); err != nil {
+		return User{}, s.revision(), err
+	}
+	u.Version = old.Version + 1
+	sh.m[u.ID] = u
+	s.index(u.ID, old, u)
+	return u, s.record("create", u.ID), nil
+}
+
+func (s *Memory) CompareAndSwap(ctx context.Context, id string, expected uint64, u User) (User, uint64, error) {
+	if err := s.rlock(ctx); err != nil {
+		return User{}, 0, err
+	}
+	defer s.global.RUnlock()
+	sh := s.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	cur, ok := sh.m[id]
+	if !ok {
+		return User{}, s.revision(), ErrNotFound
+	}
+	if cur.Version != expected {
+		return cur, s.revision(), ErrConflict
+	}
+	u.ID = id
+	if err := s.ext.claim(id, externalKeys(cur), externalKeys(u)); err != nil {
+		return User{}, s.revision(), err
+	}
+	u.Version = cur.Version + 1
+	sh.m[id] = u
+	s.index(id, cur, u)
+	return u, s.record("update", id), nil
+}
+
+func (s *Memory) Delete(ctx context.Context, id string) (User, uint64, error) {
+	if err := s.rlock(ctx); err != nil {
+		return User{}, 0, err
+	}
+	defer s.global.RUnlock()
+	sh := s.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	u, ok := sh.m[id]
+	if !ok {
+		return User{}, s.revision(), ErrNotFound
+	}
+	delete(sh.m, id)
+	s.ext.claim(id, externalKeys(u), nil)
+	s.index(id, u, User{})
+	return u, s.record("delete", id), nil
+}
+
+func (s *Memory) CompareAndDelete(ctx context.Context, id string, expected uint64) (User, uint64, error) {
+	if err := s.rlock(ctx); err != nil {
+		return User{}, 0, err
+	}
+	defer s.global.RUnlock()
+	sh := s.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	u, ok := sh.m[id]
+	if !ok {
+		return User{}, s.revision(), ErrNotFound
+	}
+	if u.Version != expected {
+		return u, s.revision(), ErrConflict
+	}
+	delete(sh.m, id)
+	s.ext.claim(id, externalKeys(u), nil)
+	s.index(id, u, User{})
+	return u, s.record("delete", id), nil
+}
+
+// Replace builds the new shards and indexes aside, so that a collection
+// failing to load, as with a duplicate external id, leaves the store
+// unchanged, then swaps them in under the global lock.
+func (s *Memory) Replace(ctx context.Context, users []User) (uint64, error) {
+	var shards [numShards]map[string]User
+	for i := range shards {
+		shards[i] = map[string]User{}
+	}
+	tags, meta, ext := newIndex(), newIndex(), newUniqueIndex()
+	for _, u := range users {
+		if err := ext.claim(u.ID, nil, externalKeys(u)); err != nil {
+			return 0, err
+		}
+		if u.Version == 0 {
+			u.Version = 1
+		}
+		shards[shardOf(u.ID)][u.ID] = u
+		tags.update(u.ID, nil, u.Tags)
+		meta.update(u.ID, nil, metadataKeys(u))
+	}
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.global.Unlock()
+	for i := range s.shards {
+		s.shards[i].m = shards[i]
+	}
+	s.tags, s.meta, s.ext = tags, meta, ext
+	return s.record("replace", ""), nil
+}
+
+func (s *Memory) ChangesSince(ctx context.Context, rev uint64) ([]Change, uint64, <-chan struct{}, error) {
+	s.feedMu.Lock()
+	defer s.feedMu.Unlock()
+	i := sort.Search(len(s.changes), func(i int) bool { return s.changes[i].Rev > rev })
+	changes := make([]Change, len(s.changes)-i)
+	copy(changes, s.changes[i:])
+	// the revisions follow each other, so a gap after rev is a change
+	// dropped from the feed
+	if rev < s.rev && (len(changes) == 0 || changes[0].Rev > rev+1) {
+		return nil, 0, nil, ErrChangesGone
+	}
+	return changes, s.rev, s.changed, nil
+}
+
+func (s *Memory) revision() uint64 {
+	s.feedMu.Lock()
+	defer s.feedMu.Unlock()
+	return s.rev
+}
+
+// record bumps the collection revision, adds a change to the feed and
+// wakes up the waiting pollers. The lock of the changed record must be
+// held, so that changes of a record are recorded in order.
+func (s *Memory) record(op, id string) uint64 {
+	s.feedMu.Lock()
+	defer s.feedMu.Unlock()
+	s.rev++
+	s.changes = append(s.changes, Change{Rev: s.rev, Op: op, ID: id})
+	if len(s.changes) > maxChanges {
+		s.changes = s.changes[len(s.changes)-maxChanges:]
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return s.rev
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryChangesGone(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory(nil)
+	for i := 1; i <= maxChanges+10; i++ {
+		if _, _, err := s.Create(ctx, User{ID: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the changes 1 to 10 were dropped
+	for _, since := range []uint64{0, 9} {
+		if _, _, _, err := s.ChangesSince(ctx, since); !errors.Is(err, ErrChangesGone) {
+			t.Errorf("since %d: %v, want ErrChangesGone", since, err)
+		}
+	}
+	changes, rev, _, err := s.ChangesSince(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != maxChanges || changes[0].Rev != 11 || rev != maxChanges+10 {
+		t.Errorf("%d changes from %d at %d, want %d from 11", len(changes), changes[0].Rev, rev, maxChanges)
+	}
+	if changes, _, _, err := s.ChangesSince(ctx, rev); err != nil || len(changes) != 0 {
+		t.Errorf("since the current revision: %v, %v", changes, err)
+	}
+}
+
+func TestMemoryReplaceFailureLeavesStoreUnchanged(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory(nil)
+	if _, _, err := s.Create(ctx, User{ID: "1", Name: "Ada", Tags: []string{"staff"},
+		ExternalIDs: map[string]string{"crm": "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.Replace(ctx, []User{
+		{ID: "2", Name: "Bob", ExternalIDs: map[string]string{"crm": "b"}},
+		{ID: "3", Name: "Cy", ExternalIDs: map[string]string{"crm": "b"}},
+	})
+	if !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("replace with a duplicate external id: %v, want ErrDuplicate", err)
+	}
+	users, rev, err := s.List(ctx, Query{}, Strong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev != 1 || len(users) != 1 || users[0].ID != "1" {
+		t.Errorf("after a failed replace: %+v at %d, want user 1 at 1", users, rev)
+	}
+	if u, _, err := s.GetByExternalID(ctx, "crm", "a", Strong); err != nil || u.ID != "1" {
+		t.Errorf("external id of user 1: %+v, %v", u, err)
+	}
+	if _, _, err := s.GetByExternalID(ctx, "crm", "b", Strong); !errors.Is(err, ErrNotFound) {
+		t.Errorf("external id of the failed import: %v, want ErrNotFound", err)
+	}
+	if users, _, _ := s.List(ctx, Query{Tag: "staff"}, Strong); len(users) != 1 {
+		t.Errorf("tag index after a failed replace: %+v", users)
+	}
+
+	rev, err = s.Replace(ctx, []User{{ID: "2", Name: "Bob", ExternalIDs: map[string]string{"crm": "a"}}})
+	if err != nil || rev != 2 {
+		t.Fatalf("replace: %d, %v", rev, err)
+	}
+	if u, _, err := s.GetByExternalID(ctx, "crm", "a", Strong); err != nil || u.ID != "2" || u.Version != 1 {
+		t.Errorf("external id after replace: %+v, %v", u, err)
+	}
+	if changes, _, _, _ := s.ChangesSince(ctx, 1); len(changes) != 1 || changes[0].Op != "replace" {
+		t.Errorf("changes of the replace: %+v", changes)
+	}
+}
+
+func TestMemoryListConcurrently(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory(nil)
+	for i := 0; i < 1000; i++ {
+		if _, _, err := s.Create(ctx, User{ID: strconv.Itoa(i), Name: "Ada", Tags: []string{"t"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a single-record operation holding the global lock doesn't block
+	// the listings
+	if err := s.rlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	_, _, err := s.List(short, Query{}, Strong)
+	cancel()
+	s.global.RUnlock()
+	if err != nil {
+		t.Fatalf("list while the global lock is read-held: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 250)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := Query{}
+			if i%2 == 0 {
+				q.Tag = "t"
+			}
+			users, _, err := s.List(ctx, q, Strong)
+			if err == nil && len(users) < 1000 {
+				err = fmt.Errorf("listed %d users, want at least 1000", len(users))
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, _, err := s.Create(ctx, User{ID: fmt.Sprint("new", i), Tags: []string{"t"}}); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestMemoryShardedWrites(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory(nil)
+	a, b := "a", "b"
+	for shardOf(a) == shardOf(b) {
+		b += "b"
+	}
+	// a write holding the shard of a doesn't block the writes to b
+	sh := s.shard(a)
+	sh.Lock()
+	done := make(chan error)
+	go func() {
+		_, _, err := s.Create(ctx, User{ID: b, Name: "Bob"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("create in another shard: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("create blocked by the lock of another shard")
+	}
+	sh.Unlock()
+	if _, _, err := s.Create(ctx, User{ID: a, Name: "Ada"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, _, err := s.Get(ctx, a, Strong); err != nil || u.Name != "Ada" {
+		t.Errorf("get %s: %+v, %v", a, u, err)
+	}
+}
@@ -0,0 +1,34 @@
+package store
+
+import "context"
+
+// eventsKey is the context key of the events of the writes
+type eventsKey struct{}
+
+// WithEvents returns ctx carrying fn, which gives the events of a write
+// made with it from the user written or deleted, none for Replace. The
+// stores having an Outbox commit them with the write.
+func WithEvents(ctx context.Context, fn func(u User) ([][]byte, error)) context.Context {
+	return context.WithValue(ctx, eventsKey{}, fn)
+}
+
+// Events returns the events of the write of u made with ctx, none when
+// ctx carries no WithEvents
+func Events(ctx context.Context, u User) ([][]byte, error) {
+	fn, ok := ctx.Value(eventsKey{}).(func(u User) ([][]byte, error))
+	if !ok {
+		return nil, nil
+	}
+	return fn(u)
+}
+
+// Outbox is implemented by the stores committing the events of a write
+// in the same transaction, to be relayed once committed: none is lost
+// when the process stops in between.
+type Outbox interface {
+	// RelayEvents passes the n oldest events of the outbox to publish,
+	// in the order they were written, until it fails. The events
+	// published are removed. It returns how many were, and a channel
+	// closed on the next write.
+	RelayEvents(ctx context.Context, n int, publish func(event []byte) error) (int, <-chan struct{}, error)
+}
@@ -0,0 +1,160 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+// migration is a change of the schema, applied once in a transaction
+type migration struct {
+	version int
+	name    string
+	sql     string
+	// backfill, if set, moves the data SQL can't after the change
+	backfill func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations are applied in order. Released ones must never change:
+// fix them with new ones.
+var migrations = []migration{
+	{1, "create users", `
+CREATE TABLE users (
+	id      text PRIMARY KEY,
+	doc     jsonb NOT NULL,
+	version bigint NOT NULL
+);
+CREATE INDEX users_tags ON users USING gin ((doc->'tags'));
+CREATE INDEX users_metadata ON users USING gin ((doc->'metadata'));
+
+CREATE TABLE user_external_ids (
+	system      text NOT NULL,
+	external_id text NOT NULL,
+	user_id     text NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	PRIMARY KEY (system, external_id)
+);
+CREATE INDEX user_external_ids_user ON user_external_ids (user_id);
+
+CREATE TABLE revision (rev bigint NOT NULL);
+INSERT INTO revision VALUES (0);
+
+CREATE TABLE changes (
+	rev bigint PRIMARY KEY,
+	op  text NOT NULL,
+	id  text NOT NULL
+);`, nil},
+	{2, "create outbox", `
+CREATE TABLE outbox (
+	seq   bigserial PRIMARY KEY,
+	event jsonb NOT NULL
+);`, nil},
+	// sorted byte-wise, as the API does, whatever the collation of the
+	// database
+	{3, "sort and select users", `
+ALTER TABLE users ADD COLUMN name text COLLATE "C" NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN created text COLLATE "C" NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN active boolean NOT NULL DEFAULT true;
+CREATE INDEX users_id ON users ((id COLLATE "C"));
+CREATE INDEX users_name ON users (name, (id COLLATE "C"));
+CREATE INDEX users_created ON users (created, (id COLLATE "C"));`, backfillColumns},
+	// no user was quarantined before the column
+	{4, "select quarantined users", `
+ALTER TABLE users ADD COLUMN quarantined boolean NOT NULL DEFAULT false;`, nil},
+}
+
+// backfillColumns sets the columns sorting and selecting the users from
+// their documents
+func backfillColumns(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT doc, version FROM users`)
+	if err != nil {
+		return err
+	}
+	var users []store.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, u := range users {
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET name = $2, created = $3, active = $4 WHERE id = $1`,
+			u.ID, u.Name, u.CreatedKey(), u.Active); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const createMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    integer PRIMARY KEY,
+	name       text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// Migrate applies the migrations not applied yet, returning their names
+func (s *Store) Migrate(ctx context.Context) ([]string, error) {
+	if _, err := s.db.ExecContext(ctx, createMigrations); err != nil {
+		return nil, fmt.Errorf("postgres: %w", err)
+	}
+	var applied []string
+	for _, m := range migrations {
+		err := s.tx(ctx, func(tx *sql.Tx) error {
+			// the lock serializes the servers migrating at once
+			if _, err := tx.ExecContext(ctx, `LOCK TABLE schema_migrations IN EXCLUSIVE MODE`); err != nil {
+				return err
+			}
+			var done bool
+			if err := tx.QueryRowContext(ctx,
+				`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.version).Scan(&done); err != nil || done {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+				return err
+			}
+			if m.backfill != nil {
+				if err := m.backfill(ctx, tx); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name); err != nil {
+				return err
+			}
+			applied = append(applied, m.name)
+			return nil
+		})
+		if err != nil {
+			return applied, fmt.Errorf("postgres: migration %d, %s: %w", m.version, m.name, err)
+		}
+	}
+	return applied, nil
+}
+
+// PendingMigrations returns the names of the migrations not applied yet
+func (s *Store) PendingMigrations(ctx context.Context) ([]string, error) {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("postgres: %w", err)
+	}
+	latest := 0
+	if exists {
+		if err := s.db.QueryRowContext(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&latest); err != nil {
+			return nil, fmt.Errorf("postgres: %w", err)
+		}
+	}
+	var pending []string
+	for _, m := range migrations {
+		if m.version > latest {
+			pending = append(pending, m.name)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/store/storetest"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// open returns a store on the database of POSTGRES_DSN, emptied, skipping
+// the test when it isn't set
+func open(t *testing.T) *Store {
+	t.Helper()
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_DSN not set")
+	}
+	ctx := context.Background()
+	s, err := Open(Config{DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{`DELETE FROM users`, `DELETE FROM changes`, `UPDATE revision SET rev = 0`} {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.UserStore { return open(t) })
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	s := open(t)
+	if applied, err := s.Migrate(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("migrations applied again: %v, %v", applied, err)
+	}
+	if pending, err := s.PendingMigrations(ctx); err != nil || len(pending) != 0 {
+		t.Errorf("pending after migrating: %v, %v", pending, err)
+	}
+}
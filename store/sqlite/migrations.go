@@ -0,0 +1,151 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+// migration is a change of the schema, applied once in a transaction.
+// The version of the schema is kept in PRAGMA user_version.
+type migration struct {
+	version int
+	name    string
+	sql     string
+	// backfill, if set, moves the data SQL can't after the change
+	backfill func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations are applied in order. Released ones must never change:
+// fix them with new ones.
+var migrations = []migration{
+	{1, "create users", `
+CREATE TABLE users (
+	id      TEXT PRIMARY KEY,
+	doc     TEXT NOT NULL,
+	version INTEGER NOT NULL
+);
+
+CREATE TABLE user_tags (
+	tag     TEXT NOT NULL,
+	user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	PRIMARY KEY (tag, user_id)
+);
+CREATE INDEX user_tags_user ON user_tags (user_id);
+
+CREATE TABLE user_metadata (
+	key     TEXT NOT NULL,
+	user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	value   TEXT NOT NULL,
+	PRIMARY KEY (key, user_id)
+);
+CREATE INDEX user_metadata_user ON user_metadata (user_id);
+
+CREATE TABLE user_external_ids (
+	system      TEXT NOT NULL,
+	external_id TEXT NOT NULL,
+	user_id     TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	PRIMARY KEY (system, external_id)
+);
+CREATE INDEX user_external_ids_user ON user_external_ids (user_id);
+
+CREATE TABLE revision (rev INTEGER NOT NULL);
+INSERT INTO revision VALUES (0);
+
+CREATE TABLE changes (
+	rev INTEGER PRIMARY KEY,
+	op  TEXT NOT NULL,
+	id  TEXT NOT NULL
+);`, nil},
+	{2, "create outbox", `
+CREATE TABLE outbox (
+	seq   INTEGER PRIMARY KEY AUTOINCREMENT,
+	event TEXT NOT NULL
+);`, nil},
+	{3, "sort and select users", `
+ALTER TABLE users ADD COLUMN name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN created TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN active INTEGER NOT NULL DEFAULT 1;
+CREATE INDEX users_name ON users (name, id);
+CREATE INDEX users_created ON users (created, id);`, backfillColumns},
+	// no user was quarantined before the column
+	{4, "select quarantined users", `
+ALTER TABLE users ADD COLUMN quarantined INTEGER NOT NULL DEFAULT 0;`, nil},
+}
+
+// backfillColumns sets the columns sorting and selecting the users from
+// their documents
+func backfillColumns(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT doc, version FROM users`)
+	if err != nil {
+		return err
+	}
+	var users []store.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, u := range users {
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET name = ?, created = ?, active = ? WHERE id = ?`,
+			u.Name, u.CreatedKey(), u.Active, u.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrate applies the migrations not applied yet, returning their
+// names. Open runs it.
+func (s *Store) Migrate(ctx context.Context) ([]string, error) {
+	var applied []string
+	for _, m := range migrations {
+		err := s.tx(ctx, func(tx *sql.Tx) error {
+			var version int
+			if err := tx.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil || version >= m.version {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+				return err
+			}
+			if m.backfill != nil {
+				if err := m.backfill(ctx, tx); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, m.version)); err != nil {
+				return err
+			}
+			applied = append(applied, m.name)
+			return nil
+		})
+		if err != nil {
+			return applied, fmt.Errorf("sqlite: migration %d, %s: %w", m.version, m.name, err)
+		}
+	}
+	return applied, nil
+}
+
+// PendingMigrations returns the names of the migrations not applied yet
+func (s *Store) PendingMigrations(ctx context.Context) ([]string, error) {
+	var version int
+	if err := s.db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	var pending []string
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m.name)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,670 @@
+// Package sqlite keeps the users in a SQLite file, for the deployments
+// of a single binary. As the postgres store, it goes through
+// database/sql without importing a driver: binaries register the one
+// they use, as modernc.org/sqlite or mattn/go-sqlite3, and name it in
+// the Config.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/santisdev/go-restapi.git/store"
+)
+
+const (
+	maxChanges = 1000 // number of changes kept for the change feed
+	minBatch   = 100  // users read at once when filtering a page
+)
+
+// Config tells where the database is
+type Config struct {
+	Path string // of the database file, created if missing
+	// Driver is the name of the database/sql driver, "sqlite" unless set
+	Driver string
+}
+
+// ConfigFromEnv completes cfg with the driver named by
+// USERSAPI_SQLITE_DRIVER, if any
+func ConfigFromEnv(cfg Config) Config {
+	if d := os.Getenv("USERSAPI_SQLITE_DRIVER"); d != "" {
+		cfg.Driver = d
+	}
+	return cfg
+}
+
+// Store is a store.UserStore over SQLite. The users are kept as JSON
+// documents, their tags, metadata keys and external ids in tables
+// indexing them. A single connection is used, SQLite serializing the
+// writes anyway, so the changes are numbered in the order they commit
+// and the waiting clients are woken up without polling.
+type Store struct {
+	db *sql.DB
+
+	mu      sync.Mutex // guards changed
+	changed chan struct{}
+}
+
+// Open opens the database, creating it and its schema when missing
+func Open(ctx context.Context, cfg Config) (*Store, error) {
+	if cfg.Driver == "" {
+		cfg.Driver = "sqlite"
+	}
+	db, err := sql.Open(cfg.Driver, cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA foreign_keys = ON`,
+		`PRAGMA busy_timeout = 5000`,
+	} {
+		if _, err := db.ExecContext(ctx, pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sqlite: %s: %w", cfg.Path, err)
+		}
+	}
+	s := &Store{db: db, changed: make(chan struct{})}
+	if _, err := s.Migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Ping checks the database can be read
+func (s *Store) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *Store) List(ctx context.Context, q store.Query, rc store.ReadConsistency) ([]store.User, uint64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+	var rev uint64
+	if err := tx.QueryRowContext(ctx, `SELECT rev FROM revision`).Scan(&rev); err != nil {
+		return nil, 0, err
+	}
+	// the filter is matched on the users read, so they are read by
+	// batches until the page is full
+	batch := q.Limit
+	if q.Filter != nil && batch > 0 {
+		batch = max(batch, minBatch)
+	}
+	users := []store.User{}
+	after := q.After
+	for {
+		conds, args := selected(q)
+		if after != nil {
+			cond, keyArgs := keyset(q.Sort, *after)
+			conds, args = append(conds, cond), append(args, keyArgs...)
+		}
+		query := `SELECT doc, version FROM users` + where(conds) + orderBy(q.Sort)
+		if batch > 0 {
+			query += ` LIMIT ?`
+			args = append(args, batch)
+		}
+		n, last, err := read(ctx, tx, query, args, func(u store.User) bool {
+			if q.Match(u) {
+				users = append(users, u)
+			}
+			return q.Limit <= 0 || len(users) < q.Limit
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if batch <= 0 || n < batch || len(users) == q.Limit {
+			return users, rev, nil
+		}
+		after = &last
+	}
+}
+
+// read runs query, calling fn on the users it reads until fn returns
+// false, and returns how many it read and the last one
+func read(ctx context.Context, tx *sql.Tx, query string, args []any, fn func(store.User) bool) (int, store.User, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, store.User{}, err
+	}
+	defer rows.Close()
+	n := 0
+	var u store.User
+	for rows.Next() {
+		if u, err = scanUser(rows); err != nil {
+			return 0, store.User{}, err
+		}
+		n++
+		if !fn(u) {
+			break
+		}
+	}
+	return n, u, rows.Err()
+}
+
+// Count counts the users selected by q
+func (s *Store) Count(ctx context.Context, q store.Query, rc store.ReadConsistency) (int, error) {
+	conds, args := selected(q)
+	n := 0
+	if q.Filter == nil {
+		err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM users`+where(conds), args...).Scan(&n)
+		return n, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	_, _, err = read(ctx, tx, `SELECT doc, version FROM users`+where(conds), args, func(u store.User) bool {
+		if q.Match(u) {
+			n++
+		}
+		return true
+	})
+	return n, err
+}
+
+// Estimate counts the users List would examine for q
+func (s *Store) Estimate(ctx context.Context, q store.Query) (store.Estimate, error) {
+	conds, args := indexed(q)
+	var e store.Estimate
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM users`+where(conds), args...).Scan(&e.Scanned)
+	e.Indexed = len(conds) > 0
+	return e, err
+}
+
+// indexed returns the conditions selecting the users of q from the
+// index tables. The rest of q is matched on the users read.
+func indexed(q store.Query) ([]string, []any) {
+	var conds []string
+	var args []any
+	if q.Tag != "" {
+		conds = append(conds, `id IN (SELECT user_id FROM user_tags WHERE tag = ?)`)
+		args = append(args, q.Tag)
+	}
+	keys := make([]string, 0, len(q.Metadata))
+	for k := range q.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v := q.Metadata[k]; v != "" {
+			conds = append(conds, `id IN (SELECT user_id FROM user_metadata WHERE key = ? AND value = ?)`)
+			args = append(args, k, v)
+		} else {
+			conds = append(conds, `id IN (SELECT user_id FROM user_metadata WHERE key = ?)`)
+			args = append(args, k)
+		}
+	}
+	return conds, args
+}
+
+// selected returns the conditions selecting the users of q by the
+// index tables and the columns of the users
+func selected(q store.Query) ([]string, []any) {
+	conds, args := indexed(q)
+	if q.Active != nil {
+		conds, args = append(conds, `active = ?`), append(args, *q.Active)
+	}
+	if q.Quarantined != nil {
+		conds, args = append(conds, `quarantined = ?`), append(args, *q.Quarantined)
+	}
+	return conds, args
+}
+
+func where(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// sortColumn returns the column of the users sorted in order o
+func sortColumn(o store.Sort) string {
+	switch o.Field {
+	case store.SortName:
+		return "name"
+	case store.SortCreated:
+		return "created"
+	}
+	return "id"
+}
+
+func orderBy(o store.Sort) string {
+	dir := ""
+	if o.Desc {
+		dir = " DESC"
+	}
+	if col := sortColumn(o); col != "id" {
+		return " ORDER BY " + col + dir + ", id" + dir
+	}
+	return " ORDER BY id" + dir
+}
+
+// keyset returns the condition selecting the users past u in order o
+func keyset(o store.Sort, u store.User) (string, []any) {
+	op := ">"
+	if o.Desc {
+		op = "<"
+	}
+	switch sortColumn(o) {
+	case "name":
+		return "(name " + op + " ? OR name = ? AND id " + op + " ?)", []any{u.Name, u.Name, u.ID}
+	case "created":
+		key := u.CreatedKey()
+		return "(created " + op + " ? OR created = ? AND id " + op + " ?)", []any{key, key, u.ID}
+	}
+	return "id " + op + " ?", []any{u.ID}
+}
+
+func (s *Store) Get(ctx context.Context, id string, rc store.ReadConsistency) (store.User, uint64, error) {
+	return s.getWhere(ctx, `users.id = ?`, id)
+}
+
+func (s *Store) GetByExternalID(ctx context.Context, system, id string, rc store.ReadConsistency) (store.User, uint64, error) {
+	return s.getWhere(ctx,
+		`users.id = (SELECT user_id FROM user_external_ids WHERE system = ? AND external_id = ?)`, system, id)
+}
+
+// getWhere returns the user selected by cond with the revision, in a
+// single statement so that they match
+func (s *Store) getWhere(ctx context.Context, cond string, args ...any) (store.User, uint64, error) {
+	var doc sql.NullString
+	var version sql.NullInt64
+	var rev uint64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT users.doc, users.version, revision.rev FROM revision LEFT JOIN users ON `+cond, args...).
+		Scan(&doc, &version, &rev)
+	if err != nil {
+		return store.User{}, 0, err
+	}
+	if !doc.Valid {
+		return store.User{}, rev, store.ErrNotFound
+	}
+	u, err := decodeUser(doc.String, uint64(version.Int64))
+	return u, rev, err
+}
+
+func (s *Store) Create(ctx context.Context, u store.User) (store.User, uint64, error) {
+	var rev uint64
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if err := checkExternalIDs(ctx, tx, u); err != nil {
+			return err
+		}
+		doc, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if err := tx.QueryRowContext(ctx, `INSERT INTO users (id, doc, version, name, created, active, quarantined) VALUES (?, ?, 1, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET doc = excluded.doc, version = users.version + 1,
+				name = excluded.name, created = excluded.created, active = excluded.active, quarantined = excluded.quarantined
+			RETURNING version`, u.ID, string(doc), u.Name, u.CreatedKey(), u.Active, u.Quarantine != nil).Scan(&u.Version); err != nil {
+			return err
+		}
+		if err := setIndexes(ctx, tx, u); err != nil {
+			return err
+		}
+		if rev, err = record(ctx, tx, "create", u.ID); err != nil {
+			return err
+		}
+		return writeEvents(ctx, tx, u)
+	})
+	if err != nil {
+		return store.User{}, 0, err
+	}
+	s.notify()
+	return u, rev, nil
+}
+
+func (s *Store) CompareAndSwap(ctx context.Context, id string, expected uint64, u store.User) (store.User, uint64, error) {
+	var rev uint64
+	var cur store.User
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `SELECT doc, version FROM users WHERE id = ?`, id)
+		var err error
+		if cur, err = scanUser(row); errors.Is(err, sql.ErrNoRows) {
+			return store.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if cur.Version != expected {
+			return store.ErrConflict
+		}
+		u.ID, u.Version = id, cur.Version+1
+		if err := checkExternalIDs(ctx, tx, u); err != nil {
+			return err
+		}
+		doc, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET doc = ?, version = ?, name = ?, created = ?, active = ?, quarantined = ? WHERE id = ?`,
+			string(doc), u.Version, u.Name, u.CreatedKey(), u.Active, u.Quarantine != nil, id); err != nil {
+			return err
+		}
+		if err := setIndexes(ctx, tx, u); err != nil {
+			return err
+		}
+		if rev, err = record(ctx, tx, "update", id); err != nil {
+			return err
+		}
+		return writeEvents(ctx, tx, u)
+	})
+	if errors.Is(err, store.ErrConflict) {
+		return cur, 0, err
+	}
+	if err != nil {
+		return store.User{}, 0, err
+	}
+	s.notify()
+	return u, rev, nil
+}
+
+func (s *Store) Delete(ctx context.Context, id string) (store.User, uint64, error) {
+	var rev uint64
+	var u store.User
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		// the index rows go with the user, by cascade
+		row := tx.QueryRowContext(ctx, `DELETE FROM users WHERE id = ? RETURNING doc, version`, id)
+		var err error
+		if u, err = scanUser(row); errors.Is(err, sql.ErrNoRows) {
+			return store.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if rev, err = record(ctx, tx, "delete", id); err != nil {
+			return err
+		}
+		return writeEvents(ctx, tx, u)
+	})
+	if err != nil {
+		return store.User{}, 0, err
+	}
+	s.notify()
+	return u, rev, nil
+}
+
+func (s *Store) CompareAndDelete(ctx context.Context, id string, expected uint64) (store.User, uint64, error) {
+	var rev uint64
+	var u store.User
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `SELECT doc, version FROM users WHERE id = ?`, id)
+		var err error
+		if u, err = scanUser(row); errors.Is(err, sql.ErrNoRows) {
+			return store.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if u.Version != expected {
+			return store.ErrConflict
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id); err != nil {
+			return err
+		}
+		if rev, err = record(ctx, tx, "delete", id); err != nil {
+			return err
+		}
+		return writeEvents(ctx, tx, u)
+	})
+	if errors.Is(err, store.ErrConflict) {
+		return u, 0, err
+	}
+	if err != nil {
+		return store.User{}, 0, err
+	}
+	s.notify()
+	return u, rev, nil
+}
+
+func (s *Store) Replace(ctx context.Context, users []store.User) (uint64, error) {
+	var rev uint64
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM users`); err != nil {
+			return err
+		}
+		for _, u := range users {
+			if err := checkExternalIDs(ctx, tx, u); err != nil {
+				return err
+			}
+			doc, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO users (id, doc, version, name, created, active, quarantined) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				u.ID, string(doc), max(u.Version, 1), u.Name, u.CreatedKey(), u.Active, u.Quarantine != nil); err != nil {
+				return err
+			}
+			if err := setIndexes(ctx, tx, u); err != nil {
+				return err
+			}
+		}
+		var err error
+		if rev, err = record(ctx, tx, "replace", ""); err != nil {
+			return err
+		}
+		return writeEvents(ctx, tx, store.User{})
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.notify()
+	return rev, nil
+}
+
+func (s *Store) ChangesSince(ctx context.Context, rev uint64) ([]store.Change, uint64, <-chan struct{}, error) {
+	// taken first, so a change committed after the query closes it
+	s.mu.Lock()
+	changed := s.changed
+	s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer tx.Rollback()
+	var cur uint64
+	if err := tx.QueryRowContext(ctx, `SELECT rev FROM revision`).Scan(&cur); err != nil {
+		return nil, 0, nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT rev, op, id FROM changes WHERE rev > ? ORDER BY rev`, rev)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer rows.Close()
+	changes := []store.Change{}
+	for rows.Next() {
+		var c store.Change
+		if err := rows.Scan(&c.Rev, &c.Op, &c.ID); err != nil {
+			return nil, 0, nil, err
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, nil, err
+	}
+	// the revisions follow each other, so a gap after rev is a change
+	// dropped from the feed
+	if rev < cur && (len(changes) == 0 || changes[0].Rev > rev+1) {
+		return nil, 0, nil, store.ErrChangesGone
+	}
+	return changes, cur, changed, nil
+}
+
+// RelayEvents passes the oldest events of the outbox to publish. The
+// single connection isn't held while they are published, for publish
+// to use the store: the events are removed afterwards, so those of a
+// process stopping in between are published again.
+func (s *Store) RelayEvents(ctx context.Context, n int, publish func(event []byte) error) (int, <-chan struct{}, error) {
+	// taken first, so an event written after the query closes it
+	s.mu.Lock()
+	changed := s.changed
+	s.mu.Unlock()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, event FROM outbox ORDER BY seq LIMIT ?`, n)
+	if err != nil {
+		return 0, nil, err
+	}
+	var seqs []int64
+	var events []string
+	for rows.Next() {
+		var seq int64
+		var e string
+		if err := rows.Scan(&seq, &e); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		seqs, events = append(seqs, seq), append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	published := 0
+	var perr error
+	for _, e := range events {
+		if perr = publish([]byte(e)); perr != nil {
+			break
+		}
+		published++
+	}
+	if published > 0 {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM outbox WHERE seq <= ?`, seqs[published-1]); err != nil {
+			return 0, nil, err
+		}
+	}
+	return published, changed, perr
+}
+
+// notify wakes up the clients waiting for a change
+func (s *Store) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// tx runs fn in a transaction, committed unless fn fails
+func (s *Store) tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// record bumps the revision and adds a change to the feed, dropping the
+// changes past maxChanges
+func record(ctx context.Context, tx *sql.Tx, op, id string) (uint64, error) {
+	var rev uint64
+	if err := tx.QueryRowContext(ctx, `UPDATE revision SET rev = rev + 1 RETURNING rev`).Scan(&rev); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO changes (rev, op, id) VALUES (?, ?, ?)`, rev, op, id); err != nil {
+		return 0, err
+	}
+	if rev > maxChanges {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM changes WHERE rev <= ?`, rev-maxChanges); err != nil {
+			return 0, err
+		}
+	}
+	return rev, nil
+}
+
+// writeEvents adds the events of the write of u made with ctx to the
+// outbox
+func writeEvents(ctx context.Context, tx *sql.Tx, u store.User) error {
+	events, err := store.Events(ctx, u)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO outbox (event) VALUES (?)`, string(e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkExternalIDs fails with store.ErrDuplicate when another user holds
+// one of the external ids of u. The single connection makes the check
+// and the write atomic.
+func checkExternalIDs(ctx context.Context, tx *sql.Tx, u store.User) error {
+	for system, id := range u.ExternalIDs {
+		var holder string
+		err := tx.QueryRowContext(ctx,
+			`SELECT user_id FROM user_external_ids WHERE system = ? AND external_id = ? AND user_id != ?`,
+			system, id, u.ID).Scan(&holder)
+		if err == nil {
+			return store.ErrDuplicate
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+	return nil
+}
+
+// setIndexes replaces the rows of u in the index tables
+func setIndexes(ctx context.Context, tx *sql.Tx, u store.User) error {
+	for _, table := range []string{"user_tags", "user_metadata", "user_external_ids"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = ?`, u.ID); err != nil {
+			return err
+		}
+	}
+	for _, tag := range u.Tags {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT OR IGNORE INTO user_tags (tag, user_id) VALUES (?, ?)`, tag, u.ID); err != nil {
+			return err
+		}
+	}
+	for k, v := range u.Metadata {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO user_metadata (key, user_id, value) VALUES (?, ?, ?)`, k, u.ID, v); err != nil {
+			return err
+		}
+	}
+	for system, id := range u.ExternalIDs {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO user_external_ids (system, external_id, user_id) VALUES (?, ?, ?)`, system, id, u.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanUser(row interface{ Scan(...any) error }) (store.User, error) {
+	var doc string
+	var version uint64
+	if err := row.Scan(&doc, &version); err != nil {
+		return store.User{}, err
+	}
+	return decodeUser(doc, version)
+}
+
+func decodeUser(doc string, version uint64) (store.User, error) {
+	var u store.User
+	if err := json.Unmarshal([]byte(doc), &u); err != nil {
+		return store.User{}, fmt.Errorf("sqlite: corrupt user: %w", err)
+	}
+	u.Version = version
+	return u, nil
+}
@@ -0,0 +1,118 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/store/storetest"
+
+	_ "modernc.org/sqlite"
+)
+
+func open(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(context.Background(), Config{Path: filepath.Join(t.TempDir(), "users.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.UserStore { return open(t) })
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+	s, err := Open(ctx, Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := s.PendingMigrations(ctx); err != nil || len(pending) != 0 {
+		t.Errorf("pending after open: %v, %v", pending, err)
+	}
+	if _, _, err := s.Create(ctx, store.User{ID: "1", Name: "Ada"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// reopening keeps the users, applying nothing again
+	if s, err = Open(ctx, Config{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if applied, err := s.Migrate(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("migrations applied again: %v, %v", applied, err)
+	}
+	if u, rev, err := s.Get(ctx, "1", store.Strong); err != nil || u.Name != "Ada" || rev != 1 {
+		t.Errorf("user after reopening: %+v at %d, %v", u, rev, err)
+	}
+}
+
+func TestMigrationBackfill(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a database of the first schema
+	if _, err := db.ExecContext(ctx, migrations[0].sql+`;
+		PRAGMA user_version = 1;
+		INSERT INTO users (id, doc, version) VALUES
+			('1', '{"id":"1","name":"Cy","active":true,"created_at":"2024-06-01T14:00:00+02:00"}', 1),
+			('2', '{"id":"2","name":"Ada","active":false,"created_at":"2024-06-01T12:30:00.5Z"}', 1),
+			('3', '{"id":"3","name":"Bob","active":true}', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := Open(ctx, Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, tc := range []struct {
+		q    store.Query
+		want string
+	}{
+		{store.Query{Sort: store.Sort{Field: store.SortName}}, "2,3,1"},
+		{store.Query{Sort: store.Sort{Field: store.SortCreated}}, "3,1,2"},
+		{store.Query{Sort: store.Sort{Field: store.SortCreated}, Active: new(bool)}, "2"},
+	} {
+		users, _, err := s.List(ctx, tc.q, store.Strong)
+		var got []string
+		for _, u := range users {
+			got = append(got, u.ID)
+		}
+		if err != nil || strings.Join(got, ",") != tc.want {
+			t.Errorf("%+v after the migration: %v, %v, want %s", tc.q, got, err, tc.want)
+		}
+	}
+	yes := true
+	if n, err := s.Count(ctx, store.Query{Active: &yes}, store.Strong); err != nil || n != 2 {
+		t.Errorf("active users: %d, %v, want 2", n, err)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	ctx := context.Background()
+	s := open(t)
+	for _, u := range []store.User{{ID: "1", Tags: []string{"vip"}}, {ID: "2"}, {ID: "3"}} {
+		if _, _, err := s.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e, err := s.Estimate(ctx, store.Query{Tag: "vip"}); err != nil || e.Scanned != 1 || !e.Indexed {
+		t.Errorf("estimate by tag: %+v, %v", e, err)
+	}
+	if e, err := s.Estimate(ctx, store.Query{}); err != nil || e.Scanned != 3 || e.Indexed {
+		t.Errorf("estimate of a full scan: %+v, %v", e, err)
+	}
+}
@@ -0,0 +1,333 @@
+// Package store defines the storage interface of the users API and
+// provides its in-memory implementation.
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+var (
+	// ErrNotFound is returned when there is no user with the given id
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a record isn't at the expected version
+	ErrConflict = errors.New("version conflict")
+	// ErrDuplicate is returned when a write would give a user an
+	// external id already held by another one
+	ErrDuplicate = errors.New("duplicate external id")
+	// ErrBusy is returned when a lock couldn't be obtained in time, for
+	// instance during a long full-collection operation
+	ErrBusy = errors.New("store busy")
+	// ErrChangesGone is returned by ChangesSince when some of the
+	// changes after the revision were dropped from the feed, the client
+	// having to list the users again
+	ErrChangesGone = errors.New("changes no longer in the feed")
+)
+
+// User is the resource served by the API
+type User struct {
+	ID   string `json:"id" validate:"max=128"`
+	Name string `json:"name" validate:"required,max=200"`
+	// Active is false for deactivated users, which are kept for
+	// referential integrity but hidden from default listings
+	Active bool `json:"active"`
+	// CreatedAt is when the user was created, set by the server. The
+	// users created before it was recorded have none.
+	CreatedAt *timestamp.Time `json:"created_at,omitempty"`
+	// DeactivatedAt is when the user was deactivated, set by the server
+	// on the inactive users for their retention
+	DeactivatedAt *timestamp.Time `json:"deactivated_at,omitempty"`
+	// Tags are free-form labels for cohorting users
+	Tags []string `json:"tags,omitempty"`
+	// Metadata holds integrator-defined values
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ExternalIDs maps external systems to the id of the user there.
+	// No two users share the same id in a system.
+	ExternalIDs map[string]string `json:"external_ids,omitempty"`
+	// MergedInto is the id of the user this one was merged into, if any
+	MergedInto string `json:"merged_into,omitempty"`
+	// Quarantine is set on the users held for abuse triage, hidden from
+	// everyone but the admins
+	Quarantine *Quarantine `json:"quarantine,omitempty"`
+	// LegalHold is set on the users held for litigation, which can't be
+	// deleted nor purged until it is released
+	LegalHold *LegalHold `json:"legal_hold,omitempty"`
+	// Consents are the acceptances of the terms of service by the user,
+	// oldest first, recorded by the server
+	Consents []Consent `json:"consents,omitempty"`
+	// Version is set by the store and bumped on every write
+	Version uint64 `json:"version"`
+}
+
+// CreatedBefore tells whether u was created before v, the users created
+// at the same time ordered by id. Those without a creation time come
+// first.
+func (u User) CreatedBefore(v User) bool {
+	var a, b time.Time
+	if u.CreatedAt != nil {
+		a = u.CreatedAt.Time
+	}
+	if v.CreatedAt != nil {
+		b = v.CreatedAt.Time
+	}
+	if !a.Equal(b) {
+		return a.Before(b)
+	}
+	return u.ID < v.ID
+}
+
+// CreatedKey is the creation time of u as a string in the order of the
+// times, empty when it has none, for the stores sorting on strings
+func (u User) CreatedKey() string {
+	if u.CreatedAt == nil {
+		return ""
+	}
+	return u.CreatedAt.UTC().Format(createdKeyLayout)
+}
+
+// createdKeyLayout is RFC 3339 of a fixed width
+const createdKeyLayout = "2006-01-02T15:04:05.000000000Z"
+
+// Consent is the acceptance of a version of the terms of service
+type Consent struct {
+	PolicyVersion string         `json:"policy_version"`
+	AcceptedAt    timestamp.Time `json:"accepted_at"`
+	// IP is the address of the client recording the consent
+	IP string `json:"ip,omitempty"`
+}
+
+// LegalHold tells why, since when and by whom a user is held
+type LegalHold struct {
+	Reason   string         `json:"reason"`
+	By       string         `json:"by"`
+	PlacedAt timestamp.Time `json:"placed_at"`
+}
+
+// Quarantine tells why and by whom a user was quarantined
+type Quarantine struct {
+	Reason string `json:"reason"`
+	// By is the subject of the admin, or the rule, quarantining the user
+	By string `json:"by"`
+}
+
+// Query selects the users returned by List. The zero value selects
+// every user, by id.
+type Query struct {
+	// Tag selects the users having this tag
+	Tag string
+	// Metadata selects the users having these metadata keys, with the
+	// given values unless they are empty
+	Metadata map[string]string
+	// Filter selects the users it matches, if set
+	Filter Filter
+	// Active, when set, selects the active users, or the inactive ones
+	Active *bool
+	// Quarantined, when set, selects the users in quarantine, or the
+	// others
+	Quarantined *bool
+	// Sort is the order of the users listed
+	Sort Sort
+	// After lists only the users past it in the order of Sort, as the
+	// cursor of a page. Only its id and sorted field are read.
+	After *User
+	// Limit caps the number of users listed, when positive
+	Limit int
+}
+
+// The fields users are sorted by
+const (
+	SortID      = "id"
+	SortName    = "name"
+	SortCreated = "created"
+)
+
+// Sort is an order of the users: by Field, SortID when empty, ties
+// being broken by id
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// Compare orders a and b, returning -1, 0 or +1
+func (o Sort) Compare(a, b User) int {
+	c := 0
+	switch {
+	case o.Field == SortCreated && a.CreatedBefore(b):
+		c = -1
+	case o.Field == SortCreated && b.CreatedBefore(a):
+		c = 1
+	case o.Field == SortName:
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	if o.Desc {
+		return -c
+	}
+	return c
+}
+
+// page sorts users, which q selects, returning those of the page of q
+func (q Query) page(users []User) []User {
+	sort.Slice(users, func(i, j int) bool { return q.Sort.Compare(users[i], users[j]) < 0 })
+	if q.After != nil {
+		users = users[sort.Search(len(users), func(i int) bool { return q.Sort.Compare(*q.After, users[i]) < 0 }):]
+	}
+	if q.Limit > 0 && q.Limit < len(users) {
+		users = users[:q.Limit]
+	}
+	return users
+}
+
+// Unpaged returns q selecting the same users, without the sort and
+// the bounds of a page
+func (q Query) Unpaged() Query {
+	return Query{Tag: q.Tag, Metadata: q.Metadata, Filter: q.Filter, Active: q.Active, Quarantined: q.Quarantined}
+}
+
+// Match tells whether q selects u
+func (q Query) Match(u User) bool {
+	if q.Active != nil && u.Active != *q.Active {
+		return false
+	}
+	if q.Quarantined != nil && (u.Quarantine != nil) != *q.Quarantined {
+		return false
+	}
+	if q.Filter != nil && !q.Filter.Match(u) {
+		return false
+	}
+	if q.Tag != "" && !hasTag(u, q.Tag) {
+		return false
+	}
+	for k, v := range q.Metadata {
+		if got, ok := u.Metadata[k]; !ok || (v != "" && got != v) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTag(u User, tag string) bool {
+	for _, t := range u.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Change is an entry of the change feed
+type Change struct {
+	Rev uint64 `json:"rev"`
+	Op  string `json:"op"`
+	ID  string `json:"id"`
+}
+
+// ReadConsistency tells a store how fresh the data of a read must be.
+// Stores without caches or replicas always serve strong reads.
+type ReadConsistency int
+
+const (
+	// Strong reads reflect every write acknowledged before them
+	Strong ReadConsistency = iota
+	// Eventual reads may be served from a stale cache or replica
+	Eventual
+)
+
+func (c ReadConsistency) String() string {
+	if c == Eventual {
+		return "eventual"
+	}
+	return "strong"
+}
+
+// UserStore is the storage backend of the users API. Every method
+// returns the collection revision the result reflects.
+type UserStore interface {
+	// List returns the users selected by q, in its order and page.
+	// Stores should serve the tag and metadata queries from an index
+	// rather than a full scan, and the pages without reading the users
+	// before them.
+	List(ctx context.Context, q Query, rc ReadConsistency) ([]User, uint64, error)
+	Get(ctx context.Context, id string, rc ReadConsistency) (User, uint64, error)
+	// GetByExternalID returns the user having id in the external system
+	GetByExternalID(ctx context.Context, system, id string, rc ReadConsistency) (User, uint64, error)
+	Create(ctx context.Context, u User) (User, uint64, error)
+	// CompareAndSwap replaces the user with the given id by u, provided
+	// it is still at the expected version. Otherwise it fails with
+	// ErrConflict and leaves it unchanged.
+	CompareAndSwap(ctx context.Context, id string, expected uint64, u User) (User, uint64, error)
+	Delete(ctx context.Context, id string) (User, uint64, error)
+	// CompareAndDelete deletes the user with the given id, provided it
+	// is still at the expected version. Otherwise it fails with
+	// ErrConflict, returning the current user.
+	CompareAndDelete(ctx context.Context, id string, expected uint64) (User, uint64, error)
+	// Replace swaps the whole collection for users, as when restoring a
+	// backup
+	Replace(ctx context.Context, users []User) (uint64, error)
+	// ChangesSince returns the changes after rev, the current revision,
+	// and a channel closed on the next change. It fails with
+	// ErrChangesGone when the feed no longer holds them all.
+	ChangesSince(ctx context.Context, rev uint64) ([]Change, uint64, <-chan struct{}, error)
+}
+
+// Estimate is the expected cost of a query
+type Estimate struct {
+	// Scanned is the number of users the store examines
+	Scanned int `json:"scanned"`
+	// Indexed tells whether an index narrows the users examined
+	Indexed bool `json:"indexed"`
+}
+
+// Counter is implemented by the stores able to count the users of a
+// query without listing them, regardless of its sort and page
+type Counter interface {
+	Count(ctx context.Context, q Query, rc ReadConsistency) (int, error)
+}
+
+// Estimator is implemented by the stores able to estimate the cost of
+// a query before running it
+type Estimator interface {
+	Estimate(ctx context.Context, q Query) (Estimate, error)
+}
+
+// Pinger is implemented by the stores able to tell whether they are
+// reachable, as at startup
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Migrator is implemented by the stores having a schema, to tell the
+// migrations not applied yet
+type Migrator interface {
+	PendingMigrations(ctx context.Context) ([]string, error)
+}
+
+// metadataKeys returns the metadata keys of u
+func metadataKeys(u User) []string {
+	keys := make([]string, 0, len(u.Metadata))
+	for k := range u.Metadata {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// externalKeys returns the keys of the external ids of u in the unique
+// index
+func externalKeys(u User) []string {
+	keys := make([]string, 0, len(u.ExternalIDs))
+	for system, id := range u.ExternalIDs {
+		keys = append(keys, externalKey(system, id))
+	}
+	return keys
+}
+
+func externalKey(system, id string) string {
+	return system + "\x00" + id
+}
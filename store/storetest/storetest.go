@@ -0,0 +1,466 @@
+// Package storetest checks that a store.UserStore behaves as the API
+// expects, for the tests of the stores.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/store"
+	"github.com/santisdev/go-restapi.git/timestamp"
+)
+
+// Run runs the conformance tests on the empty stores returned by open
+func Run(t *testing.T, open func(t *testing.T) store.UserStore) {
+	for _, tc := range []struct {
+		name string
+		fn   func(t *testing.T, s store.UserStore)
+	}{
+		{"CreateGet", testCreateGet},
+		{"CompareAndSwap", testCompareAndSwap},
+		{"Delete", testDelete},
+		{"ExternalIDs", testExternalIDs},
+		{"Replace", testReplace},
+		{"List", testList},
+		{"Status", testStatus},
+		{"Pages", testPages},
+		{"FilteredPages", testFilteredPages},
+		{"ChangesSince", testChangesSince},
+		{"Outbox", testOutbox},
+	} {
+		t.Run(tc.name, func(t *testing.T) { tc.fn(t, open(t)) })
+	}
+}
+
+func create(t *testing.T, s store.UserStore, u store.User) store.User {
+	t.Helper()
+	u, _, err := s.Create(context.Background(), u)
+	if err != nil {
+		t.Fatalf("creating %s: %v", u.ID, err)
+	}
+	return u
+}
+
+func ids(users []store.User) []string {
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testCreateGet(t *testing.T, s store.UserStore) {
+	ctx := context.Background()
+	if _, _, err := s.Get(ctx, "1", store.Strong); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("get of a missing user: %v, want ErrNotFound", err)
+	}
+	u, rev, err := s.Create(ctx, store.User{ID: "1", Name: "Ada", Active: true,
+		Tags: []string{"staff"}, Metadata: map[string]string{"team": "core"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Version != 1 || rev != 1 {
+		t.Errorf("created at version %d, revision %d, want 1 and 1", u.Version, rev)
+	}
+	got, rev, err := s.Get(ctx, "1", store.Strong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Ada" || !got.Active || got.Version != 1 || got.Metadata["team"] != "core" || rev != 1 {
+		t.Errorf("got %+v at %d", got, rev)
+	}
+}
+
+func testCompareAndSwap(t *testing.T, s store.UserStore) {
+	ctx := context.Background()
+	u := create(t, s, store.User{ID: "1", Name: "Ada"})
+	u.Name = "Ada L."
+	u, _, err := s.CompareAndSwap(ctx, "1", 1, u)
+	if err != nil || u.Version != 2 {
+		t.Fatalf("swap at the current version: %+v, %v", u, err)
+	}
+	cur, _, err := s.CompareAndSwap(ctx, "1", 1, store.User{Name: "stale"})
+	if !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("swap at a stale version: %v, want ErrConflict", err)
+	}
+	if cur.Version != 2 || cur.Name != "Ada L." {
+		t.Errorf("conflict returned %+v, want the current user", cur)
+	}
+	if _, _, err := s.CompareAndSwap(ctx, "2", 1, store.User{}); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("swap of a missing user: %v, want ErrNotFound", err)
+	}
+}
+
+func testDelete(t *testing.T, s store.UserStore) {
+	ctx := context.Background()
+	create(t, s, store.User{ID: "1", Name: "Ada", Tags: []string{"staff"}})
+	create(t, s, store.User{ID: "2", Name: "Bob"})
+	if _, _, err := s.CompareAndDelete(ctx, "1", 2); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("delete at a stale version: %v, want ErrConflict", err)
+	}
+	if u, _, err := s.CompareAndDelete(ctx, "1", 1); err != nil || u.Name != "Ada" {
+		t.Errorf("delete at the current version: %+v, %v", u, err)
+	}
+	if u, _, err := s.Delete(ctx, "2"); err != nil || u.Name != "Bob" {
+		t.Errorf("delete: %+v, %v", u, err)
+	}
+	if _, _, err := s.Delete(ctx, "2"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("second delete: %v, want ErrNotFound", err)
+	}
+	if users, _, err := s.List(ctx, store.Query{Tag: "staff"}, store.Strong); err != nil || len(users) != 0 {
+		t.Errorf("deleted user still listed: %v, %v", ids(users), err)
+	}
+}
+
+func testExternalIDs(t *testing.T, s store.UserStore) {
+	ctx := context.Background()
+	create(t, s, store.User{ID: "1", Name: "Ada", ExternalIDs: map[string]string{"crm": "a"}})
+	if _, _, err := s.Create(ctx, store.User{ID: "2", Name: "Bob", ExternalIDs: map[string]string{"crm": "a"}}); !errors.Is(err, store.ErrDuplicate) {
+		t.Fatalf("create with a taken external id: %v, want ErrDuplicate", err)
+	}
+	if _, _, err := s.Get(ctx, "2", store.Strong); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("user of a duplicate external id created: %v", err)
+	}
+	u, _, err := s.GetByExternalID(ctx, "crm", "a", store.Strong)
+	if err != nil || u.ID != "1" {
+		t.Fatalf("by external id: %+v, %v", u, err)
+	}
+	// the id moves with the updates
+	u.ExternalIDs = map[string]string{"crm": "b"}
+	if _, _, err := s.CompareAndSwap(ctx, "1", u.Version, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.GetByExternalID(ctx, "crm", "a", store.Strong); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("released external id: %v, want ErrNotFound", err)
+	}
+	create(t, s, store.User{ID: "2", Name: "Bob", ExternalIDs: map[string]string{"crm": "a"}})
+	if _, _, err := s.Delete(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.GetByExternalID(ctx, "crm", "b", store.Strong); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("external id of a deleted user: %v, want ErrNotFound", err)
+	}
+}
+
+func testReplace(t *testing.T, s store.UserStore) {
+	ctx := context.Background()
+	create(t, s, store.User{ID: "1", Name: "Ada", ExternalIDs: map[string]string{"crm": "a"}})
+	_, err := s.Replace(ctx, []store.User{
+		{ID: "2", Name: "Bob", ExternalIDs: map[string]string{"crm": "b"}},
+		{ID: "3", Name: "Cy", ExternalIDs: map[string]string{"crm": "b"}},
+	})
+	if !errors.Is(err, store.ErrDuplicate) {
+		t.Fatalf("replace with a duplicate external id: %v, want ErrDuplicate", err)
+	}
+	users, rev, err := s.List(ctx, store.Query{}, store.Strong)
+	if err != nil || !equal(ids(users), []string{"1"}) || rev != 1 {
+		t.Errorf("after a failed replace: %v at %d, %v, want user 1 at 1", ids(users), rev, err)
+	}
+	if u, _, err := s.GetByExternalID(ctx, "crm", "a", store.Strong); err != nil || u.ID != "1" {
+		t.Errorf("external id after a failed replace: %+v, %v", u, err)
+	}
+
+	rev, err = s.Replace(ctx, []store.User{{ID: "2", Name: "Bob", Version: 4, Tags: []string{"t"}}, {ID: "3", Name: "Cy"}})
+	if err != nil || rev != 2 {
+		t.Fatalf("replace: %d, %v", rev, err)
+	}
+	if users, _, _ := s.List(ctx, store.Query{}, store.Strong); !equal(ids(users), []string{"2", "3"}) {
+		t.Errorf("after replace: %v", ids(users))
+	}
+	if users, _, _ := s.List(ctx, store.Query{Tag: "t"}, store.Strong); !equal(ids(users), []string{"2"}) {
+		t.Errorf("tag after replace: %v", ids(users))
+	}
+	if u, _, err := s.Get(ctx, "2", store.Strong); err != nil || u.Version != 4 {
+		t.Errorf("replaced user %+v, %v, want its version kept", u, err)
+	}
+	if u, _, err := s.Get(ctx, "3", store.Strong); err != nil || u.Version != 1 {
+		t.Errorf("replaced user %+v, %v, want version 1", u, err)
+	}
+	if _, _, err := s.GetByExternalID(ctx, "crm", "a", store.Strong); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("external id of a replaced user: %v, want ErrNotFound", err)
+	}
+}
+
+func testList(t *testing.T, s store.UserStore) {
+	ctx := context.Background()
+	create(t, s, store.User{ID: "1", Name: "Ada", Tags: []string{"staff", "vip"}, Metadata: map[string]string{"team": "core"}})
+	create(t, s, store.User{ID: "2", Name: "Bob", Tags: []string{"staff"}, Metadata: map[string]string{"team": "web"}})
+	create(t, s, store.User{ID: "3", Name: "Cy", Metadata: map[string]string{"city": "Paris"}})
+	for _, tc := range []struct {
+		q    store.Query
+		want []string
+	}{
+		{store.Query{}, []string{"1", "2", "3"}},
+		{store.Query{Tag: "staff"}, []string{"1", "2"}},
+		{store.Query{Tag: "vip"}, []string{"1"}},
+		{store.Query{Tag: "none"}, []string{}},
+		// an empty value selects the users having the key, whatever its value
+		{store.Query{Metadata: map[string]string{"team": ""}}, []string{"1", "2"}},
+		{store.Query{Metadata: map[string]string{"city": ""}}, []string{"3"}},
+		{store.Query{Metadata: map[string]string{"team": "", "city": ""}}, []string{}},
+		{store.Query{Metadata: map[string]string{"team": "web"}}, []string{"2"}},
+		{store.Query{Tag: "staff", Metadata: map[string]string{"team": "core"}}, []string{"1"}},
+		{store.Query{Filter: store.Compare{Field: "name", Op: store.StartsWith, Value: "B"}}, []string{"2"}},
+	} {
+		users, rev, err := s.List(ctx, tc.q, store.Strong)
+		if err != nil {
+			t.Errorf("%+v: %v", tc.q, err)
+			continue
+		}
+		if got := ids(users); !equal(got, tc.want) || rev != 3 {
+			t.Errorf("%+v: %v at %d, want %v at 3", tc.q, got, rev, tc.want)
+		}
+	}
+}
+
+func testStatus(t *testing.T, s store.UserStore) {
+	ctx := context.Background()
+	create(t, s, store.User{ID: "1", Name: "Ada", Active: true})
+	create(t, s, store.User{ID: "2", Name: "Bob", Tags: []string{"x"}})
+	create(t, s, store.User{ID: "3", Name: "Cy", Active: true, Quarantine: &store.Quarantine{Reason: "spam"}})
+	yes, no := true, false
+	for _, tc := range []struct {
+		q    store.Query
+		want []string
+	}{
+		{store.Query{Active: &yes}, []string{"1", "3"}},
+		{store.Query{Active: &no}, []string{"2"}},
+		{store.Query{Active: &yes, Tag: "x"}, nil},
+		{store.Query{Quarantined: &yes}, []string{"3"}},
+		{store.Query{Active: &yes, Quarantined: &no}, []string{"1"}},
+	} {
+		users, _, err := s.List(ctx, tc.q, store.Strong)
+		if got := ids(users); err != nil || !equal(got, tc.want) {
+			t.Errorf("%+v: %v, %v, want %v", tc.q, got, err, tc.want)
+		}
+		if c, ok := s.(store.Counter); ok {
+			if n, err := c.Count(ctx, tc.q, store.Strong); err != nil || n != len(tc.want) {
+				t.Errorf("count of %+v: %d, %v, want %d", tc.q, n, err, len(tc.want))
+			}
+		}
+	}
+}
+
+// inOrder returns the ids of users, in their order
+func inOrder(users []store.User) []string {
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	return ids
+}
+
+// pages lists the users of q page by page, returning their ids
+func pages(t *testing.T, s store.UserStore, q store.Query) []string {
+	t.Helper()
+	var all []string
+	for i := 0; ; i++ {
+		users, _, err := s.List(context.Background(), q, store.Strong)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) > q.Limit {
+			t.Fatalf("page of %d users over the limit of %d", len(users), q.Limit)
+		}
+		all = append(all, inOrder(users)...)
+		if len(users) < q.Limit || i > 100 {
+			return all
+		}
+		last := users[len(users)-1]
+		q.After = &last
+	}
+}
+
+func testPages(t *testing.T, s store.UserStore) {
+	at := func(min int) *timestamp.Time {
+		t := timestamp.New(time.Date(2024, 6, 1, 12, min, 0, 0, time.UTC))
+		return &t
+	}
+	// created in the order of the letters, the ids telling otherwise
+	create(t, s, store.User{ID: "b", Name: "Cy", CreatedAt: at(1)})
+	create(t, s, store.User{ID: "a", Name: "Bob", CreatedAt: at(2)})
+	create(t, s, store.User{ID: "d", Name: "Ada", CreatedAt: at(2)})
+	create(t, s, store.User{ID: "c", Name: "Bob", CreatedAt: at(3)})
+	create(t, s, store.User{ID: "e", Name: "Dee"})
+	for _, tc := range []struct {
+		sort store.Sort
+		want []string
+	}{
+		{store.Sort{}, []string{"a", "b", "c", "d", "e"}},
+		{store.Sort{Desc: true}, []string{"e", "d", "c", "b", "a"}},
+		{store.Sort{Field: store.SortName}, []string{"d", "a", "c", "b", "e"}},
+		{store.Sort{Field: store.SortName, Desc: true}, []string{"e", "b", "c", "a", "d"}},
+		// the users without a creation time first
+		{store.Sort{Field: store.SortCreated}, []string{"e", "b", "a", "d", "c"}},
+		{store.Sort{Field: store.SortCreated, Desc: true}, []string{"c", "d", "a", "b", "e"}},
+	} {
+		for _, limit := range []int{0, 1, 2, 5} {
+			q := store.Query{Sort: tc.sort, Limit: limit}
+			var got []string
+			if limit == 0 {
+				users, _, err := s.List(context.Background(), q, store.Strong)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = inOrder(users)
+			} else {
+				got = pages(t, s, q)
+			}
+			if !equal(got, tc.want) {
+				t.Errorf("sort %+v by pages of %d: %v, want %v", tc.sort, limit, got, tc.want)
+			}
+		}
+	}
+}
+
+func testFilteredPages(t *testing.T, s store.UserStore) {
+	var want []string
+	for i := 0; i < 300; i++ {
+		u := store.User{ID: fmt.Sprintf("%03d", i), Name: "user", Active: i%2 == 0, Tags: []string{"all"}}
+		if i%7 == 0 {
+			u.Name = "seven"
+			if u.Active {
+				want = append(want, u.ID)
+			}
+		}
+		create(t, s, u)
+	}
+	yes := true
+	q := store.Query{Tag: "all", Active: &yes, Filter: store.Compare{Field: "name", Op: store.Eq, Value: "seven"}, Limit: 4}
+	if got := pages(t, s, q); !equal(got, want) {
+		t.Errorf("filtered pages %v, want %v", got, want)
+	}
+	if c, ok := s.(store.Counter); ok {
+		if n, err := c.Count(context.Background(), q.Unpaged(), store.Strong); err != nil || n != len(want) {
+			t.Errorf("count %d, %v, want %d", n, err, len(want))
+		}
+	}
+}
+
+func testChangesSince(t *testing.T, s store.UserStore) {
+	ctx := context.Background()
+	changes, rev, changed, err := s.ChangesSince(ctx, 0)
+	if err != nil || len(changes) != 0 || rev != 0 {
+		t.Fatalf("empty feed: %v, %d, %v", changes, rev, err)
+	}
+	u := create(t, s, store.User{ID: "1", Name: "Ada"})
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Error("the channel of the feed isn't closed on a change")
+	}
+	if _, _, err := s.CompareAndSwap(ctx, "1", u.Version, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Delete(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	changes, rev, _, err = s.ChangesSince(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []store.Change{{Rev: 1, Op: "create", ID: "1"}, {Rev: 2, Op: "update", ID: "1"}, {Rev: 3, Op: "delete", ID: "1"}}
+	if rev != 3 || len(changes) != len(want) {
+		t.Fatalf("changes %+v at %d, want %+v at 3", changes, rev, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d: %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+	if changes, _, _, err = s.ChangesSince(ctx, 2); err != nil || len(changes) != 1 || changes[0].Rev != 3 {
+		t.Errorf("changes since 2: %v, %v", changes, err)
+	}
+}
+
+func testOutbox(t *testing.T, s store.UserStore) {
+	outbox, ok := s.(store.Outbox)
+	if !ok {
+		t.Skip("no outbox")
+	}
+	ctx := store.WithEvents(context.Background(), func(u store.User) ([][]byte, error) {
+		return [][]byte{[]byte(fmt.Sprintf(`"%s@%d"`, u.ID, u.Version))}, nil
+	})
+	u, _, err := s.Create(ctx, store.User{ID: "1", Name: "Ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.CompareAndSwap(ctx, "1", u.Version, u); err != nil {
+		t.Fatal(err)
+	}
+	// a write failing, or made without events, writes none
+	if _, _, err := s.CompareAndSwap(ctx, "1", u.Version, u); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("stale swap: %v", err)
+	}
+	create(t, s, store.User{ID: "2", Name: "Grace"})
+	if _, _, err := s.Delete(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.CompareAndDelete(ctx, "2", 1); err != nil {
+		t.Fatal(err)
+	}
+	// nor is a write whose events fail
+	failing := store.WithEvents(context.Background(), func(store.User) ([][]byte, error) {
+		return nil, errors.New("no event")
+	})
+	if _, _, err := s.Create(failing, store.User{ID: "3", Name: "Edsger"}); err == nil {
+		t.Error("write saved without its events")
+	}
+	if _, _, err := s.Get(ctx, "3", store.Strong); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("user of the failed write: %v", err)
+	}
+	if _, err := s.Replace(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	down := errors.New("bus down")
+	n, _, err := outbox.RelayEvents(ctx, 10, func(e []byte) error {
+		if len(got) == 2 {
+			return down
+		}
+		got = append(got, string(e))
+		return nil
+	})
+	if n != 2 || !errors.Is(err, down) {
+		t.Errorf("relaying until the bus fails: %d, %v", n, err)
+	}
+	// the events not published are relayed next time
+	n, _, err = outbox.RelayEvents(ctx, 10, func(e []byte) error {
+		got = append(got, string(e))
+		return nil
+	})
+	if n != 3 || err != nil {
+		t.Errorf("relaying the rest: %d, %v", n, err)
+	}
+	if want := []string{`"1@1"`, `"1@2"`, `"1@2"`, `"2@1"`, `"@0"`}; !equal(got, want) {
+		t.Errorf("events relayed %q, want %q", got, want)
+	}
+	n, changed, err := outbox.RelayEvents(ctx, 10, func([]byte) error { return nil })
+	if n != 0 || err != nil {
+		t.Fatalf("events relayed twice: %d, %v", n, err)
+	}
+	create(t, s, store.User{ID: "4", Name: "Barbara"})
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Error("the channel of the outbox isn't closed on a write")
+	}
+}
@@ -0,0 +1,208 @@
+// Package timestamp defines the timestamps of the API, written and read
+// as RFC 3339 strings, as "2024-05-01T09:30:00Z". Other formats are
+// rejected, except the epoch milliseconds of the legacy clients decoded
+// with Decode.
+package timestamp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/validate"
+	"github.com/santisdev/go-restapi.git/wire"
+)
+
+// Layout is the layout of the timestamps written
+const Layout = time.RFC3339Nano
+
+// ErrFormat is the error of the timestamps not in RFC 3339
+var ErrFormat = errors.New("expected an RFC 3339 timestamp, as 2024-05-01T09:30:00Z")
+
+// Time is a timestamp of the API
+type Time struct {
+	time.Time
+}
+
+// New returns the timestamp of t
+func New(t time.Time) Time {
+	return Time{t}
+}
+
+// Parse reads an RFC 3339 timestamp
+func Parse(s string) (Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return Time{}, fmt.Errorf("%w, not %q", ErrFormat, s)
+	}
+	return Time{t}, nil
+}
+
+func init() {
+	wire.Register(wire.Format[Time]{
+		Name:   "timestamp",
+		Format: func(t Time) string { return t.Format(Layout) },
+		Parse:  Parse,
+	})
+}
+
+// String returns t in RFC 3339
+func (t Time) String() string {
+	return wire.String(t)
+}
+
+func (t Time) MarshalJSON() ([]byte, error) {
+	if y := t.Year(); y < 0 || y > 9999 {
+		return nil, fmt.Errorf("timestamp: year %d outside of RFC 3339", y)
+	}
+	return wire.MarshalJSON(t)
+}
+
+func (t *Time) UnmarshalJSON(b []byte) error {
+	var s string
+	if string(b) != "null" && json.Unmarshal(b, &s) != nil {
+		return fmt.Errorf("%w, not %s", ErrFormat, b)
+	}
+	return wire.UnmarshalJSON(b, t)
+}
+
+func (t Time) MarshalText() ([]byte, error) {
+	return []byte(wire.String(t)), nil
+}
+
+func (t *Time) UnmarshalText(b []byte) error {
+	parsed, err := wire.Parse[Time](string(b))
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// Mode is how Decode reads the timestamps
+type Mode int
+
+const (
+	// Strict accepts RFC 3339 strings only
+	Strict Mode = iota
+	// EpochMillis accepts the milliseconds since the Unix epoch too, as
+	// 1714555800000, for the clients written before the API settled on
+	// RFC 3339
+	EpochMillis
+)
+
+var timeType = reflect.TypeOf(Time{})
+
+// Decode reads the JSON document of r into v, a pointer, checking its
+// timestamps first: those not in the format of mode are reported as
+// validate.Errors naming their field, as the struct tag rules are. Other
+// errors are those of encoding/json.
+func Decode(r io.Reader, v any, mode Mode) error {
+	var doc any
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	var errs validate.Errors
+	doc = walk(doc, reflect.TypeOf(v), "", mode, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// walk checks the timestamps of doc, a document decoded into t, returning
+// doc with the epoch milliseconds rewritten in RFC 3339
+func walk(doc any, t reflect.Type, path string, mode Mode, errs *validate.Errors) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return checkTime(doc, path, mode, errs)
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			return doc
+		}
+		for key, val := range obj {
+			if f, ok := fieldOf(t, key); ok {
+				obj[key] = walk(val, f.Type, join(path, key), mode, errs)
+			}
+		}
+	case reflect.Map:
+		if obj, ok := doc.(map[string]any); ok {
+			for key, val := range obj {
+				obj[key] = walk(val, t.Elem(), join(path, key), mode, errs)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if arr, ok := doc.([]any); ok {
+			for i, val := range arr {
+				arr[i] = walk(val, t.Elem(), path+"["+strconv.Itoa(i)+"]", mode, errs)
+			}
+		}
+	}
+	return doc
+}
+
+func checkTime(doc any, path string, mode Mode, errs *validate.Errors) any {
+	switch val := doc.(type) {
+	case nil:
+		return doc
+	case string:
+		if _, err := Parse(val); err == nil {
+			return doc
+		}
+	case json.Number:
+		if ms, err := val.Int64(); err == nil && mode == EpochMillis {
+			return time.UnixMilli(ms).UTC().Format(Layout)
+		}
+	}
+	*errs = append(*errs, validate.FieldError{Field: path, Rule: "format", Message: ErrFormat.Error()})
+	return doc
+}
+
+// fieldOf returns the field of struct t that encoding/json decodes key
+// into, preferring an exact match of the names to a case-insensitive one
+func fieldOf(t reflect.Type, key string) (reflect.StructField, bool) {
+	var fold reflect.StructField
+	found := false
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous && f.Tag.Get("json") == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if name == key {
+			return f, true
+		}
+		if !found && strings.EqualFold(name, key) {
+			fold, found = f, true
+		}
+	}
+	return fold, found
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,30 @@
+package tracing
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogHandler adds the trace and span ids of the current span to the
+// records logged with a context, so that logs can be joined to traces
+type LogHandler struct {
+	slog.Handler
+}
+
+func (h LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if s := SpanFrom(ctx); s != nil {
+		r.AddAttrs(
+			slog.String("trace_id", s.Context.TraceID.String()),
+			slog.String("span_id", s.Context.SpanID.String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return LogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h LogHandler) WithGroup(name string) slog.Handler {
+	return LogHandler{h.Handler.WithGroup(name)}
+}
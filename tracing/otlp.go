@@ -0,0 +1,244 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	otlpBatch    = 512             // spans sent at most in a request
+	otlpQueue    = 4 * otlpBatch   // spans waiting, the others dropped
+	otlpInterval = 5 * time.Second // between the sends of the spans
+	otlpTimeout  = 10 * time.Second
+)
+
+// OTLPConfig tells where the spans are exported
+type OTLPConfig struct {
+	// Endpoint is the URL of the traces of the collector, as
+	// http://localhost:4318/v1/traces
+	Endpoint string
+	// ServiceName is the service.name of the spans
+	ServiceName string
+	// Transport carries the exports, the default one when nil
+	Transport http.RoundTripper
+	Logger    *slog.Logger
+}
+
+// OTLPExporter sends the spans to an OpenTelemetry collector, with the
+// OTLP/HTTP protocol in JSON, by batches. The spans finished while the
+// queue is full are dropped rather than slowing the requests.
+type OTLPExporter struct {
+	cfg     OTLPConfig
+	client  *http.Client
+	queue   chan *Span
+	dropped atomic.Int64 // since the last export
+	done    chan struct{}
+	once    sync.Once
+	stopped chan struct{}
+}
+
+// NewOTLPExporter returns an exporter sending to the collector of cfg
+// until closed
+func NewOTLPExporter(cfg OTLPConfig) (*OTLPExporter, error) {
+	if u, err := url.Parse(cfg.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("otlp: invalid endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	e := &OTLPExporter{
+		cfg:     cfg,
+		client:  &http.Client{Transport: cfg.Transport, Timeout: otlpTimeout},
+		queue:   make(chan *Span, otlpQueue),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+func (e *OTLPExporter) Export(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Close sends the spans queued and stops the exporter
+func (e *OTLPExporter) Close() {
+	e.once.Do(func() { close(e.done) })
+	<-e.stopped
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(otlpInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) < otlpBatch {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.done:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			for len(batch) > 0 {
+				n := min(len(batch), otlpBatch)
+				e.send(batch[:n])
+				batch = batch[n:]
+			}
+			return
+		}
+		if len(batch) > 0 {
+			e.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// send exports spans, logging the failures, which aren't retried
+func (e *OTLPExporter) send(spans []*Span) {
+	if n := e.dropped.Swap(0); n > 0 {
+		e.cfg.Logger.Warn("spans dropped, the export queue being full", "spans", n)
+	}
+	body, err := json.Marshal(e.request(spans))
+	if err == nil {
+		err = e.post(body)
+	}
+	if err != nil {
+		e.cfg.Logger.Warn("exporting spans", "endpoint", e.cfg.Endpoint, "spans", len(spans), "err", err)
+	}
+}
+
+func (e *OTLPExporter) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of the spans, as in
+// opentelemetry/proto/collector/trace/v1/trace_service.proto
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceID      string          `json:"traceId"`
+		SpanID       string          `json:"spanId"`
+		ParentSpanID string          `json:"parentSpanId,omitempty"`
+		Name         string          `json:"name"`
+		Kind         int             `json:"kind"`
+		Start        string          `json:"startTimeUnixNano"`
+		End          string          `json:"endTimeUnixNano"`
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+		Status       struct {
+			Code int `json:"code,omitempty"`
+		} `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+)
+
+// the OTLP span kinds and status codes
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpStatusError  = 2
+)
+
+func (e *OTLPExporter) request(spans []*Span) otlpRequest {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	scope.Scope.Name = "github.com/santisdev/go-restapi.git/tracing"
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID: s.Context.TraceID.String(),
+			SpanID:  s.Context.SpanID.String(),
+			Name:    s.Name,
+			Kind:    otlpKindInternal,
+			Start:   strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent != (SpanID{}) {
+			o.ParentSpanID = s.Parent.String()
+		}
+		if s.Kind == SpanKindServer {
+			o.Kind = otlpKindServer
+		}
+		if s.Error {
+			o.Status.Code = otlpStatusError
+		}
+		for k, v := range s.Attributes {
+			o.Attributes = append(o.Attributes, otlpAttr(k, v))
+		}
+		s.mu.Unlock()
+		scope.Spans = append(scope.Spans, o)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{otlpAttr("service.name", e.cfg.ServiceName)}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
+
+func otlpAttr(key string, v any) otlpAttribute {
+	var value map[string]any
+	switch v := v.(type) {
+	case string:
+		value = map[string]any{"stringValue": v}
+	case bool:
+		value = map[string]any{"boolValue": v}
+	case int:
+		value = map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		value = map[string]any{"doubleValue": v}
+	default:
+		value = map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+	return otlpAttribute{Key: key, Value: value}
+}
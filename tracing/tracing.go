@@ -0,0 +1,248 @@
+// Package tracing implements request tracing with W3C Trace Context
+// propagation and head-based sampling.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanContext is the part of a span propagated across processes
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// ParseTraceparent parses a W3C traceparent header
+func ParseTraceparent(h string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return SpanContext{}, false
+	}
+	if sc.TraceID == (TraceID{}) || sc.SpanID == (SpanID{}) {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// Traceparent formats sc as a W3C traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// Sampler decides which traces are kept. The decision is taken when the
+// trace starts, following the caller's decision when there is one.
+type Sampler struct {
+	// Rate is the fraction of the traces sampled, from 0 to 1
+	Rate float64
+	// AlwaysOnError keeps the spans ending in error even when their
+	// trace wasn't sampled
+	AlwaysOnError bool
+	// Routes overrides Rate per route, by route name
+	Routes map[string]float64
+}
+
+func (s Sampler) sample(route string) bool {
+	rate, ok := s.Routes[route]
+	if !ok {
+		rate = s.Rate
+	}
+	return rate > 0 && (rate >= 1 || mrand.Float64() < rate)
+}
+
+// SpanKind tells the role of a span in its trace
+type SpanKind int
+
+const (
+	// SpanKindInternal is an operation within the server, as a call to
+	// the store
+	SpanKindInternal SpanKind = iota
+	// SpanKindServer is the handling of a request
+	SpanKindServer
+)
+
+// Span is a timed operation of a trace
+type Span struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	Error      bool
+
+	tracer   *Tracer
+	recorded bool
+	mu       sync.Mutex
+	ended    bool
+}
+
+// SetAttribute annotates the span
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil || !s.recorded {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = true
+}
+
+// Finish ends the span and exports it if it's kept
+func (s *Span) Finish() {
+	if s == nil || !s.recorded {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	keep := s.Context.Sampled || (s.Error && s.tracer.sampler.Load().AlwaysOnError)
+	s.mu.Unlock()
+	if keep {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// Exporter sends the finished spans to a tracing backend
+type Exporter interface {
+	Export(s *Span)
+}
+
+// LogExporter writes the spans to a logger, at debug level
+type LogExporter struct {
+	Logger *slog.Logger
+}
+
+func (e LogExporter) Export(s *Span) {
+	attrs := []any{
+		"trace_id", s.Context.TraceID.String(),
+		"span_id", s.Context.SpanID.String(),
+		"duration", s.End.Sub(s.Start),
+		"error", s.Error,
+	}
+	if s.Parent != (SpanID{}) {
+		attrs = append(attrs, "parent_id", s.Parent.String())
+	}
+	for k, v := range s.Attributes {
+		attrs = append(attrs, k, v)
+	}
+	e.Logger.Debug("span "+s.Name, attrs...)
+}
+
+// Tracer creates the spans
+type Tracer struct {
+	sampler  atomic.Pointer[Sampler]
+	exporter Exporter
+}
+
+// New returns a tracer sampling with s and exporting to e
+func New(s Sampler, e Exporter) *Tracer {
+	t := &Tracer{exporter: e}
+	t.sampler.Store(&s)
+	return t
+}
+
+// Sampler returns the sampler of the new traces
+func (t *Tracer) Sampler() Sampler {
+	return *t.sampler.Load()
+}
+
+// SetSampler replaces the sampler of the new traces
+func (t *Tracer) SetSampler(s Sampler) {
+	t.sampler.Store(&s)
+}
+
+type spanKey struct{}
+
+// SpanFrom returns the current span of ctx, if any
+func SpanFrom(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// StartRequest starts the server span of a request to the named route,
+// continuing the trace of the caller given in the traceparent header
+func (t *Tracer) StartRequest(r *http.Request, route string) (*http.Request, *Span) {
+	s := &Span{Name: route, Kind: SpanKindServer, tracer: t}
+	if parent, ok := ParseTraceparent(r.Header.Get("traceparent")); ok {
+		s.Context = parent
+		s.Parent = parent.SpanID
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		s.Context.Sampled = t.sampler.Load().sample(route)
+	}
+	rand.Read(s.Context.SpanID[:])
+	t.begin(s)
+	return r.WithContext(context.WithValue(r.Context(), spanKey{}, s)), s
+}
+
+// Start starts a child span of the current span of ctx. Without
+// current span, it returns ctx and a nil span, which is a no-op.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFrom(ctx)
+	if t == nil || parent == nil {
+		return ctx, nil
+	}
+	s := &Span{Name: name, tracer: t, Context: parent.Context, Parent: parent.Context.SpanID}
+	rand.Read(s.Context.SpanID[:])
+	t.begin(s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *Tracer) begin(s *Span) {
+	s.recorded = s.Context.Sampled || t.sampler.Load().AlwaysOnError
+	if s.recorded {
+		s.Start = time.Now()
+		s.Attributes = map[string]any{}
+	}
+}
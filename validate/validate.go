@@ -0,0 +1,336 @@
+// Package validate checks structs against the rules declared in the
+// validate tags of their fields, as in
+//
+//	Name string `json:"name" validate:"required,max=200"`
+//
+// so new resources declare their constraints next to their fields. The
+// rules are:
+//
+//	required    the field isn't zero, nor only spaces for strings
+//	min=N       strings have at least N characters, slices and maps N
+//	            items, numbers are at least N
+//	max=N       as min, at most
+//	oneof=a b   the string is one of the values
+//	pattern=re  the string matches the regular expression, which can't
+//	            hold a comma
+//	email       the string is an email address
+//	url         the string is an absolute http or https URL
+//
+// The rules other than required pass on zero values. The nested structs
+// are checked too, the fields being named by their path, as
+// address.city.
+//
+// Every string must be valid UTF-8, the items of the slices and the keys
+// and values of the maps included, and is bounded by Limits, at most
+// DefaultMaxLength characters for the fields without a max rule.
+package validate
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// FieldError is a field breaking one of its rules
+type FieldError struct {
+	// Field is the JSON name of the field, its path in nested structs
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// Errors are the fields breaking their rules, in the order of the
+// fields
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// DefaultMaxLength bounds the strings of the fields without a max rule,
+// in characters
+const DefaultMaxLength = 4096
+
+// Limits bound the lengths of the strings of the fields
+type Limits struct {
+	// MaxLength bounds the strings of the fields without a max rule, in
+	// characters, DefaultMaxLength unless set
+	MaxLength int
+	// Fields bound the strings of some fields, by path as address.city,
+	// replacing their max rule
+	Fields map[string]int
+}
+
+// Struct checks the fields of v, a struct or a pointer to one, against
+// their rules, returning Errors when some break them. It panics on the
+// rules it doesn't know, as regexp.MustCompile.
+func Struct(v any) error {
+	return Limits{}.Struct(v)
+}
+
+// Struct checks v as the function Struct, its strings bounded by l
+func (l Limits) Struct(v any) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("validate: %T is not a struct", v))
+	}
+	if l.MaxLength == 0 {
+		l.MaxLength = DefaultMaxLength
+	}
+	var errs Errors
+	l.check(rv, "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (l Limits) check(v reflect.Value, prefix string, errs *Errors) {
+	for _, f := range fieldsOf(v.Type()) {
+		fv := v.Field(f.index)
+		path := prefix + f.name
+		if fe, ok := l.checkStrings(fv, f, path); !ok {
+			*errs = append(*errs, fe)
+		} else {
+			for _, r := range f.rules {
+				if _, replaced := l.Fields[path]; replaced && r.name == "max" && fv.Kind() == reflect.String {
+					continue
+				}
+				if msg, ok := r.check(fv); !ok {
+					*errs = append(*errs, FieldError{path, r.name, msg})
+					break // the first broken rule of a field tells enough
+				}
+			}
+		}
+		if fv.Kind() == reflect.Pointer && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct {
+			l.check(fv, path+".", errs)
+		}
+	}
+}
+
+// checkStrings checks the strings of the field f are valid UTF-8 and
+// within their limit
+func (l Limits) checkStrings(v reflect.Value, f field, path string) (FieldError, bool) {
+	limit, ok := l.Fields[path]
+	if !ok {
+		limit = l.MaxLength
+		if f.hasMax && v.Kind() == reflect.String {
+			limit = 0 // left to the max rule
+		}
+	}
+	fe := FieldError{Field: path}
+	eachString(v, func(s string) bool {
+		switch {
+		case !utf8.ValidString(s):
+			fe.Rule, fe.Message = "utf8", "must be valid UTF-8"
+		case limit > 0 && len(s) > limit && utf8.RuneCountInString(s) > limit:
+			fe.Rule, fe.Message = "max", fmt.Sprintf("must be at most %d characters", limit)
+		default:
+			return true
+		}
+		return false
+	})
+	return fe, fe.Rule == ""
+}
+
+// eachString calls fn on the strings of v, the items of its slices and
+// the keys and values of its maps included, until fn returns false
+func eachString(v reflect.Value, fn func(string) bool) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return fn(v.String())
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil() || eachString(v.Elem(), fn)
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return true // bytes, not text
+		}
+		for i := 0; i < v.Len(); i++ {
+			if !eachString(v.Index(i), fn) {
+				return false
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if !eachString(iter.Key(), fn) || !eachString(iter.Value(), fn) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+type field struct {
+	index int
+	name  string
+	rules []rule
+	// hasMax is set when a max rule bounds the field
+	hasMax bool
+}
+
+// fields caches the fields of the struct types, by reflect.Type
+var fields sync.Map
+
+func fieldsOf(t reflect.Type) []field {
+	if fs, ok := fields.Load(t); ok {
+		return fs.([]field)
+	}
+	var fs []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		f := field{index: i, name: name}
+		if tag := sf.Tag.Get("validate"); tag != "" {
+			for _, spec := range strings.Split(tag, ",") {
+				r := parseRule(t, sf, spec)
+				f.rules = append(f.rules, r)
+				f.hasMax = f.hasMax || r.name == "max"
+			}
+		}
+		fs = append(fs, f)
+	}
+	fields.Store(t, fs)
+	return fs
+}
+
+// rule checks a value, returning the message telling why it doesn't
+// comply
+type rule struct {
+	name  string
+	check func(v reflect.Value) (string, bool)
+}
+
+func parseRule(t reflect.Type, sf reflect.StructField, spec string) rule {
+	name, arg, _ := strings.Cut(strings.TrimSpace(spec), "=")
+	bad := func(reason string) {
+		panic(fmt.Sprintf("validate: %s.%s: rule %q: %s", t.Name(), sf.Name, spec, reason))
+	}
+	kind := sf.Type.Kind()
+	isString := kind == reflect.String
+	switch name {
+	case "required":
+		return rule{name, func(v reflect.Value) (string, bool) {
+			if v.Kind() == reflect.String {
+				return "is required", strings.TrimSpace(v.String()) != ""
+			}
+			return "is required", !v.IsZero()
+		}}
+
+	case "min", "max":
+		n, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			bad("expected a number")
+		}
+		atMost := name == "max"
+		word := map[bool]string{false: "least", true: "most"}[atMost]
+		within := func(x float64) bool {
+			if atMost {
+				return x <= n
+			}
+			return x >= n
+		}
+		switch kind {
+		case reflect.String:
+			return rule{name, func(v reflect.Value) (string, bool) {
+				return fmt.Sprintf("must be at %s %s characters", word, arg), v.Len() == 0 || within(float64(utf8.RuneCountInString(v.String())))
+			}}
+		case reflect.Slice, reflect.Map, reflect.Array:
+			return rule{name, func(v reflect.Value) (string, bool) {
+				return fmt.Sprintf("must have at %s %s items", word, arg), v.Len() == 0 || within(float64(v.Len()))
+			}}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return rule{name, func(v reflect.Value) (string, bool) {
+				return fmt.Sprintf("must be at %s %s", word, arg), v.Int() == 0 || within(float64(v.Int()))
+			}}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return rule{name, func(v reflect.Value) (string, bool) {
+				return fmt.Sprintf("must be at %s %s", word, arg), v.Uint() == 0 || within(float64(v.Uint()))
+			}}
+		case reflect.Float32, reflect.Float64:
+			return rule{name, func(v reflect.Value) (string, bool) {
+				return fmt.Sprintf("must be at %s %s", word, arg), v.Float() == 0 || within(v.Float())
+			}}
+		}
+		bad("not applicable to " + sf.Type.String())
+
+	case "oneof":
+		if !isString {
+			bad("only applicable to strings")
+		}
+		values := strings.Fields(arg)
+		return rule{name, func(v reflect.Value) (string, bool) {
+			s := v.String()
+			for _, allowed := range values {
+				if s == allowed {
+					return "", true
+				}
+			}
+			return "must be one of " + strings.Join(values, ", "), s == ""
+		}}
+
+	case "pattern":
+		if !isString {
+			bad("only applicable to strings")
+		}
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			bad(err.Error())
+		}
+		return rule{name, func(v reflect.Value) (string, bool) {
+			return "must match " + arg, v.Len() == 0 || re.MatchString(v.String())
+		}}
+
+	case "email":
+		if !isString {
+			bad("only applicable to strings")
+		}
+		return rule{name, func(v reflect.Value) (string, bool) {
+			if v.Len() == 0 {
+				return "", true
+			}
+			addr, err := mail.ParseAddress(v.String())
+			return "must be an email address", err == nil && addr.Address == v.String()
+		}}
+
+	case "url":
+		if !isString {
+			bad("only applicable to strings")
+		}
+		return rule{name, func(v reflect.Value) (string, bool) {
+			if v.Len() == 0 {
+				return "", true
+			}
+			u, err := url.Parse(v.String())
+			return "must be an http or https URL", err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+		}}
+	}
+	bad("unknown rule")
+	return rule{}
+}
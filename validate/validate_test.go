@@ -0,0 +1,68 @@
+package validate
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type address struct {
+	City string `json:"city" validate:"required"`
+}
+
+type account struct {
+	Name    string   `json:"name" validate:"required,max=5"`
+	Tags    []string `json:"tags" validate:"max=2"`
+	Age     int      `json:"age" validate:"min=18"`
+	Plan    string   `json:"plan" validate:"oneof=free pro"`
+	Code    string   `json:"code" validate:"pattern=^[a-z]+$"`
+	Email   string   `json:"email" validate:"email"`
+	Site    string   `json:"site" validate:"url"`
+	Address *address `json:"address"`
+	Ignored string   `json:"-" validate:"required"`
+}
+
+func TestStruct(t *testing.T) {
+	for _, tt := range []struct {
+		a    account
+		want string // the broken rules, as field:rule
+	}{
+		{account{Name: "Ada"}, ""},
+		{account{Name: "Ada", Tags: []string{"a", "b"}, Age: 36, Plan: "pro", Code: "abc", Email: "ada@example.com", Site: "https://example.com", Address: &address{City: "London"}}, ""},
+		{account{}, "name:required"},
+		{account{Name: "   "}, "name:required"},
+		{account{Name: "Adélaïde"}, "name:max"},
+		{account{Name: "Ada", Tags: []string{"a", "b", "c"}}, "tags:max"},
+		{account{Name: "Ada", Age: 12}, "age:min"},
+		{account{Name: "Ada", Plan: "gold"}, "plan:oneof"},
+		{account{Name: "Ada", Code: "ABC"}, "code:pattern"},
+		{account{Name: "Ada", Email: "Ada <ada@example.com>"}, "email:email"},
+		{account{Name: "Ada", Site: "ftp://example.com"}, "site:url"},
+		{account{Name: "Ada", Address: &address{}}, "address.city:required"},
+		{account{Name: "", Age: 1, Site: "example.com"}, "name:required age:min site:url"},
+	} {
+		var got []string
+		err := Struct(&tt.a)
+		var errs Errors
+		if err != nil && !errors.As(err, &errs) {
+			t.Fatalf("%+v: %v isn't Errors", tt.a, err)
+		}
+		for _, fe := range errs {
+			got = append(got, fe.Field+":"+fe.Rule)
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%+v broke %q, want %q", tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestUnknownRule(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("an unknown rule didn't panic")
+		}
+	}()
+	Struct(struct {
+		Name string `validate:"nope"`
+	}{})
+}
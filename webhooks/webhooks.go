@@ -0,0 +1,410 @@
+// Package webhooks delivers the events to the HTTP endpoints subscribed
+// to them. Failed deliveries are retried with exponential backoff, then
+// kept in a dead-letter queue from which they can be redelivered.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/idgen"
+	"github.com/santisdev/go-restapi.git/jose"
+	"github.com/santisdev/go-restapi.git/timestamp"
+	"github.com/santisdev/go-restapi.git/wire"
+)
+
+const (
+	// DefaultMaxAttempts is the number of attempts of a delivery
+	// before it is dead-lettered
+	DefaultMaxAttempts = 5
+	// DefaultBackoff is the wait before the second attempt, doubled
+	// after every further one
+	DefaultBackoff = time.Second
+
+	// DefaultSource is the source of the events unless set
+	DefaultSource = "urn:usersapi"
+
+	// JWEContentType is the data content type of the encrypted events
+	JWEContentType = "application/jose"
+
+	attemptTimeout = 10 * time.Second
+	maxConcurrent  = 16 // deliveries being attempted at once
+)
+
+var (
+	// ErrNotFound is returned for unknown subscriptions and dead letters
+	ErrNotFound = errors.New("not found")
+	// ErrClosed is returned when redelivering after Close
+	ErrClosed = errors.New("dispatcher closed")
+)
+
+// Subscription is an endpoint the events are delivered to
+type Subscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Events are the types of the events delivered, all when empty.
+	// Versioned types, as in user.created.v1, select a single version.
+	Events []string `json:"events,omitempty"`
+	// Secret is the HMAC-SHA256 key signing the deliveries, if any.
+	// It isn't returned by Subscriptions.
+	Secret wire.Secret `json:"secret,omitempty"`
+	// EncryptionKey is the public key, P-256, X25519 or RSA, the data of
+	// the sensitive events is encrypted to, as a compact JWE, if any
+	EncryptionKey *jose.JWK `json:"encryption_key,omitempty"`
+	// Tenant is the tenant whose admins manage the subscription, none
+	// for the ones of the platform admins
+	Tenant    string         `json:"tenant,omitempty"`
+	CreatedAt timestamp.Time `json:"created_at"`
+}
+
+func (s Subscription) wants(e events.Event) bool {
+	return len(s.Events) == 0 || slices.Contains(s.Events, e.Type) || slices.Contains(s.Events, e.SchemaType())
+}
+
+// Delivery is the delivery of an event to a subscription
+type Delivery struct {
+	ID           string         `json:"id"`
+	Subscription string         `json:"subscription"`
+	URL          string         `json:"url"`
+	Event        events.Event   `json:"event"`
+	Attempts     int            `json:"attempts"` // over every redelivery
+	LastError    string         `json:"last_error,omitempty"`
+	DeadAt       timestamp.Time `json:"dead_at"`
+}
+
+// Dispatcher delivers the events it handles to the subscriptions
+// wanting them. Subscriptions and dead letters are kept in memory.
+type Dispatcher struct {
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+	// Source is the source of the events, delivered as CloudEvents
+	Source string
+	// CheckURL, when set, refuses the URLs of the subscriptions the
+	// server mustn't call, as those of its own network
+	CheckURL func(u *url.URL) error
+	// TenantOf, when set, returns the tenant of the subject of an event,
+	// empty for none. The subscriptions of a tenant are delivered the
+	// events of its subjects only, and none without it.
+	TenantOf func(subject string) string
+
+	clock  clock.Clock
+	ids    idgen.Generator
+	logger *slog.Logger
+
+	mu   sync.Mutex
+	subs map[string]Subscription
+	dead map[string]Delivery
+
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	closed chan struct{}
+	once   sync.Once
+}
+
+// New returns a dispatcher with the default retry policy
+func New(c clock.Clock, ids idgen.Generator, logger *slog.Logger) *Dispatcher {
+	return &Dispatcher{
+		Client:      &http.Client{Timeout: attemptTimeout},
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		Source:      DefaultSource,
+		clock:       c,
+		ids:         ids,
+		logger:      logger,
+		subs:        map[string]Subscription{},
+		dead:        map[string]Delivery{},
+		sem:         make(chan struct{}, maxConcurrent),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Subscribe adds a subscription, returning it with its id set
+func (d *Dispatcher) Subscribe(sub Subscription) (Subscription, error) {
+	if err := d.check(sub); err != nil {
+		return Subscription{}, err
+	}
+	sub.ID = d.ids.NewID()
+	sub.CreatedAt = timestamp.New(d.clock.Now().UTC())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subs[sub.ID] = sub
+	return sub, nil
+}
+
+func (d *Dispatcher) check(sub Subscription) error {
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %q: must be an absolute http or https url", sub.URL)
+	}
+	if d.CheckURL != nil {
+		if err := d.CheckURL(u); err != nil {
+			return fmt.Errorf("invalid webhook url %q: %w", sub.URL, err)
+		}
+	}
+	if sub.EncryptionKey != nil {
+		if _, err := sub.EncryptionKey.EncryptionKey(); err != nil {
+			return fmt.Errorf("invalid webhook encryption key: %w", err)
+		}
+	}
+	return nil
+}
+
+// Restore replaces the subscriptions by subs, as exported by Export,
+// keeping their ids. None is replaced when one is invalid.
+func (d *Dispatcher) Restore(subs []Subscription) error {
+	restored := make(map[string]Subscription, len(subs))
+	for _, s := range subs {
+		if s.ID == "" {
+			return errors.New("webhook subscription with no id")
+		}
+		if _, ok := restored[s.ID]; ok {
+			return fmt.Errorf("duplicate webhook subscription %q", s.ID)
+		}
+		if err := d.check(s); err != nil {
+			return fmt.Errorf("webhook subscription %q: %w", s.ID, err)
+		}
+		restored[s.ID] = s
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subs = restored
+	return nil
+}
+
+// Unsubscribe removes a subscription. Its pending retries are dropped.
+func (d *Dispatcher) Unsubscribe(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.subs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(d.subs, id)
+	return nil
+}
+
+// Subscriptions returns the subscriptions, oldest first, without their
+// secrets
+func (d *Dispatcher) Subscriptions() []Subscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subs := make([]Subscription, 0, len(d.subs))
+	for _, s := range d.subs {
+		s.Secret = ""
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt.Time) })
+	return subs
+}
+
+// Export returns the subscriptions, oldest first, with their secrets,
+// as kept in the state archives
+func (d *Dispatcher) Export() []Subscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subs := make([]Subscription, 0, len(d.subs))
+	for _, s := range d.subs {
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt.Time) })
+	return subs
+}
+
+// Handle delivers e to the subscriptions wanting it, in the background.
+// It is meant to be subscribed to the bus.
+func (d *Dispatcher) Handle(e events.Event) {
+	tenant := ""
+	if d.TenantOf != nil && e.Subject != "" {
+		tenant = d.TenantOf(e.Subject)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.subs {
+		if s.Tenant != "" && s.Tenant != tenant {
+			continue
+		}
+		if s.wants(e) {
+			d.start(Delivery{ID: d.ids.NewID(), Subscription: s.ID, URL: s.URL, Event: e})
+		}
+	}
+}
+
+// Dead returns the dead letters, oldest first
+func (d *Dispatcher) Dead() []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dead := make([]Delivery, 0, len(d.dead))
+	for _, del := range d.dead {
+		dead = append(dead, del)
+	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i].DeadAt.Before(dead[j].DeadAt.Time) })
+	return dead
+}
+
+// DeadLetter returns the dead letter with the given id
+func (d *Dispatcher) DeadLetter(id string) (Delivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	del, ok := d.dead[id]
+	if !ok {
+		return Delivery{}, ErrNotFound
+	}
+	return del, nil
+}
+
+// PurgeDead removes the dead letters dead before t, returning them
+func (d *Dispatcher) PurgeDead(t time.Time) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var purged []Delivery
+	for id, del := range d.dead {
+		if del.DeadAt.Before(t) {
+			purged = append(purged, del)
+			delete(d.dead, id)
+		}
+	}
+	sort.Slice(purged, func(i, j int) bool { return purged[i].DeadAt.Before(purged[j].DeadAt.Time) })
+	return purged
+}
+
+// Redeliver takes a dead letter out of the queue and delivers it again,
+// with a new round of attempts. Its subscription must still exist.
+func (d *Dispatcher) Redeliver(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	del, ok := d.dead[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := d.subs[del.Subscription]; !ok {
+		return fmt.Errorf("redelivering %s: subscription %s: %w", id, del.Subscription, ErrNotFound)
+	}
+	if !d.start(del) {
+		return ErrClosed
+	}
+	delete(d.dead, id)
+	return nil
+}
+
+// Close stops the retries and waits for the attempts in progress
+func (d *Dispatcher) Close() {
+	d.once.Do(func() { close(d.closed) })
+	d.wg.Wait()
+}
+
+// start delivers del in the background, unless the dispatcher is
+// closed. d.mu must be held.
+func (d *Dispatcher) start(del Delivery) bool {
+	select {
+	case <-d.closed:
+		return false
+	default:
+	}
+	d.wg.Add(1)
+	go d.deliver(del)
+	return true
+}
+
+// deliver attempts del until it succeeds, its subscription is removed,
+// the dispatcher is closed or the attempts are exhausted, in which case
+// it is dead-lettered
+func (d *Dispatcher) deliver(del Delivery) {
+	defer d.wg.Done()
+	backoff := d.Backoff
+	for attempt := 1; ; attempt++ {
+		d.mu.Lock()
+		sub, ok := d.subs[del.Subscription]
+		d.mu.Unlock()
+		if !ok {
+			return
+		}
+
+		d.sem <- struct{}{}
+		err := d.attempt(sub, del)
+		<-d.sem
+		del.Attempts++
+		if err == nil {
+			d.logger.Debug("webhook delivered", "delivery", del.ID, "subscription", sub.ID, "event", del.Event.ID)
+			return
+		}
+		del.LastError = err.Error()
+		if attempt >= d.MaxAttempts {
+			del.DeadAt = timestamp.New(d.clock.Now().UTC())
+			d.mu.Lock()
+			d.dead[del.ID] = del
+			d.mu.Unlock()
+			d.logger.Warn("webhook dead-lettered", "delivery", del.ID, "subscription", sub.ID, "attempts", del.Attempts, "err", err)
+			return
+		}
+
+		select {
+		case <-d.clock.After(backoff):
+		case <-d.closed:
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// attempt posts the event of del to sub as a structured CloudEvent,
+// failing on non-2xx statuses. The data of the sensitive events is
+// encrypted when sub has a key, the signature being over the encrypted
+// event.
+func (d *Dispatcher) attempt(sub Subscription, del Delivery) error {
+	ce := del.Event.CloudEvent(d.Source)
+	if sub.EncryptionKey != nil && del.Event.Sensitive() {
+		jwe, err := jose.Encrypt(*sub.EncryptionKey, ce.Data)
+		if err != nil {
+			return err
+		}
+		// data that isn't JSON is a string in the JSON format of CloudEvents
+		ce.DataContentType = JWEContentType
+		ce.Data, _ = json.Marshal(jwe)
+	}
+	body, err := json.Marshal(ce)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", events.CloudEventsContentType)
+	req.Header.Set("X-Webhook-Delivery", del.ID)
+	req.Header.Set("X-Event-Type", del.Event.Type)
+	if sub.Secret != "" {
+		req.Header.Set("X-Signature-256", "sha256="+Sign(string(sub.Secret), body))
+	}
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of body keyed by secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
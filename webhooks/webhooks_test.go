@@ -0,0 +1,171 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/santisdev/go-restapi.git/clock"
+	"github.com/santisdev/go-restapi.git/events"
+	"github.com/santisdev/go-restapi.git/idgen"
+)
+
+func newDispatcher() *Dispatcher {
+	return New(clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)),
+		&idgen.Sequence{Prefix: "d"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// received is a delivery as seen by the endpoint
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// endpoint returns an endpoint answering status, whose requests are sent
+// on the returned channel
+func endpoint(t *testing.T, status int) (*httptest.Server, <-chan received) {
+	t.Helper()
+	c := make(chan received, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		c <- received{r.Header, body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, c
+}
+
+func receive(t *testing.T, c <-chan received) received {
+	t.Helper()
+	select {
+	case r := <-c:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+		return received{}
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	srv, c := endpoint(t, http.StatusNoContent)
+	d := newDispatcher()
+	defer d.Close()
+	if _, err := d.Subscribe(Subscription{URL: srv.URL, Events: []string{"user.created"}, Secret: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Handle(events.Event{ID: "e1", Type: "user.deleted"})
+	d.Handle(events.Event{ID: "e2", Type: "user.created", Version: 1})
+	r := receive(t, c)
+	if got := r.header.Get("Content-Type"); got != events.CloudEventsContentType {
+		t.Errorf("content type %s, want %s", got, events.CloudEventsContentType)
+	}
+	var ce events.CloudEvent
+	if err := json.Unmarshal(r.body, &ce); err != nil {
+		t.Fatal(err)
+	}
+	if ce.ID != "e2" || ce.Source != DefaultSource || ce.SpecVersion != "1.0" {
+		t.Errorf("delivered %+v, want only e2 as a CloudEvent", ce)
+	}
+	if got, want := r.header.Get("X-Signature-256"), "sha256="+Sign("s3cret", r.body); got != want {
+		t.Errorf("signature %s, want %s", got, want)
+	}
+	for _, s := range d.Subscriptions() {
+		if s.Secret != "" {
+			t.Errorf("subscription %s lists its secret", s.ID)
+		}
+	}
+}
+
+func TestSubscribeInvalidURL(t *testing.T) {
+	d := newDispatcher()
+	defer d.Close()
+	for _, u := range []string{"", "ftp://example.com", "/hooks", "http://"} {
+		if _, err := d.Subscribe(Subscription{URL: u}); err == nil {
+			t.Errorf("subscribing %q succeeded", u)
+		}
+	}
+}
+
+func TestDeadLetterAndRedeliver(t *testing.T) {
+	srv, c := endpoint(t, http.StatusInternalServerError)
+	d := newDispatcher()
+	defer d.Close()
+	d.MaxAttempts = 3
+	d.Backoff = 0
+	sub, err := d.Subscribe(Subscription{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Handle(events.Event{ID: "e1", Type: "user.created"})
+	for i := 0; i < d.MaxAttempts; i++ {
+		receive(t, c)
+	}
+	var dead []Delivery
+	for deadline := time.Now().Add(5 * time.Second); len(dead) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		dead = d.Dead()
+	}
+	if len(dead) != 1 || dead[0].Attempts != 3 || dead[0].Subscription != sub.ID || dead[0].LastError != "status 500" {
+		t.Fatalf("dead letters %+v, want the delivery after 3 attempts", dead)
+	}
+
+	if err := d.Redeliver(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, c)
+	if _, err := d.DeadLetter(dead[0].ID); err != ErrNotFound {
+		t.Errorf("redelivered letter still dead: %v", err)
+	}
+	if err := d.Redeliver("nope"); err != ErrNotFound {
+		t.Errorf("redelivering an unknown letter: %v, want ErrNotFound", err)
+	}
+}
+
+func TestTenantSubscriptions(t *testing.T) {
+	srvA, a := endpoint(t, http.StatusNoContent)
+	srvB, b := endpoint(t, http.StatusNoContent)
+	srvAll, all := endpoint(t, http.StatusNoContent)
+	d := newDispatcher()
+	defer d.Close()
+	tenants := map[string]string{"u1": "a", "u2": "b"}
+	d.TenantOf = func(subject string) string { return tenants[subject] }
+	for _, sub := range []Subscription{{URL: srvA.URL, Tenant: "a"}, {URL: srvB.URL, Tenant: "b"}, {URL: srvAll.URL}} {
+		if _, err := d.Subscribe(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subject := func(r received) string {
+		var ce events.CloudEvent
+		if err := json.Unmarshal(r.body, &ce); err != nil {
+			t.Fatal(err)
+		}
+		return ce.Subject
+	}
+	// the events of a user of b, or of no tenant, don't reach a
+	d.Handle(events.Event{ID: "e1", Type: "user.created", Subject: "u2"})
+	d.Handle(events.Event{ID: "e2", Type: "user.created", Subject: "u3"})
+	d.Handle(events.Event{ID: "e3", Type: "user.created", Subject: "u1"})
+	if got := subject(receive(t, a)); got != "u1" {
+		t.Errorf("tenant a delivered the event of %s, want u1 only", got)
+	}
+	if got := subject(receive(t, b)); got != "u2" {
+		t.Errorf("tenant b delivered the event of %s, want u2 only", got)
+	}
+	for i := 0; i < 3; i++ {
+		receive(t, all)
+	}
+	select {
+	case r := <-a:
+		t.Errorf("tenant a also delivered the event of %s", subject(r))
+	case r := <-b:
+		t.Errorf("tenant b also delivered the event of %s", subject(r))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,57 @@
+package wire
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+)
+
+// Email is an email address, canonically trimmed and in lower case
+type Email string
+
+// Secret is a key or password, redacted in the logs
+type Secret string
+
+func init() {
+	Register(Format[Email]{
+		Name:   "email",
+		Format: func(e Email) string { return string(e) },
+		Parse:  parseEmail,
+		Redact: func(e Email) string {
+			// the first letter and the domain, as c***@example.com
+			local, domain, _ := strings.Cut(string(e), "@")
+			if local == "" {
+				return "***"
+			}
+			return local[:1] + "***@" + domain
+		},
+	})
+	Register(Format[Secret]{
+		Name:   "secret",
+		Format: func(s Secret) string { return string(s) },
+		Parse:  func(s string) (Secret, error) { return Secret(s), nil },
+		Redact: func(Secret) string { return "REDACTED" },
+	})
+}
+
+var errEmail = errors.New("expected an email address, as ann@example.com")
+
+func parseEmail(s string) (Email, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	local, domain, ok := strings.Cut(s, "@")
+	if !ok || local == "" || domain == "" || strings.ContainsAny(domain, "@ ") {
+		return "", errEmail
+	}
+	return Email(s), nil
+}
+
+func (e Email) MarshalJSON() ([]byte, error)  { return MarshalJSON(e) }
+func (e *Email) UnmarshalJSON(b []byte) error { return UnmarshalJSON(b, e) }
+func (e Email) LogValue() slog.Value          { return LogValue(e) }
+
+func (s Secret) MarshalJSON() ([]byte, error)  { return MarshalJSON(s) }
+func (s *Secret) UnmarshalJSON(b []byte) error { return UnmarshalJSON(b, s) }
+func (s Secret) LogValue() slog.Value          { return LogValue(s) }
+
+// String returns the redacted secret, so it isn't printed by mistake
+func (s Secret) String() string { return Redacted(s) }
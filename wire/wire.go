@@ -0,0 +1,119 @@
+// Package wire registers the representation of the domain types on the
+// wire, so each has a single canonical form in the JSON of the API and a
+// single redaction in the logs, whatever struct it is a field of. The
+// types marshal themselves through the registry:
+//
+//	func (e Email) MarshalJSON() ([]byte, error) { return wire.MarshalJSON(e) }
+//
+// and register their Format in an init function of their package.
+package wire
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+)
+
+// Format is the representation of a domain type T
+type Format[T any] struct {
+	// Name names the format in the errors, as "email"
+	Name string
+	// Format returns the canonical text of a value
+	Format func(v T) string
+	// Parse reads a value from its text, which may be a variant of the
+	// canonical one, as an email in capitals
+	Parse func(s string) (T, error)
+	// Redact returns the text of a value in the logs, nil when it is
+	// logged as is
+	Redact func(v T) string
+}
+
+var (
+	mu      sync.RWMutex
+	formats = map[reflect.Type]any{} // of Format[T], by T
+)
+
+// Register registers the format of T. It panics when T already has one,
+// or when f misses its Format or Parse functions.
+func Register[T any](f Format[T]) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if f.Format == nil || f.Parse == nil {
+		panic(fmt.Sprintf("wire: format of %s without Format or Parse", t))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := formats[t]; ok {
+		panic(fmt.Sprintf("wire: %s registered twice", t))
+	}
+	formats[t] = f
+}
+
+// Lookup returns the format of T. It panics when T has none, as it is a
+// mistake of the package of T.
+func Lookup[T any]() Format[T] {
+	mu.RLock()
+	f, ok := formats[reflect.TypeOf((*T)(nil)).Elem()]
+	mu.RUnlock()
+	if !ok {
+		panic(fmt.Sprintf("wire: %T not registered", *new(T)))
+	}
+	return f.(Format[T])
+}
+
+// String returns the canonical text of v
+func String[T any](v T) string {
+	return Lookup[T]().Format(v)
+}
+
+// Parse reads a T from its text, returning its canonical value
+func Parse[T any](s string) (T, error) {
+	return Lookup[T]().Parse(s)
+}
+
+// MarshalJSON writes v as a JSON string of its canonical text
+func MarshalJSON[T any](v T) ([]byte, error) {
+	return json.Marshal(String(v))
+}
+
+// UnmarshalJSON reads a T from a JSON string into v, leaving v as is on
+// null
+func UnmarshalJSON[T any](b []byte, v *T) error {
+	if string(b) == "null" {
+		return nil
+	}
+	f := Lookup[T]()
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("expected %s %s as a string, not %s", article(f.Name), f.Name, b)
+	}
+	parsed, err := f.Parse(s)
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
+
+// Redacted returns the text of v in the logs
+func Redacted[T any](v T) string {
+	f := Lookup[T]()
+	if f.Redact == nil {
+		return f.Format(v)
+	}
+	return f.Redact(v)
+}
+
+// LogValue returns the redacted text of v as a slog value, for the
+// LogValue methods of the types
+func LogValue[T any](v T) slog.Value {
+	return slog.StringValue(Redacted(v))
+}
+
+func article(name string) string {
+	if name != "" && (name[0] == 'a' || name[0] == 'e' || name[0] == 'i' || name[0] == 'o' || name[0] == 'u') {
+		return "an"
+	}
+	return "a"
+}